@@ -19,6 +19,7 @@ import (
 	"github.com/richardartoul/nola/virtual"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/registry/fdbregistry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
 	"github.com/richardartoul/nola/virtual/registry/localregistry"
 
 	"github.com/google/uuid"
@@ -33,6 +34,16 @@ var (
 	shutdownTimeout             = flag.Duration("shutdownTimeout", 0, "timeout until the server is forced to shutdown, without waiting actors and other components to close gracefully. By default is 0, which is infinite duration untill all actors are closed")
 	logFormat                   = flag.String("logFormat", "text", "format to use for the logger. The formats it accepst are: 'text', 'json'")
 	logLevel                    = flag.String("logLevel", "debug", "level to use for the logger. The levels it accepts are: 'info', 'debug', 'error', 'warn'")
+	remoteClientType            = flag.String("remoteClient", "http", "protocol to use for communicating with other servers. Valid options: http|rpc. Servers accept both protocols regardless")
+	tlsCertFile                 = flag.String("tlsCertFile", "", "path to the PEM encoded certificate to use for TLS. TLS is disabled if empty. The certificate is also presented to other servers as a client certificate (mutual TLS)")
+	tlsKeyFile                  = flag.String("tlsKeyFile", "", "path to the PEM encoded private key for tlsCertFile")
+	tlsCAFile                   = flag.String("tlsCAFile", "", "path to the PEM encoded CA certificates used to verify the certificates of other servers and clients")
+	tlsServerName               = flag.String("tlsServerName", "", "name to verify the certificates of other servers against. Defaults to the address they advertise")
+	tlsRequireClientCerts       = flag.Bool("tlsRequireClientCerts", false, "require a verified client certificate for the public endpoints as well as the server-to-server ones")
+	peerToken                   = flag.String("peerToken", "", "secret shared by all the servers in the cluster that they present to each other. Requests to the server-to-server endpoints that don't present it are rejected")
+	enableAsyncInvocations      = flag.Bool("enableAsyncInvocations", false, "enable async invocations (invoke-actor-async). Invocations are enqueued in the same backend as the Registry")
+	enableReminders             = flag.Bool("enableReminders", false, "enable durable reminders. Reminders are persisted in the same backend as the Registry")
+	maxActorMailboxDepth        = flag.Int("maxActorMailboxDepth", virtual.DefaultMaxActorMailboxDepth, "maximum number of invocations of a single actor that can be waiting for their turn. Invocations beyond that are rejected with HTTP 503")
 )
 
 func main() {
@@ -53,12 +64,18 @@ func main() {
 	var (
 		reg         registry.Registry
 		moduleStore registry.ModuleStore
+		// kvStore backs async invocations and reminders, if enabled.
+		kvStore kv.Store
+		needsKV = *enableAsyncInvocations || *enableReminders
 	)
 	switch *registryType {
 	case "memory":
 		reg = localregistry.NewLocalRegistry("test-server-id")
 		// Local registry also implements ModuleStore for convenience.
 		moduleStore = reg.(registry.ModuleStore)
+		if needsKV {
+			kvStore = localregistry.NewLocalKV()
+		}
 	case "foundationdb":
 		var err error
 		reg, err = fdbregistry.NewFoundationDBRegistry("test-server-id", *foundationDBClusterFilePath)
@@ -68,28 +85,67 @@ func main() {
 		}
 		// FoundationDB registry also implements ModuleStore for convenience.
 		moduleStore = reg.(registry.ModuleStore)
+		if needsKV {
+			kvStore, err = fdbregistry.NewFoundationDBKV(*foundationDBClusterFilePath)
+			if err != nil {
+				log.Error("error creating FoundationDB KV", slog.Any("error", err))
+				os.Exit(1)
+			}
+		}
 	default:
 		log.Error("unknown registry type", slog.String("registryType", *registryType))
 		os.Exit(1)
 	}
 
-	client := virtual.NewHTTPClient()
+	tlsOpts := virtual.TLSOptions{
+		CertFile:                             *tlsCertFile,
+		KeyFile:                              *tlsKeyFile,
+		CAFile:                               *tlsCAFile,
+		ServerName:                           *tlsServerName,
+		RequireClientCertsForPublicEndpoints: *tlsRequireClientCerts,
+	}
 
-	ctx, cc := context.WithTimeout(context.Background(), 10*time.Second)
-	environment, err := virtual.NewEnvironment(ctx, *serverID, reg, moduleStore, client, virtual.EnvironmentOptions{
+	var client virtual.RemoteClient
+	switch *remoteClientType {
+	case "http":
+		client, err = virtual.NewHTTPClientWithOptions(virtual.HTTPClientOptions{TLS: tlsOpts, PeerToken: *peerToken})
+	case "rpc":
+		client, err = virtual.NewRPCClient(virtual.RPCClientOptions{TLS: tlsOpts, PeerToken: *peerToken})
+	default:
+		log.Error("unknown remote client type", slog.String("remoteClientType", *remoteClientType))
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Error("error creating remote client", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	envOpts := virtual.EnvironmentOptions{
 		Discovery: virtual.DiscoveryOptions{
 			DiscoveryType: *discoveryType,
 			Port:          *port,
 		},
-		Logger: log,
-	})
+		MaxActorMailboxDepth: *maxActorMailboxDepth,
+		TLS:                  tlsOpts,
+		Logger:               log,
+	}
+	if *enableAsyncInvocations {
+		envOpts.AsyncInvocations = virtual.AsyncInvocationOptions{Store: kvStore}
+	}
+	if *enableReminders {
+		envOpts.Reminders = virtual.ReminderOptions{Store: kvStore}
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 10*time.Second)
+	environment, err := virtual.NewEnvironment(ctx, *serverID, reg, moduleStore, client, envOpts)
 	cc()
 	if err != nil {
 		log.Error("error creating environment", slog.Any("error", err))
 		os.Exit(1)
 	}
 
-	var server virtualServer = virtual.NewServer(moduleStore, environment)
+	var server virtualServer = virtual.NewServerWithOptions(
+		moduleStore, environment, virtual.ServerOptions{TLS: tlsOpts, PeerToken: *peerToken})
 
 	log.Info("server listening", slog.Int("port", *port))
 
@@ -0,0 +1,174 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+// ensureActivationBatcher coalesces concurrent EnsureActivation calls into batched calls
+// to the registry's EnsureActivations method so that one registry round-trip / transaction
+// can resolve many actors at once.
+//
+// Batching is opportunistic: a bounded number of workers are spawned on demand, and each
+// worker grabs everything that is pending (up to maxBatchSize) every time it's ready to
+// make a call to the registry. As a result, when the registry is keeping up each request is
+// sent immediately on its own and no latency is added, but when the registry can't keep up
+// (like during a cold start when nothing is cached) requests naturally accumulate into larger
+// batches instead of accumulating as more concurrent transactions.
+type ensureActivationBatcher struct {
+	sync.Mutex
+
+	// Dependencies / configuration.
+	registry       registry.Registry
+	maxConcurrency int
+	maxBatchSize   int
+	timeout        time.Duration
+
+	// State.
+	pending    []*pendingEnsureActivation
+	numWorkers int
+}
+
+type pendingEnsureActivation struct {
+	ctx context.Context
+	req registry.EnsureActivationRequest
+
+	// Populated before doneCh is closed.
+	result registry.EnsureActivationResult
+	err    error
+	doneCh chan struct{}
+}
+
+func newEnsureActivationBatcher(
+	reg registry.Registry,
+	maxConcurrency int,
+	maxBatchSize int,
+	timeout time.Duration,
+) *ensureActivationBatcher {
+	if maxConcurrency <= 0 {
+		panic(fmt.Sprintf("maxConcurrency must be > 0, but was: %d", maxConcurrency))
+	}
+	if maxBatchSize <= 0 || maxBatchSize > registry.MaxEnsureActivationsBatchSize {
+		panic(fmt.Sprintf(
+			"maxBatchSize must be > 0 and <= %d, but was: %d",
+			registry.MaxEnsureActivationsBatchSize, maxBatchSize))
+	}
+
+	return &ensureActivationBatcher{
+		registry:       reg,
+		maxConcurrency: maxConcurrency,
+		maxBatchSize:   maxBatchSize,
+		timeout:        timeout,
+	}
+}
+
+// ensureActivation enqueues the request to be sent to the registry as part of the next
+// batch and then waits for the result.
+func (b *ensureActivationBatcher) ensureActivation(
+	ctx context.Context,
+	req registry.EnsureActivationRequest,
+) (registry.EnsureActivationResult, error) {
+	p := &pendingEnsureActivation{
+		ctx:    ctx,
+		req:    req,
+		doneCh: make(chan struct{}),
+	}
+
+	b.Lock()
+	b.pending = append(b.pending, p)
+	if b.numWorkers < b.maxConcurrency {
+		b.numWorkers++
+		go b.worker()
+	}
+	b.Unlock()
+
+	select {
+	case <-p.doneCh:
+		return p.result, p.err
+	case <-ctx.Done():
+		return registry.EnsureActivationResult{}, fmt.Errorf(
+			"context expired while waiting for batched ensureActivation: %w", ctx.Err())
+	}
+}
+
+// worker sends batches to the registry until there is nothing left pending.
+func (b *ensureActivationBatcher) worker() {
+	for {
+		b.Lock()
+		if len(b.pending) == 0 {
+			b.numWorkers--
+			b.Unlock()
+			return
+		}
+
+		n := len(b.pending)
+		if n > b.maxBatchSize {
+			n = b.maxBatchSize
+		}
+		batch := make([]*pendingEnsureActivation, 0, n)
+		for _, p := range b.pending[:n] {
+			// Skip requests whose caller has already given up.
+			if p.ctx.Err() == nil {
+				batch = append(batch, p)
+			}
+		}
+		// Copy so the backing array doesn't retain the requests that were just taken.
+		b.pending = append([]*pendingEnsureActivation(nil), b.pending[n:]...)
+		b.Unlock()
+
+		if len(batch) > 0 {
+			b.flush(batch)
+		}
+	}
+}
+
+func (b *ensureActivationBatcher) flush(batch []*pendingEnsureActivation) {
+	if len(batch) == 1 {
+		// Use the regular method when there is nothing to coalesce so that errors
+		// are attributed to the request precisely.
+		b.ensureActivationOne(batch[0])
+		return
+	}
+
+	// Use a context that isn't tied to any specific caller so one of them giving up
+	// doesn't fail the entire batch. Callers stop waiting when their own context expires.
+	ctx, cc := context.WithTimeout(context.Background(), b.timeout)
+	defer cc()
+
+	reqs := make([]registry.EnsureActivationRequest, 0, len(batch))
+	for _, p := range batch {
+		reqs = append(reqs, p.req)
+	}
+	results, err := b.registry.EnsureActivations(ctx, reqs)
+	if err == nil && len(results) != len(reqs) {
+		err = fmt.Errorf(
+			"[invariant violated] registry returned %d results for %d requests",
+			len(results), len(reqs))
+	}
+	if err != nil {
+		// The batch fails as a whole, but the failure may have been caused by a single
+		// request so fall back to resolving each request individually so that one bad
+		// request can't fail all the other ones. The requests are resolved one at a time
+		// by this worker (instead of concurrently) because this usually happens when the
+		// registry is already failing or overloaded, and the number of workers is what
+		// bounds the load on the registry.
+		for _, p := range batch {
+			b.ensureActivationOne(p)
+		}
+		return
+	}
+
+	for i, p := range batch {
+		p.result = results[i]
+		close(p.doneCh)
+	}
+}
+
+func (b *ensureActivationBatcher) ensureActivationOne(p *pendingEnsureActivation) {
+	p.result, p.err = b.registry.EnsureActivation(p.ctx, p.req)
+	close(p.doneCh)
+}
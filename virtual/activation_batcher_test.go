@@ -0,0 +1,151 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestEnsureActivationBatcherCoalesces ensures that concurrent requests are coalesced
+// into batched registry calls when the registry can't keep up.
+func TestEnsureActivationBatcherCoalesces(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newCountingRegistry(localregistry.NewLocalRegistry("test-registry-server-id"))
+	defer reg.Close(ctx)
+	_, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1"})
+	require.NoError(t, err)
+
+	// Block the first registry call until every request has been enqueued so that the
+	// remaining requests have no choice but to accumulate into a batch.
+	b := newEnsureActivationBatcher(reg, 1, registry.MaxEnsureActivationsBatchSize, defaultActivationCacheTimeout)
+	reg.gate = make(chan struct{})
+
+	const numRequests = 100
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := b.ensureActivation(ctx, registry.EnsureActivationRequest{
+				Namespace: "ns1",
+				ModuleID:  "module1",
+				ActorID:   fmt.Sprintf("a-%d", i),
+			})
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("a-%d", i), result.References[0].Virtual.ActorID)
+			require.Equal(t, "server1", result.References[0].Physical.ServerID)
+		}(i)
+	}
+
+	require.Eventually(t, func() bool {
+		b.Lock()
+		defer b.Unlock()
+		return len(b.pending) == numRequests-1
+	}, defaultActivationCacheTimeout, time.Millisecond)
+	close(reg.gate)
+	wg.Wait()
+
+	require.Equal(t, int64(1), reg.numEnsureActivation.Load())
+	require.Equal(t, int64(1), reg.numEnsureActivations.Load())
+}
+
+// TestEnsureActivationBatcherFallback ensures that when a batch fails each request is
+// retried individually without exceeding the batcher's concurrency.
+func TestEnsureActivationBatcherFallback(t *testing.T) {
+	ctx := context.Background()
+
+	reg := newCountingRegistry(localregistry.NewLocalRegistry("test-registry-server-id"))
+	defer reg.Close(ctx)
+	_, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1"})
+	require.NoError(t, err)
+
+	b := newEnsureActivationBatcher(reg, 1, registry.MaxEnsureActivationsBatchSize, defaultActivationCacheTimeout)
+	reg.gate = make(chan struct{})
+	reg.failBatches = true
+
+	const numRequests = 20
+	var wg sync.WaitGroup
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := b.ensureActivation(ctx, registry.EnsureActivationRequest{
+				Namespace: "ns1",
+				ModuleID:  "module1",
+				ActorID:   fmt.Sprintf("a-%d", i),
+			})
+			require.NoError(t, err)
+		}(i)
+	}
+
+	require.Eventually(t, func() bool {
+		b.Lock()
+		defer b.Unlock()
+		return len(b.pending) == numRequests-1
+	}, defaultActivationCacheTimeout, time.Millisecond)
+	close(reg.gate)
+	wg.Wait()
+
+	require.Equal(t, int64(1), reg.numEnsureActivations.Load())
+	require.Equal(t, int64(numRequests), reg.numEnsureActivation.Load())
+	require.Equal(t, int64(1), reg.maxConcurrentEnsureActivation.Load())
+}
+
+// countingRegistry wraps a registry.Registry and counts calls to EnsureActivation
+// and EnsureActivations.
+type countingRegistry struct {
+	registry.Registry
+
+	gate                 chan struct{}
+	failBatches          bool
+	numEnsureActivation  atomic.Int64
+	numEnsureActivations atomic.Int64
+
+	concurrentEnsureActivation    atomic.Int64
+	maxConcurrentEnsureActivation atomic.Int64
+}
+
+func newCountingRegistry(reg registry.Registry) *countingRegistry {
+	return &countingRegistry{Registry: reg}
+}
+
+func (c *countingRegistry) EnsureActivation(
+	ctx context.Context,
+	req registry.EnsureActivationRequest,
+) (registry.EnsureActivationResult, error) {
+	if c.gate != nil {
+		<-c.gate
+	}
+	c.numEnsureActivation.Add(1)
+
+	concurrent := c.concurrentEnsureActivation.Add(1)
+	defer c.concurrentEnsureActivation.Add(-1)
+	for {
+		max := c.maxConcurrentEnsureActivation.Load()
+		if concurrent <= max || c.maxConcurrentEnsureActivation.CompareAndSwap(max, concurrent) {
+			break
+		}
+	}
+	return c.Registry.EnsureActivation(ctx, req)
+}
+
+func (c *countingRegistry) EnsureActivations(
+	ctx context.Context,
+	reqs []registry.EnsureActivationRequest,
+) ([]registry.EnsureActivationResult, error) {
+	c.numEnsureActivations.Add(1)
+	if c.failBatches {
+		return nil, errors.New("batch failed")
+	}
+	return c.Registry.EnsureActivations(ctx, reqs)
+}
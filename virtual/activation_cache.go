@@ -6,20 +6,32 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 	"golang.org/x/exp/slog"
-	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 )
 
 var (
 	// TODO: Make these configurable.
-	defaultMaxConcurrentEnsureActivationCalls = runtime.NumCPU() * 16
-	defaultActivationCacheTimeout             = 5 * time.Second
+	defaultMaxConcurrentEnsureActivationBatches = runtime.NumCPU()
+	defaultMaxEnsureActivationsBatchSize        = 256
+	// defaultActivationCacheTimeout is the default value for
+	// EnvironmentOptions.ActivationCacheTimeout.
+	defaultActivationCacheTimeout = 5 * time.Second
+)
+
+const (
+	// deadServerRetention is how long the cache remembers that a server died after being
+	// notified by the registry. Entries that reference the dead server are treated as cache
+	// misses during this window. Entries that survive longer than this will be refreshed
+	// by the regular staleness logic anyways.
+	deadServerRetention = 10 * time.Minute
 )
 
 // activationCache is an "intelligent" cache that tries to balance:
@@ -32,19 +44,35 @@ type activationsCache struct {
 	// Dependencies / configuration.
 	registry            registry.Registry
 	idealCacheStaleness time.Duration
+	timeout             time.Duration
 	logger              *slog.Logger
+	tracer              tracing.Tracer
+	metrics             *environmentMetrics
 
 	// "State".
-	ensureSem *semaphore.Weighted
-	c         *ristretto.Cache
-	deduper   singleflight.Group
+	batcher *ensureActivationBatcher
+	c       *ristretto.Cache
+	deduper singleflight.Group
+	// deadServers is a copy-on-write map[string]deadServer that tracks servers the
+	// registry told us have died. It's copy-on-write because it's read on every cache
+	// hit, but only updated when a server dies which is rare.
+	deadServers atomic.Value
+}
+
+// deadServer records the last version of a server that the registry reported as dead.
+type deadServer struct {
+	serverVersion int64
+	diedAt        time.Time
 }
 
 func newActivationsCache(
 	registry registry.Registry,
 	idealCacheStaleness time.Duration,
+	timeout time.Duration,
 	disableCache bool,
 	logger *slog.Logger,
+	tracer tracing.Tracer,
+	metrics *environmentMetrics,
 ) *activationsCache {
 	if registry == nil {
 		panic("registry cannot be nil")
@@ -69,13 +97,99 @@ func newActivationsCache(
 		}
 	}
 
-	return &activationsCache{
-		ensureSem:           semaphore.NewWeighted(int64(defaultMaxConcurrentEnsureActivationCalls)),
+	a := &activationsCache{
+		batcher: newEnsureActivationBatcher(
+			registry,
+			defaultMaxConcurrentEnsureActivationBatches,
+			defaultMaxEnsureActivationsBatchSize,
+			timeout),
 		c:                   c,
 		registry:            registry,
 		idealCacheStaleness: idealCacheStaleness,
+		timeout:             timeout,
 		logger:              logger,
+		tracer:              tracer,
+		metrics:             metrics,
 	}
+	a.deadServers.Store(map[string]deadServer{})
+	return a
+}
+
+// watch subscribes to the registry's stream of activation changes and invalidates
+// cached activations as soon as they're known to be stale instead of waiting for
+// them to expire. It runs in the background until ctx is canceled. If the registry
+// can't be watched, the cache just falls back to its regular staleness logic.
+func (a *activationsCache) watch(ctx context.Context) {
+	if a.c == nil {
+		// Cache disabled, nothing to invalidate.
+		return
+	}
+
+	changes, err := a.registry.Watch(ctx)
+	if err != nil {
+		a.logger.Error(
+			"error watching registry for activation changes, relying on cache staleness only",
+			slog.String("error", err.Error()))
+		return
+	}
+
+	go func() {
+		for change := range changes {
+			a.applyChange(change)
+		}
+	}()
+}
+
+func (a *activationsCache) applyChange(change registry.ActivationChange) {
+	switch change.Type {
+	case registry.ActivationChangeTypeActorMoved:
+		a.delete(change.Namespace, change.ModuleID, change.ActorID)
+	case registry.ActivationChangeTypeServerDied:
+		a.markServerDead(change.ServerID, change.ServerVersion)
+	case registry.ActivationChangeTypeReset:
+		a.c.Clear()
+	default:
+		a.logger.Warn(
+			"unknown activation change type, clearing cache",
+			slog.String("type", string(change.Type)))
+		a.c.Clear()
+	}
+}
+
+func (a *activationsCache) markServerDead(serverID string, serverVersion int64) {
+	a.Lock()
+	defer a.Unlock()
+
+	var (
+		now  = time.Now()
+		prev = a.deadServers.Load().(map[string]deadServer)
+		next = make(map[string]deadServer, len(prev)+1)
+	)
+	for id, ds := range prev {
+		if now.Sub(ds.diedAt) < deadServerRetention {
+			next[id] = ds
+		}
+	}
+	if existing, ok := next[serverID]; !ok || existing.serverVersion < serverVersion {
+		next[serverID] = deadServer{serverVersion: serverVersion, diedAt: now}
+	}
+	a.deadServers.Store(next)
+}
+
+// referencesDeadServer returns true if any of the references point to a version of a
+// server that the registry has told us is dead.
+func (a *activationsCache) referencesDeadServer(references []types.ActorReference) bool {
+	deadServers := a.deadServers.Load().(map[string]deadServer)
+	if len(deadServers) == 0 {
+		return false
+	}
+	for _, ref := range references {
+		ds, ok := deadServers[ref.Physical.ServerID]
+		if ok && ref.Physical.ServerVersion <= ds.serverVersion {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *activationsCache) ensureActivation(
@@ -87,8 +201,11 @@ func (a *activationsCache) ensureActivation(
 	extraReplicas uint64,
 	blacklistedServerIDs []string,
 ) ([]types.ActorReference, error) {
+	ctx, span := a.tracer.Start(ctx, "nola.activationCache.ensureActivation")
+	defer span.End()
+
 	// Ensure we have a short timeout when communicating with registry.
-	ctx, cc := context.WithTimeout(ctx, defaultActivationCacheTimeout)
+	ctx, cc := context.WithTimeout(ctx, a.timeout)
 	defer cc()
 
 	isServerIDBlacklisted := types.StringSliceToSet(blacklistedServerIDs)
@@ -106,6 +223,11 @@ func (a *activationsCache) ensureActivation(
 	bufIface, cacheKey = actorCacheKeyUnsafePooled(namespace, moduleID, actorID)
 	aceI, ok := a.c.Get(cacheKey)
 	bufPool.Put(bufIface)
+	if ok && a.referencesDeadServer(aceI.(activationCacheEntry).references) {
+		// The registry told us that (at least one of) the server(s) the actor is
+		// cached as activated on died so treat the entry as a miss.
+		ok = false
+	}
 
 	var (
 		cachedReferences                []types.ActorReference
@@ -150,12 +272,16 @@ func (a *activationsCache) ensureActivation(
 		// stale and end up routing us back to the blacklisted server ID.
 		currentBlacklistedIDsAreInvalid {
 		// Force cache update and ignore the existing entry to prevent routing to blacklisted server ID.
+		span.SetAttributes(tracing.Bool("nola.cache_hit", false))
+		a.metrics.activationCache.Inc("miss")
 		return a.ensureActivationAndUpdateCache(
 			ctx, namespace, moduleID, actorID, extraReplicas, cachedReferences, isServerIDBlacklisted, blacklistedServerIDs)
 	}
 
 	// Cache hit, return result from cache but check if we should proactively refresh
 	// the cache also.
+	span.SetAttributes(tracing.Bool("nola.cache_hit", true))
+	a.metrics.activationCache.Inc("hit")
 	ace := aceI.(activationCacheEntry)
 	// TODO: Jitter here.
 	if time.Since(ace.cachedAt) > a.idealCacheStaleness {
@@ -219,14 +345,12 @@ func (a *activationsCache) ensureActivationAndUpdateCache(
 			cachedServerIDs = append(cachedServerIDs, ref.Physical.ServerID)
 		}
 
-		// Acquire the semaphore before making the network call to avoid DDOSing the
-		// registry in pathological workloads/scenarios.
-		if err := a.ensureSem.Acquire(ctx, 1); err != nil {
-			return nil, fmt.Errorf(
-				"context expired while waiting to acquire ensureActivation semaphore: %w",
-				err)
-		}
-		references, err := a.registry.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		// Go through the batcher so that concurrent cache misses are coalesced into a
+		// bounded number of batched registry calls instead of DDOSing the registry in
+		// pathological workloads/scenarios (like cold starts).
+		registryCtx, span := a.tracer.Start(ctx, "nola.registry.EnsureActivation")
+		start := time.Now()
+		references, err := a.batcher.ensureActivation(registryCtx, registry.EnsureActivationRequest{
 			Namespace: namespace,
 			ModuleID:  moduleID,
 			ActorID:   actorID,
@@ -235,9 +359,9 @@ func (a *activationsCache) ensureActivationAndUpdateCache(
 			BlacklistedServerIDs:      blacklistedServerIDs,
 			CachedActivationServerIDs: cachedServerIDs,
 		})
-		// Release the semaphore as soon as we're done with the network call since the purpose
-		// of this semaphore is really just to avoid DDOSing the registry.
-		a.ensureSem.Release(1)
+		a.metrics.recordRegistryCall("EnsureActivation", start, err)
+		span.RecordError(err)
+		span.End()
 		if err != nil {
 			existingAceI, ok := a.c.Get(cacheKey)
 			if ok {
@@ -0,0 +1,68 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/metrics"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/tracing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// TestActivationCacheWatchInvalidation ensures that the activation cache invalidates
+// entries as soon as the registry reports that an actor moved, instead of waiting for
+// the cache entry to go stale.
+func TestActivationCacheWatchInvalidation(t *testing.T) {
+	ctx, cc := context.WithCancel(context.Background())
+	defer cc()
+
+	reg := localregistry.NewLocalRegistry("test-registry-server-id")
+	defer reg.Close(context.Background())
+	for _, serverID := range []string{"server1", "server2"} {
+		_, err := reg.Heartbeat(ctx, serverID, registry.HeartbeatState{Address: serverID})
+		require.NoError(t, err)
+	}
+
+	// Use a large staleness so that the cache never refreshes on its own during the test.
+	c := newActivationsCache(
+		reg, time.Hour, defaultActivationCacheTimeout, false, slog.Default(), tracing.NewNoopTracer(),
+		newEnvironmentMetrics(metrics.NewRegistry()))
+	c.watch(ctx)
+
+	refs, err := c.ensureActivation(ctx, "ns1", "module1", "a", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(refs))
+	prevServerID := refs[0].Physical.ServerID
+	c.c.Wait()
+
+	// Move the actor "behind the cache's back".
+	result, err := reg.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		Namespace:            "ns1",
+		ModuleID:             "module1",
+		ActorID:              "a",
+		BlacklistedServerIDs: []string{prevServerID},
+	})
+	require.NoError(t, err)
+	newServerID := result.References[0].Physical.ServerID
+	require.NotEqual(t, prevServerID, newServerID)
+
+	require.Eventually(t, func() bool {
+		refs, err := c.ensureActivation(ctx, "ns1", "module1", "a", 0, nil)
+		require.NoError(t, err)
+		return refs[0].Physical.ServerID == newServerID
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Server deaths should invalidate every entry that references the dead server.
+	c.c.Wait()
+	c.applyChange(registry.ActivationChange{
+		Type:          registry.ActivationChangeTypeServerDied,
+		ServerID:      newServerID,
+		ServerVersion: result.References[0].Physical.ServerVersion,
+	})
+	require.True(t, c.referencesDeadServer(result.References))
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/futures"
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 
@@ -26,6 +27,12 @@ import (
 const (
 	// TODO: This should be configurable.
 	activationBlacklistCacheTTL = time.Minute
+	// TODO: This should be configurable.
+	//
+	// actorNotOwnedTTL is how long the server will keep redirecting invocations for an actor
+	// that it handed off to a different server. It only needs to be long enough for every
+	// other server in the cluster to observe the same membership change.
+	actorNotOwnedTTL = time.Minute
 )
 
 type activations struct {
@@ -37,6 +44,9 @@ type activations struct {
 	_actors               map[types.NamespacedActorID]futures.Future[*activatedActor]
 	_actorResourceTracker *actorResourceTracker
 	_blacklist            *ristretto.Cache
+	// _notOwned tracks actors that were handed off to a different server due to a
+	// cluster membership change, and when that happened.
+	_notOwned map[types.NamespacedActorID]time.Time
 
 	_moduleState struct {
 		// Give _moduleState its own lock because otherwise its really easy to have
@@ -61,6 +71,24 @@ type activations struct {
 	goModules     map[types.NamespacedIDNoType]Module
 	customHostFns map[string]func([]byte) ([]byte, error)
 	gcActorsAfter time.Duration
+	// wheel is shared by every activated actor for its idle GC checks and self timers so
+	// that they don't each require a runtime timer.
+	wheel       *timingWheel
+	idleSweeper *idleActorSweeper
+	// maxMailboxDepth is the maximum number of invocations that can be waiting in each
+	// actor's mailbox.
+	maxMailboxDepth int
+	mailboxStats    *mailboxStats
+	// idempotencyKeyTTL, maxIdempotencyKeys and maxIdempotentResponseBytes configure how
+	// long, how many and how many bytes of responses of invocations with idempotency keys
+	// each activated actor remembers.
+	idempotencyKeyTTL          time.Duration
+	maxIdempotencyKeys         int
+	maxIdempotentResponseBytes int
+	// namespaceLimits returns the current limits for a namespace.
+	namespaceLimits func(namespace string) registry.NamespaceLimits
+	tracer          tracing.Tracer
+	metrics         *environmentMetrics
 }
 
 func newActivations(
@@ -70,10 +98,25 @@ func newActivations(
 	environment Environment,
 	customHostFns map[string]func([]byte) ([]byte, error),
 	gcActorsAfter time.Duration,
+	maxMailboxDepth int,
+	idempotencyKeyTTL time.Duration,
+	maxIdempotencyKeys int,
+	maxIdempotentResponseBytes int,
+	namespaceLimits func(namespace string) registry.NamespaceLimits,
+	tracer tracing.Tracer,
+	metrics *environmentMetrics,
 ) *activations {
 	if gcActorsAfter < 0 {
 		panic(fmt.Sprintf("[invariant violated] illegal value for gcActorsAfter: %d", gcActorsAfter))
 	}
+	if maxMailboxDepth <= 0 {
+		panic(fmt.Sprintf("[invariant violated] illegal value for maxMailboxDepth: %d", maxMailboxDepth))
+	}
+	if idempotencyKeyTTL <= 0 || maxIdempotencyKeys <= 0 || maxIdempotentResponseBytes <= 0 {
+		panic(fmt.Sprintf(
+			"[invariant violated] illegal values for idempotencyKeyTTL: %s, maxIdempotencyKeys: %d, maxIdempotentResponseBytes: %d",
+			idempotencyKeyTTL, maxIdempotencyKeys, maxIdempotentResponseBytes))
+	}
 
 	blacklist, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: maxNumActivationsToCache * 10, // * 10 per the docs.
@@ -88,20 +131,36 @@ func newActivations(
 		panic(fmt.Sprintf("[invariant violated] unable to construct blacklist cache: %v", err))
 	}
 
+	wheel := newTimingWheel(
+		defaultTimingWheelTick, defaultTimingWheelNumSlots, defaultTimingWheelNumLevels)
 	a := &activations{
 		_actors:               make(map[types.NamespacedActorID]futures.Future[*activatedActor]),
 		_blacklist:            blacklist,
+		_notOwned:             make(map[types.NamespacedActorID]time.Time),
 		_actorResourceTracker: newActorResourceTracker(),
 
-		log:           log.With(slog.String("module", "activations")),
-		registry:      registry,
-		moduleStore:   moduleStore,
-		environment:   environment,
-		goModules:     make(map[types.NamespacedIDNoType]Module),
-		customHostFns: customHostFns,
-		gcActorsAfter: gcActorsAfter,
+		log:             log.With(slog.String("module", "activations")),
+		registry:        registry,
+		moduleStore:     moduleStore,
+		environment:     environment,
+		goModules:       make(map[types.NamespacedIDNoType]Module),
+		customHostFns:   customHostFns,
+		gcActorsAfter:   gcActorsAfter,
+		wheel:           wheel,
+		idleSweeper:     newIdleActorSweeper(wheel, gcActorsAfter),
+		maxMailboxDepth: maxMailboxDepth,
+		mailboxStats:    &mailboxStats{},
+		namespaceLimits: namespaceLimits,
+		tracer:          tracer,
+		metrics:         metrics,
+
+		idempotencyKeyTTL:          idempotencyKeyTTL,
+		maxIdempotencyKeys:         maxIdempotencyKeys,
+		maxIdempotentResponseBytes: maxIdempotentResponseBytes,
 	}
 	a._moduleState.modules = make(map[types.NamespacedID]Module)
+	a.wheel.start()
+	a.idleSweeper.start()
 	return a
 }
 
@@ -134,6 +193,10 @@ func (a *activations) invoke(
 
 	// First check if the actor is already activated.
 	a.Lock()
+	if err := a.isNotOwnedWithLock(reference); err != nil {
+		a.Unlock()
+		return nil, err
+	}
 	actorF, ok := a._actors[reference.ActorIDWithNamespace()]
 	if !ok {
 		if isTimer {
@@ -255,6 +318,10 @@ func (a *activations) invokeNotExistWithLock(
 			}
 		}()
 
+		if err := a.checkNamespaceMemLimit(reference.Namespace); err != nil {
+			return nil, err
+		}
+
 		module, err := a.ensureModule(ctx, reference.ModuleIDWithNamespace())
 		if err != nil {
 			return nil, fmt.Errorf(
@@ -262,8 +329,9 @@ func (a *activations) invokeNotExistWithLock(
 				reference, err)
 		}
 
+		timers := newActorTimers(a.wheel)
 		hostCapabilities := newHostCapabilities(
-			a.log, a.registry, a.environment, a, a.customHostFns, reference, a.getServerState)
+			a.log, a.registry, a.environment, a, a.customHostFns, reference, timers, a.getServerState)
 		iActor, err := module.Instantiate(ctx, reference, instantiatePayload, hostCapabilities)
 		if err != nil {
 			return nil, fmt.Errorf(
@@ -297,15 +365,21 @@ func (a *activations) invokeNotExistWithLock(
 			// instance of the actor that created this onGc function so we should remove it.
 			delete(a._actors, reference.ActorIDWithNamespace())
 			a._actorResourceTracker.track(reference.ActorIDWithNamespace(), 0)
+			a.metrics.gcs.Inc()
 		}
 
 		var currMemUsage int
 		currMemUsage, actor, err = newActivatedActor(
-			ctx, a.log, iActor, reference, hostCapabilities, instantiatePayload, a.gcActorsAfter, onGc)
+			ctx, a.log, iActor, reference, hostCapabilities, timers,
+			newActorMailbox(reference.ActorIDWithNamespace(), a.maxMailboxDepth, a.mailboxStats),
+			newIdempotentResponses(
+				a.idempotencyKeyTTL, a.maxIdempotencyKeys, a.maxIdempotentResponseBytes),
+			isReentrantModule(module), instantiatePayload, a.gcActorsAfter, a.idleSweeper, onGc)
 		if err != nil {
 			return nil, fmt.Errorf("error activating actor: %w", err)
 		}
 		a._actorResourceTracker.track(reference.ActorIDWithNamespace(), currMemUsage)
+		a.metrics.activations.Inc(reference.Namespace, reference.ModuleID)
 
 		return actor, nil
 	})
@@ -318,22 +392,141 @@ func (a *activations) invokeNotExistWithLock(
 	return a.invokeActivatedActor(ctx, actor, operation, invokePayload)
 }
 
+// checkNamespaceMemLimit returns a NamespaceLimitExceededErr if the namespace's activated
+// actors are already using as much memory as this server's share of its
+// MaxActivatedMemoryBytes allows so that no additional actors are activated until some
+// are GC'd.
+func (a *activations) checkNamespaceMemLimit(namespace string) error {
+	limit := a.namespaceLimits(namespace).MaxActivatedMemoryBytes
+	if limit <= 0 {
+		return nil
+	}
+	if usage := a._actorResourceTracker.namespaceMemUsageBytes(namespace); usage >= limit {
+		return registry.NewNamespaceLimitExceededError(fmt.Errorf(
+			"namespace: %s is using: %d bytes of memory for activated actors, "+
+				"this server's share of its limit is: %d",
+			namespace, usage, limit))
+	}
+	return nil
+}
+
 func (a *activations) invokeActivatedActor(
 	ctx context.Context,
 	actor *activatedActor,
 	operation string,
 	invokePayload []byte,
 ) (io.ReadCloser, error) {
-	currMemUsage, stream, err := actor.invoke(ctx, operation, invokePayload, false, false)
+	ref := actor.reference()
+	id := ref.ActorIDWithNamespace()
+
+	chain, ok := callChainFromContext(ctx)
+	if !ok {
+		// This is the first invocation of the call chain.
+		serverID, _ := a.getServerState()
+		chain = callChain{ID: newCallChainID(serverID)}
+	}
+
+	// If the actor is already part of the call chain and its mailbox is held by the chain
+	// then the invocation looped back to the actor while it is waiting for the chain to
+	// complete. Waiting for our turn in the mailbox would deadlock so either run the
+	// invocation right away (reusing the mailbox and lock held further up the chain) if the
+	// actor is reentrant, or fail fast.
+	reentrant := false
+	if chain.contains(id) && actor.mailbox.isHeldBy(chain.ID) {
+		if !actor.reentrant {
+			return nil, NewDeadlockError(fmt.Errorf(
+				"invocation of operation: %s on actor: %s would deadlock because it is already waiting for call chain: %s",
+				operation, id.String(), chain.String()))
+		}
+		// If the chain only holds the actor in shared mode (because it's waiting for a
+		// read-only invocation) then other read-only invocations may be running as well,
+		// so only read-only invocations can reuse the hold.
+		if !actor.isReadOnly(operation) && !actor.mailbox.isHeldExclusivelyBy(chain.ID) {
+			return nil, NewDeadlockError(fmt.Errorf(
+				"invocation of operation: %s on actor: %s would deadlock because call chain: %s is waiting for a read-only invocation of the actor",
+				operation, id.String(), chain.String()))
+		}
+		reentrant = true
+	}
+	ctx = withCallChain(ctx, chain.with(id))
+
+	// The actors that this actor invokes don't inherit the idempotency key since their
+	// invocations are different from this one.
+	idempotencyKey := idempotencyKeyFromContext(ctx)
+	if idempotencyKey != "" {
+		ctx = WithIdempotencyKey(ctx, "")
+	}
+
+	if !reentrant {
+		// Wait for our turn in the actor's mailbox (or fail fast if the mailbox is full) before
+		// trying to acquire the actor's lock so that invocations are processed fairly and a hot
+		// actor can't pile up an unbounded number of goroutines. Read-only invocations share
+		// the mailbox with each other.
+		_, waitSpan := a.tracer.Start(ctx, "nola.mailbox.wait")
+		err := actor.mailbox.acquire(ctx, !actor.isReadOnly(operation))
+		waitSpan.RecordError(err)
+		waitSpan.End()
+		if err != nil {
+			return nil, err
+		}
+		defer actor.mailbox.release(ctx)
+	}
+
+	if idempotencyKey != "" {
+		// Check for a response only once the invocation's turn in the mailbox has come so
+		// that a retry that arrives while the original invocation is still running observes
+		// its response instead of running the operation again.
+		resp, ok, err := actor.idempotentResponses.get(idempotencyKey, operation, invokePayload)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			a.metrics.idempotentReplays.Inc()
+			return io.NopCloser(bytes.NewReader(resp)), nil
+		}
+	}
+
+	// Any actors that the actor invokes while it's executing inherit the span through the
+	// context.
+	ctx, span := a.tracer.Start(ctx, "nola.actor.invoke", tracing.WithAttributes(
+		tracing.Bool("nola.reentrant", reentrant)))
+	currMemUsage, stream, err := actor.invoke(ctx, operation, invokePayload, reentrant, false)
+	span.RecordError(err)
+	span.End()
 	if err != nil {
 		return nil, err
 	}
 
-	ref := actor.reference()
-	a._actorResourceTracker.track(ref.ActorIDWithNamespace(), currMemUsage)
+	if idempotencyKey != "" {
+		// The response has to be buffered so that it can be replayed. Read it while the
+		// mailbox is still held so that retries can't observe the invocation before its
+		// response is recorded.
+		resp, err := readAllAndClose(stream)
+		if err != nil {
+			a._actorResourceTracker.track(
+				id, currMemUsage+actor.idempotentResponses.memUsageBytes())
+			return nil, fmt.Errorf("error reading response of invocation with idempotency key: %w", err)
+		}
+		actor.idempotentResponses.record(idempotencyKey, operation, invokePayload, resp)
+		stream = io.NopCloser(bytes.NewReader(resp))
+	}
+
+	// The recorded responses count towards the actor's memory usage so that they're
+	// accounted for by the memory limits and shedding.
+	a._actorResourceTracker.track(id, currMemUsage+actor.idempotentResponses.memUsageBytes())
 	return stream, nil
 }
 
+func readAllAndClose(stream io.ReadCloser) ([]byte, error) {
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func isReentrantModule(module Module) bool {
+	reentrantModule, ok := module.(ReentrantModule)
+	return ok && reentrantModule.Reentrant()
+}
+
 func (a *activations) ensureModule(
 	ctx context.Context,
 	moduleID types.NamespacedID,
@@ -371,7 +564,7 @@ func (a *activations) ensureModule(
 		} else {
 			// TODO: Should consider not using the context from the request here since this
 			// timeout ends up being shared across multiple different requests potentially.
-			moduleBytes, _, err := a.moduleStore.GetModule(ctx, moduleID.Namespace, moduleID.ID)
+			moduleBytes, moduleOpts, err := a.moduleStore.GetModule(ctx, moduleID.Namespace, moduleID.ID)
 			if err != nil {
 				return nil, fmt.Errorf(
 					"error getting module bytes from registry for module: %s, err: %w",
@@ -379,7 +572,7 @@ func (a *activations) ensureModule(
 			}
 
 			hostFn := newHostFnRouter(
-				a.log, a.environment, a, a.customHostFns, moduleID.Namespace, moduleID.ID)
+				a.environment, a.customHostFns, moduleID.Namespace, moduleID.ID)
 			if len(moduleBytes) > 0 {
 				// WASM byte codes exists for the module so we should just use that.
 				// TODO: Hard-coded for now, but we should support using different runtimes with
@@ -393,7 +586,7 @@ func (a *activations) ensureModule(
 				}
 
 				// Wrap the wazero module so it implements Module.
-				module = wazeroModule{wazeroMod}
+				module = newWazeroModule(wazeroMod, moduleOpts)
 			}
 		}
 
@@ -411,6 +604,48 @@ func (a *activations) ensureModule(
 	return moduleI.(Module), nil
 }
 
+// isModuleLoaded returns true if the module was registered as a Go module or was loaded
+// from the module store to activate an actor.
+func (a *activations) isModuleLoaded(namespace, moduleID string) bool {
+	a.Lock()
+	_, ok := a.goModules[types.NewNamespacedIDNoType(namespace, moduleID)]
+	a.Unlock()
+	if ok {
+		return true
+	}
+
+	a._moduleState.Lock()
+	defer a._moduleState.Unlock()
+	for _, idType := range []string{types.IDTypeActor, types.IDTypeWorker} {
+		if _, ok := a._moduleState.modules[types.NewNamespacedID(namespace, moduleID, idType)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getMailboxStats returns the mailbox stats aggregated across every actor that has been
+// activated.
+func (a *activations) getMailboxStats() MailboxStats {
+	return a.mailboxStats.snapshot()
+}
+
+// actorMailboxStats returns the mailbox stats of the actor, or false if it's not activated.
+func (a *activations) actorMailboxStats(id types.NamespacedActorID) (MailboxStats, bool) {
+	a.Lock()
+	actorF, ok := a._actors[id]
+	a.Unlock()
+	if !ok {
+		return MailboxStats{}, false
+	}
+
+	actor, err := actorF.Wait()
+	if err != nil {
+		return MailboxStats{}, false
+	}
+	return actor.mailbox.stats.snapshot(), true
+}
+
 func (a *activations) numActivatedActors() int {
 	a.Lock()
 	defer a.Unlock()
@@ -422,6 +657,11 @@ func (a *activations) memUsageBytes() int {
 	return a._actorResourceTracker.memUsageBytes()
 }
 
+func (a *activations) memUsageBytesByNamespace() map[string]int {
+	// No need for lock since actorResourceTracker is already synchronized internally.
+	return a._actorResourceTracker.memUsageBytesByNamespace()
+}
+
 func (a *activations) setServerState(
 	serverID string,
 	serverVersion int64,
@@ -530,25 +770,67 @@ func (a *activations) shedMemUsage(numBytes int) {
 
 	if len(toShed) == len(actorsByMem) {
 		// Always ensure we retain at least one actor on the server since there
-		// is no scenario (with homogenous nodes at least) where it makes sense
-		// to evict all the actors from the server.
+		// is no scenario where it makes sense to evict all the actors from the
+		// server. Note that numBytes already accounts for differences in capacity
+		// between servers (the registry computes it based on memory utilization
+		// when servers report their memory limits) so even the smallest server in
+		// a heterogeneous cluster will only be asked to shed its "fair share".
 		toShed = toShed[:len(toShed)-1]
 	}
 
+	a.blacklistActors(toShed, shedReasonMemory, "shedding actor to reduce memory usage")
+
+	a.log.Info(
+		"done shedding actors based on memory usage",
+		slog.Int("num_actors", len(actorsByMem)),
+		slog.Int("num_actors_shedded", len(toShed)))
+}
+
+// shedActors instructs the activation cache to try and shed n actors so that the number of
+// actors activated across the cluster can be rebalanced (for example, after a new server joins
+// the cluster). Actors are selected and shed the same way as shedMemUsage (lowest memory usage
+// first, by adding them to the blacklist cache) and at least one actor is always retained.
+func (a *activations) shedActors(n int) {
+	if n <= 0 {
+		return
+	}
+
+	actorsByMem := a._actorResourceTracker.bottomNByMemory(n + 1)
+	if len(actorsByMem) <= 1 {
+		a.log.Info(
+			"skipping shedding actors for rebalancing because there are <= 1 actors",
+			slog.Int("num_actors", len(actorsByMem)))
+		return
+	}
+
+	toShed := actorsByMem
+	if len(toShed) > n {
+		toShed = toShed[:n]
+	}
+	if len(toShed) == len(actorsByMem) {
+		// Always ensure we retain at least one actor on the server.
+		toShed = toShed[:len(toShed)-1]
+	}
+
+	a.blacklistActors(toShed, shedReasonRebalance, "shedding actor to rebalance actors")
+
+	a.log.Info(
+		"done shedding actors for rebalancing",
+		slog.Int("num_actors_requested", n),
+		slog.Int("num_actors_shedded", len(toShed)))
+}
+
+// blacklistActors adds the provided actors to the blacklist cache (if they're not already
+// in it) so that subsequent invocations will be redirected to the registry.
+func (a *activations) blacklistActors(toShed []actorByMem, reason, msg string) {
 	for _, v := range toShed {
 		key := formatActorCacheKey(nil, v.id.Namespace, v.id.Module, v.id.ID)
 		if _, ok := a._blacklist.Get(key); !ok {
 			a._blacklist.SetWithTTL(key, nil, 1, activationBlacklistCacheTTL)
-			a.log.Info(
-				"shedding actor to reduce memory usage",
-				slog.String("actor_id", v.id.String()))
+			a.log.Info(msg, slog.String("actor_id", v.id.String()))
+			a.metrics.sheds.Inc(reason)
 		}
 	}
-
-	a.log.Info(
-		"done shedding actors based on memory usage",
-		slog.Int("num_actors", len(actorsByMem)),
-		slog.Int("num_actors_shedded", len(toShed)))
 }
 
 func (a *activations) topNByMem(n int) []actorByMem {
@@ -556,6 +838,13 @@ func (a *activations) topNByMem(n int) []actorByMem {
 }
 
 func (a *activations) close(ctx context.Context, numWorkers int) error {
+	// Stop the sweeper and the wheel after the lock is released since the sweeper may be
+	// waiting to acquire it to remove an actor that it just GC'd.
+	defer func() {
+		a.idleSweeper.close()
+		a.wheel.close()
+	}()
+
 	a.log.Info("acquiring lock for closing actor activations")
 	a.Lock()
 	a.log.Info("acquired lock for closing actor activations")
@@ -628,6 +917,7 @@ func (a *activations) isServerIDBlacklisted(
 	// Immediately return to the pool cause we're done with it now regardless.
 	bufPool.Put(bufIface)
 	if ok {
+		a.metrics.blacklistHits.Inc()
 		err := fmt.Errorf(
 			"actor %s is blacklisted on this server", reference.ActorID)
 		serverID, _ := a.getServerState()
@@ -637,20 +927,129 @@ func (a *activations) isServerIDBlacklisted(
 	return nil
 }
 
+func (a *activations) isNotOwnedWithLock(
+	reference types.ActorReferenceVirtual,
+) error {
+	handedOffAt, ok := a._notOwned[reference.ActorIDWithNamespace()]
+	if !ok {
+		return nil
+	}
+	if time.Since(handedOffAt) > actorNotOwnedTTL {
+		delete(a._notOwned, reference.ActorIDWithNamespace())
+		return nil
+	}
+
+	err := fmt.Errorf(
+		"actor %s was handed off to a different server", reference.ActorID)
+	serverID, _ := a.getServerState()
+	return NewActorNotOwnedError(err, []string{serverID})
+}
+
+// handoffCandidates returns the IDs of all the actors whose ownership should be
+// re-evaluated after a cluster membership change. This includes all of the actors
+// that are currently activated as well as all the actors that were previously handed
+// off and may have been returned to this server by the latest membership change.
+func (a *activations) handoffCandidates() []types.NamespacedActorID {
+	a.Lock()
+	defer a.Unlock()
+
+	candidates := make([]types.NamespacedActorID, 0, len(a._actors)+len(a._notOwned))
+	for id := range a._actors {
+		if id.IDType != types.IDTypeActor {
+			// Workers are not subject to single-activation semantics.
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+	for id, handedOffAt := range a._notOwned {
+		if time.Since(handedOffAt) > actorNotOwnedTTL {
+			delete(a._notOwned, id)
+			continue
+		}
+		if _, ok := a._actors[id]; !ok {
+			candidates = append(candidates, id)
+		}
+	}
+	return candidates
+}
+
+// markOwned indicates that the server owns the actor (again) so that invocations
+// for it should no longer be redirected.
+func (a *activations) markOwned(id types.NamespacedActorID) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a._notOwned, id)
+}
+
+// handoff marks the actor as not owned by this server so that all subsequent
+// invocations are redirected, and then deactivates it if its currently activated.
+// If the actor implements ActorSnapshotter then a snapshot of its state is taken
+// right before it is deactivated and returned so that the caller can transfer it
+// to the actor's new owner.
+func (a *activations) handoff(
+	ctx context.Context,
+	id types.NamespacedActorID,
+) ([]byte, error) {
+	a.Lock()
+	if _, ok := a._notOwned[id]; !ok {
+		a._notOwned[id] = time.Now()
+	}
+	futActor, ok := a._actors[id]
+	if ok {
+		delete(a._actors, id)
+	}
+	a.Unlock()
+
+	if !ok {
+		// Not activated, nothing else to do.
+		return nil, nil
+	}
+
+	actor, err := futActor.Wait()
+	if err != nil {
+		// Actor failed to activate so there is nothing to deactivate.
+		return nil, nil
+	}
+
+	snapshot, err := actor.snapshotAndClose(ctx)
+	a._actorResourceTracker.track(id, 0)
+	if err != nil {
+		return snapshot, fmt.Errorf("error closing actor during handoff: %w", err)
+	}
+	return snapshot, nil
+}
+
 type activatedActor struct {
-	sync.Mutex
+	// Accessed atomically so the idle checks that run on the timing wheel never have to
+	// wait for the actor's lock. Kept as the first field to guarantee 64-bit alignment.
+	_lastInvokeNanos int64
+	// _hydratable is 1 until the actor is invoked for the first time (other than startup).
+	// Accessed atomically since read-only invocations only hold the lock in shared mode.
+	_hydratable int32
+
+	// Read-only invocations hold the lock in shared mode, everything else (including
+	// closing the actor) holds it exclusively.
+	sync.RWMutex
 
 	_log *slog.Logger
 
+	// mailbox must be acquired by invocations before they invoke the actor.
+	mailbox *actorMailbox
+	// idempotentResponses is internally synchronized.
+	idempotentResponses *idempotentResponses
+	// reentrant is true if the actor's module is a ReentrantModule.
+	reentrant bool
+
 	// Don't access directly from outside this structs own method implementations,
 	// use methods like invoke() and close() instead.
-	_a          Actor
-	_reference  types.ActorReferenceVirtual
-	_host       HostCapabilities
-	_closed     bool
-	_lastInvoke time.Time
-	_gcAfter    time.Duration
-	_gcTimer    *time.Timer
+	_a         Actor
+	_reference types.ActorReferenceVirtual
+	_host      HostCapabilities
+	_timers    *actorTimers
+	_closed    bool
+	_gcAfter   time.Duration
+	_sweeper   *idleActorSweeper
+	_onGc      func()
 }
 
 func newActivatedActor(
@@ -659,52 +1058,38 @@ func newActivatedActor(
 	actor Actor,
 	reference types.ActorReferenceVirtual,
 	host HostCapabilities,
+	timers *actorTimers,
+	mailbox *actorMailbox,
+	idempotentResponses *idempotentResponses,
+	reentrant bool,
 	instantiatePayload []byte,
 	gcAfter time.Duration,
+	sweeper *idleActorSweeper,
 	onGc func(),
 ) (int, *activatedActor, error) {
 	a := &activatedActor{
-		_log:        log.With(slog.String("module", "activatedActor")),
-		_a:          actor,
-		_reference:  reference,
-		_host:       host,
-		_lastInvoke: time.Now(),
-		_gcAfter:    gcAfter,
-	}
-
-	var gcFunc func()
-	gcFunc = func() {
-		a.Lock()
-		defer a.Unlock()
-
-		if a._closed {
-			// Actor is already closed, nothing to do.
-			return
-		}
-
-		if time.Since(a._lastInvoke) > gcAfter {
-			// The actor has not been invoked recently, GC it.
-			alreadyClosed, err := a.closeWithLock(context.Background())
-			if err != nil {
-				log.Error("error closing GC'd actor", slog.Any("error", err))
-			}
-			if alreadyClosed {
-				return
-			}
-			onGc()
-		} else {
-			// Actor was invoked recently, schedule a new GC check later.
-			time.AfterFunc(gcAfter, gcFunc)
-		}
+		_lastInvokeNanos:    time.Now().UnixNano(),
+		_hydratable:         1,
+		_log:                log.With(slog.String("module", "activatedActor")),
+		mailbox:             mailbox,
+		idempotentResponses: idempotentResponses,
+		reentrant:           reentrant,
+		_a:                  actor,
+		_reference:          reference,
+		_host:               host,
+		_timers:             timers,
+		_gcAfter:            gcAfter,
+		_sweeper:            sweeper,
+		_onGc:               onGc,
 	}
-	gcTimer := time.AfterFunc(gcAfter, gcFunc)
-	a._gcTimer = gcTimer
-
 	currMemUsage, _, err := a.invoke(ctx, wapcutils.StartupOperationName, instantiatePayload, false, false)
 	if err != nil {
 		a.close(ctx)
 		return 0, nil, fmt.Errorf("newActivatedActor: error invoking startup function: %w", err)
 	}
+	// Only start checking whether the actor is idle once it has started up, otherwise a
+	// slow startup could be mistaken for the actor being idle.
+	sweeper.watch(a)
 
 	return currMemUsage, a, nil
 }
@@ -720,8 +1105,13 @@ func (a *activatedActor) invoke(
 	isClosing bool,
 ) (int, io.ReadCloser, error) {
 	if !alreadyLocked {
-		a.Lock()
-		defer a.Unlock()
+		if !isClosing && a.isReadOnly(operation) {
+			a.RLock()
+			defer a.RUnlock()
+		} else {
+			a.Lock()
+			defer a.Unlock()
+		}
 	}
 
 	if a._closed {
@@ -729,17 +1119,37 @@ func (a *activatedActor) invoke(
 			"tried to invoke actor: %s which has already been closed", a._reference.ActorID)
 	}
 
-	// Set a._lastInvoke to now so that if the timer function runs after we release the lock it will
-	// immediately see that an invocation has run recently.
-	a._lastInvoke = time.Now()
 	if !isClosing {
-		// In addition, Reset the timer manually for the common case in which the actor has not expired
-		// yet which spares the runtime the cost of spawning a goroutine to run the GC function just to
-		// immediately check a._lastInvoke and see that it is recent.
-		//
-		// Note that we skip this branch if the actor is closed to prevent invoking the Shutdown
-		// operation during close from triggering an additional GC reschedule.
-		a._gcTimer.Reset(a._gcAfter)
+		// Record the time of the invocation so the actor's next idle check reschedules itself
+		// instead of GC'ing the actor. This is much cheaper than resetting a timer on every
+		// invocation. Note that we skip this if the actor is closing so the Shutdown operation
+		// isn't counted as activity.
+		atomic.StoreInt64(&a._lastInvokeNanos, time.Now().UnixNano())
+	}
+
+	if operation == wapcutils.HydrateOperationName {
+		// Hydrate is handled by the host instead of being dispatched to the actor's code.
+		snapshotter, ok := a._a.(ActorSnapshotter)
+		if !ok {
+			return 0, nil, fmt.Errorf(
+				"actor: %s does not support hydrating from a snapshot", a._reference.ActorID)
+		}
+		// The snapshot may be older than the actor's current state if the actor has been
+		// invoked already, in which case it must not be overwritten. This also prevents the
+		// actor from being hydrated more than once.
+		if !atomic.CompareAndSwapInt32(&a._hydratable, 1, 0) {
+			return 0, nil, fmt.Errorf(
+				"actor: %s cannot be hydrated from a snapshot because it has been invoked already",
+				a._reference.ActorID)
+		}
+		if err := snapshotter.Hydrate(ctx, payload); err != nil {
+			return 0, nil, fmt.Errorf("error hydrating actor: %s from snapshot: %w", a._reference.ActorID, err)
+		}
+		return a._a.MemoryUsageBytes(), io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	if operation != wapcutils.StartupOperationName && atomic.LoadInt32(&a._hydratable) == 1 {
+		atomic.StoreInt32(&a._hydratable, 0)
 	}
 
 	streamActor, ok := a._a.(ActorStream)
@@ -762,6 +1172,59 @@ func (a *activatedActor) invoke(
 	return a._a.MemoryUsageBytes(), io.NopCloser(bytes.NewBuffer(resp)), nil
 }
 
+// isReadOnly returns whether the provided operation is declared as read-only by the actor.
+// The operations that are handled by the host, like startup and shutdown, are never
+// read-only.
+func (a *activatedActor) isReadOnly(operation string) bool {
+	switch operation {
+	case wapcutils.StartupOperationName, wapcutils.ShutdownOperationName, wapcutils.HydrateOperationName:
+		return false
+	}
+	readOnlyActor, ok := a._a.(ActorReadOnly)
+	return ok && readOnlyActor.IsReadOnly(operation)
+}
+
+func (a *activatedActor) lastInvoke() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a._lastInvokeNanos))
+}
+
+func (a *activatedActor) isIdle() bool {
+	return time.Since(a.lastInvoke()) >= a._gcAfter
+}
+
+// gcIfIdle closes the actor if it has not been invoked recently, otherwise it schedules
+// another idle check.
+func (a *activatedActor) gcIfIdle() {
+	if !a.TryLock() {
+		// The actor is busy so it isn't idle. Don't block the sweeper (and the GC of every
+		// other idle actor) until it's done, just check it again on the next sweep.
+		a._sweeper.watch(a)
+		return
+	}
+	defer a.Unlock()
+
+	if a._closed {
+		// Actor is already closed, nothing to do.
+		return
+	}
+
+	if !a.isIdle() {
+		// Actor was invoked recently, schedule a new GC check later.
+		a._sweeper.watch(a)
+		return
+	}
+
+	// The actor has not been invoked recently, GC it.
+	alreadyClosed, err := a.closeWithLock(context.Background())
+	if err != nil {
+		a._log.Error("error closing GC'd actor", slog.Any("error", err))
+	}
+	if alreadyClosed {
+		return
+	}
+	a._onGc()
+}
+
 func (a *activatedActor) close(ctx context.Context) error {
 	a.Lock()
 	defer a.Unlock()
@@ -769,6 +1232,33 @@ func (a *activatedActor) close(ctx context.Context) error {
 	return err
 }
 
+// snapshotAndClose is the same as close, except if the actor implements ActorSnapshotter
+// then a snapshot of the actor's state is taken and returned before the actor is closed.
+func (a *activatedActor) snapshotAndClose(ctx context.Context) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a._closed {
+		return nil, nil
+	}
+
+	var snapshot []byte
+	if snapshotter, ok := a._a.(ActorSnapshotter); ok {
+		var err error
+		snapshot, err = snapshotter.Snapshot(ctx)
+		if err != nil {
+			// Still close the actor since the server no longer owns it. The new owner will
+			// just have to reactivate it from scratch.
+			a._log.Error(
+				"error snapshotting actor", slog.Any("actor", a._reference), slog.Any("error", err))
+			snapshot = nil
+		}
+	}
+
+	_, err := a.closeWithLock(ctx)
+	return snapshot, err
+}
+
 func (a *activatedActor) closeWithLock(ctx context.Context) (alreadyClosed bool, err error) {
 	if a._closed {
 		return true, nil
@@ -783,6 +1273,9 @@ func (a *activatedActor) closeWithLock(ctx context.Context) (alreadyClosed bool,
 	}
 
 	a._closed = true
+	// Stop the actor's outstanding timers so they don't linger in the Go runtime until
+	// they fire.
+	a._timers.close()
 
 	return false, a._a.Close(ctx)
 }
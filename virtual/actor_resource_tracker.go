@@ -14,6 +14,8 @@ type actorResourceTracker struct {
 	_actors               map[types.NamespacedActorID]*actorResources
 	_topActorsByMem       *btree.BTreeG[actorByMem]
 	_currMemoryUsageBytes int
+	// _memUsageBytesByNamespace only contains namespaces with non-zero memory usage.
+	_memUsageBytesByNamespace map[string]int
 }
 
 func newActorResourceTracker() *actorResourceTracker {
@@ -25,7 +27,8 @@ func newActorResourceTracker() *actorResourceTracker {
 			}
 			return a.id.Less(b.id) > 0
 		}),
-		_currMemoryUsageBytes: 0,
+		_currMemoryUsageBytes:     0,
+		_memUsageBytesByNamespace: make(map[string]int),
 	}
 }
 
@@ -47,6 +50,11 @@ func (m *actorResourceTracker) track(
 	curr.memoryBytes = memUsageBytes
 	delta := memUsageBytes - prevMemUsage
 	m._currMemoryUsageBytes += delta
+	if nsUsage := m._memUsageBytesByNamespace[id.Namespace] + delta; nsUsage == 0 {
+		delete(m._memUsageBytesByNamespace, id.Namespace)
+	} else {
+		m._memUsageBytesByNamespace[id.Namespace] = nsUsage
+	}
 
 	// Next, update the index of actors by memory usage.
 	m._topActorsByMem.Delete(actorByMem{id: id, memoryBytes: prevMemUsage})
@@ -63,6 +71,24 @@ func (m *actorResourceTracker) memUsageBytes() int {
 	return m._currMemoryUsageBytes
 }
 
+func (m *actorResourceTracker) namespaceMemUsageBytes(namespace string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m._memUsageBytesByNamespace[namespace]
+}
+
+// memUsageBytesByNamespace returns a copy of the memory usage of each namespace that has
+// non-zero memory usage.
+func (m *actorResourceTracker) memUsageBytesByNamespace() map[string]int {
+	m.Lock()
+	defer m.Unlock()
+	usage := make(map[string]int, len(m._memUsageBytesByNamespace))
+	for namespace, bytes := range m._memUsageBytesByNamespace {
+		usage[namespace] = bytes
+	}
+	return usage
+}
+
 func (m *actorResourceTracker) topNByMemory(n int) []actorByMem {
 	// Pre-alloc before acquiring lock to avoid tail latencies.
 	topN := make([]actorByMem, 0, n)
@@ -111,6 +137,12 @@ func (m *actorResourceTracker) assertInvariantsWithLock() {
 			"[invariant violated] len(m._actors) == 0 but m._currMemoryUsageBytes == %d",
 			m._currMemoryUsageBytes))
 	}
+
+	if len(m._actors) == 0 && len(m._memUsageBytesByNamespace) != 0 {
+		panic(fmt.Sprintf(
+			"[invariant violated] len(m._actors) == 0 but len(m._memUsageBytesByNamespace) == %d",
+			len(m._memUsageBytesByNamespace)))
+	}
 }
 
 type actorResources struct {
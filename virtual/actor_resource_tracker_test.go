@@ -23,13 +23,14 @@ func testActorResourceTrackerConcurrentProperty(t *testing.T) {
 		numActors         = 100
 		numWorkers        = 10
 		numItersPerWorker = 100
+		namespaces        = []string{"ns-0", "ns-1"}
 
 		actorIDs = []types.NamespacedActorID{}
 	)
 
 	for i := 0; i < numActors; i++ {
 		id := types.NewNamespacedActorID(
-			"ns", fmt.Sprintf("actor-%d", i), "module", types.IDTypeActor)
+			namespaces[i%len(namespaces)], fmt.Sprintf("actor-%d", i), "module", types.IDTypeActor)
 		actorIDs = append(actorIDs, id)
 	}
 
@@ -60,6 +61,10 @@ func testActorResourceTrackerConcurrentProperty(t *testing.T) {
 	wg.Wait()
 
 	require.Equal(t, reference.memUsageBytes(), tracker.memUsageBytes())
+	for _, namespace := range namespaces {
+		require.Equal(t,
+			reference.namespaceMemUsageBytes(namespace), tracker.namespaceMemUsageBytes(namespace))
+	}
 
 	n := rand.Intn(len(actorIDs))
 	require.Equal(t, reference.topNByMemory(n), tracker.topNByMemory(n))
@@ -109,6 +114,18 @@ func (a *testActorResourceReferenceImpl) memUsageBytes() int {
 	return usage
 }
 
+func (a *testActorResourceReferenceImpl) namespaceMemUsageBytes(namespace string) int {
+	a.Lock()
+	defer a.Unlock()
+	usage := 0
+	for k, v := range a.m {
+		if k.Namespace == namespace {
+			usage += v.memoryBytes
+		}
+	}
+	return usage
+}
+
 func (a *testActorResourceReferenceImpl) topNByMemory(n int) []actorByMem {
 	a.Lock()
 	defer a.Unlock()
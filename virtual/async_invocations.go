@@ -0,0 +1,728 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// DefaultAsyncInvocationMaxAttempts is the default value for
+	// AsyncInvocationOptions.MaxAttempts.
+	DefaultAsyncInvocationMaxAttempts = 10
+	// DefaultAsyncInvocationInitialBackoff is the default value for
+	// AsyncInvocationOptions.InitialBackoff.
+	DefaultAsyncInvocationInitialBackoff = 100 * time.Millisecond
+	// DefaultAsyncInvocationMaxBackoff is the default value for
+	// AsyncInvocationOptions.MaxBackoff.
+	DefaultAsyncInvocationMaxBackoff = time.Minute
+	// DefaultAsyncInvocationPollInterval is the default value for
+	// AsyncInvocationOptions.PollInterval.
+	DefaultAsyncInvocationPollInterval = 100 * time.Millisecond
+	// DefaultAsyncInvocationLeaseDuration is the default value for
+	// AsyncInvocationOptions.LeaseDuration.
+	DefaultAsyncInvocationLeaseDuration = 30 * time.Second
+	// DefaultAsyncInvocationMaxConcurrentDeliveries is the default value for
+	// AsyncInvocationOptions.MaxConcurrentDeliveries.
+	DefaultAsyncInvocationMaxConcurrentDeliveries = 64
+
+	asyncInvocationsKeyPrefix = "async_invocations"
+)
+
+// errStopIteration is returned from IterPrefix callbacks to stop iterating early.
+var errStopIteration = errors.New("stop iteration")
+
+// AsyncInvocationOptions configures the durable queue that backs InvokeActorAsync.
+//
+// Invocations are enqueued in Store and delivered in the background by whichever
+// environment sharing the Store claims the target actor's queue first. Delivery is
+// at-least-once: an invocation is only removed from the queue once the actor has
+// processed it successfully, so actors must tolerate receiving the same invocation more
+// than once (for example if the delivering server dies right after the invocation
+// completed). Invocations for the same actor are delivered one at a time in the order
+// they were enqueued. Failed invocations are retried with exponential backoff, and moved
+// to a dead-letter record after MaxAttempts so they don't block the actor's queue
+// forever.
+type AsyncInvocationOptions struct {
+	// Store is the KV store that async invocations are enqueued in. Every environment in
+	// the cluster should use the same Store so that invocations enqueued by a server that
+	// dies are still delivered. InvokeActorAsync returns an error if it is nil.
+	Store kv.Store
+	// MaxAttempts is the maximum number of times an invocation is attempted before it is
+	// moved to the dead letters. Defaults to DefaultAsyncInvocationMaxAttempts.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before retrying an invocation that failed for
+	// the first time. The backoff doubles with every subsequent failure up to MaxBackoff.
+	// Defaults to DefaultAsyncInvocationInitialBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum amount of time to wait between attempts. Defaults to
+	// DefaultAsyncInvocationMaxBackoff.
+	MaxBackoff time.Duration
+	// PollInterval controls how often the environment checks the Store for invocations
+	// that are ready to be delivered. Defaults to DefaultAsyncInvocationPollInterval.
+	PollInterval time.Duration
+	// LeaseDuration is how long an environment has exclusive ownership of an actor's queue
+	// after it claims it. The lease is renewed after every delivered invocation, and other
+	// environments take over the queue if it expires (because the environment died).
+	// Individual invocations time out after half of LeaseDuration so that they complete
+	// before the lease expires. Defaults to DefaultAsyncInvocationLeaseDuration.
+	LeaseDuration time.Duration
+	// MaxConcurrentDeliveries is the maximum number of actor queues that the environment
+	// delivers invocations for concurrently. Defaults to
+	// DefaultAsyncInvocationMaxConcurrentDeliveries.
+	MaxConcurrentDeliveries int
+}
+
+// Enabled returns true if async invocations are enabled.
+func (a AsyncInvocationOptions) Enabled() bool {
+	return a.Store != nil
+}
+
+// Validate validates the options.
+func (a AsyncInvocationOptions) Validate() error {
+	if a.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts must be >= 0, but was: %d", a.MaxAttempts)
+	}
+	if a.InitialBackoff < 0 {
+		return fmt.Errorf("InitialBackoff must be >= 0, but was: %s", a.InitialBackoff)
+	}
+	if a.MaxBackoff < 0 {
+		return fmt.Errorf("MaxBackoff must be >= 0, but was: %s", a.MaxBackoff)
+	}
+	if a.InitialBackoff > 0 && a.MaxBackoff > 0 && a.InitialBackoff > a.MaxBackoff {
+		return fmt.Errorf(
+			"InitialBackoff(%s) must be <= MaxBackoff(%s)", a.InitialBackoff, a.MaxBackoff)
+	}
+	if a.PollInterval < 0 {
+		return fmt.Errorf("PollInterval must be >= 0, but was: %s", a.PollInterval)
+	}
+	if a.LeaseDuration < 0 {
+		return fmt.Errorf("LeaseDuration must be >= 0, but was: %s", a.LeaseDuration)
+	}
+	if a.MaxConcurrentDeliveries < 0 {
+		return fmt.Errorf(
+			"MaxConcurrentDeliveries must be >= 0, but was: %d", a.MaxConcurrentDeliveries)
+	}
+	return nil
+}
+
+func (a AsyncInvocationOptions) withDefaults() AsyncInvocationOptions {
+	if a.MaxAttempts == 0 {
+		a.MaxAttempts = DefaultAsyncInvocationMaxAttempts
+	}
+	if a.InitialBackoff == 0 {
+		a.InitialBackoff = DefaultAsyncInvocationInitialBackoff
+	}
+	if a.MaxBackoff == 0 {
+		a.MaxBackoff = DefaultAsyncInvocationMaxBackoff
+	}
+	if a.MaxBackoff < a.InitialBackoff {
+		a.MaxBackoff = a.InitialBackoff
+	}
+	if a.PollInterval == 0 {
+		a.PollInterval = DefaultAsyncInvocationPollInterval
+	}
+	if a.LeaseDuration == 0 {
+		a.LeaseDuration = DefaultAsyncInvocationLeaseDuration
+	}
+	if a.MaxConcurrentDeliveries == 0 {
+		a.MaxConcurrentDeliveries = DefaultAsyncInvocationMaxConcurrentDeliveries
+	}
+	return a
+}
+
+// asyncInvocation is an invocation that is stored in the queue of its target actor.
+type asyncInvocation struct {
+	Namespace        string
+	ActorID          string
+	ModuleID         string
+	Operation        string
+	Payload          []byte
+	CreateIfNotExist types.CreateIfNotExist
+	// Attempts is the number of times delivering the invocation has failed.
+	Attempts int
+	// LastError is the error returned by the most recent failed attempt.
+	LastError string
+}
+
+// asyncQueueState is the state of a single actor's queue. It only exists while the queue
+// is not empty.
+//
+// Every queue is also indexed by readyAt() in the ready index so that the pollers only
+// have to read the queues that are due instead of scanning (and conflicting with) every
+// queue on every poll.
+type asyncQueueState struct {
+	// NextSeq is the sequence number that will be assigned to the next enqueued
+	// invocation. Sequence numbers determine the delivery order.
+	NextSeq int64
+	// NextAttemptAt is the versionstamp after which the invocation at the head of the
+	// queue can be (re)attempted.
+	NextAttemptAt int64
+	// LeaseOwner identifies the asyncInvocationQueue that currently owns the queue, if any.
+	LeaseOwner string
+	// LeaseExpiresAt is the versionstamp at which the lease expires.
+	LeaseExpiresAt int64
+
+	// indexedAt is the position of the queue in the ready index when the state was read,
+	// or -1 if the queue didn't exist yet. It is not persisted.
+	indexedAt int64
+}
+
+func (s asyncQueueState) isLeasedBy(owner string, vs int64) bool {
+	return s.LeaseOwner == owner && s.LeaseExpiresAt > vs
+}
+
+// readyAt returns the versionstamp after which the queue can be claimed by a poller.
+func (s asyncQueueState) readyAt() int64 {
+	if s.LeaseExpiresAt > s.NextAttemptAt {
+		return s.LeaseExpiresAt
+	}
+	return s.NextAttemptAt
+}
+
+// asyncInvocationQueue is the durable queue that backs InvokeActorAsync. It is built on
+// top of a kv.Store so it is shared by every environment that uses the same store. See
+// AsyncInvocationOptions for a description of the delivery semantics.
+type asyncInvocationQueue struct {
+	log     *slog.Logger
+	store   kv.Store
+	opts    AsyncInvocationOptions
+	ownerID string
+	deliver func(context.Context, asyncInvocation) error
+
+	// _delivering contains the queues that this instance is currently delivering
+	// invocations for so the poller doesn't try to claim them again.
+	_delivering struct {
+		sync.Mutex
+		queues map[types.NamespacedActorID]struct{}
+	}
+
+	closeCh    chan struct{}
+	closedCh   chan struct{}
+	deliveryWg sync.WaitGroup
+}
+
+func newAsyncInvocationQueue(
+	log *slog.Logger,
+	serverID string,
+	opts AsyncInvocationOptions,
+	deliver func(context.Context, asyncInvocation) error,
+) *asyncInvocationQueue {
+	q := &asyncInvocationQueue{
+		log:   log.With(slog.String("module", "asyncInvocationQueue")),
+		store: opts.Store,
+		opts:  opts.withDefaults(),
+		// Include a random component so that a restarted server with the same ID doesn't
+		// mistake the leases of its previous incarnation for its own.
+		ownerID:  fmt.Sprintf("%s-%d", serverID, rand.Int63()),
+		deliver:  deliver,
+		closeCh:  make(chan struct{}),
+		closedCh: make(chan struct{}),
+	}
+	q._delivering.queues = make(map[types.NamespacedActorID]struct{})
+	return q
+}
+
+// start starts delivering invocations in the background.
+func (q *asyncInvocationQueue) start() {
+	go func() {
+		defer close(q.closedCh)
+		ticker := time.NewTicker(q.opts.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := q.poll(); err != nil {
+					q.log.Error("error polling for async invocations", slog.Any("error", err))
+				}
+			case <-q.closeCh:
+				return
+			}
+		}
+	}()
+}
+
+// close stops delivering invocations and waits for the in-flight deliveries to complete.
+func (q *asyncInvocationQueue) close() {
+	close(q.closeCh)
+	<-q.closedCh
+	q.deliveryWg.Wait()
+}
+
+// enqueue durably enqueues the invocation at the tail of its target actor's queue.
+func (q *asyncInvocationQueue) enqueue(ctx context.Context, inv asyncInvocation) error {
+	var (
+		id    = inv.actorID()
+		value = encodeAsyncInvocation(inv)
+	)
+	_, err := q.store.Transact(func(tr kv.Transaction) (any, error) {
+		state, _, err := getAsyncQueueState(ctx, tr, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tr.Put(ctx, getAsyncInvocationKey(id, state.NextSeq), value); err != nil {
+			return nil, err
+		}
+		state.NextSeq++
+		return nil, putAsyncQueueState(ctx, tr, id, state)
+	})
+	if err != nil {
+		return fmt.Errorf("error enqueuing async invocation: %w", err)
+	}
+	return nil
+}
+
+// poll claims the queues that are ready for delivery (up to the maximum concurrency) and
+// starts delivering their invocations.
+func (q *asyncInvocationQueue) poll() error {
+	q._delivering.Lock()
+	available := q.opts.MaxConcurrentDeliveries - len(q._delivering.queues)
+	delivering := make(map[types.NamespacedActorID]struct{}, len(q._delivering.queues))
+	for id := range q._delivering.queues {
+		delivering[id] = struct{}{}
+	}
+	q._delivering.Unlock()
+	if available <= 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	var claimed []types.NamespacedActorID
+	_, err := q.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		claimed = nil
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		// Only scan the part of the ready index that is due. The queues that are backing
+		// off or leased by someone else sort after it.
+		var toClaim []types.NamespacedActorID
+		err = tr.IterRange(
+			ctx, getAsyncReadyKeyFrom(0), getAsyncReadyKeyFrom(vs+1),
+			func(k, _ []byte) error {
+				if len(toClaim) >= available {
+					return errStopIteration
+				}
+
+				id, err := unpackAsyncReadyKey(k)
+				if err != nil {
+					return err
+				}
+				if _, ok := delivering[id]; ok {
+					return nil
+				}
+				toClaim = append(toClaim, id)
+				return nil
+			})
+		if err != nil && err != errStopIteration {
+			return nil, fmt.Errorf("error iterating async queues: %w", err)
+		}
+
+		claimable := toClaim[:0]
+		for _, id := range toClaim {
+			state, exists, err := getAsyncQueueState(ctx, tr, id)
+			if err != nil {
+				return nil, err
+			}
+			if !exists || state.readyAt() > vs {
+				return nil, fmt.Errorf(
+					"[invariant violated] async ready index is out of sync for queue: %s::%s::%s",
+					id.Namespace, id.Module, id.ID)
+			}
+			claimable = append(claimable, id)
+			state.LeaseOwner = q.ownerID
+			state.LeaseExpiresAt = vs + q.opts.LeaseDuration.Microseconds()
+			if err := putAsyncQueueState(ctx, tr, id, state); err != nil {
+				return nil, err
+			}
+		}
+		claimed = claimable
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range claimed {
+		q._delivering.Lock()
+		q._delivering.queues[id] = struct{}{}
+		q._delivering.Unlock()
+
+		q.deliveryWg.Add(1)
+		go func(id types.NamespacedActorID) {
+			defer q.deliveryWg.Done()
+			defer func() {
+				q._delivering.Lock()
+				delete(q._delivering.queues, id)
+				q._delivering.Unlock()
+			}()
+
+			if err := q.deliverQueue(id); err != nil {
+				q.log.Error(
+					"error delivering async invocations",
+					slog.String("actor_id", fmt.Sprintf("%s::%s::%s", id.Namespace, id.Module, id.ID)),
+					slog.Any("error", err))
+			}
+		}(id)
+	}
+	return nil
+}
+
+// deliverQueue delivers the invocations in the actor's queue (which must be leased by q)
+// one at a time until the queue is empty, an invocation fails, the lease is lost, or q is
+// closed.
+func (q *asyncInvocationQueue) deliverQueue(id types.NamespacedActorID) error {
+	ctx := context.Background()
+	for {
+		select {
+		case <-q.closeCh:
+			// Release the lease so that other environments can take over immediately
+			// instead of waiting for it to expire.
+			return q.releaseLease(ctx, id)
+		default:
+		}
+
+		inv, seq, ok, err := q.head(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		deliverCtx, cc := context.WithTimeout(ctx, q.opts.LeaseDuration/2)
+		deliverErr := q.deliver(deliverCtx, inv)
+		cc()
+
+		retry, err := q.ack(ctx, id, seq, inv, deliverErr)
+		if err != nil {
+			return err
+		}
+		if retry {
+			return nil
+		}
+	}
+}
+
+// head returns the invocation at the head of the actor's queue and its sequence number.
+// If the queue is empty, it is deleted and ok is false. It also returns false if q no
+// longer owns the queue's lease.
+func (q *asyncInvocationQueue) head(
+	ctx context.Context,
+	id types.NamespacedActorID,
+) (inv asyncInvocation, seq int64, ok bool, err error) {
+	_, err = q.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		inv, seq, ok = asyncInvocation{}, 0, false
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		state, exists, err := getAsyncQueueState(ctx, tr, id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists || !state.isLeasedBy(q.ownerID, vs) {
+			return nil, nil
+		}
+
+		var key []byte
+		err = tr.IterPrefix(ctx, getAsyncInvocationsPrefix(id), func(k, v []byte) error {
+			key = k
+			inv, err = decodeAsyncInvocation(v)
+			if err != nil {
+				return fmt.Errorf("error decoding async invocation: %w", err)
+			}
+			return errStopIteration
+		})
+		if err != nil && err != errStopIteration {
+			return nil, fmt.Errorf("error iterating async invocations: %w", err)
+		}
+		if key == nil {
+			// Queue is empty, delete its state so it no longer has to be polled.
+			return nil, deleteAsyncQueueState(ctx, tr, id, state)
+		}
+
+		unpacked, err := tuple.Unpack(key)
+		if err != nil {
+			return nil, fmt.Errorf("error unpacking async invocation key: %w", err)
+		}
+		seq, ok = unpacked[len(unpacked)-1].(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected async invocation key: %v", unpacked)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return asyncInvocation{}, 0, false, fmt.Errorf("error getting head of async queue: %w", err)
+	}
+	return inv, seq, ok, nil
+}
+
+// ack records the result of delivering the invocation with sequence number seq. It
+// returns true if the invocation should be retried later, in which case the lease is
+// released.
+func (q *asyncInvocationQueue) ack(
+	ctx context.Context,
+	id types.NamespacedActorID,
+	seq int64,
+	inv asyncInvocation,
+	deliverErr error,
+) (retry bool, err error) {
+	if deliverErr != nil {
+		inv.Attempts++
+		inv.LastError = deliverErr.Error()
+	}
+	deadLetter := deliverErr != nil && inv.Attempts >= q.opts.MaxAttempts
+
+	_, err = q.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		retry = false
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		state, _, err := getAsyncQueueState(ctx, tr, id)
+		if err != nil {
+			return nil, err
+		}
+		if !state.isLeasedBy(q.ownerID, vs) {
+			// Someone else took over the queue in the meantime so they'll (re)deliver
+			// the invocation.
+			return nil, errors.New("lost lease on async queue")
+		}
+
+		key := getAsyncInvocationKey(id, seq)
+		switch {
+		case deliverErr == nil:
+			if err := tr.Delete(ctx, key); err != nil {
+				return nil, err
+			}
+			state.LeaseExpiresAt = vs + q.opts.LeaseDuration.Microseconds()
+		case deadLetter:
+			if err := tr.Put(ctx, getAsyncDeadLetterKey(id, seq), encodeAsyncInvocation(inv)); err != nil {
+				return nil, err
+			}
+			if err := tr.Delete(ctx, key); err != nil {
+				return nil, err
+			}
+			state.LeaseExpiresAt = vs + q.opts.LeaseDuration.Microseconds()
+		default:
+			if err := tr.Put(ctx, key, encodeAsyncInvocation(inv)); err != nil {
+				return nil, err
+			}
+			state.NextAttemptAt = vs + q.backoff(inv.Attempts).Microseconds()
+			state.LeaseOwner = ""
+			state.LeaseExpiresAt = 0
+			retry = true
+		}
+		return nil, putAsyncQueueState(ctx, tr, id, state)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error acknowledging async invocation: %w", err)
+	}
+
+	if deadLetter {
+		q.log.Warn(
+			"moved async invocation to dead letters after exhausting its attempts",
+			slog.String("actor_id", fmt.Sprintf("%s::%s::%s", id.Namespace, id.Module, id.ID)),
+			slog.String("operation", inv.Operation),
+			slog.Int("attempts", inv.Attempts),
+			slog.String("last_error", inv.LastError))
+	}
+	return retry, nil
+}
+
+func (q *asyncInvocationQueue) releaseLease(ctx context.Context, id types.NamespacedActorID) error {
+	_, err := q.store.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		state, exists, err := getAsyncQueueState(ctx, tr, id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists || !state.isLeasedBy(q.ownerID, vs) {
+			return nil, nil
+		}
+		state.LeaseOwner = ""
+		state.LeaseExpiresAt = 0
+		return nil, putAsyncQueueState(ctx, tr, id, state)
+	})
+	if err != nil {
+		return fmt.Errorf("error releasing lease on async queue: %w", err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt of an invocation that failed
+// attempts times.
+func (q *asyncInvocationQueue) backoff(attempts int) time.Duration {
+	backoff := q.opts.InitialBackoff
+	for i := 1; i < attempts && backoff < q.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.opts.MaxBackoff {
+		backoff = q.opts.MaxBackoff
+	}
+	return backoff
+}
+
+// deadLetters returns the invocations for the actor that were moved to the dead letters
+// because they exhausted their attempts, in the order they were enqueued.
+func (q *asyncInvocationQueue) deadLetters(
+	ctx context.Context,
+	id types.NamespacedActorID,
+) ([]asyncInvocation, error) {
+	var deadLetters []asyncInvocation
+	_, err := q.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		deadLetters = nil
+		return nil, tr.IterPrefix(ctx, getAsyncDeadLettersPrefix(id), func(k, v []byte) error {
+			inv, err := decodeAsyncInvocation(v)
+			if err != nil {
+				return fmt.Errorf("error decoding async invocation: %w", err)
+			}
+			deadLetters = append(deadLetters, inv)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting async invocation dead letters: %w", err)
+	}
+	return deadLetters, nil
+}
+
+func (inv asyncInvocation) actorID() types.NamespacedActorID {
+	return types.NewNamespacedActorID(inv.Namespace, inv.ActorID, inv.ModuleID, types.IDTypeActor)
+}
+
+// getAsyncQueueState returns the state of the actor's queue. If the queue doesn't exist,
+// the zero state (which is immediately ready) is returned along with false.
+func getAsyncQueueState(
+	ctx context.Context,
+	tr kv.Transaction,
+	id types.NamespacedActorID,
+) (asyncQueueState, bool, error) {
+	v, ok, err := tr.Get(ctx, getAsyncQueueStateKey(id))
+	if err != nil {
+		return asyncQueueState{}, false, fmt.Errorf("error getting async queue state: %w", err)
+	}
+	if !ok {
+		return asyncQueueState{indexedAt: -1}, false, nil
+	}
+
+	state, err := decodeAsyncQueueState(v)
+	if err != nil {
+		return asyncQueueState{}, false, fmt.Errorf("error decoding async queue state: %w", err)
+	}
+	state.indexedAt = state.readyAt()
+	return state, true, nil
+}
+
+// putAsyncQueueState stores the state of the actor's queue (which must have been read by
+// getAsyncQueueState in the same transaction) and moves it in the ready index if
+// necessary. Updates that don't change when the queue is ready (like enqueuing more
+// invocations) don't touch the index so they don't conflict with the pollers.
+func putAsyncQueueState(
+	ctx context.Context,
+	tr kv.Transaction,
+	id types.NamespacedActorID,
+	state asyncQueueState,
+) error {
+	if err := tr.Put(ctx, getAsyncQueueStateKey(id), encodeAsyncQueueState(state)); err != nil {
+		return err
+	}
+	if readyAt := state.readyAt(); readyAt != state.indexedAt {
+		if state.indexedAt >= 0 {
+			if err := tr.Delete(ctx, getAsyncReadyKey(state.indexedAt, id)); err != nil {
+				return err
+			}
+		}
+		if err := tr.Put(ctx, getAsyncReadyKey(readyAt, id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAsyncQueueState deletes the state of the actor's queue (which must have been read
+// by getAsyncQueueState in the same transaction) and removes it from the ready index.
+func deleteAsyncQueueState(
+	ctx context.Context,
+	tr kv.Transaction,
+	id types.NamespacedActorID,
+	state asyncQueueState,
+) error {
+	if err := tr.Delete(ctx, getAsyncQueueStateKey(id)); err != nil {
+		return err
+	}
+	return tr.Delete(ctx, getAsyncReadyKey(state.indexedAt, id))
+}
+
+func unpackAsyncReadyKey(k []byte) (types.NamespacedActorID, error) {
+	unpacked, err := tuple.Unpack(k)
+	if err != nil {
+		return types.NamespacedActorID{}, fmt.Errorf("error unpacking async ready key: %w", err)
+	}
+	if len(unpacked) != 6 {
+		return types.NamespacedActorID{}, fmt.Errorf("unexpected async ready key: %v", unpacked)
+	}
+	namespace, ok1 := unpacked[3].(string)
+	moduleID, ok2 := unpacked[4].(string)
+	actorID, ok3 := unpacked[5].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return types.NamespacedActorID{}, fmt.Errorf("unexpected async ready key: %v", unpacked)
+	}
+	return types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor), nil
+}
+
+func getAsyncQueueStatesPrefix() []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "queues"}.Pack()
+}
+
+func getAsyncQueueStateKey(id types.NamespacedActorID) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "queues", id.Namespace, id.Module, id.ID}.Pack()
+}
+
+// getAsyncReadyKeyFrom returns the key that sorts before the entries of every queue in the
+// ready index that is ready at (or after) readyAt.
+func getAsyncReadyKeyFrom(readyAt int64) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "ready", readyAt}.Pack()
+}
+
+func getAsyncReadyKey(readyAt int64, id types.NamespacedActorID) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "ready", readyAt, id.Namespace, id.Module, id.ID}.Pack()
+}
+
+func getAsyncInvocationsPrefix(id types.NamespacedActorID) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "invocations", id.Namespace, id.Module, id.ID}.Pack()
+}
+
+func getAsyncInvocationKey(id types.NamespacedActorID, seq int64) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "invocations", id.Namespace, id.Module, id.ID, seq}.Pack()
+}
+
+func getAsyncDeadLettersPrefix(id types.NamespacedActorID) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "dead_letters", id.Namespace, id.Module, id.ID}.Pack()
+}
+
+func getAsyncDeadLetterKey(id types.NamespacedActorID, seq int64) []byte {
+	return tuple.Tuple{asyncInvocationsKeyPrefix, "dead_letters", id.Namespace, id.Module, id.ID, seq}.Pack()
+}
@@ -0,0 +1,326 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// TestAsyncInvocationQueue tests that invocations are delivered in order per actor, that
+// failed invocations are retried, and that invocations that exhaust their attempts are
+// moved to the dead letters without blocking the rest of the queue.
+func TestAsyncInvocationQueue(t *testing.T) {
+	var (
+		ctx = context.Background()
+
+		mu        sync.Mutex
+		delivered = map[string][]string{}
+		failures  = map[string]int{}
+	)
+	deliver := func(ctx context.Context, inv asyncInvocation) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch inv.Operation {
+		case "poison":
+			return errors.New("poison")
+		case "flaky":
+			if failures[inv.ActorID] < 2 {
+				failures[inv.ActorID]++
+				return errors.New("flaky")
+			}
+		}
+		delivered[inv.ActorID] = append(delivered[inv.ActorID], string(inv.Payload))
+		return nil
+	}
+
+	q := newAsyncInvocationQueue(slog.Default(), "server1", AsyncInvocationOptions{
+		Store:          localregistry.NewLocalKV(),
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		PollInterval:   time.Millisecond,
+	}, deliver)
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		operation := "inc"
+		switch i {
+		case 5:
+			operation = "flaky"
+		case 10:
+			operation = "poison"
+		}
+		if operation != "poison" {
+			expected = append(expected, strconv.Itoa(i))
+		}
+
+		for _, actorID := range []string{"a", "b"} {
+			require.NoError(t, q.enqueue(ctx, asyncInvocation{
+				Namespace: "ns-1",
+				ActorID:   actorID,
+				ModuleID:  "test-module",
+				Operation: operation,
+				Payload:   []byte(strconv.Itoa(i)),
+			}))
+		}
+	}
+
+	q.start()
+	defer q.close()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered["a"]) == len(expected) && len(delivered["b"]) == len(expected)
+	}, 10*time.Second, time.Millisecond)
+	mu.Lock()
+	require.Equal(t, expected, delivered["a"])
+	require.Equal(t, expected, delivered["b"])
+	mu.Unlock()
+
+	for _, actorID := range []string{"a", "b"} {
+		deadLetters, err := q.deadLetters(ctx, types.NewNamespacedActorID(
+			"ns-1", actorID, "test-module", types.IDTypeActor))
+		require.NoError(t, err)
+		require.Equal(t, 1, len(deadLetters))
+		require.Equal(t, "poison", deadLetters[0].Operation)
+		require.Equal(t, "10", string(deadLetters[0].Payload))
+		require.Equal(t, 3, deadLetters[0].Attempts)
+		require.Equal(t, "poison", deadLetters[0].LastError)
+	}
+
+	// Empty queues should be deleted, along with their entries in the ready index.
+	require.Eventually(t, func() bool {
+		_, err := q.store.Transact(func(tr kv.Transaction) (any, error) {
+			return nil, tr.IterPrefix(ctx, getAsyncQueueStatesPrefix(), func(k, v []byte) error {
+				return errors.New("queue still exists")
+			})
+		})
+		return err == nil
+	}, 10*time.Second, time.Millisecond)
+	require.Empty(t, getAsyncReadyIndex(t, q.store))
+}
+
+// TestAsyncInvocationQueueReadyIndex tests that queues are only claimed once they're due
+// according to the ready index, and that enqueuing into an existing queue doesn't move it
+// in the index.
+func TestAsyncInvocationQueueReadyIndex(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = localregistry.NewLocalKV()
+
+		mu        sync.Mutex
+		delivered = map[string]int{}
+	)
+	q := newAsyncInvocationQueue(slog.Default(), "server1", AsyncInvocationOptions{
+		Store:          store,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+	}, func(ctx context.Context, inv asyncInvocation) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[inv.ActorID]++
+		if inv.ActorID == "a" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	enqueue := func(actorID string) {
+		require.NoError(t, q.enqueue(ctx, asyncInvocation{
+			Namespace: "ns-1",
+			ActorID:   actorID,
+			ModuleID:  "test-module",
+			Operation: "inc",
+		}))
+	}
+	poll := func() {
+		require.NoError(t, q.poll())
+		q.deliveryWg.Wait()
+	}
+
+	enqueue("a")
+	require.Equal(t, map[string]int64{"a": 0}, getAsyncReadyIndex(t, store))
+
+	// The failed invocation should push the queue back in the index until its next attempt.
+	poll()
+	index := getAsyncReadyIndex(t, store)
+	require.Equal(t, 1, len(index))
+	require.Greater(t, index["a"], int64(0))
+
+	enqueue("a")
+	enqueue("b")
+	require.Equal(t, map[string]int64{"a": index["a"], "b": 0}, getAsyncReadyIndex(t, store))
+
+	// Only b is due.
+	poll()
+	mu.Lock()
+	require.Equal(t, map[string]int{"a": 1, "b": 1}, delivered)
+	mu.Unlock()
+	require.Equal(t, map[string]int64{"a": index["a"]}, getAsyncReadyIndex(t, store))
+}
+
+// getAsyncReadyIndex returns the position of every queue in the ready index keyed by the
+// ID of its actor.
+func getAsyncReadyIndex(t *testing.T, store kv.Store) map[string]int64 {
+	index := make(map[string]int64)
+	_, err := store.Transact(func(tr kv.Transaction) (any, error) {
+		return nil, tr.IterPrefix(
+			context.Background(),
+			tuple.Tuple{asyncInvocationsKeyPrefix, "ready"}.Pack(),
+			func(k, _ []byte) error {
+				unpacked, err := tuple.Unpack(k)
+				require.NoError(t, err)
+				id, err := unpackAsyncReadyKey(k)
+				require.NoError(t, err)
+				index[id.ID] = unpacked[2].(int64)
+				return nil
+			})
+	})
+	require.NoError(t, err)
+	return index
+}
+
+// TestAsyncInvocationQueueLeaseExpiry tests that invocations are redelivered by another
+// queue if the queue that claimed them stops making progress.
+func TestAsyncInvocationQueueLeaseExpiry(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = localregistry.NewLocalKV()
+		opts  = AsyncInvocationOptions{
+			Store:         store,
+			PollInterval:  time.Millisecond,
+			LeaseDuration: 100 * time.Millisecond,
+		}
+
+		unblock    = make(chan struct{})
+		delivered1 = make(chan struct{}, 1)
+		delivered2 = make(chan string, 10)
+	)
+
+	// q1 claims the queue and then hangs.
+	q1 := newAsyncInvocationQueue(slog.Default(), "server1", opts, func(ctx context.Context, inv asyncInvocation) error {
+		<-unblock
+		delivered1 <- struct{}{}
+		return nil
+	})
+	q2 := newAsyncInvocationQueue(slog.Default(), "server2", opts, func(ctx context.Context, inv asyncInvocation) error {
+		delivered2 <- string(inv.Payload)
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, q1.enqueue(ctx, asyncInvocation{
+			Namespace: "ns-1",
+			ActorID:   "a",
+			ModuleID:  "test-module",
+			Operation: "inc",
+			Payload:   []byte(strconv.Itoa(i)),
+		}))
+	}
+	require.NoError(t, q1.poll())
+	q2.start()
+	defer q2.close()
+
+	// q2 should take over once q1's lease expires and deliver every invocation.
+	select {
+	case payload := <-delivered2:
+		require.Equal(t, "0", payload)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for q2 to take over")
+	}
+	require.Equal(t, "1", <-delivered2)
+
+	// q1 should notice that it lost its lease and not acknowledge the invocation.
+	close(unblock)
+	<-delivered1
+	q1.deliveryWg.Wait()
+	select {
+	case payload := <-delivered2:
+		t.Fatalf("unexpected redelivery: %s", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAsyncInvocationOptionsValidate(t *testing.T) {
+	require.NoError(t, AsyncInvocationOptions{}.Validate())
+	require.Error(t, AsyncInvocationOptions{MaxAttempts: -1}.Validate())
+	require.Error(t, AsyncInvocationOptions{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Millisecond,
+	}.Validate())
+}
+
+// TestInvokeActorAsync tests InvokeActorAsync and the corresponding host function.
+func TestInvokeActorAsync(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		opts        = defaultOptsGoByte
+	)
+	defer reg.Close(ctx)
+
+	// Async invocations are disabled by default.
+	env, err := NewEnvironment(ctx, "serverID1", reg, moduleStore, nil, opts)
+	require.NoError(t, err)
+	require.Error(t, env.InvokeActorAsync(
+		ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{}))
+	require.NoError(t, env.Close(ctx))
+
+	opts.AsyncInvocations = AsyncInvocationOptions{
+		Store:        localregistry.NewLocalKV(),
+		PollInterval: time.Millisecond,
+	}
+	env, err = NewEnvironment(ctx, "serverID1", reg, moduleStore, nil, opts)
+	require.NoError(t, err)
+	defer func() { noErrIgnoreDupeClose(t, env.Close(context.Background())) }()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	getCount := func(actorID string) int {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", actorID, "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		count, err := strconv.Atoi(string(result))
+		require.NoError(t, err)
+		return count
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, env.InvokeActorAsync(
+			ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{}))
+	}
+	require.Eventually(t, func() bool {
+		return getCount("a") == 10
+	}, 10*time.Second, time.Millisecond)
+
+	// Actors can enqueue async invocations too.
+	for i := 0; i < 10; i++ {
+		req, err := json.Marshal(types.InvokeActorRequest{
+			ActorID:   "b",
+			ModuleID:  "test-module",
+			Operation: "inc",
+		})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(
+			ctx, "ns-1", fmt.Sprintf("caller-%d", i), "test-module", "invokeActorAsync", req,
+			types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return getCount("b") == 10
+	}, 10*time.Second, time.Millisecond)
+}
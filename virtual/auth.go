@@ -0,0 +1,295 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PermissionRegisterModule allows a principal to register modules in a namespace.
+	PermissionRegisterModule Permission = "register-module"
+	// PermissionInvoke allows a principal to invoke actors and workers in a namespace.
+	PermissionInvoke Permission = "invoke"
+	// PermissionAdmin allows a principal to perform administrative operations (like
+	// migrating actors) in a namespace. It implies all of the other permissions.
+	PermissionAdmin Permission = "admin"
+
+	// AllNamespaces can be used as the namespace of a NamespaceGrant to grant the
+	// permissions in every namespace.
+	AllNamespaces = "*"
+
+	// HTTPHeaderHMACTimestamp is the header that contains the time (in unix seconds) at
+	// which an HMAC-signed request was signed.
+	HTTPHeaderHMACTimestamp = "X-Nola-Timestamp"
+	// DefaultHMACMaxClockSkew is the default value for the maxClockSkew argument of
+	// NewHMACAuthenticator.
+	DefaultHMACMaxClockSkew = 5 * time.Minute
+
+	hmacAuthScheme = "NOLA-HMAC-SHA256"
+	// maxAuthenticatedBodySize matches the maximum request size of the handlers.
+	maxAuthenticatedBodySize = 1 << 24
+)
+
+// hmacSignedHeaders are the headers (other than the timestamp) that are included in the
+// signature of HMAC-signed requests because the server uses them to route the request.
+var hmacSignedHeaders = []string{"namespace", "module_id"}
+
+// Permission is a permission that can be granted to a principal within a namespace.
+type Permission string
+
+// Principal is the authenticated identity of the caller of a request.
+type Principal struct {
+	// ID identifies the principal. Authorizers grant permissions based on it.
+	ID string
+}
+
+// Authenticator authenticates the requests received by the Server's public endpoints.
+type Authenticator interface {
+	// Authenticate returns the principal that sent the request. It should return an
+	// error that wraps an UnauthenticatedErr if the request does not contain valid
+	// credentials. Implementations may consume the request's body as long as they
+	// replace it with an equivalent one.
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// Authorizer decides which operations authenticated principals are allowed to perform.
+type Authorizer interface {
+	// Authorize returns an error that wraps a PermissionDeniedErr if the principal does
+	// not have the permission in the namespace.
+	Authorize(ctx context.Context, principal Principal, namespace string, permission Permission) error
+}
+
+type principalContextKey struct{}
+
+func contextWithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
+
+type bearerTokenAuthenticator struct {
+	// Keyed by the SHA256 of the token instead of the token itself so that the lookup
+	// does not leak information about valid tokens through timing.
+	principals map[[sha256.Size]byte]Principal
+}
+
+// NewBearerTokenAuthenticator returns an Authenticator that authenticates requests with an
+// "Authorization: Bearer <token>" header. tokens maps each valid token to the ID of the
+// principal it identifies.
+func NewBearerTokenAuthenticator(tokens map[string]string) Authenticator {
+	principals := make(map[[sha256.Size]byte]Principal, len(tokens))
+	for token, principalID := range tokens {
+		principals[sha256.Sum256([]byte(token))] = Principal{ID: principalID}
+	}
+	return &bearerTokenAuthenticator{principals: principals}
+}
+
+func (b *bearerTokenAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return Principal{}, NewUnauthenticatedError(errors.New("missing bearer token"))
+	}
+
+	principal, ok := b.principals[sha256.Sum256([]byte(strings.TrimPrefix(header, "Bearer ")))]
+	if !ok {
+		return Principal{}, NewUnauthenticatedError(errors.New("invalid bearer token"))
+	}
+	return principal, nil
+}
+
+type hmacAuthenticator struct {
+	keys         map[string][]byte
+	maxClockSkew time.Duration
+}
+
+// NewHMACAuthenticator returns an Authenticator that authenticates requests signed with
+// SignRequestHMAC. keys maps each key ID to its secret, and the key ID is used as the ID
+// of the principal. Requests whose timestamp differs from the server's clock by more than
+// maxClockSkew are rejected to limit replays. A value of 0 for maxClockSkew is replaced
+// with DefaultHMACMaxClockSkew.
+func NewHMACAuthenticator(keys map[string][]byte, maxClockSkew time.Duration) Authenticator {
+	if maxClockSkew <= 0 {
+		maxClockSkew = DefaultHMACMaxClockSkew
+	}
+	return &hmacAuthenticator{
+		keys:         keys,
+		maxClockSkew: maxClockSkew,
+	}
+}
+
+func (h *hmacAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, hmacAuthScheme+" ") {
+		return Principal{}, NewUnauthenticatedError(errors.New("missing HMAC signature"))
+	}
+	keyID, encodedSig, ok := strings.Cut(strings.TrimPrefix(header, hmacAuthScheme+" "), ":")
+	if !ok {
+		return Principal{}, NewUnauthenticatedError(errors.New("malformed HMAC signature"))
+	}
+	sig, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return Principal{}, NewUnauthenticatedError(
+			fmt.Errorf("malformed HMAC signature: %w", err))
+	}
+
+	secret, ok := h.keys[keyID]
+	if !ok {
+		return Principal{}, NewUnauthenticatedError(fmt.Errorf("unknown HMAC key ID: %s", keyID))
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(HTTPHeaderHMACTimestamp), 10, 64)
+	if err != nil {
+		return Principal{}, NewUnauthenticatedError(
+			fmt.Errorf("malformed %s header: %w", HTTPHeaderHMACTimestamp, err))
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > h.maxClockSkew || skew < -h.maxClockSkew {
+		return Principal{}, NewUnauthenticatedError(fmt.Errorf(
+			"HMAC signature timestamp is outside of the allowed clock skew: %s", h.maxClockSkew))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAuthenticatedBodySize))
+	if err != nil {
+		return Principal{}, fmt.Errorf("error reading request body: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(sig, computeHMACSignature(secret, r, body)) {
+		return Principal{}, NewUnauthenticatedError(errors.New("invalid HMAC signature"))
+	}
+	return Principal{ID: keyID}, nil
+}
+
+// SignRequestHMAC signs the request so that it can be authenticated by the Authenticator
+// returned by NewHMACAuthenticator. The signature covers the method, path, body,
+// timestamp, and the headers that the server uses to route the request so it must be
+// called after the request is fully constructed.
+func SignRequestHMAC(req *http.Request, keyID string, secret []byte) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return fmt.Errorf("error reading request body: %w", err)
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	req.Header.Set(HTTPHeaderHMACTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+	sig := computeHMACSignature(secret, req, body)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s %s:%s", hmacAuthScheme, keyID, base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+func computeHMACSignature(secret []byte, r *http.Request, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(r.Method))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(r.URL.Path))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(r.Header.Get(HTTPHeaderHMACTimestamp)))
+	mac.Write([]byte{'\n'})
+	for _, header := range hmacSignedHeaders {
+		mac.Write([]byte(r.Header.Get(header)))
+		mac.Write([]byte{'\n'})
+	}
+	mac.Write([]byte(hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
+
+type clientCertAuthenticator struct{}
+
+// NewClientCertAuthenticator returns an Authenticator that authenticates requests with the
+// client certificate that was verified during the TLS handshake (see TLSOptions). The
+// certificate's subject common name is used as the ID of the principal.
+func NewClientCertAuthenticator() Authenticator {
+	return clientCertAuthenticator{}
+}
+
+func (clientCertAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if !hasVerifiedClientCert(r.TLS) {
+		return Principal{}, NewUnauthenticatedError(
+			errors.New("a verified client certificate is required"))
+	}
+	return Principal{ID: r.TLS.VerifiedChains[0][0].Subject.CommonName}, nil
+}
+
+// NamespaceGrant grants a principal a set of permissions within a namespace.
+type NamespaceGrant struct {
+	// PrincipalID is the ID of the principal that the permissions are granted to.
+	PrincipalID string
+	// Namespace is the namespace in which the permissions are granted. Use AllNamespaces
+	// to grant them in every namespace.
+	Namespace string
+	// Permissions are the permissions that are granted.
+	Permissions []Permission
+}
+
+type staticAuthorizer struct {
+	// principalID -> namespace -> permissions.
+	grants map[string]map[string]map[Permission]struct{}
+}
+
+// NewStaticAuthorizer returns an Authorizer that only allows the operations that are
+// explicitly granted by grants.
+func NewStaticAuthorizer(grants []NamespaceGrant) Authorizer {
+	a := &staticAuthorizer{
+		grants: make(map[string]map[string]map[Permission]struct{}),
+	}
+	for _, grant := range grants {
+		namespaces, ok := a.grants[grant.PrincipalID]
+		if !ok {
+			namespaces = make(map[string]map[Permission]struct{})
+			a.grants[grant.PrincipalID] = namespaces
+		}
+		permissions, ok := namespaces[grant.Namespace]
+		if !ok {
+			permissions = make(map[Permission]struct{})
+			namespaces[grant.Namespace] = permissions
+		}
+		for _, permission := range grant.Permissions {
+			permissions[permission] = struct{}{}
+		}
+	}
+	return a
+}
+
+func (a *staticAuthorizer) Authorize(
+	ctx context.Context,
+	principal Principal,
+	namespace string,
+	permission Permission,
+) error {
+	namespaces := a.grants[principal.ID]
+	for _, ns := range []string{namespace, AllNamespaces} {
+		permissions := namespaces[ns]
+		if _, ok := permissions[permission]; ok {
+			return nil
+		}
+		if _, ok := permissions[PermissionAdmin]; ok {
+			return nil
+		}
+	}
+	return NewPermissionDeniedError(fmt.Errorf(
+		"principal: %s does not have permission: %s in namespace: %s",
+		principal.ID, permission, namespace))
+}
@@ -0,0 +1,272 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearerTokenAuthenticator(t *testing.T) {
+	auth := NewBearerTokenAuthenticator(map[string]string{"token-a": "a"})
+
+	req := httptest.NewRequest("POST", "/api/v1/invoke-actor", nil)
+	_, err := auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+
+	req.Header.Set("Authorization", "Bearer token-b")
+	_, err = auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+
+	req.Header.Set("Authorization", "Bearer token-a")
+	principal, err := auth.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "a", principal.ID)
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	var (
+		secret = []byte("secret")
+		auth   = NewHMACAuthenticator(map[string][]byte{"key-a": secret}, time.Minute)
+	)
+	newReq := func(body string) *http.Request {
+		req := httptest.NewRequest("POST", "/api/v1/register-module", bytes.NewReader([]byte(body)))
+		req.Header.Set("namespace", "ns-1")
+		return req
+	}
+
+	// Unsigned.
+	_, err := auth.Authenticate(newReq("body"))
+	require.True(t, IsUnauthenticatedError(err))
+
+	// Valid, and the body is still readable afterwards.
+	req := newReq("body")
+	require.NoError(t, SignRequestHMAC(req, "key-a", secret))
+	principal, err := auth.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "key-a", principal.ID)
+	body := make([]byte, 4)
+	_, err = req.Body.Read(body)
+	require.NoError(t, err)
+	require.Equal(t, "body", string(body))
+
+	// Unknown key.
+	req = newReq("body")
+	require.NoError(t, SignRequestHMAC(req, "key-b", secret))
+	_, err = auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+
+	// Wrong secret.
+	req = newReq("body")
+	require.NoError(t, SignRequestHMAC(req, "key-a", []byte("wrong")))
+	_, err = auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+
+	// Tampered body.
+	req = newReq("body")
+	require.NoError(t, SignRequestHMAC(req, "key-a", secret))
+	req.Body = httptest.NewRequest("POST", "/", bytes.NewReader([]byte("tampered"))).Body
+	_, err = auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+
+	// Tampered namespace.
+	req = newReq("body")
+	require.NoError(t, SignRequestHMAC(req, "key-a", secret))
+	req.Header.Set("namespace", "ns-2")
+	_, err = auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+
+	// Expired.
+	req = newReq("body")
+	require.NoError(t, SignRequestHMAC(req, "key-a", secret))
+	req.Header.Set(
+		HTTPHeaderHMACTimestamp, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	_, err = auth.Authenticate(req)
+	require.True(t, IsUnauthenticatedError(err))
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		auth = NewStaticAuthorizer([]NamespaceGrant{
+			{PrincipalID: "a", Namespace: "ns-1", Permissions: []Permission{PermissionInvoke}},
+			{PrincipalID: "a", Namespace: "ns-2", Permissions: []Permission{PermissionAdmin}},
+			{PrincipalID: "b", Namespace: AllNamespaces, Permissions: []Permission{PermissionRegisterModule}},
+		})
+	)
+
+	require.NoError(t, auth.Authorize(ctx, Principal{ID: "a"}, "ns-1", PermissionInvoke))
+	require.True(t, IsPermissionDeniedError(
+		auth.Authorize(ctx, Principal{ID: "a"}, "ns-1", PermissionRegisterModule)))
+	require.True(t, IsPermissionDeniedError(
+		auth.Authorize(ctx, Principal{ID: "a"}, "ns-3", PermissionInvoke)))
+
+	// Admin implies all the other permissions.
+	require.NoError(t, auth.Authorize(ctx, Principal{ID: "a"}, "ns-2", PermissionInvoke))
+	require.NoError(t, auth.Authorize(ctx, Principal{ID: "a"}, "ns-2", PermissionRegisterModule))
+	require.NoError(t, auth.Authorize(ctx, Principal{ID: "a"}, "ns-2", PermissionAdmin))
+
+	require.NoError(t, auth.Authorize(ctx, Principal{ID: "b"}, "ns-1", PermissionRegisterModule))
+	require.NoError(t, auth.Authorize(ctx, Principal{ID: "b"}, "ns-3", PermissionRegisterModule))
+	require.True(t, IsPermissionDeniedError(
+		auth.Authorize(ctx, Principal{ID: "b"}, "ns-1", PermissionInvoke)))
+
+	require.True(t, IsPermissionDeniedError(
+		auth.Authorize(ctx, Principal{ID: "c"}, "ns-1", PermissionInvoke)))
+}
+
+// TestServerAuth tests that the server authenticates and authorizes requests to the
+// public endpoints, but not server-to-server invocations.
+func TestServerAuth(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		clientOpts  = HTTPClientOptions{PeerToken: "peer-token"}
+		serverOpts  = ServerOptions{
+			PeerToken: "peer-token",
+			Authenticator: NewBearerTokenAuthenticator(map[string]string{
+				"invoker-token": "invoker",
+				"admin-token":   "admin",
+			}),
+			Authorizer: NewStaticAuthorizer([]NamespaceGrant{
+				{PrincipalID: "invoker", Namespace: "ns-1", Permissions: []Permission{PermissionInvoke}},
+				{PrincipalID: "admin", Namespace: AllNamespaces, Permissions: []Permission{PermissionAdmin}},
+			}),
+		}
+		env1 = newTestServerEnvironmentWithOptions(
+			t, reg, moduleStore, "serverID1", newTestHTTPClient(t, clientOpts), serverOpts)
+		env2 = newTestServerEnvironmentWithOptions(
+			t, reg, moduleStore, "serverID2", newTestHTTPClient(t, clientOpts), serverOpts)
+	)
+
+	// Server-to-server invocations don't use the public endpoints.
+	for i := 0; i < 10; i++ {
+		_, err := env1.InvokeActor(
+			ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	require.True(t, env1.NumActivatedActors() > 0)
+	require.True(t, env2.NumActivatedActors() > 0)
+
+	result, err := reg.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		Namespace: "ns-1",
+		ModuleID:  "test-module",
+		ActorID:   "a-0",
+	})
+	require.NoError(t, err)
+	address := result.References[0].Physical.ServerState.Address
+
+	invoke := func(namespace, token string) int {
+		return postWithToken(t, address, "invoke-actor", token, invokeActorRequest{
+			Namespace: namespace,
+			InvokeActorRequest: types.InvokeActorRequest{
+				ActorID:   "a-0",
+				ModuleID:  "test-module",
+				Operation: "inc",
+			},
+		})
+	}
+	require.Equal(t, http.StatusUnauthorized, invoke("ns-1", ""))
+	require.Equal(t, http.StatusUnauthorized, invoke("ns-1", "invalid-token"))
+	require.Equal(t, http.StatusOK, invoke("ns-1", "invoker-token"))
+	require.Equal(t, http.StatusForbidden, invoke("ns-2", "invoker-token"))
+	require.Equal(t, http.StatusOK, invoke("ns-1", "admin-token"))
+
+	// Reserved operations can only be sent by other servers.
+	require.NotEqual(t, http.StatusOK, postWithToken(t, address, "invoke-actor", "admin-token", invokeActorRequest{
+		Namespace: "ns-1",
+		InvokeActorRequest: types.InvokeActorRequest{
+			ActorID:   "a-0",
+			ModuleID:  "test-module",
+			Operation: wapcutils.HydrateOperationName,
+		},
+	}))
+
+	migrate := func(token string) int {
+		return postWithToken(t, address, "admin/migrate-actor", token, migrateActorRequest{
+			Namespace:      "ns-1",
+			ModuleID:       "test-module",
+			ActorID:        "a-0",
+			TargetServerID: result.References[0].Physical.ServerID,
+		})
+	}
+	require.Equal(t, http.StatusForbidden, migrate("invoker-token"))
+	require.Equal(t, http.StatusOK, migrate("admin-token"))
+
+	// The server-to-server endpoints bypass the Authenticator so they require the peer
+	// token instead.
+	for _, peerToken := range []string{"", "invalid-peer-token"} {
+		client, err := NewHTTPClientWithOptions(HTTPClientOptions{PeerToken: peerToken})
+		require.NoError(t, err)
+		_, err = client.InvokeActorRemote(
+			ctx, 0, result.References[0], "inc", nil, types.CreateIfNotExist{})
+		require.Error(t, err)
+		require.True(t, IsUnauthenticatedError(err))
+
+		rpcClient, err := NewRPCClient(RPCClientOptions{PeerToken: peerToken})
+		require.NoError(t, err)
+		_, err = rpcClient.InvokeActorRemote(
+			ctx, 0, result.References[0], "inc", nil, types.CreateIfNotExist{})
+		require.Error(t, err)
+	}
+
+	req, err := http.NewRequest(
+		"POST", fmt.Sprintf("http://%s/api/v1/register-module", address),
+		bytes.NewReader([]byte("module")))
+	require.NoError(t, err)
+	req.Header.Set("namespace", "ns-1")
+	req.Header.Set("module_id", "some-module")
+	req.Header.Set("Authorization", "Bearer invoker-token")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestServerAuthorizerRequiresAuthenticator(t *testing.T) {
+	server := NewServerWithOptions(nil, nil, ServerOptions{
+		Authorizer: NewStaticAuthorizer(nil),
+	})
+	require.Error(t, server.Start(getFreePort(t)))
+}
+
+func TestServerAuthenticatorRequiresTLSOrPeerToken(t *testing.T) {
+	server := NewServerWithOptions(nil, nil, ServerOptions{
+		Authenticator: NewBearerTokenAuthenticator(nil),
+	})
+	require.Error(t, server.Start(getFreePort(t)))
+}
+
+func newTestHTTPClient(t *testing.T, opts HTTPClientOptions) RemoteClient {
+	client, err := NewHTTPClientWithOptions(opts)
+	require.NoError(t, err)
+	return client
+}
+
+func postWithToken(t *testing.T, address, endpoint, token string, v interface{}) int {
+	marshaled, err := json.Marshal(v)
+	require.NoError(t, err)
+	req, err := http.NewRequest(
+		"POST", fmt.Sprintf("http://%s/api/v1/%s", address, endpoint), bytes.NewReader(marshaled))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,63 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// callChain identifies a chain of synchronous invocations that all stem from the same
+// top-level invocation. For example, if actor A is invoked and invokes actor B while it's
+// processing that invocation, then the invocations of A and B are part of the same call
+// chain. The chain is propagated through the context (and across servers by
+// invoke-actor-direct) so that invocations that loop back to an actor that is already
+// waiting further up the chain can be detected instead of deadlocking on its mailbox.
+type callChain struct {
+	// ID uniquely identifies the call chain.
+	ID string `json:"id"`
+	// Actors are the actors that are currently processing an invocation in the chain, in
+	// the order they were invoked in.
+	Actors []types.NamespacedActorID `json:"actors"`
+}
+
+type callChainCtxKey struct{}
+
+func newCallChainID(serverID string) string {
+	return fmt.Sprintf("%s-%d", serverID, rand.Int63())
+}
+
+func withCallChain(ctx context.Context, chain callChain) context.Context {
+	return context.WithValue(ctx, callChainCtxKey{}, chain)
+}
+
+func callChainFromContext(ctx context.Context) (callChain, bool) {
+	chain, ok := ctx.Value(callChainCtxKey{}).(callChain)
+	return chain, ok
+}
+
+func (c callChain) contains(id types.NamespacedActorID) bool {
+	for _, actor := range c.Actors {
+		if actor == id {
+			return true
+		}
+	}
+	return false
+}
+
+// with returns a copy of the chain with id appended to it.
+func (c callChain) with(id types.NamespacedActorID) callChain {
+	actors := make([]types.NamespacedActorID, 0, len(c.Actors)+1)
+	actors = append(actors, c.Actors...)
+	return callChain{ID: c.ID, Actors: append(actors, id)}
+}
+
+func (c callChain) String() string {
+	actors := make([]string, 0, len(c.Actors))
+	for _, actor := range c.Actors {
+		actors = append(actors, actor.String())
+	}
+	return fmt.Sprintf("%s(%s)", c.ID, strings.Join(actors, " -> "))
+}
@@ -0,0 +1,204 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+type reentrantTestModule struct {
+	testModule
+}
+
+func (tm reentrantTestModule) Reentrant() bool {
+	return true
+}
+
+// reentrantReadOnlyTestModule is the same as reentrantTestModule, except that its actors
+// declare the operations that don't modify their state as read-only.
+type reentrantReadOnlyTestModule struct {
+	reentrantTestModule
+}
+
+func (tm reentrantReadOnlyTestModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	actor, err := tm.reentrantTestModule.Instantiate(ctx, reference, payload, host)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyInvokeTestActor{actor.(*testActor)}, nil
+}
+
+type readOnlyInvokeTestActor struct {
+	*testActor
+}
+
+func (ta readOnlyInvokeTestActor) IsReadOnly(operation string) bool {
+	return operation == "invokeActor" || operation == "getCount"
+}
+
+// invokeActorPayload returns the payload for the testActor's invokeActor operation that
+// makes it invoke the provided operation on actorID.
+func invokeActorPayload(t *testing.T, actorID, operation string, payload []byte) []byte {
+	marshaled, err := json.Marshal(types.InvokeActorRequest{
+		ActorID:   actorID,
+		ModuleID:  "test-module",
+		Operation: operation,
+		Payload:   payload,
+	})
+	require.NoError(t, err)
+	return marshaled
+}
+
+// TestCallChainDeadlock tests that invocations that loop back to an actor that is waiting
+// further up the call chain fail with a DeadlockErr instead of hanging, both when all the
+// actors are invoked locally and when the chain is propagated to other servers.
+func TestCallChainDeadlock(t *testing.T) {
+	ctx := context.Background()
+
+	// Each environment gets its own registry so that the actors are always activated on the
+	// environment that is being tested.
+	newRegistry := func() registry.Registry {
+		reg := localregistry.NewLocalRegistry("test-server-id")
+		t.Cleanup(func() { reg.Close(ctx) })
+		return reg
+	}
+
+	localEnv, err := NewEnvironment(ctx, "serverID1", newRegistry(), newTestModuleStore(), nil, defaultOptsGoByte)
+	require.NoError(t, err)
+	defer localEnv.Close(ctx)
+	require.NoError(t, localEnv.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	rpcClient, err := NewRPCClient(RPCClientOptions{})
+	require.NoError(t, err)
+	envs := map[string]Environment{
+		"local": localEnv,
+		"http":  newTestServerEnvironment(t, newRegistry(), newTestModuleStore(), "serverID2", NewHTTPClient()),
+		"rpc":   newTestServerEnvironment(t, newRegistry(), newTestModuleStore(), "serverID3", rpcClient),
+	}
+	for name, env := range envs {
+		env := env
+		t.Run(name, func(t *testing.T) {
+			a, b := name+"-a", name+"-b"
+
+			// a -> a
+			_, err := env.InvokeActor(
+				ctx, "ns-1", a, "test-module", "invokeActor",
+				invokeActorPayload(t, a, "inc", nil), types.CreateIfNotExist{})
+			require.True(t, IsDeadlockError(err), err)
+
+			// a -> b -> a
+			_, err = env.InvokeActor(
+				ctx, "ns-1", a, "test-module", "invokeActor",
+				invokeActorPayload(t, b, "invokeActor", invokeActorPayload(t, a, "inc", nil)),
+				types.CreateIfNotExist{})
+			require.True(t, IsDeadlockError(err), err)
+
+			// a -> b -> b's count, actors can still be invoked by different chains and the
+			// same actor can be invoked multiple times by a chain as long as it doesn't loop.
+			for i := 0; i < 2; i++ {
+				_, err = env.InvokeActor(
+					ctx, "ns-1", a, "test-module", "invokeActor",
+					invokeActorPayload(t, b, "inc", nil), types.CreateIfNotExist{})
+				require.NoError(t, err)
+			}
+			result, err := env.InvokeActor(
+				ctx, "ns-1", b, "test-module", "getCount", nil, types.CreateIfNotExist{})
+			require.NoError(t, err)
+			require.Equal(t, "2", string(result))
+
+			// The actors that rejected the invocations are not stuck.
+			result, err = env.InvokeActor(
+				ctx, "ns-1", a, "test-module", "inc", nil, types.CreateIfNotExist{})
+			require.NoError(t, err)
+			require.Equal(t, "1", string(result))
+		})
+	}
+}
+
+// TestCallChainReentrancy tests that actors from reentrant modules can be invoked by call
+// chains that are already waiting for them.
+func TestCallChainReentrancy(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry("test-server-id")
+	)
+	defer reg.Close(ctx)
+
+	env, err := NewEnvironment(ctx, "serverID1", reg, newTestModuleStore(), nil, defaultOptsGoByte)
+	require.NoError(t, err)
+	defer env.Close(ctx)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, reentrantTestModule{}))
+
+	// a -> b -> a
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor",
+		invokeActorPayload(t, "b", "invokeActor", invokeActorPayload(t, "a", "inc", nil)),
+		types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	// a -> a
+	result, err := env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor",
+		invokeActorPayload(t, "a", "inc", nil), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "2", string(result))
+
+	result, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	count, err := strconv.Atoi(string(result))
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
+
+// TestCallChainReentrancyReadOnly tests that invocations which loop back to an actor that is
+// waiting for a read-only invocation can only reenter it if they're read-only as well, since
+// other read-only invocations of the actor may be running concurrently.
+func TestCallChainReentrancyReadOnly(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry("test-server-id")
+	)
+	defer reg.Close(ctx)
+
+	env, err := NewEnvironment(ctx, "serverID1", reg, newTestModuleStore(), nil, defaultOptsGoByte)
+	require.NoError(t, err)
+	defer env.Close(ctx)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, reentrantReadOnlyTestModule{}))
+
+	// read-only a -> b -> write a
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor",
+		invokeActorPayload(t, "b", "invokeActor", invokeActorPayload(t, "a", "inc", nil)),
+		types.CreateIfNotExist{})
+	require.True(t, IsDeadlockError(err), err)
+
+	// read-only a -> b -> read-only a
+	result, err := env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor",
+		invokeActorPayload(t, "b", "invokeActor", invokeActorPayload(t, "a", "getCount", nil)),
+		types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "0", string(result))
+
+	// The actor that rejected the invocation is not stuck.
+	result, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "1", string(result))
+}
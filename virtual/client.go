@@ -11,11 +11,26 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 )
 
+// HTTPClientOptions contains the options for the RemoteClient returned by
+// NewHTTPClientWithOptions.
+type HTTPClientOptions struct {
+	// TLS configures the client to use HTTPS and present a client certificate to the
+	// servers it connects to. The servers must be configured with TLS as well.
+	TLS TLSOptions
+	// PeerToken is presented to the servers the client connects to so that they can
+	// verify that the client is part of the cluster. It must match the servers'
+	// ServerOptions.PeerToken.
+	PeerToken string
+}
+
 type httpClient struct {
-	c *http.Client
+	c         *http.Client
+	scheme    string
+	peerToken string
 }
 
 func (h *httpClient) InvokeActorRemote(
@@ -37,6 +52,10 @@ func (h *httpClient) InvokeActorRemote(
 		Operation:        operation,
 		Payload:          payload,
 		CreateIfNotExist: create,
+		IdempotencyKey:   idempotencyKeyFromContext(ctx),
+	}
+	if chain, ok := callChainFromContext(ctx); ok {
+		ir.CallChain = &chain
 	}
 	marshaled, err := json.Marshal(&ir)
 	if err != nil {
@@ -45,7 +64,7 @@ func (h *httpClient) InvokeActorRemote(
 
 	req, err := http.NewRequestWithContext(
 		ctx, "POST",
-		fmt.Sprintf("http://%s/api/v1/invoke-actor-direct", reference.Physical.ServerState.Address),
+		fmt.Sprintf("%s://%s/api/v1/invoke-actor-direct", h.scheme, reference.Physical.ServerState.Address),
 		bytes.NewReader(marshaled))
 	if err != nil {
 		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error constructing request: %w", err)
@@ -56,6 +75,10 @@ func (h *httpClient) InvokeActorRemote(
 		timeout := time.Until(deadline)
 		req.Header.Add(types.HTTPHeaderTimeout, timeout.String())
 	}
+	if h.peerToken != "" {
+		req.Header.Set(types.HTTPHeaderPeerToken, h.peerToken)
+	}
+	tracing.Inject(ctx, req.Header)
 
 	resp, err := h.c.Do(req)
 	if err != nil {
@@ -85,14 +108,29 @@ func (h *httpClient) InvokeActorRemote(
 
 // NewHTTPClient returns a new HTTPClient that implements the RemoteClient interface.
 func NewHTTPClient() RemoteClient {
+	client, err := NewHTTPClientWithOptions(HTTPClientOptions{})
+	if err != nil {
+		panic(fmt.Sprintf("error creating HTTP client with default options: %v", err))
+	}
+	return client
+}
+
+// NewHTTPClientWithOptions is the same as NewHTTPClient, but allows the caller to specify
+// the options.
+func NewHTTPClientWithOptions(opts HTTPClientOptions) (RemoteClient, error) {
+	if err := opts.TLS.Validate(); err != nil {
+		return nil, fmt.Errorf("NewHTTPClientWithOptions: error validating TLS options: %w", err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
 	transport := &http.Transport{
 		// Some of this is copy-pasta from http.DefaultTransport.
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
 		MaxIdleConns:        0, // No limit.
 		MaxIdleConnsPerHost: 6500,
 		MaxConnsPerHost:     0, // No limit.
@@ -109,8 +147,21 @@ func NewHTTPClient() RemoteClient {
 		WriteBufferSize:       1 << 18,
 		ReadBufferSize:        1 << 18,
 	}
+
+	scheme := "http"
+	if opts.TLS.Enabled() {
+		reloader, err := newTLSReloader(opts.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("NewHTTPClientWithOptions: error loading TLS files: %w", err)
+		}
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return reloader.dial(ctx, dialer, network, addr, []string{httpALPNProtocol})
+		}
+		scheme = "https"
+	}
+
 	c := &http.Client{Transport: transport}
-	return &httpClient{c: c}
+	return &httpClient{c: c, scheme: scheme, peerToken: opts.PeerToken}, nil
 }
 
 // noopClient implements RemoteClient, but always returns an error.
@@ -1,30 +1,40 @@
 package virtual
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/richardartoul/nola/virtual/metrics"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/registry/dnsregistry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
 
 	"golang.org/x/exp/slog"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
 	Localhost = "127.0.0.1"
 
 	maxNumActivationsToCache = 1e6 // 1 Million.
-	heartbeatTimeout         = registry.HeartbeatTTL
+	heartbeatTimeout         = registry.DefaultHeartbeatTTL
+	// TODO: This should be configurable.
+	actorHandoffTimeout = time.Minute
 )
 
 var (
@@ -35,6 +45,10 @@ var (
 	// Var so can be modified by tests.
 	defaultActivationsCacheTTL                    = heartbeatTimeout
 	DefaultGCActorsAfterDurationWithNoInvocations = time.Minute
+	DefaultMaxActorMailboxDepth                   = 1024
+	DefaultIdempotencyKeyTTL                      = 10 * time.Minute
+	DefaultMaxIdempotencyKeysPerActor             = 1024
+	DefaultMaxIdempotentResponseBytesPerActor     = 4 << 20
 )
 
 type environment struct {
@@ -44,6 +58,18 @@ type environment struct {
 	activations      *activations // Internally synchronized.
 	activationsCache *activationsCache
 	lastHearbeatLog  time.Time
+	// namespaceRateLimiter enforces this server's share of
+	// NamespaceLimits.MaxInvocationsPerSecond.
+	namespaceRateLimiter *namespaceRateLimiter
+	// latencies tracks the latencies of the invocations that may be hedged.
+	latencies *latencyTracker
+	// asyncInvocations is nil if async invocations are not enabled.
+	asyncInvocations *asyncInvocationQueue
+	// reminders is nil if reminders are not enabled.
+	reminders *reminderService
+	// stopWatchingRegistry cancels the activationsCache's subscription to the registry's
+	// stream of activation changes.
+	stopWatchingRegistry context.CancelFunc
 
 	heartbeatState struct {
 		sync.RWMutex
@@ -52,6 +78,14 @@ type environment struct {
 		paused bool
 	}
 
+	// handoffState tracks the background process that hands off actors that this
+	// environment no longer owns after a cluster membership change.
+	handoffState struct {
+		sync.Mutex
+		running           bool
+		membershipVersion int64
+	}
+
 	// Closed when the background heartbeating goroutine should be shut down.
 	closeCh chan struct{}
 	// Closed when the background heartbeating goroutine completes shutting down.
@@ -71,6 +105,7 @@ type environment struct {
 	registry registry.Registry
 	client   RemoteClient
 	opts     EnvironmentOptions
+	metrics  *environmentMetrics
 
 	randState struct {
 		sync.Mutex
@@ -91,6 +126,9 @@ const (
 type EnvironmentOptions struct {
 	// ActivationCacheTTL is the TTL of the activation cache.
 	ActivationCacheTTL time.Duration
+	// ActivationCacheTimeout is the timeout for the registry calls the activation cache
+	// makes to resolve activations that are not cached (or stale).
+	ActivationCacheTimeout time.Duration
 	// DisableActivationCache disables the activation cache.
 	DisableActivationCache bool
 	// Discovery contains the discovery options.
@@ -116,11 +154,88 @@ type EnvironmentOptions struct {
 	// functionality entirely, just use a really large value.
 	GCActorsAfterDurationWithNoInvocations time.Duration
 
+	// MaxActorMailboxDepth is the maximum number of invocations of a single activated actor
+	// that can be waiting for the actor to finish processing the invocations ahead of them.
+	// Invocations that arrive when the actor's mailbox is full are rejected with a
+	// MailboxFullErr (HTTP 503) so that a single hot actor can't pile up an unbounded number
+	// of goroutines on the server.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// DefaultMaxActorMailboxDepth.
+	MaxActorMailboxDepth int
+
+	// IdempotencyKeyTTL is how long an activated actor remembers the response of an
+	// invocation with an idempotency key (see WithIdempotencyKey) so that retries of the
+	// invocation with the same key return the same response instead of executing the
+	// operation again. Note that the responses are forgotten before the TTL expires if the
+	// actor is GC'd (see GCActorsAfterDurationWithNoInvocations).
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// DefaultIdempotencyKeyTTL.
+	IdempotencyKeyTTL time.Duration
+	// MaxIdempotencyKeysPerActor is the maximum number of responses of invocations with
+	// idempotency keys that each activated actor remembers. The oldest responses are
+	// forgotten first.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// DefaultMaxIdempotencyKeysPerActor.
+	MaxIdempotencyKeysPerActor int
+	// MaxIdempotentResponseBytesPerActor is the maximum number of bytes of responses of
+	// invocations with idempotency keys that each activated actor remembers. The oldest
+	// responses are forgotten first, and responses that are larger on their own are not
+	// remembered at all. The remembered responses count towards the memory usage of the
+	// actor.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// DefaultMaxIdempotentResponseBytesPerActor.
+	MaxIdempotentResponseBytesPerActor int
+
 	// MaxNumShutdownWorkers specifies the number of workers used for shutting down the active actors
 	// in the environment. This determines the level of parallelism and CPU resources utilized
 	// during the shutdown process. By default, all available CPUs (runtime.NumCPU()) are used.
 	MaxNumShutdownWorkers int
 
+	// MemoryLimitBytes is the amount of memory available to actors in the environment. It
+	// is reported to the registry so that actors can be balanced based on memory utilization
+	// in clusters with servers of different sizes. Defaults to the Go runtime's soft memory
+	// limit (GOMEMLIMIT) if one is configured, otherwise the limit is reported as unknown and
+	// the registry balances actors based on absolute memory usage.
+	MemoryLimitBytes int
+	// NumCPUCores is the number of CPU cores available to actors in the environment. It is
+	// reported to the registry so that actors can be balanced based on the number of actors
+	// per core in clusters with servers of different sizes. Defaults to runtime.NumCPU().
+	NumCPUCores int
+
+	// TLS configures TLS for the communication with other servers. It is used by the
+	// convenience functions in this package (and the leaderregistry implementation) that
+	// construct a RemoteClient and Server on behalf of the caller. Callers that construct
+	// their own should pass the same options to NewHTTPClientWithOptions (or
+	// NewRPCClient) and NewServerWithOptions.
+	TLS TLSOptions
+
+	// AsyncInvocations configures the durable queue used by InvokeActorAsync. Async
+	// invocations are disabled unless AsyncInvocations.Store is set.
+	AsyncInvocations AsyncInvocationOptions
+
+	// Reminders configures the durable reminders registered with RegisterReminder.
+	// Reminders are disabled unless Reminders.Store is set.
+	Reminders ReminderOptions
+
+	// Tracer is used to trace actor invocations, including the activation cache lookups,
+	// registry calls, remote hops to other servers, time spent waiting in actor mailboxes
+	// and the execution of the actors themselves. Trace context is propagated to other
+	// servers using the W3C Trace Context headers (and to the actors that are invoked by
+	// other actors through the context). If no tracer is provided, a tracer that doesn't
+	// record anything (tracing.NewNoopTracer()) will be used.
+	Tracer tracing.Tracer
+
+	// Metrics is the registry that the environment's metrics are registered with. This
+	// includes invocation counts and latencies, activations, GCs, sheds, activation cache
+	// hit rates, registry call latencies, heartbeat failures and memory usage. The metrics
+	// are exposed by the Server's /metrics endpoint. If no registry is provided, a new one
+	// will be created.
+	Metrics *metrics.Registry
+
 	// Logger is a logging instance used for logging messages.
 	// If no logger is provided, the default logger from the slog package (slog.Default()) will be used.
 	Logger *slog.Logger
@@ -156,8 +271,13 @@ func NewDNSRegistryEnvironment(
 		return nil, nil, fmt.Errorf("error creating DNS registry: %w", err)
 	}
 
+	client, err := NewHTTPClientWithOptions(HTTPClientOptions{TLS: opts.TLS})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating HTTP client: %w", err)
+	}
+
 	env, err := NewEnvironment(
-		ctx, dnsregistry.DNSServerID, reg, registry.NewNoopModuleStore(), NewHTTPClient(), opts)
+		ctx, dnsregistry.DNSServerID, reg, registry.NewNoopModuleStore(), client, opts)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error creating new virtual environment: %w", err)
 	}
@@ -210,6 +330,33 @@ func (e *EnvironmentOptions) Validate() error {
 	if e.GCActorsAfterDurationWithNoInvocations < 0 {
 		return fmt.Errorf("GCActorsAfterDurationWithNoInvocations must be >= 0")
 	}
+	if e.MaxActorMailboxDepth < 0 {
+		return fmt.Errorf("MaxActorMailboxDepth must be >= 0")
+	}
+	if e.IdempotencyKeyTTL < 0 {
+		return fmt.Errorf("IdempotencyKeyTTL must be >= 0")
+	}
+	if e.MaxIdempotencyKeysPerActor < 0 {
+		return fmt.Errorf("MaxIdempotencyKeysPerActor must be >= 0")
+	}
+	if e.MaxIdempotentResponseBytesPerActor < 0 {
+		return fmt.Errorf("MaxIdempotentResponseBytesPerActor must be >= 0")
+	}
+	if e.MemoryLimitBytes < 0 {
+		return fmt.Errorf("MemoryLimitBytes must be >= 0")
+	}
+	if e.NumCPUCores < 0 {
+		return fmt.Errorf("NumCPUCores must be >= 0")
+	}
+	if err := e.TLS.Validate(); err != nil {
+		return fmt.Errorf("error validating TLS options: %w", err)
+	}
+	if err := e.AsyncInvocations.Validate(); err != nil {
+		return fmt.Errorf("error validating AsyncInvocations options: %w", err)
+	}
+	if err := e.Reminders.Validate(); err != nil {
+		return fmt.Errorf("error validating Reminders options: %w", err)
+	}
 
 	return nil
 }
@@ -226,12 +373,42 @@ func NewEnvironment(
 	if opts.ActivationCacheTTL == 0 {
 		opts.ActivationCacheTTL = defaultActivationsCacheTTL
 	}
+	if opts.ActivationCacheTimeout == 0 {
+		opts.ActivationCacheTimeout = defaultActivationCacheTimeout
+	}
 	if opts.GCActorsAfterDurationWithNoInvocations == 0 {
 		opts.GCActorsAfterDurationWithNoInvocations = DefaultGCActorsAfterDurationWithNoInvocations
 	}
+	if opts.MaxActorMailboxDepth == 0 {
+		opts.MaxActorMailboxDepth = DefaultMaxActorMailboxDepth
+	}
+	if opts.IdempotencyKeyTTL == 0 {
+		opts.IdempotencyKeyTTL = DefaultIdempotencyKeyTTL
+	}
+	if opts.MaxIdempotencyKeysPerActor == 0 {
+		opts.MaxIdempotencyKeysPerActor = DefaultMaxIdempotencyKeysPerActor
+	}
+	if opts.MaxIdempotentResponseBytesPerActor == 0 {
+		opts.MaxIdempotentResponseBytesPerActor = DefaultMaxIdempotentResponseBytesPerActor
+	}
 	if opts.MaxNumShutdownWorkers == 0 {
 		opts.MaxNumShutdownWorkers = runtime.NumCPU()
 	}
+	if opts.MemoryLimitBytes == 0 {
+		// Passing a negative value returns the current limit without modifying it.
+		if limit := debug.SetMemoryLimit(-1); limit > 0 && limit < math.MaxInt64 {
+			opts.MemoryLimitBytes = int(limit)
+		}
+	}
+	if opts.NumCPUCores == 0 {
+		opts.NumCPUCores = runtime.NumCPU()
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = tracing.NewNoopTracer()
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.NewRegistry()
+	}
 	if opts.Logger == nil {
 		opts.Logger = slog.Default()
 	}
@@ -259,6 +436,7 @@ func NewEnvironment(
 		slog.String("address", address),
 	)
 
+	envMetrics := newEnvironmentMetrics(opts.Metrics)
 	env := &environment{
 		log: opts.Logger.With(
 			slog.String("module", "environment"),
@@ -266,23 +444,42 @@ func NewEnvironment(
 		activationsCache: newActivationsCache(
 			reg,
 			opts.ActivationCacheTTL,
+			opts.ActivationCacheTimeout,
 			opts.DisableActivationCache,
 			opts.Logger.With(
 				slog.String("module", "environment"),
 				slog.String("sub_service", "activations_cache"),
-			)),
-		closeCh:  make(chan struct{}),
-		closedCh: make(chan struct{}),
-		registry: reg,
-		client:   client,
-		address:  address,
-		serverID: serverID,
-		opts:     opts,
+			),
+			opts.Tracer,
+			envMetrics),
+		namespaceRateLimiter: newNamespaceRateLimiter(),
+		latencies:            newLatencyTracker(hedgeMaxTrackedOperations),
+		closeCh:              make(chan struct{}),
+		closedCh:             make(chan struct{}),
+		registry:             reg,
+		client:               client,
+		address:              address,
+		serverID:             serverID,
+		opts:                 opts,
+		metrics:              envMetrics,
 	}
 	env.randState.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 	activations := newActivations(
-		opts.Logger, reg, moduleStore, env, env.opts.CustomHostFns, opts.GCActorsAfterDurationWithNoInvocations)
+		opts.Logger, reg, moduleStore, env, env.opts.CustomHostFns,
+		opts.GCActorsAfterDurationWithNoInvocations, opts.MaxActorMailboxDepth,
+		opts.IdempotencyKeyTTL, opts.MaxIdempotencyKeysPerActor,
+		opts.MaxIdempotentResponseBytesPerActor,
+		env.namespaceLimits, opts.Tracer, envMetrics)
 	env.activations = activations
+	registerEnvironmentMetricFuncs(opts.Metrics, env)
+	if opts.AsyncInvocations.Enabled() {
+		env.asyncInvocations = newAsyncInvocationQueue(
+			opts.Logger, serverID, opts.AsyncInvocations, env.deliverAsyncInvocation)
+	}
+	if opts.Reminders.Enabled() {
+		env.reminders = newReminderService(
+			opts.Logger, serverID, opts.Reminders, env.fireReminder)
+	}
 
 	// Skip confusing log if dnsregistry is being used since it doesn't use the registry-based
 	// registration mechanism in the traditional way.
@@ -303,25 +500,45 @@ func NewEnvironment(
 	}
 	opts.Logger.Info("performed initial heartbeat", slog.String("address", address))
 
+	// Invalidate cached activations as soon as the registry tells us they're stale. The
+	// subscription is canceled when the environment is closed. Note that this must happen
+	// before acquiring localEnvironmentsRouterLock because subscribing may require the
+	// registry to communicate with other (local) environments.
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	env.stopWatchingRegistry = stopWatch
+	env.activationsCache.watch(watchCtx)
+
 	localEnvironmentsRouterLock.Lock()
 	defer localEnvironmentsRouterLock.Unlock()
 	if _, ok := localEnvironmentsRouter[address]; ok {
+		stopWatch()
 		return nil, fmt.Errorf("tried to register: %s to local environment router twice", address)
 	}
 	localEnvironmentsRouter[address] = env
 
+	if env.asyncInvocations != nil {
+		env.asyncInvocations.start()
+	}
+	if env.reminders != nil {
+		env.reminders.start()
+	}
+
 	go func() {
 		defer close(env.closedCh)
-		ticker := time.NewTicker(1 * time.Second)
+		// Use a timer instead of a ticker so changes to the cluster's heartbeat interval
+		// are picked up immediately.
+		timer := time.NewTimer(env.heartbeatInterval())
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				if env.isHeartbeatPaused() {
 					return
 				}
 				if err := env.Heartbeat(); err != nil {
 					opts.Logger.Error("error performing background heartbeat", slog.Any("error", err))
 				}
+				timer.Reset(env.heartbeatInterval())
 			case <-env.closeCh:
 				opts.Logger.Info("shutting down environment", slog.String("serverID", env.serverID), slog.String("address", env.address))
 				return
@@ -417,9 +634,38 @@ func (r *environment) InvokeActorStream(
 	payload []byte,
 	create types.CreateIfNotExist,
 ) (io.ReadCloser, error) {
+	ctx, span := r.opts.Tracer.Start(
+		ctx, "nola.InvokeActor",
+		tracing.WithAttributes(invocationSpanAttributes(namespace, actorID, moduleID, operation)...))
+	defer span.End()
+
+	start := time.Now()
+	resp, err := r.invokeActorStream(ctx, namespace, actorID, moduleID, operation, payload, create)
+	r.metrics.recordInvocation(
+		invocationKindInvoke, namespace, moduleID, operation,
+		r.activations.isModuleLoaded, start, err)
+	span.RecordError(err)
+	return resp, err
+}
+
+func (r *environment) invokeActorStream(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
+	if err := validateOperation(operation); err != nil {
+		return nil, err
+	}
 	if err := create.Validate(); err != nil {
 		return nil, fmt.Errorf("error validating CreateIfNotExist: %w", err)
 	}
+	if err := r.checkNamespaceRateLimit(namespace); err != nil {
+		return nil, err
+	}
 
 	resp, err := r.invokeActorStreamHelper(
 		ctx, namespace, actorID, moduleID, operation, payload, create, nil)
@@ -427,6 +673,23 @@ func (r *environment) InvokeActorStream(
 		return resp, nil
 	}
 
+	if IsActorNotOwnedError(err) {
+		// If we received an error because the target server no longer owns the actor due
+		// to a cluster membership change, then we'll invalidate our cache to force the
+		// subsequent call to lookup the actor's new location in the registry. Unlike the
+		// blacklist case below, the registry already knows where the actor should live
+		// so there is no need to provide any additional hints.
+		r.activationsCache.delete(namespace, moduleID, actorID)
+
+		r.log.Warn(
+			"encountered actor that is being handed off, forcing activation cache refresh and retrying",
+			slog.String("actor_id", fmt.Sprintf("%s::%s::%s", namespace, moduleID, actorID)),
+			slog.Any("server_ids", err.(ActorNotOwnedErr).ServerIDs()))
+
+		return r.invokeActorStreamHelper(
+			ctx, namespace, actorID, moduleID, operation, payload, create, nil)
+	}
+
 	if IsBlacklistedActivationError(err) {
 		// If we received an error because the target server has blacklisted activations
 		// of this actor, then we'll invalidate our cache to force the subsequent call
@@ -473,19 +736,10 @@ func (r *environment) invokeActorStreamHelper(
 		return nil, errors.New("InvokeActor: moduleID cannot be empty")
 	}
 
-	vs, err := r.registry.GetVersionStamp(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error getting version stamp: %w", err)
-	}
-
-	references, err := r.activationsCache.ensureActivation(
-		ctx, namespace, moduleID, actorID, create.Options.ExtraReplicas, blacklistedServerIDs)
+	vs, references, err := r.resolveActivation(
+		ctx, namespace, moduleID, actorID, create, blacklistedServerIDs)
 	if err != nil {
-		return nil, fmt.Errorf("error ensuring actor activation: %w", err)
-	}
-	if len(references) == 0 {
-		return nil, fmt.Errorf(
-			"ensureActivation() success with 0 references for actor ID: %s", actorID)
+		return nil, err
 	}
 
 	var (
@@ -509,7 +763,8 @@ func (r *environment) invokeActorStreamHelper(
 		if retryPolicy.PerAttemptTimeout > 0 {
 			invokeCtx, cc = context.WithTimeout(ctx, retryPolicy.PerAttemptTimeout)
 		}
-		resp, selectedReferences, err := r.invokeReferences(invokeCtx, vs, references, operation, payload, create)
+		resp, selectedReferences, err := r.invokeReferencesWithHedging(
+			invokeCtx, vs, namespace, moduleID, references, operation, payload, create)
 		if err != nil {
 			// If there was an error we can cancel the per-attempt context immediately.
 			cc()
@@ -519,17 +774,52 @@ func (r *environment) invokeActorStreamHelper(
 			resp = newCtxReaderCloser(cc, resp)
 		}
 
-		// If there is no error or the error is due to server blacklisting, consider the invocation successful.
-		// Return the response and error to exit the retry loop.
-		if err == nil || IsBlacklistedActivationError(err) {
+		// If there is no error or the error is due to server blacklisting / actor handoff, consider the
+		// invocation successful. Return the response and error to exit the retry loop.
+		if err == nil || IsBlacklistedActivationError(err) || IsActorNotOwnedError(err) {
 			return resp, err
 		}
 
 		// Store the error encountered during the current invocation attempt.
 		invocationErr = err
+		if retryAttempt == retryPolicy.MaxNumRetries {
+			break
+		}
+
+		class := classifyInvocationError(ctx, err)
+		if class == retryClassFatal {
+			return nil, fmt.Errorf(
+				"failed invocation with an error that can't be retried, after %d attempts: %w",
+				retryAttempt+1, err)
+		}
+		r.metrics.retries.Inc(class.String())
 
 		// Remove the servers that failed to invoke the actor from the available references.
 		references = filterReferences(references, selectedReferences)
+		if class == retryClassStale {
+			// Make sure that no other invocation is routed with the stale references either.
+			r.activationsCache.delete(namespace, moduleID, actorID)
+		}
+
+		// Back off before retrying so that transient failures (like a server that is
+		// restarting) have a chance to resolve themselves before the next attempt.
+		if err := sleepWithContext(ctx, r.retryBackoff(retryPolicy, retryAttempt+1)); err != nil {
+			return nil, fmt.Errorf(
+				"failed invocation because the context was done while backing off, after %d attempts, and with last error %w",
+				retryAttempt+1, invocationErr)
+		}
+
+		if len(references) == 0 && class != retryClassReplica {
+			// The error may be resolved by retrying the activations that are currently
+			// known, even if that means retrying the same server.
+			vs, references, err = r.resolveActivation(
+				ctx, namespace, moduleID, actorID, create, blacklistedServerIDs)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed invocation because the actor could not be re-resolved, after %d attempts, and with last error %v: %w",
+					retryAttempt+1, invocationErr, err)
+			}
+		}
 	}
 
 	// Return an error indicating that the maximum number of retries has been reached without success.
@@ -537,6 +827,181 @@ func (r *environment) invokeActorStreamHelper(
 	return nil, fmt.Errorf("failed invocation after maximum number of retries, after %d attempts, and with last error %w", 1+retryPolicy.MaxNumRetries, invocationErr)
 }
 
+// resolveActivation returns the current versionstamp of the registry and the references of
+// the actor's activations.
+func (r *environment) resolveActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	create types.CreateIfNotExist,
+	blacklistedServerIDs []string,
+) (int64, []types.ActorReference, error) {
+	start := time.Now()
+	vs, err := r.registry.GetVersionStamp(ctx)
+	r.metrics.recordRegistryCall("GetVersionStamp", start, err)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error getting version stamp: %w", err)
+	}
+
+	references, err := r.activationsCache.ensureActivation(
+		ctx, namespace, moduleID, actorID, create.Options.ExtraReplicas, blacklistedServerIDs)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error ensuring actor activation: %w", err)
+	}
+	if len(references) == 0 {
+		return 0, nil, fmt.Errorf(
+			"ensureActivation() success with 0 references for actor ID: %s", actorID)
+	}
+	return vs, references, nil
+}
+
+func (r *environment) InvokeActorAsync(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) error {
+	if r.isClosed() {
+		return ErrEnvironmentClosed
+	}
+	if err := validateOperation(operation); err != nil {
+		return fmt.Errorf("InvokeActorAsync: %w", err)
+	}
+	if err := create.Validate(); err != nil {
+		return fmt.Errorf("error validating CreateIfNotExist: %w", err)
+	}
+	if r.asyncInvocations == nil {
+		return errors.New(
+			"InvokeActorAsync: async invocations are not enabled, see EnvironmentOptions.AsyncInvocations")
+	}
+
+	err := r.asyncInvocations.enqueue(ctx, asyncInvocation{
+		Namespace:        namespace,
+		ActorID:          actorID,
+		ModuleID:         moduleID,
+		Operation:        operation,
+		Payload:          payload,
+		CreateIfNotExist: create,
+	})
+	if err != nil {
+		return fmt.Errorf("InvokeActorAsync: %w", err)
+	}
+	return nil
+}
+
+// deliverAsyncInvocation performs an invocation that was enqueued with InvokeActorAsync.
+// The response is discarded since there is no one to return it to.
+func (r *environment) deliverAsyncInvocation(ctx context.Context, inv asyncInvocation) error {
+	resp, err := r.InvokeActorStream(
+		ctx, inv.Namespace, inv.ActorID, inv.ModuleID, inv.Operation, inv.Payload, inv.CreateIfNotExist)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if _, err := io.Copy(io.Discard, resp); err != nil {
+		return fmt.Errorf("error reading actor response from stream: %w", err)
+	}
+	return nil
+}
+
+func (r *environment) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	reminder types.Reminder,
+) error {
+	if err := r.checkReminders(namespace, actorID, moduleID); err != nil {
+		return fmt.Errorf("RegisterReminder: %w", err)
+	}
+	if err := reminder.Validate(); err != nil {
+		return fmt.Errorf("RegisterReminder: error validating reminder: %w", err)
+	}
+
+	id := types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor)
+	if err := r.reminders.register(ctx, id, reminder); err != nil {
+		return fmt.Errorf("RegisterReminder: %w", err)
+	}
+	return nil
+}
+
+func (r *environment) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	if err := r.checkReminders(namespace, actorID, moduleID); err != nil {
+		return fmt.Errorf("UnregisterReminder: %w", err)
+	}
+
+	id := types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor)
+	if err := r.reminders.unregister(ctx, id, name); err != nil {
+		return fmt.Errorf("UnregisterReminder: %w", err)
+	}
+	return nil
+}
+
+func (r *environment) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]types.Reminder, error) {
+	if err := r.checkReminders(namespace, actorID, moduleID); err != nil {
+		return nil, fmt.Errorf("ListReminders: %w", err)
+	}
+
+	id := types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor)
+	reminders, err := r.reminders.list(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("ListReminders: %w", err)
+	}
+	return reminders, nil
+}
+
+func (r *environment) checkReminders(namespace, actorID, moduleID string) error {
+	if r.isClosed() {
+		return ErrEnvironmentClosed
+	}
+	if r.reminders == nil {
+		return errors.New("reminders are not enabled, see EnvironmentOptions.Reminders")
+	}
+	if namespace == "" {
+		return errors.New("namespace cannot be empty")
+	}
+	if actorID == "" {
+		return errors.New("actorID cannot be empty")
+	}
+	if moduleID == "" {
+		return errors.New("moduleID cannot be empty")
+	}
+	return nil
+}
+
+// fireReminder invokes the reminder's operation on its actor, reactivating the actor if
+// necessary. The response is discarded since there is no one to return it to.
+func (r *environment) fireReminder(ctx context.Context, record reminderRecord) error {
+	resp, err := r.InvokeActorStream(
+		ctx, record.Namespace, record.ActorID, record.ModuleID,
+		record.Reminder.Operation, record.Reminder.Payload, record.Reminder.CreateIfNotExist)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if _, err := io.Copy(io.Discard, resp); err != nil {
+		return fmt.Errorf("error reading actor response from stream: %w", err)
+	}
+	return nil
+}
+
 func (r *environment) InvokeActorDirect(
 	ctx context.Context,
 	versionStamp int64,
@@ -579,6 +1044,38 @@ func (r *environment) InvokeActorDirectStream(
 	operation string,
 	payload []byte,
 	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
+	spanKind := tracing.SpanKindInternal
+	if tracing.SpanContextFromContext(ctx).Remote {
+		// The invocation was sent by another server.
+		spanKind = tracing.SpanKindServer
+	}
+	ctx, span := r.opts.Tracer.Start(
+		ctx, "nola.InvokeActorDirect",
+		tracing.WithSpanKind(spanKind),
+		tracing.WithAttributes(invocationSpanAttributes(
+			reference.Namespace, reference.ActorID, reference.ModuleID, operation)...))
+	defer span.End()
+
+	start := time.Now()
+	resp, err := r.invokeActorDirectStream(
+		ctx, versionStamp, serverID, serverVersion, reference, operation, payload, create)
+	r.metrics.recordInvocation(
+		invocationKindDirect, reference.Namespace, reference.ModuleID, operation,
+		r.activations.isModuleLoaded, start, err)
+	span.RecordError(err)
+	return resp, err
+}
+
+func (r *environment) invokeActorDirectStream(
+	ctx context.Context,
+	versionStamp int64,
+	serverID string,
+	serverVersion int64,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
 ) (io.ReadCloser, error) {
 	if r.isClosed() {
 		return nil, ErrEnvironmentClosed
@@ -604,9 +1101,9 @@ func (r *environment) InvokeActorDirectStream(
 		//       client should assert on that as well to avoid issues where the request
 		//       reaches the wrong application entirely and that application just returns
 		//       OK to everything.
-		return nil, fmt.Errorf(
+		return nil, NewStaleActivationError(fmt.Errorf(
 			"request for serverID: %s received by server: %s, cannot fullfil",
-			serverID, r.serverID)
+			serverID, r.serverID))
 	}
 	if versionStamp <= 0 {
 		return nil, fmt.Errorf("versionStamp must be >= 0, but was: %d", versionStamp)
@@ -617,18 +1114,29 @@ func (r *environment) InvokeActorDirectStream(
 	r.heartbeatState.RUnlock()
 
 	if heartbeatResult.VersionStamp+heartbeatResult.HeartbeatTTL < versionStamp {
-		return nil, fmt.Errorf(
+		return nil, NewStaleActivationError(fmt.Errorf(
 			"InvokeLocal: server heartbeat(%d) + TTL(%d) < versionStamp(%d)",
-			heartbeatResult.VersionStamp, heartbeatResult.HeartbeatTTL, versionStamp)
+			heartbeatResult.VersionStamp, heartbeatResult.HeartbeatTTL, versionStamp))
 	}
 
 	// Compare server version of this environment to the server version from the actor activation reference to ensure
 	// the env hasn't missed a heartbeat recently, which could cause it to lose ownership of the actor.
 	// This bug was identified using this model: https://github.com/richardartoul/nola/blob/master/proofs/stateright/activation-cache/README.md
 	if heartbeatResult.ServerVersion != serverVersion {
-		return nil, fmt.Errorf(
+		return nil, NewStaleActivationError(fmt.Errorf(
 			"InvokeLocal: server version(%d) != server version from reference(%d)",
-			heartbeatResult.ServerVersion, serverVersion)
+			heartbeatResult.ServerVersion, serverVersion))
+	}
+
+	if operation == wapcutils.MigrateOperationName {
+		// Migrate is handled by the environment instead of being dispatched to the actor's code.
+		// It's a reserved operation, so it can only be received from other servers (which
+		// send it on behalf of MigrateActor, after the admin has been authorized), never
+		// from the public APIs.
+		if _, err := r.maybeHandoffActor(ctx, reference.ActorIDWithNamespace()); err != nil {
+			return nil, fmt.Errorf("error handing off migrated actor: %w", err)
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
 	}
 
 	return r.activations.invoke(ctx, reference, operation, create.InstantiatePayload, payload, false)
@@ -671,6 +1179,12 @@ func (r *environment) InvokeWorkerStream(
 	if r.isClosed() {
 		return nil, ErrEnvironmentClosed
 	}
+	if err := validateOperation(operation); err != nil {
+		return nil, fmt.Errorf("InvokeWorker: %w", err)
+	}
+	if err := r.checkNamespaceRateLimit(namespace); err != nil {
+		return nil, err
+	}
 
 	// TODO: The implementation of this function is nice because it just reusees a bunch of the
 	//       actor logic. However, it's also less performant than it could be because it still
@@ -688,6 +1202,54 @@ func (r *environment) InvokeWorkerStream(
 	return r.activations.invoke(ctx, ref, operation, create.InstantiatePayload, payload, false)
 }
 
+func (r *environment) MigrateActor(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	targetServerID string,
+) error {
+	if r.isClosed() {
+		return ErrEnvironmentClosed
+	}
+
+	result, err := r.registry.MigrateActor(ctx, namespace, moduleID, actorID, targetServerID)
+	if err != nil {
+		return fmt.Errorf("MigrateActor: error migrating actor in registry: %w", err)
+	}
+	r.activationsCache.delete(namespace, moduleID, actorID)
+
+	start := time.Now()
+	vs, err := r.registry.GetVersionStamp(ctx)
+	r.metrics.recordRegistryCall("GetVersionStamp", start, err)
+	if err != nil {
+		return fmt.Errorf("MigrateActor: error getting version stamp: %w", err)
+	}
+
+	// Notify the target server first so that it knows it owns the actor again (in case it
+	// handed the actor off recently) before the previous servers deactivate the actor and
+	// transfer its snapshot to the target server.
+	for _, refs := range [][]types.ActorReference{result.References, result.PreviousReferences} {
+		for _, ref := range refs {
+			resp, err := r.invokeSingleReference(
+				ctx, vs, ref, wapcutils.MigrateOperationName, nil, types.CreateIfNotExist{})
+			if err != nil {
+				return fmt.Errorf(
+					"MigrateActor: error notifying server: %s of migration: %w",
+					ref.Physical.ServerID, err)
+			}
+			resp.Close()
+		}
+	}
+
+	r.log.Info(
+		"migrated actor",
+		slog.String("actor_id", fmt.Sprintf("%s::%s::%s", namespace, moduleID, actorID)),
+		slog.String("target_server_id", targetServerID),
+		slog.Int("num_previous_activations", len(result.PreviousReferences)))
+	return nil
+}
+
 func (r *environment) Close(ctx context.Context) error {
 	if r.isClosed() {
 		return ErrEnvironmentClosed
@@ -698,6 +1260,7 @@ func (r *environment) Close(ctx context.Context) error {
 	localEnvironmentsRouterLock.Unlock()
 
 	close(r.closeCh)
+	r.stopWatchingRegistry()
 
 	// Wait for the background heartbeating mechanism to shutdown first.
 	// This gives the heartbeating / discovery system time to shutdown and proactively unregister
@@ -708,6 +1271,15 @@ func (r *environment) Close(ctx context.Context) error {
 		return ctx.Err()
 	}
 
+	// Stop delivering async invocations and firing reminders before rejecting new requests
+	// so the in-flight deliveries can complete instead of failing (and being retried later).
+	if r.asyncInvocations != nil {
+		r.asyncInvocations.close()
+	}
+	if r.reminders != nil {
+		r.reminders.close()
+	}
+
 	// Now that the heartbeating / discovery system has performed a clean shutdown, we can safely
 	// begin rejecting all new requests.
 	r.shutdownState.mu.Lock()
@@ -731,24 +1303,47 @@ func (r *environment) Close(ctx context.Context) error {
 	return nil
 }
 
+func (r *environment) MailboxStats() MailboxStats {
+	return r.activations.getMailboxStats()
+}
+
+func (r *environment) ActorMailboxStats(
+	namespace string,
+	actorID string,
+	moduleID string,
+) (MailboxStats, bool) {
+	return r.activations.actorMailboxStats(
+		types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor))
+}
+
+func (r *environment) Metrics() *metrics.Registry {
+	return r.opts.Metrics
+}
+
 func (r *environment) NumActivatedActors() int {
 	return r.activations.numActivatedActors()
 }
 
 func (r *environment) Heartbeat() error {
-	ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
+	ttl, _ := r.heartbeatSettings()
+	ctx, cc := context.WithTimeout(context.Background(), ttl)
 	defer cc()
 
 	var (
 		numActors  = r.NumActivatedActors()
 		usedMemory = r.activations.memUsageBytes()
 	)
+	start := time.Now()
 	result, err := r.registry.Heartbeat(ctx, r.serverID, registry.HeartbeatState{
 		NumActivatedActors: numActors,
 		UsedMemory:         usedMemory,
 		Address:            r.address,
+		MemoryLimitBytes:   r.opts.MemoryLimitBytes,
+		NumCPUCores:        r.opts.NumCPUCores,
 	})
+	r.metrics.recordRegistryCall("Heartbeat", start, err)
 	if err != nil {
+		r.metrics.heartbeatFailures.Inc()
 		return fmt.Errorf("error heartbeating: %w", err)
 	}
 
@@ -773,9 +1368,252 @@ func (r *environment) Heartbeat() error {
 		r.activations.shedMemUsage(int(r.heartbeatState.MemoryBytesToShed))
 	}
 
+	if result.NumActorsToShed > 0 {
+		// Server told us we have significantly more actors than our peers and should
+		// shed some of them so they're rebalanced onto other servers.
+		r.log.Info(
+			"attempting to shed actors to rebalance",
+			slog.Int("num_actors_to_shed", result.NumActorsToShed))
+		r.activations.shedActors(result.NumActorsToShed)
+	}
+
+	if result.MembershipVersion > 0 {
+		r.maybeHandoffActors(result.MembershipVersion)
+	}
+
+	return nil
+}
+
+// namespaceLimits returns this server's share of the limits for the namespace that the
+// registry returned with the most recent heartbeat. The limits that are enforced by the
+// servers (instead of the registry) apply to the whole cluster, so they're split evenly
+// across the live servers.
+func (r *environment) namespaceLimits(namespace string) registry.NamespaceLimits {
+	r.heartbeatState.RLock()
+	limits := r.heartbeatState.NamespaceLimits[namespace]
+	numServers := r.heartbeatState.NumLiveServers
+	r.heartbeatState.RUnlock()
+
+	limits.MaxActivatedMemoryBytes = serverShareOfLimit(limits.MaxActivatedMemoryBytes, numServers)
+	limits.MaxInvocationsPerSecond = serverShareOfLimit(limits.MaxInvocationsPerSecond, numServers)
+	return limits
+}
+
+// serverShareOfLimit splits a cluster-wide limit evenly across numServers. The result is
+// rounded up so that a (non-zero) limit never turns into 0, which would mean unlimited.
+func serverShareOfLimit(limit, numServers int) int {
+	if limit <= 0 || numServers <= 1 {
+		return limit
+	}
+	return (limit + numServers - 1) / numServers
+}
+
+// checkNamespaceRateLimit returns a NamespaceLimitExceededErr if accepting another
+// invocation for the namespace would exceed this server's share of its
+// MaxInvocationsPerSecond.
+func (r *environment) checkNamespaceRateLimit(namespace string) error {
+	limit := r.namespaceLimits(namespace).MaxInvocationsPerSecond
+	if limit <= 0 {
+		return nil
+	}
+	if !r.namespaceRateLimiter.allow(namespace, limit, time.Now()) {
+		return registry.NewNamespaceLimitExceededError(fmt.Errorf(
+			"namespace: %s exceeded this server's share of its limit: %d invocations per second",
+			namespace, limit))
+	}
+	return nil
+}
+
+// heartbeatSettings returns the heartbeat TTL and interval that the registry returned
+// with the most recent heartbeat. The defaults are returned if the registry doesn't
+// manage them (or no heartbeat has succeeded yet).
+func (r *environment) heartbeatSettings() (ttl, interval time.Duration) {
+	r.heartbeatState.RLock()
+	result := r.heartbeatState.HeartbeatResult
+	r.heartbeatState.RUnlock()
+
+	if result.HeartbeatInterval <= 0 || result.HeartbeatTTL <= result.HeartbeatInterval {
+		return heartbeatTimeout, registry.DefaultHeartbeatInterval
+	}
+	// HeartbeatResult uses the same unit as the versionstamp (microseconds).
+	return time.Duration(result.HeartbeatTTL) * time.Microsecond,
+		time.Duration(result.HeartbeatInterval) * time.Microsecond
+}
+
+func (r *environment) heartbeatInterval() time.Duration {
+	_, interval := r.heartbeatSettings()
+	return interval
+}
+
+// maybeHandoffActors starts a background process to hand off all the actors that
+// this environment no longer owns if cluster membership has changed since the last
+// time the process ran successfully. It is a no-op if the process is already running.
+func (r *environment) maybeHandoffActors(membershipVersion int64) {
+	r.handoffState.Lock()
+	if r.handoffState.running || r.handoffState.membershipVersion == membershipVersion {
+		r.handoffState.Unlock()
+		return
+	}
+	r.handoffState.running = true
+	r.handoffState.Unlock()
+
+	// Make sure the environment waits for the handoff to complete before closing
+	// the activations.
+	r.shutdownState.mu.RLock()
+	if r.shutdownState.closed {
+		r.shutdownState.mu.RUnlock()
+		r.handoffState.Lock()
+		r.handoffState.running = false
+		r.handoffState.Unlock()
+		return
+	}
+	r.shutdownState.inflight.Add(1)
+	r.shutdownState.mu.RUnlock()
+
+	go func() {
+		defer r.shutdownState.inflight.Done()
+
+		ctx, cc := context.WithTimeout(context.Background(), actorHandoffTimeout)
+		defer cc()
+
+		err := r.handoffActors(ctx)
+
+		r.handoffState.Lock()
+		defer r.handoffState.Unlock()
+		r.handoffState.running = false
+		if err != nil {
+			// Leave the membership version alone so that the process is retried on
+			// the next heartbeat.
+			r.log.Error(
+				"error handing off actors after membership change",
+				slog.Int64("membership_version", membershipVersion),
+				slog.Any("error", err))
+			return
+		}
+		r.handoffState.membershipVersion = membershipVersion
+	}()
+}
+
+// handoffActors checks with the registry whether this environment still owns each of
+// its activated actors. The ones it no longer owns are deactivated, and their state
+// is transferred to the new owner if the actor implements ActorSnapshotter. While the
+// handoff is in progress, and for a while afterwards, invocations for those actors
+// will fail with a retryable ActorNotOwnedErr so that callers with a stale view of
+// the cluster are redirected to the actor's new owner instead of creating a second
+// activation here.
+func (r *environment) handoffActors(ctx context.Context) error {
+	var (
+		candidates = r.activations.handoffCandidates()
+		sem        = semaphore.NewWeighted(int64(r.opts.MaxNumShutdownWorkers))
+		wg         sync.WaitGroup
+		numFailed  = int64(0)
+		numHanded  = int64(0)
+	)
+	for _, id := range candidates {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			wg.Wait()
+			return fmt.Errorf("error acquiring semaphore: %w", err)
+		}
+
+		wg.Add(1)
+		go func(id types.NamespacedActorID) {
+			defer sem.Release(1)
+			defer wg.Done()
+
+			handedOff, err := r.maybeHandoffActor(ctx, id)
+			if err != nil {
+				atomic.AddInt64(&numFailed, 1)
+				r.log.Error(
+					"error handing off actor",
+					slog.String("actor_id", id.String()), slog.Any("error", err))
+				return
+			}
+			if handedOff {
+				atomic.AddInt64(&numHanded, 1)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	r.log.Info(
+		"done handing off actors after membership change",
+		slog.Int("num_candidates", len(candidates)),
+		slog.Int64("num_handed_off", numHanded),
+		slog.Int64("num_failed", numFailed))
+
+	if numFailed > 0 {
+		return fmt.Errorf("failed to hand off %d actors", numFailed)
+	}
 	return nil
 }
 
+func (r *environment) maybeHandoffActor(
+	ctx context.Context,
+	id types.NamespacedActorID,
+) (bool, error) {
+	// Bypass the activations cache since it may be stale. Note that the activation is only
+	// looked up (instead of ensured) so that checking ownership never activates the actor
+	// anywhere, like an extra replica on this server.
+	start := time.Now()
+	references, err := r.registry.LookupActivation(ctx, id.Namespace, id.Module, id.ID)
+	r.metrics.recordRegistryCall("LookupActivation", start, err)
+	if err != nil {
+		return false, fmt.Errorf("error looking up activation: %w", err)
+	}
+
+	for _, ref := range references {
+		if ref.Physical.ServerState.Address == r.address {
+			r.activations.markOwned(id)
+			return false, nil
+		}
+	}
+
+	r.activationsCache.delete(id.Namespace, id.Module, id.ID)
+	snapshot, err := r.activations.handoff(ctx, id)
+	if err != nil {
+		return true, err
+	}
+	if snapshot == nil {
+		// Actor was not activated or doesn't support snapshots, the new owner will
+		// just activate it from scratch when it receives its first invocation.
+		return true, nil
+	}
+
+	if err := r.transferSnapshot(ctx, id, snapshot); err != nil {
+		return true, fmt.Errorf("error transferring snapshot to new owner: %w", err)
+	}
+	return true, nil
+}
+
+// transferSnapshot hydrates the actor's new activations with the snapshot taken when it
+// was handed off. Hydrate is a reserved operation so it's sent directly to the servers
+// that host the new activations instead of going through InvokeActor, which only accepts
+// user operations.
+func (r *environment) transferSnapshot(
+	ctx context.Context,
+	id types.NamespacedActorID,
+	snapshot []byte,
+) error {
+	vs, references, err := r.resolveActivation(
+		ctx, id.Namespace, id.Module, id.ID, types.CreateIfNotExist{}, nil)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, ref := range references {
+		resp, err := r.invokeSingleReference(
+			ctx, vs, ref, wapcutils.HydrateOperationName, snapshot, types.CreateIfNotExist{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf(
+				"error hydrating activation on server: %s: %w", ref.Physical.ServerID, err))
+			continue
+		}
+		resp.Close()
+	}
+	return errors.Join(errs...)
+}
+
 func (r *environment) maybeLogHeartbeatState(
 	numActors int,
 	usedMemory int,
@@ -944,8 +1782,7 @@ func (r *environment) invokeSingleReference(
 	create types.CreateIfNotExist,
 ) (io.ReadCloser, error) {
 	if r.opts.ForceRemoteProcedureCalls {
-		resp, err := r.client.InvokeActorRemote(ctx, versionStamp, ref, operation, payload, create)
-		return resp, err
+		return r.invokeActorRemote(ctx, versionStamp, ref, operation, payload, create)
 	}
 
 	// First check the global localEnvironmentsRouter map for scenarios where we're
@@ -985,10 +1822,56 @@ func (r *environment) invokeSingleReference(
 	}
 
 	// Definitely need to invoke remotely, so just do that.
+	return r.invokeActorRemote(ctx, versionStamp, ref, operation, payload, create)
+}
+
+// invokeActorRemote invokes the actor on another server using the environment's
+// RemoteClient.
+func (r *environment) invokeActorRemote(
+	ctx context.Context,
+	versionStamp int64,
+	ref types.ActorReference,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
+	ctx, span := r.opts.Tracer.Start(
+		ctx, "nola.InvokeActorRemote",
+		tracing.WithSpanKind(tracing.SpanKindClient),
+		tracing.WithAttributes(
+			tracing.String("nola.server_id", ref.Physical.ServerID),
+			tracing.String("nola.server_address", ref.Physical.ServerState.Address)))
+	defer span.End()
+
 	resp, err := r.client.InvokeActorRemote(ctx, versionStamp, ref, operation, payload, create)
+	span.RecordError(err)
 	return resp, err
 }
 
+// validateOperation returns an error if the operation is reserved for the host. Reserved
+// operations (like hydrating an actor from a snapshot) can only be sent by other servers
+// in the cluster using InvokeActorDirect, never by callers of the public APIs.
+func validateOperation(operation string) error {
+	switch operation {
+	case wapcutils.StartupOperationName,
+		wapcutils.ShutdownOperationName,
+		wapcutils.HydrateOperationName,
+		wapcutils.MigrateOperationName:
+		return fmt.Errorf("operation: %s is reserved and cannot be invoked", operation)
+	}
+	return nil
+}
+
+// invocationSpanAttributes returns the attributes that identify an invocation in its spans.
+func invocationSpanAttributes(namespace, actorID, moduleID, operation string) []tracing.Attribute {
+	return []tracing.Attribute{
+		tracing.String("nola.namespace", namespace),
+		tracing.String("nola.actor_id", actorID),
+		tracing.String("nola.module_id", moduleID),
+		tracing.String("nola.operation", operation),
+	}
+}
+
 func (r *environment) freezeHeartbeatState() {
 	r.heartbeatState.Lock()
 	r.heartbeatState.frozen = true
@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"time"
 
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/dnsregistry"
 	"github.com/richardartoul/nola/virtual/registry/localregistry"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
@@ -394,6 +396,88 @@ func TestScheduleSelfTimersAndGC(t *testing.T) {
 	runWithDifferentConfigs(t, testFn, nil, false, false, gcDuration)
 }
 
+// TestSelfTimerHandles tests that actors can list and cancel their outstanding timers, and
+// that an actor's timers are stopped when it is closed.
+func TestSelfTimerHandles(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+	)
+	defer reg.Close(ctx)
+
+	env, err := NewEnvironment(ctx, "serverID1", reg, moduleStore, nil, defaultOptsGoByte)
+	require.NoError(t, err)
+	defer func() { noErrIgnoreDupeClose(t, env.Close(context.Background())) }()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	invoke := func(operation string, payload any) []byte {
+		marshaled, err := json.Marshal(payload)
+		require.NoError(t, err)
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", operation, marshaled, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		return result
+	}
+	scheduleTimer := func(afterMillis int) string {
+		var result wapcutils.ScheduleSelfTimerResult
+		require.NoError(t, json.Unmarshal(invoke("scheduleSelfTimer", wapcutils.ScheduleSelfTimer{
+			Operation:   "inc",
+			AfterMillis: afterMillis,
+		}), &result))
+		require.NotEmpty(t, result.TimerID)
+		return result.TimerID
+	}
+	listTimers := func() []wapcutils.SelfTimer {
+		var timers []wapcutils.SelfTimer
+		require.NoError(t, json.Unmarshal(invoke("listSelfTimers", nil), &timers))
+		return timers
+	}
+
+	id1 := scheduleTimer(100)
+	id2 := scheduleTimer(100)
+	timers := listTimers()
+	require.Equal(t, 2, len(timers))
+	require.Equal(t, id1, timers[0].TimerID)
+	require.Equal(t, id2, timers[1].TimerID)
+
+	// Only the timer that wasn't cancelled should fire.
+	invoke("cancelSelfTimer", wapcutils.CancelSelfTimer{TimerID: id1})
+	require.Equal(t, 1, len(listTimers()))
+	require.Eventually(t, func() bool {
+		return getCount(t, invoke("getCount", nil)) == 1
+	}, 10*time.Second, time.Millisecond)
+	require.Equal(t, 0, len(listTimers()))
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int64(1), getCount(t, invoke("getCount", nil)))
+
+	// Timers can fire as soon as possible, but not in the past.
+	scheduleTimer(0)
+	require.Eventually(t, func() bool {
+		return getCount(t, invoke("getCount", nil)) == 2
+	}, 10*time.Second, time.Millisecond)
+	marshaled, err := json.Marshal(wapcutils.ScheduleSelfTimer{Operation: "inc", AfterMillis: -1})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "scheduleSelfTimer", marshaled, types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "AfterMillis < 0")
+
+	// Closing the actor should stop its timers.
+	scheduleTimer(int(time.Hour.Milliseconds()))
+	activations := env.(*environment).activations
+	activations.Lock()
+	actorF, ok := activations._actors[types.NewNamespacedActorID(
+		"ns-1", "a", "test-module", types.IDTypeActor)]
+	activations.Unlock()
+	require.True(t, ok)
+	actor, err := actorF.Wait()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(actor._timers.list()))
+	require.NoError(t, env.Close(ctx))
+	require.Equal(t, 0, len(actor._timers.list()))
+}
+
 // TestInvokeActorHostFunctionDeadlockRegression is a regression test to ensure that an actor can invoke
 // another actor that is not yet activated without introducing a deadlock.
 func TestInvokeActorHostFunctionDeadlockRegression(t *testing.T) {
@@ -526,6 +610,208 @@ func TestHeartbeatAndSelfHealing(t *testing.T) {
 	runThreeEnvironmentsWithDifferentConfigs(t, testFn)
 }
 
+// TestDNSRegistryActorHandoff tests that when DNS membership changes, environments hand off
+// the actors they no longer own (including their state when the actor supports snapshots)
+// instead of leaving a second activation behind.
+func TestDNSRegistryActorHandoff(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		resolver = &testResolver{}
+		numActor = 20
+	)
+	resolver.setPorts(1)
+
+	newEnv := func(port int) Environment {
+		reg, err := dnsregistry.NewDNSRegistryFromResolver(
+			resolver, "test", dnsregistry.DNSRegistryOptions{ResolveEvery: 10 * time.Millisecond})
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, reg.Close(context.Background())) })
+
+		opts := defaultOptsGoByte
+		opts.Discovery.Port = port
+		env, err := NewEnvironment(
+			ctx, dnsregistry.DNSServerID, reg, registry.NewNoopModuleStore(), nil, opts)
+		require.NoError(t, err)
+		t.Cleanup(func() { noErrIgnoreDupeClose(t, env.Close(context.Background())) })
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+		return env
+	}
+	env1, env2 := newEnv(1), newEnv(2)
+
+	// Only env1 is in the ring so all the actors should be activated there.
+	for i := 0; i < numActor; i++ {
+		_, err := env2.InvokeActor(ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, numActor, env1.NumActivatedActors())
+	require.Equal(t, 0, env2.NumActivatedActors())
+
+	// Add env2 to the ring and wait for env1 to hand off the actors it no longer owns. The
+	// actors must not be invoked until the handoff completes, otherwise they'd be activated
+	// on env2 before their snapshot arrives and the snapshot would be rejected.
+	resolver.setPorts(1, 2)
+	for env1.NumActivatedActors() == numActor || isHandoffRunning(env1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Every actor should retain its state, and should only be activated once.
+	for i := 0; i < numActor; i++ {
+		result, err := env1.InvokeActor(ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+	}
+	require.Equal(t, numActor, env1.NumActivatedActors()+env2.NumActivatedActors())
+	require.True(t, env2.NumActivatedActors() > 0)
+}
+
+func isHandoffRunning(env Environment) bool {
+	e := env.(*environment)
+	e.handoffState.Lock()
+	defer e.handoffState.Unlock()
+	return e.handoffState.running
+}
+
+// TestReservedOperations tests that the operations which are reserved for the host can't
+// be invoked through the public APIs, and that actors can only be hydrated from a snapshot
+// before they're invoked.
+func TestReservedOperations(t *testing.T) {
+	testFn := func(t *testing.T, reg registry.Registry, env Environment) {
+		ctx := context.Background()
+		_, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+
+		for _, operation := range []string{
+			wapcutils.StartupOperationName,
+			wapcutils.ShutdownOperationName,
+			wapcutils.HydrateOperationName,
+			wapcutils.MigrateOperationName,
+		} {
+			_, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", operation, []byte("100"), types.CreateIfNotExist{})
+			require.Error(t, err)
+			_, err = env.InvokeWorker(ctx, "ns-1", "test-module", operation, []byte("100"), types.CreateIfNotExist{})
+			require.Error(t, err)
+		}
+
+		hydrate := func(actorID string, snapshot string) error {
+			result, err := reg.EnsureActivation(ctx, registry.EnsureActivationRequest{
+				Namespace: "ns-1",
+				ModuleID:  "test-module",
+				ActorID:   actorID,
+			})
+			require.NoError(t, err)
+			vs, err := reg.GetVersionStamp(ctx)
+			require.NoError(t, err)
+
+			ref := result.References[0]
+			_, err = env.InvokeActorDirect(
+				ctx, vs, ref.Physical.ServerID, ref.Physical.ServerVersion, ref.Virtual,
+				wapcutils.HydrateOperationName, []byte(snapshot), types.CreateIfNotExist{})
+			return err
+		}
+
+		// The actor was invoked already so the snapshot could be older than its state.
+		require.Error(t, hydrate("a", "100"))
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+
+		// Fresh activations can be hydrated, but only once.
+		require.NoError(t, hydrate("b", "100"))
+		require.Error(t, hydrate("b", "200"))
+		result, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(100), getCount(t, result))
+	}
+
+	runWithDifferentConfigs(t, testFn, nil, true, true, testGCActorsAfterDurationWithNoInvocations)
+}
+
+// TestMigrateActor tests that actors can be migrated to a specific server manually and
+// that their state is transferred to the target server.
+func TestMigrateActor(t *testing.T) {
+	runThreeEnvironmentsWithDifferentConfigs(t,
+		func(t *testing.T, reg registry.Registry, env1, env2, env3 Environment) {
+			testMigrateActor(t, env1, env2, env3)
+		})
+}
+
+func testMigrateActor(t *testing.T, env1, env2, env3 Environment) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+
+	var (
+		envs     = []Environment{env1, env2, env3}
+		from, to = -1, -1
+	)
+	for i, env := range envs {
+		if env.NumActivatedActors() == 1 {
+			from = i
+		}
+	}
+	require.NotEqual(t, -1, from)
+	to = (from + 1) % len(envs)
+
+	require.NoError(t, env1.MigrateActor(
+		ctx, "ns-1", "a", "test-module", fmt.Sprintf("serverID%d", to+1)))
+	require.Equal(t, 0, envs[from].NumActivatedActors())
+
+	// The actor should retain its state and be activated on the target server only,
+	// regardless of which environment it's invoked from.
+	for _, env := range envs {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(3), getCount(t, result))
+	}
+	require.Equal(t, 1, envs[to].NumActivatedActors())
+	require.Equal(t, 1, env1.NumActivatedActors()+env2.NumActivatedActors()+env3.NumActivatedActors())
+
+	// Migrating the actor back should work too, even though the original server handed it
+	// off recently.
+	require.NoError(t, env1.MigrateActor(
+		ctx, "ns-1", "a", "test-module", fmt.Sprintf("serverID%d", from+1)))
+	result, err := env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), getCount(t, result))
+	require.Equal(t, 1, envs[from].NumActivatedActors())
+	require.Equal(t, 0, envs[to].NumActivatedActors())
+
+	require.Error(t, env1.MigrateActor(ctx, "ns-1", "a", "test-module", "unknown-server"))
+
+	// Migrating an actor that doesn't exist fails instead of creating it.
+	err = env1.MigrateActor(
+		ctx, "ns-1", "does-not-exist", "test-module", fmt.Sprintf("serverID%d", to+1))
+	require.True(t, registry.IsActorNotFoundError(err))
+	require.Equal(t, 404, statusCodeForError(err))
+	require.Equal(t, 1, env1.NumActivatedActors()+env2.NumActivatedActors()+env3.NumActivatedActors())
+}
+
+// testResolver is a dnsregistry.DNSResolver that resolves to localhost on a configurable
+// set of ports.
+type testResolver struct {
+	sync.Mutex
+	addresses []registry.Address
+}
+
+func (r *testResolver) setPorts(ports ...int) {
+	r.Lock()
+	defer r.Unlock()
+	r.addresses = nil
+	for _, port := range ports {
+		r.addresses = append(r.addresses, registry.Address{IP: net.ParseIP(Localhost), Port: port})
+	}
+}
+
+func (r *testResolver) LookupIP(host string) ([]registry.Address, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.addresses, nil
+}
+
 // TestHeartbeatAndRebalancingWithMemory tests that the interaction between the environment
 // heartbeating mechanism and the registry load balancing mechanism is able to effectively
 // rebalance actors across the available nodes based on memory usage.
@@ -778,9 +1064,14 @@ func TestServerVersionIsHonored(t *testing.T) {
 	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
 	require.NoError(t, err)
 
+	// Stop watching the registry to simulate the activation cache missing the notification
+	// that the server died (watch delivery is best effort) so the cache continues routing
+	// to the stale server version and the server has to reject the invocation itself.
+	env.(*environment).stopWatchingRegistry()
+
 	env.pauseHeartbeat()
 
-	time.Sleep(registry.HeartbeatTTL + time.Second)
+	time.Sleep(registry.DefaultHeartbeatTTL + time.Second)
 
 	env.resumeHeartbeat()
 
@@ -790,6 +1081,134 @@ func TestServerVersionIsHonored(t *testing.T) {
 	require.True(
 		t,
 		strings.Contains(err.Error(), "server version(2) != server version from reference(1)"))
+	require.True(t, IsStaleActivationError(err))
+
+	// The stale activation is re-resolved through the registry when the invocation is
+	// retried.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{
+		Options: types.ActorOptions{RetryPolicy: types.RetryPolicy{MaxNumRetries: 1}},
+	})
+	require.NoError(t, err)
+}
+
+// TestClusterHeartbeatSettings ensures that environments adopt the heartbeat settings
+// stored in the registry.
+func TestClusterHeartbeatSettings(t *testing.T) {
+	var (
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		ctx         = context.Background()
+	)
+
+	env, err := NewEnvironment(ctx, "serverID1", reg, moduleStore, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer func() { noErrIgnoreDupeClose(t, env.Close(context.Background())) }()
+
+	ttl, interval := env.(*environment).heartbeatSettings()
+	require.Equal(t, registry.DefaultHeartbeatTTL, ttl)
+	require.Equal(t, registry.DefaultHeartbeatInterval, interval)
+
+	newSettings := registry.ClusterSettings{
+		HeartbeatTTL:      2 * time.Second,
+		HeartbeatInterval: 200 * time.Millisecond,
+	}
+	require.NoError(t, reg.SetClusterSettings(ctx, newSettings))
+
+	// The environment should pick up the new settings with its next heartbeat.
+	require.Eventually(t, func() bool {
+		ttl, interval := env.(*environment).heartbeatSettings()
+		return ttl == newSettings.HeartbeatTTL && interval == newSettings.HeartbeatInterval
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// And heartbeat at the new interval, which is much faster than the default one.
+	getLastHeartbeat := func() int64 {
+		e := env.(*environment)
+		e.heartbeatState.RLock()
+		defer e.heartbeatState.RUnlock()
+		return e.heartbeatState.VersionStamp
+	}
+	seen := map[int64]struct{}{}
+	for start := time.Now(); time.Since(start) < 1500*time.Millisecond; {
+		seen[getLastHeartbeat()] = struct{}{}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.GreaterOrEqual(t, len(seen), 5)
+}
+
+// TestNamespaceLimits tests that the environment enforces the namespace limits that it
+// receives from the registry in heartbeats.
+func TestNamespaceLimits(t *testing.T) {
+	var (
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		ctx         = context.Background()
+	)
+	defer reg.Close(ctx)
+
+	env, err := NewEnvironment(ctx, "serverID1", reg, moduleStore, nil, defaultOptsGoByte)
+	require.NoError(t, err)
+	defer func() { noErrIgnoreDupeClose(t, env.Close(context.Background())) }()
+	for _, namespace := range []string{"ns-1", "ns-2"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: namespace, ID: "test-module"}, testModule{}))
+	}
+
+	setLimits := func(limits registry.NamespaceLimits) {
+		require.NoError(t, reg.SetNamespaceLimits(ctx, "ns-1", limits))
+		require.NoError(t, env.Heartbeat())
+	}
+	invoke := func(namespace, actorID, operation string, payload []byte) error {
+		_, err := env.InvokeActor(
+			ctx, namespace, actorID, "test-module", operation, payload, types.CreateIfNotExist{})
+		return err
+	}
+
+	// Once the namespace's actors use all of the memory, no more can be activated.
+	setLimits(registry.NamespaceLimits{MaxActivatedMemoryBytes: 100})
+	require.NoError(t, invoke("ns-1", "a-0", "setMemoryUsage", []byte("100")))
+	err = invoke("ns-1", "a-1", "inc", nil)
+	require.Error(t, err)
+	require.True(t, registry.IsNamespaceLimitExceededError(err))
+	require.Equal(t, 429, statusCodeForError(err))
+	// Activated actors can still be invoked and other namespaces are not affected.
+	require.NoError(t, invoke("ns-1", "a-0", "inc", nil))
+	require.NoError(t, invoke("ns-2", "a-1", "inc", nil))
+	// Freeing up memory allows more actors to be activated.
+	require.NoError(t, invoke("ns-1", "a-0", "setMemoryUsage", []byte("50")))
+	require.NoError(t, invoke("ns-1", "a-1", "inc", nil))
+
+	// Invocations beyond the rate limit are rejected until the rate allows more.
+	setLimits(registry.NamespaceLimits{MaxInvocationsPerSecond: 5})
+	for i := 0; i < 5; i++ {
+		require.NoError(t, invoke("ns-1", "a-0", "inc", nil))
+	}
+	err = invoke("ns-1", "a-0", "inc", nil)
+	require.Error(t, err)
+	require.True(t, registry.IsNamespaceLimitExceededError(err))
+	require.NoError(t, invoke("ns-2", "a-0", "inc", nil))
+	require.Eventually(t, func() bool {
+		return invoke("ns-1", "a-0", "inc", nil) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// The limits apply to the whole cluster so each server only enforces its share of
+	// them once other servers join.
+	require.NoError(t, reg.SetNamespaceLimits(
+		ctx, "ns-2", registry.NamespaceLimits{MaxInvocationsPerSecond: 10}))
+	_, err = reg.Heartbeat(ctx, "serverID2", registry.HeartbeatState{Address: "127.0.0.1:1"})
+	require.NoError(t, err)
+	require.NoError(t, env.Heartbeat())
+	for i := 0; i < 5; i++ {
+		require.NoError(t, invoke("ns-2", "a-0", "inc", nil))
+	}
+	err = invoke("ns-2", "a-0", "inc", nil)
+	require.Error(t, err)
+	require.True(t, registry.IsNamespaceLimitExceededError(err))
+
+	// Removing the limits stops enforcing them.
+	setLimits(registry.NamespaceLimits{})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, invoke("ns-1", "a-0", "inc", nil))
+	}
 }
 
 var (
@@ -1133,13 +1552,55 @@ func (ta *testActor) Invoke(
 			return nil, err
 		}
 		return ta.host.InvokeActor(ctx, req)
+	case "invokeActorAsync":
+		var req types.InvokeActorRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		return nil, ta.host.InvokeActorAsync(ctx, req)
+	case "registerReminder":
+		var req types.Reminder
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		return nil, ta.host.RegisterReminder(ctx, req)
+	case "unregisterReminder":
+		return nil, ta.host.UnregisterReminder(ctx, string(payload))
+	case "listReminders":
+		reminders, err := ta.host.ListReminders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(reminders)
 	case "scheduleSelfTimer":
 		var req wapcutils.ScheduleSelfTimer
 		if err := json.Unmarshal(payload, &req); err != nil {
 			return nil, err
 		}
-		err := ta.host.ScheduleSelfTimer(ctx, req)
-		return nil, err
+		timerID, err := ta.host.ScheduleSelfTimer(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(wapcutils.ScheduleSelfTimerResult{TimerID: timerID})
+	case "cancelSelfTimer":
+		var req wapcutils.CancelSelfTimer
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		return nil, ta.host.CancelSelfTimer(ctx, req.TimerID)
+	case "listSelfTimers":
+		timers, err := ta.host.ListSelfTimers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(timers)
+	case "sleep":
+		sleepMillis, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing sleep duration in payload: %w", err)
+		}
+		time.Sleep(time.Duration(sleepMillis) * time.Millisecond)
+		return nil, nil
 	case "invokeCustomHostFn":
 		return ta.host.CustomFn(ctx, string(payload), payload)
 	case "setMemoryUsage":
@@ -1154,6 +1615,19 @@ func (ta *testActor) Invoke(
 	}
 }
 
+func (ta *testActor) Snapshot(ctx context.Context) ([]byte, error) {
+	return []byte(strconv.Itoa(ta.count)), nil
+}
+
+func (ta *testActor) Hydrate(ctx context.Context, snapshot []byte) error {
+	count, err := strconv.Atoi(string(snapshot))
+	if err != nil {
+		return fmt.Errorf("error parsing count in snapshot: %w", err)
+	}
+	ta.count = count
+	return nil
+}
+
 func (ta testActor) Close(ctx context.Context) error {
 	return nil
 }
@@ -1204,6 +1678,14 @@ func (ta *testStreamActor) InvokeStream(
 	return io.NopCloser(bytes.NewBuffer(resp)), nil
 }
 
+func (ta *testStreamActor) Snapshot(ctx context.Context) ([]byte, error) {
+	return ta.a.(ActorSnapshotter).Snapshot(ctx)
+}
+
+func (ta *testStreamActor) Hydrate(ctx context.Context, snapshot []byte) error {
+	return ta.a.(ActorSnapshotter).Hydrate(ctx, snapshot)
+}
+
 func (ta *testStreamActor) Close(ctx context.Context) error {
 	return nil
 }
@@ -4,15 +4,45 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+
+	"github.com/richardartoul/nola/virtual/registry"
 )
 
 var (
 	statusCodeToErrorWrapper = map[int]func(err error, serverID []string) error{
+		401: func(err error, _ []string) error {
+			return NewUnauthenticatedError(err)
+		},
 		410: NewBlacklistedActivationError,
+		409: func(err error, _ []string) error {
+			return NewStaleActivationError(err)
+		},
+		421: NewActorNotOwnedError,
+		422: func(err error, _ []string) error {
+			return NewIdempotencyKeyMismatchError(err)
+		},
+		429: func(err error, _ []string) error {
+			return registry.NewNamespaceLimitExceededError(err)
+		},
+		503: func(err error, _ []string) error {
+			return NewMailboxFullError(err)
+		},
+		508: func(err error, _ []string) error {
+			return NewDeadlockError(err)
+		},
 	}
 
 	// Make sure it implements interface.
 	_ HTTPError = NewBlacklistedActivationError(errors.New("n/a"), []string{"n/a"}).(HTTPError)
+	_ HTTPError = NewActorNotOwnedError(errors.New("n/a"), []string{"n/a"}).(HTTPError)
+	_ HTTPError = NewUnauthenticatedError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = NewPermissionDeniedError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = registry.NewNamespaceLimitExceededError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = registry.NewActorNotFoundError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = NewMailboxFullError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = NewDeadlockError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = NewIdempotencyKeyMismatchError(errors.New("n/a")).(HTTPError)
+	_ HTTPError = NewStaleActivationError(errors.New("n/a")).(HTTPError)
 )
 
 // HTTPError is the interface implemented by errors that map to a specific
@@ -69,3 +99,267 @@ func (b BlacklistedActivationErr) ServerIDs() []string {
 func IsBlacklistedActivationError(err error) bool {
 	return errors.Is(err, BlacklistedActivationErr{})
 }
+
+// ActorNotOwnedErr indicates that the server that received the invocation used to
+// host the actor, but no longer "owns" it because cluster membership changed and
+// the actor is in the process of being handed off to a different server. It is a
+// retryable error, the caller should resolve the actor's location again and retry.
+type ActorNotOwnedErr struct {
+	err       error
+	serverIDs []string
+}
+
+// NewActorNotOwnedError creates a new ActorNotOwnedErr.
+func NewActorNotOwnedError(err error, serverIDs []string) error {
+	if len(serverIDs) <= 0 {
+		panic("[invariant violated] serverID cannot be empty")
+	}
+	return ActorNotOwnedErr{err: err, serverIDs: serverIDs}
+}
+
+func (a ActorNotOwnedErr) Error() string {
+	return fmt.Sprintf(
+		"ActorNotOwnedError(ServerID:%s): %s",
+		a.serverIDs, a.err.Error())
+}
+
+func (a ActorNotOwnedErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*ActorNotOwnedErr)
+	_, ok2 := target.(ActorNotOwnedErr)
+	return ok1 || ok2
+}
+
+func (a ActorNotOwnedErr) HTTPStatusCode() int {
+	return http.StatusMisdirectedRequest
+}
+
+func (a ActorNotOwnedErr) ServerIDs() []string {
+	return a.serverIDs
+}
+
+// IsActorNotOwnedError returns a boolean indicating whether the error was caused
+// by the actor being handed off from the server to a different one.
+func IsActorNotOwnedError(err error) bool {
+	return errors.Is(err, ActorNotOwnedErr{})
+}
+
+// UnauthenticatedErr indicates that the request did not contain valid credentials (see
+// Authenticator).
+type UnauthenticatedErr struct {
+	err error
+}
+
+// NewUnauthenticatedError creates a new UnauthenticatedErr.
+func NewUnauthenticatedError(err error) error {
+	return UnauthenticatedErr{err: err}
+}
+
+func (u UnauthenticatedErr) Error() string {
+	return fmt.Sprintf("UnauthenticatedError: %s", u.err.Error())
+}
+
+func (u UnauthenticatedErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*UnauthenticatedErr)
+	_, ok2 := target.(UnauthenticatedErr)
+	return ok1 || ok2
+}
+
+func (u UnauthenticatedErr) HTTPStatusCode() int {
+	return http.StatusUnauthorized
+}
+
+// IsUnauthenticatedError returns a boolean indicating whether the error was caused by
+// the request not containing valid credentials.
+func IsUnauthenticatedError(err error) bool {
+	return errors.Is(err, UnauthenticatedErr{})
+}
+
+// PermissionDeniedErr indicates that the authenticated principal is not allowed to
+// perform the requested operation (see Authorizer).
+type PermissionDeniedErr struct {
+	err error
+}
+
+// NewPermissionDeniedError creates a new PermissionDeniedErr.
+func NewPermissionDeniedError(err error) error {
+	return PermissionDeniedErr{err: err}
+}
+
+func (p PermissionDeniedErr) Error() string {
+	return fmt.Sprintf("PermissionDeniedError: %s", p.err.Error())
+}
+
+func (p PermissionDeniedErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*PermissionDeniedErr)
+	_, ok2 := target.(PermissionDeniedErr)
+	return ok1 || ok2
+}
+
+func (p PermissionDeniedErr) HTTPStatusCode() int {
+	return http.StatusForbidden
+}
+
+// IsPermissionDeniedError returns a boolean indicating whether the error was caused by
+// the principal not being allowed to perform the operation.
+func IsPermissionDeniedError(err error) bool {
+	return errors.Is(err, PermissionDeniedErr{})
+}
+
+// MailboxFullErr indicates that the invocation was rejected because the actor's mailbox
+// already contains the maximum number of pending invocations (see
+// EnvironmentOptions.MaxActorMailboxDepth). It is a backpressure signal, the caller should
+// back off before retrying.
+type MailboxFullErr struct {
+	err error
+}
+
+// NewMailboxFullError creates a new MailboxFullErr.
+func NewMailboxFullError(err error) error {
+	return MailboxFullErr{err: err}
+}
+
+func (m MailboxFullErr) Error() string {
+	return fmt.Sprintf("MailboxFullError: %s", m.err.Error())
+}
+
+func (m MailboxFullErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*MailboxFullErr)
+	_, ok2 := target.(MailboxFullErr)
+	return ok1 || ok2
+}
+
+func (m MailboxFullErr) HTTPStatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// IsMailboxFullError returns a boolean indicating whether the error was caused by the
+// actor's mailbox being full.
+func IsMailboxFullError(err error) bool {
+	return errors.Is(err, MailboxFullErr{})
+}
+
+// DeadlockErr indicates that the invocation was rejected because it would have deadlocked:
+// the actor is already processing an invocation earlier in the same call chain that is
+// waiting (directly or indirectly) for this invocation to complete, and the actor's module
+// is not reentrant (see registry.ModuleOptions.Reentrant).
+type DeadlockErr struct {
+	err error
+}
+
+// NewDeadlockError creates a new DeadlockErr.
+func NewDeadlockError(err error) error {
+	return DeadlockErr{err: err}
+}
+
+func (d DeadlockErr) Error() string {
+	return fmt.Sprintf("DeadlockError: %s", d.err.Error())
+}
+
+func (d DeadlockErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*DeadlockErr)
+	_, ok2 := target.(DeadlockErr)
+	return ok1 || ok2
+}
+
+func (d DeadlockErr) HTTPStatusCode() int {
+	return http.StatusLoopDetected
+}
+
+// IsDeadlockError returns a boolean indicating whether the error was caused by the
+// invocation looping back to an actor that is waiting on it.
+func IsDeadlockError(err error) bool {
+	return errors.Is(err, DeadlockErr{})
+}
+
+// IdempotencyKeyMismatchErr indicates that the invocation was rejected because its
+// idempotency key was already used by a recent invocation of the actor with a different
+// operation or payload (see WithIdempotencyKey).
+type IdempotencyKeyMismatchErr struct {
+	err error
+}
+
+// NewIdempotencyKeyMismatchError creates a new IdempotencyKeyMismatchErr.
+func NewIdempotencyKeyMismatchError(err error) error {
+	return IdempotencyKeyMismatchErr{err: err}
+}
+
+func (i IdempotencyKeyMismatchErr) Error() string {
+	return fmt.Sprintf("IdempotencyKeyMismatchError: %s", i.err.Error())
+}
+
+func (i IdempotencyKeyMismatchErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*IdempotencyKeyMismatchErr)
+	_, ok2 := target.(IdempotencyKeyMismatchErr)
+	return ok1 || ok2
+}
+
+func (i IdempotencyKeyMismatchErr) HTTPStatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// IsIdempotencyKeyMismatchError returns a boolean indicating whether the error was caused
+// by reusing an idempotency key for a different invocation.
+func IsIdempotencyKeyMismatchError(err error) bool {
+	return errors.Is(err, IdempotencyKeyMismatchErr{})
+}
+
+// StaleActivationErr indicates that the invocation was rejected by the server because the
+// reference it was routed with is stale, for example because the server has restarted
+// since the actor was activated on it or it missed its heartbeats. Retrying the invocation
+// with a reference that is re-resolved through the registry may succeed.
+type StaleActivationErr struct {
+	err error
+}
+
+// NewStaleActivationError creates a new StaleActivationErr.
+func NewStaleActivationError(err error) error {
+	return StaleActivationErr{err: err}
+}
+
+func (s StaleActivationErr) Error() string {
+	return fmt.Sprintf("StaleActivationError: %s", s.err.Error())
+}
+
+func (s StaleActivationErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*StaleActivationErr)
+	_, ok2 := target.(StaleActivationErr)
+	return ok1 || ok2
+}
+
+func (s StaleActivationErr) HTTPStatusCode() int {
+	return http.StatusConflict
+}
+
+// IsStaleActivationError returns a boolean indicating whether the error was caused by
+// routing the invocation with a stale reference.
+func IsStaleActivationError(err error) bool {
+	return errors.Is(err, StaleActivationErr{})
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/richardartoul/nola/virtual/registry"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,3 +26,99 @@ func TestBlacklistedActivationError(t *testing.T) {
 	require.True(t, errors.As(
 		NewBlacklistedActivationError(errors.New("random"), []string{"abc"}), &httpErr))
 }
+
+func TestActorNotOwnedError(t *testing.T) {
+	require.False(t, errors.Is(errors.New("random"), &ActorNotOwnedErr{}))
+	require.False(t, IsActorNotOwnedError(errors.New("random")))
+	require.False(t, IsActorNotOwnedError(NewBlacklistedActivationError(errors.New("random"), []string{"abc"})))
+	require.False(t, IsBlacklistedActivationError(NewActorNotOwnedError(errors.New("random"), []string{"abc"})))
+
+	require.True(t, errors.Is(NewActorNotOwnedError(errors.New("random"), []string{"abc"}), &ActorNotOwnedErr{}))
+	require.True(t, IsActorNotOwnedError(NewActorNotOwnedError(errors.New("random"), []string{"abc"})))
+	require.True(t, IsActorNotOwnedError(fmt.Errorf("wrapped: %w", NewActorNotOwnedError(errors.New("random"), []string{"abc"}))))
+
+	var httpErr HTTPError
+	require.True(t, errors.As(
+		NewActorNotOwnedError(errors.New("random"), []string{"abc"}), &httpErr))
+	require.Equal(t, 421, httpErr.HTTPStatusCode())
+}
+
+func TestAuthErrors(t *testing.T) {
+	require.False(t, IsUnauthenticatedError(errors.New("random")))
+	require.False(t, IsPermissionDeniedError(errors.New("random")))
+	require.False(t, IsUnauthenticatedError(NewPermissionDeniedError(errors.New("random"))))
+	require.False(t, IsPermissionDeniedError(NewUnauthenticatedError(errors.New("random"))))
+
+	require.True(t, IsUnauthenticatedError(fmt.Errorf("wrapped: %w", NewUnauthenticatedError(errors.New("random")))))
+	require.True(t, IsPermissionDeniedError(fmt.Errorf("wrapped: %w", NewPermissionDeniedError(errors.New("random")))))
+
+	var httpErr HTTPError
+	require.True(t, errors.As(NewUnauthenticatedError(errors.New("random")), &httpErr))
+	require.Equal(t, 401, httpErr.HTTPStatusCode())
+	// Peers that present an invalid peer token receive the error as well.
+	require.True(t, IsUnauthenticatedError(
+		statusCodeToErrorWrapper[httpErr.HTTPStatusCode()](errors.New("random"), nil)))
+	require.True(t, errors.As(NewPermissionDeniedError(errors.New("random")), &httpErr))
+	require.Equal(t, 403, httpErr.HTTPStatusCode())
+}
+
+func TestNamespaceLimitExceededError(t *testing.T) {
+	require.False(t, registry.IsNamespaceLimitExceededError(errors.New("random")))
+	require.True(t, registry.IsNamespaceLimitExceededError(
+		fmt.Errorf("wrapped: %w", registry.NewNamespaceLimitExceededError(errors.New("random")))))
+
+	err := fmt.Errorf("wrapped: %w", registry.NewNamespaceLimitExceededError(errors.New("random")))
+	require.Equal(t, 429, statusCodeForError(err))
+
+	// Make sure the error is converted back when it's received by a client.
+	require.True(t, registry.IsNamespaceLimitExceededError(
+		statusCodeToErrorWrapper[statusCodeForError(err)](errors.New("random"), nil)))
+}
+
+func TestMailboxFullError(t *testing.T) {
+	require.False(t, IsMailboxFullError(errors.New("random")))
+
+	err := fmt.Errorf("wrapped: %w", NewMailboxFullError(errors.New("random")))
+	require.True(t, IsMailboxFullError(err))
+	require.Equal(t, 503, statusCodeForError(err))
+
+	// Make sure the error is converted back when it's received by a client.
+	require.True(t, IsMailboxFullError(
+		statusCodeToErrorWrapper[statusCodeForError(err)](errors.New("random"), nil)))
+}
+
+func TestDeadlockError(t *testing.T) {
+	require.False(t, IsDeadlockError(errors.New("random")))
+
+	err := fmt.Errorf("wrapped: %w", NewDeadlockError(errors.New("random")))
+	require.True(t, IsDeadlockError(err))
+	require.Equal(t, 508, statusCodeForError(err))
+
+	// Make sure the error is converted back when it's received by a client.
+	require.True(t, IsDeadlockError(
+		statusCodeToErrorWrapper[statusCodeForError(err)](errors.New("random"), nil)))
+}
+
+func TestIdempotencyKeyMismatchError(t *testing.T) {
+	require.False(t, IsIdempotencyKeyMismatchError(errors.New("random")))
+
+	err := fmt.Errorf("wrapped: %w", NewIdempotencyKeyMismatchError(errors.New("random")))
+	require.True(t, IsIdempotencyKeyMismatchError(err))
+	require.Equal(t, 422, statusCodeForError(err))
+
+	// Make sure the error is converted back when it's received by a client.
+	require.True(t, IsIdempotencyKeyMismatchError(
+		statusCodeToErrorWrapper[statusCodeForError(err)](errors.New("random"), nil)))
+}
+
+func TestStaleActivationError(t *testing.T) {
+	require.False(t, IsStaleActivationError(errors.New("random")))
+
+	err := fmt.Errorf("wrapped: %w", NewStaleActivationError(errors.New("random")))
+	require.True(t, IsStaleActivationError(err))
+	require.Equal(t, 409, statusCodeForError(err))
+
+	// Make sure the error is converted back when it's received by a client.
+	require.True(t, IsStaleActivationError(
+		statusCodeToErrorWrapper[statusCodeForError(err)](errors.New("random"), nil)))
+}
@@ -19,6 +19,7 @@ type hostCapabilities struct {
 	activations      *activations
 	customHostFns    map[string]func([]byte) ([]byte, error)
 	reference        types.ActorReferenceVirtual
+	timers           *actorTimers
 	getServerStateFn func() (string, int64)
 }
 
@@ -29,6 +30,7 @@ func newHostCapabilities(
 	activations *activations,
 	customHostFns map[string]func([]byte) ([]byte, error),
 	reference types.ActorReferenceVirtual,
+	timers *actorTimers,
 	getServerStateFn func() (string, int64),
 ) HostCapabilities {
 	return &hostCapabilities{
@@ -38,6 +40,7 @@ func newHostCapabilities(
 		activations:      activations,
 		customHostFns:    customHostFns,
 		reference:        reference,
+		timers:           timers,
 		getServerStateFn: getServerStateFn,
 	}
 }
@@ -46,31 +49,50 @@ func (h *hostCapabilities) InvokeActor(
 	ctx context.Context,
 	req types.InvokeActorRequest,
 ) ([]byte, error) {
+	if req.IdempotencyKey != "" {
+		ctx = WithIdempotencyKey(ctx, req.IdempotencyKey)
+	}
 	return h.env.InvokeActor(
 		ctx, h.reference.Namespace, req.ActorID, req.ModuleID,
 		req.Operation, req.Payload, req.CreateIfNotExist)
 }
 
+func (h *hostCapabilities) InvokeActorAsync(
+	ctx context.Context,
+	req types.InvokeActorRequest,
+) error {
+	return h.env.InvokeActorAsync(
+		ctx, h.reference.Namespace, req.ActorID, req.ModuleID,
+		req.Operation, req.Payload, req.CreateIfNotExist)
+}
+
 func (h *hostCapabilities) ScheduleSelfTimer(
 	ctx context.Context,
 	req wapcutils.ScheduleSelfTimer,
-) error {
+) (string, error) {
+	if req.Operation == "" {
+		return "", fmt.Errorf("cant schedule self timer with empty operation name")
+	}
+	if req.AfterMillis < 0 {
+		// 0 is allowed and fires the timer as soon as possible (but never as part of the
+		// current invocation).
+		return "", fmt.Errorf("cant schedule self timer with AfterMillis < 0")
+	}
+
 	// Copy the payload to make sure its safe to retain across invocations.
 	payloadCopy := make([]byte, len(req.Payload))
 	copy(payloadCopy, req.Payload)
 
-	// TODO: When the actor gets GC'd this timer won't get GC'd with it. We
-	// should keep track of all outstanding timers with the instantiation and
-	// terminate them if the actor is killed, but its fine for now.
-	time.AfterFunc(time.Duration(req.AfterMillis)*time.Millisecond, func() {
+	// The timer is tracked with the actor's activation so that it is stopped if the actor
+	// is closed (for example because it was GC'd) before the timer fires.
+	after := time.Duration(req.AfterMillis) * time.Millisecond
+	return h.timers.schedule(req.Operation, after, func() {
 		reader, err := h.activations.invoke(
 			context.Background(), h.reference, req.Operation, nil, payloadCopy, true)
 		if err == nil {
 			// This is weird, but the reader can be nil in the case where the actor the timer is
-			// associated with is no longer activated in memory anymore.
-			//
-			// TestScheduleSelfTimersAndGC intentionally triggers this behavior to ensure that timers
-			// never trigger reactivation of deactivated actors.
+			// associated with was deactivated right as the timer fired. Timers never trigger
+			// reactivation of deactivated actors.
 			if reader != nil {
 				defer reader.Close()
 			}
@@ -79,10 +101,45 @@ func (h *hostCapabilities) ScheduleSelfTimer(
 			h.log.Error("error firing timer for actor", slog.Any("actor", h.reference), slog.Any("error", err))
 		}
 	})
+}
 
+func (h *hostCapabilities) CancelSelfTimer(
+	ctx context.Context,
+	timerID string,
+) error {
+	h.timers.cancel(timerID)
 	return nil
 }
 
+func (h *hostCapabilities) ListSelfTimers(
+	ctx context.Context,
+) ([]wapcutils.SelfTimer, error) {
+	return h.timers.list(), nil
+}
+
+func (h *hostCapabilities) RegisterReminder(
+	ctx context.Context,
+	reminder types.Reminder,
+) error {
+	return h.env.RegisterReminder(
+		ctx, h.reference.Namespace, h.reference.ActorID, h.reference.ModuleID, reminder)
+}
+
+func (h *hostCapabilities) UnregisterReminder(
+	ctx context.Context,
+	name string,
+) error {
+	return h.env.UnregisterReminder(
+		ctx, h.reference.Namespace, h.reference.ActorID, h.reference.ModuleID, name)
+}
+
+func (h *hostCapabilities) ListReminders(
+	ctx context.Context,
+) ([]types.Reminder, error) {
+	return h.env.ListReminders(
+		ctx, h.reference.Namespace, h.reference.ActorID, h.reference.ModuleID)
+}
+
 func (h *hostCapabilities) CustomFn(
 	ctx context.Context,
 	operation string,
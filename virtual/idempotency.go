@@ -0,0 +1,159 @@
+package virtual
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type idempotencyKeyCtxKey struct{}
+
+// WithIdempotencyKey returns a copy of ctx that attaches the idempotency key to the actor
+// invocations that are made with it (InvokeActor and InvokeActorStream). The activation of
+// the actor remembers the responses of its recent successful invocations by idempotency key
+// (see EnvironmentOptions.IdempotencyKeyTTL) so that retrying an invocation with the same key
+// returns the original response instead of executing the operation again. Reusing a key for
+// a different operation or payload fails with an IdempotencyKeyMismatchErr.
+//
+// Keys are scoped to the actor and only remembered in memory by its current activation, so
+// they're forgotten if the actor is GC'd, handed off to a different server or the server
+// dies. Failed invocations are not remembered so they can be retried with the same key.
+// Invocations with a key are never hedged to another replica (see
+// RetryPolicy.HedgeAfterPercentile) since the replicas don't share their responses.
+// The actors that the invoked actor invokes in turn do not inherit the key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, key)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyCtxKey{}).(string)
+	return key
+}
+
+// idempotentResponseOverheadBytes approximates the memory used by each recorded response
+// in addition to its key, operation and response bytes.
+const idempotentResponseOverheadBytes = 128
+
+// idempotentResponses remembers the responses of an actor's recent invocations by their
+// idempotency key. Responses expire after ttl, and the oldest responses are evicted once
+// there are more than maxKeys of them or they use more than maxBytes of memory.
+type idempotentResponses struct {
+	sync.Mutex
+
+	ttl      time.Duration
+	maxKeys  int
+	maxBytes int
+
+	// Allocated lazily since most actors are never invoked with idempotency keys.
+	_byKey map[string]*list.Element
+	// _byAge contains *idempotentResponse ordered from oldest to newest.
+	_byAge *list.List
+	// _numBytes is the sum of the sizes of the recorded responses.
+	_numBytes int
+}
+
+type idempotentResponse struct {
+	key         string
+	operation   string
+	payloadHash [sha256.Size]byte
+	response    []byte
+	recordedAt  time.Time
+}
+
+func (r *idempotentResponse) sizeBytes() int {
+	return len(r.key) + len(r.operation) + len(r.response) + idempotentResponseOverheadBytes
+}
+
+func newIdempotentResponses(ttl time.Duration, maxKeys, maxBytes int) *idempotentResponses {
+	return &idempotentResponses{ttl: ttl, maxKeys: maxKeys, maxBytes: maxBytes}
+}
+
+// get returns the response that was recorded for key, or false if there is none. It returns
+// an IdempotencyKeyMismatchErr if the response was recorded for a different operation or
+// payload.
+func (r *idempotentResponses) get(key, operation string, payload []byte) ([]byte, bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expireWithLock(time.Now())
+	elem, ok := r._byKey[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	recorded := elem.Value.(*idempotentResponse)
+	if recorded.operation != operation || recorded.payloadHash != sha256.Sum256(payload) {
+		return nil, false, NewIdempotencyKeyMismatchError(fmt.Errorf(
+			"idempotency key: %s was already used for a different invocation of operation: %s",
+			key, recorded.operation))
+	}
+	return recorded.response, true, nil
+}
+
+// record records the response of the invocation with the provided idempotency key.
+// Responses that are larger than maxBytes on their own are not recorded, so retrying
+// their invocation executes the operation again.
+func (r *idempotentResponses) record(key, operation string, payload []byte, response []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r._byKey == nil {
+		r._byKey = make(map[string]*list.Element)
+		r._byAge = list.New()
+	}
+	if elem, ok := r._byKey[key]; ok {
+		// Only possible if invocations with the same key ran concurrently (because the
+		// operation is read-only), the first response wins.
+		r._byAge.MoveToBack(elem)
+		return
+	}
+
+	now := time.Now()
+	recorded := &idempotentResponse{
+		key:         key,
+		operation:   operation,
+		payloadHash: sha256.Sum256(payload),
+		response:    response,
+		recordedAt:  now,
+	}
+	if recorded.sizeBytes() > r.maxBytes {
+		return
+	}
+	r._byKey[key] = r._byAge.PushBack(recorded)
+	r._numBytes += recorded.sizeBytes()
+	r.expireWithLock(now)
+	for r._byAge.Len() > r.maxKeys || r._numBytes > r.maxBytes {
+		r.removeWithLock(r._byAge.Front())
+	}
+}
+
+// memUsageBytes returns the memory used by the recorded responses that haven't expired.
+func (r *idempotentResponses) memUsageBytes() int {
+	r.Lock()
+	defer r.Unlock()
+
+	r.expireWithLock(time.Now())
+	return r._numBytes
+}
+
+func (r *idempotentResponses) expireWithLock(now time.Time) {
+	if r._byAge == nil {
+		return
+	}
+	for elem := r._byAge.Front(); elem != nil; elem = r._byAge.Front() {
+		if now.Sub(elem.Value.(*idempotentResponse).recordedAt) < r.ttl {
+			return
+		}
+		r.removeWithLock(elem)
+	}
+}
+
+func (r *idempotentResponses) removeWithLock(elem *list.Element) {
+	recorded := elem.Value.(*idempotentResponse)
+	r._byAge.Remove(elem)
+	delete(r._byKey, recorded.key)
+	r._numBytes -= recorded.sizeBytes()
+}
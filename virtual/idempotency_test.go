@@ -0,0 +1,156 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentResponses(t *testing.T) {
+	r := newIdempotentResponses(time.Hour, 2, 1<<20)
+
+	_, ok, err := r.get("a", "inc", nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	r.record("a", "inc", []byte("payload"), []byte("1"))
+	resp, ok, err := r.get("a", "inc", []byte("payload"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), resp)
+
+	// The key can't be reused for a different invocation.
+	_, _, err = r.get("a", "getCount", []byte("payload"))
+	require.True(t, IsIdempotencyKeyMismatchError(err))
+	_, _, err = r.get("a", "inc", []byte("other-payload"))
+	require.True(t, IsIdempotencyKeyMismatchError(err))
+
+	// The oldest responses are evicted first.
+	r.record("b", "inc", nil, []byte("2"))
+	r.record("c", "inc", nil, []byte("3"))
+	_, ok, _ = r.get("a", "inc", []byte("payload"))
+	require.False(t, ok)
+	for _, key := range []string{"b", "c"} {
+		_, ok, _ = r.get(key, "inc", nil)
+		require.True(t, ok, key)
+	}
+
+	// Responses expire after the TTL.
+	r = newIdempotentResponses(time.Millisecond, 2, 1<<20)
+	r.record("a", "inc", nil, []byte("1"))
+	time.Sleep(10 * time.Millisecond)
+	_, ok, _ = r.get("a", "inc", nil)
+	require.False(t, ok)
+	require.Equal(t, 0, r.memUsageBytes())
+}
+
+func TestIdempotentResponsesMaxBytes(t *testing.T) {
+	var (
+		responseSize = 1000
+		entrySize    = len("a") + len("inc") + responseSize + idempotentResponseOverheadBytes
+		r            = newIdempotentResponses(time.Hour, 100, 2*entrySize)
+		response     = make([]byte, responseSize)
+	)
+
+	r.record("a", "inc", nil, response)
+	r.record("b", "inc", nil, response)
+	require.Equal(t, 2*entrySize, r.memUsageBytes())
+
+	// The oldest responses are evicted once the limit is exceeded.
+	r.record("c", "inc", nil, response)
+	require.Equal(t, 2*entrySize, r.memUsageBytes())
+	_, ok, _ := r.get("a", "inc", nil)
+	require.False(t, ok)
+	for _, key := range []string{"b", "c"} {
+		_, ok, _ = r.get(key, "inc", nil)
+		require.True(t, ok, key)
+	}
+
+	// Responses that exceed the limit on their own are not recorded, and don't evict the
+	// others.
+	r.record("d", "inc", nil, make([]byte, 2*entrySize))
+	_, ok, _ = r.get("d", "inc", nil)
+	require.False(t, ok)
+	require.Equal(t, 2*entrySize, r.memUsageBytes())
+}
+
+// TestIdempotencyKeys tests that retrying an invocation with the same idempotency key
+// returns the original response instead of invoking the actor again, including when the
+// invocation is routed to a different server.
+func TestIdempotencyKeys(t *testing.T) {
+	rpcClient, err := NewRPCClient(RPCClientOptions{})
+	require.NoError(t, err)
+
+	for name, client := range map[string]RemoteClient{
+		"http": NewHTTPClient(),
+		"rpc":  rpcClient,
+	} {
+		client := client
+		t.Run(name, func(t *testing.T) {
+			var (
+				ctx = context.Background()
+				reg = localregistry.NewLocalRegistry("test-server-id")
+			)
+			defer reg.Close(ctx)
+			env := newTestServerEnvironment(t, reg, newTestModuleStore(), "serverID1", client)
+
+			invoke := func(ctx context.Context, actorID, operation string, payload []byte) (string, error) {
+				result, err := env.InvokeActor(
+					ctx, "ns-1", actorID, "test-module", operation, payload, types.CreateIfNotExist{})
+				return string(result), err
+			}
+			requireInvoke := func(ctx context.Context, actorID, operation string, payload []byte, expected string) {
+				result, err := invoke(ctx, actorID, operation, payload)
+				require.NoError(t, err)
+				require.Equal(t, expected, result)
+			}
+
+			// Retries with the same key return the original response.
+			k1 := WithIdempotencyKey(ctx, "k1")
+			requireInvoke(k1, "a", "inc", nil, "1")
+			requireInvoke(k1, "a", "inc", nil, "1")
+			requireInvoke(ctx, "a", "getCount", nil, "1")
+			requireInvoke(WithIdempotencyKey(ctx, "k2"), "a", "inc", nil, "2")
+
+			// Keys are scoped to the actor.
+			requireInvoke(k1, "b", "inc", nil, "1")
+
+			// The key can't be reused for a different invocation.
+			_, err := invoke(k1, "a", "getCount", nil)
+			require.True(t, IsIdempotencyKeyMismatchError(err), err)
+			_, err = invoke(k1, "a", "inc", []byte("payload"))
+			require.True(t, IsIdempotencyKeyMismatchError(err), err)
+
+			// The actors that the actor invokes don't inherit the key.
+			k3 := WithIdempotencyKey(ctx, "k3")
+			requireInvoke(k3, "a", "invokeActor", invokeActorPayload(t, "b", "inc", nil), "2")
+			requireInvoke(k3, "a", "invokeActor", invokeActorPayload(t, "b", "inc", nil), "2")
+			requireInvoke(k3, "b", "inc", nil, "3")
+
+			// Actors can attach keys to the invocations they make.
+			marshaled, err := json.Marshal(types.InvokeActorRequest{
+				ActorID:        "b",
+				ModuleID:       "test-module",
+				Operation:      "inc",
+				IdempotencyKey: "k4",
+			})
+			require.NoError(t, err)
+			requireInvoke(ctx, "a", "invokeActor", marshaled, "4")
+			requireInvoke(ctx, "a", "invokeActor", marshaled, "4")
+			requireInvoke(ctx, "b", "getCount", nil, "4")
+
+			// Failed invocations are not recorded.
+			_, err = invoke(WithIdempotencyKey(ctx, "k5"), "a", "unknown", nil)
+			require.Error(t, err)
+			_, err = invoke(WithIdempotencyKey(ctx, "k5"), "a", "unknown", nil)
+			require.Error(t, err)
+			require.False(t, IsIdempotencyKeyMismatchError(err))
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package virtual
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// idleSweepsPerGCPeriod controls how coarse-grained idle actor GC is. Actors are GC'd
+	// somewhere between gcAfter and gcAfter + gcAfter/idleSweepsPerGCPeriod after their
+	// last invocation.
+	idleSweepsPerGCPeriod = 8
+)
+
+// idleActorSweeper GCs actors that have not been invoked recently. Each actor has a single
+// idle check outstanding on the shared timing wheel at all times, invocations only record
+// the time they ran at instead of resetting a timer. The checks are aligned to the sweep
+// interval so that all the actors that go idle within the same interval are checked on
+// the same tick of the wheel, and then closed as a single batch by the sweeper's goroutine
+// instead of spawning a goroutine for every actor. The sweeper never waits for an actor's
+// lock: actors that are busy are checked again on the next sweep so that a single slow
+// invocation can't delay the GC of every other idle actor.
+type idleActorSweeper struct {
+	sync.Mutex
+
+	_idle []*activatedActor
+
+	wheel    *timingWheel
+	interval time.Duration
+	notifyCh chan struct{}
+	closeCh  chan struct{}
+	closedCh chan struct{}
+	closeMu  sync.Once
+}
+
+func newIdleActorSweeper(
+	wheel *timingWheel,
+	gcAfter time.Duration,
+) *idleActorSweeper {
+	interval := gcAfter / idleSweepsPerGCPeriod
+	if interval < wheel.tick {
+		interval = wheel.tick
+	}
+	return &idleActorSweeper{
+		wheel:    wheel,
+		interval: interval,
+		notifyCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		closedCh: make(chan struct{}),
+	}
+}
+
+func (s *idleActorSweeper) start() {
+	go func() {
+		defer close(s.closedCh)
+
+		for {
+			select {
+			case <-s.closeCh:
+				return
+			case <-s.notifyCh:
+			}
+
+			s.Lock()
+			idle := s._idle
+			s._idle = nil
+			s.Unlock()
+
+			for _, actor := range idle {
+				select {
+				case <-s.closeCh:
+					// Any remaining actors will be closed by whatever is closing the sweeper.
+					return
+				default:
+				}
+				actor.gcIfIdle()
+			}
+		}
+	}()
+}
+
+func (s *idleActorSweeper) close() {
+	s.closeMu.Do(func() {
+		close(s.closeCh)
+	})
+	<-s.closedCh
+}
+
+// watch schedules the next idle check for the actor. If the actor would already be idle
+// (because it is busy with an invocation that started long ago) the check is scheduled
+// for the next sweep instead.
+func (s *idleActorSweeper) watch(actor *activatedActor) {
+	deadline := actor.lastInvoke().Add(actor._gcAfter)
+	if now := time.Now(); deadline.Before(now) {
+		deadline = now
+	}
+	deadline = deadline.Truncate(s.interval).Add(s.interval)
+	s.wheel.schedule(time.Until(deadline), func() {
+		if !actor.isIdle() {
+			// The actor was invoked since the check was scheduled.
+			s.watch(actor)
+			return
+		}
+
+		s.Lock()
+		s._idle = append(s._idle, actor)
+		s.Unlock()
+
+		select {
+		case s.notifyCh <- struct{}{}:
+		default:
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// noopActor is an actor that does nothing, used to measure the overhead of the
+// activations themselves.
+type noopActor struct{}
+
+func (noopActor) MemoryUsageBytes() int {
+	return 0
+}
+
+func (noopActor) Invoke(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func (noopActor) Close(ctx context.Context) error {
+	return nil
+}
+
+func newNoopActivatedActor(
+	tb testing.TB,
+	wheel *timingWheel,
+	sweeper *idleActorSweeper,
+	actorID string,
+	gcAfter time.Duration,
+	onGc func(),
+) *activatedActor {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", actorID, 1)
+	require.NoError(tb, err)
+	_, actor, err := newActivatedActor(
+		context.Background(), slog.Default(), noopActor{}, ref, nil,
+		newActorTimers(wheel), nil, nil, false, nil, gcAfter, sweeper, onGc)
+	require.NoError(tb, err)
+	return actor
+}
+
+// TestIdleActorSweeperSkipsBusyActors tests that an actor whose lock is held does not
+// prevent other idle actors from being GC'd, and that it is GC'd itself once released.
+func TestIdleActorSweeperSkipsBusyActors(t *testing.T) {
+	wheel := newTimingWheel(time.Millisecond, 64, 2)
+	wheel.start()
+	defer wheel.close()
+	sweeper := newIdleActorSweeper(wheel, 10*time.Millisecond)
+	sweeper.start()
+	defer sweeper.close()
+
+	var busyGCd, idleGCd atomic.Bool
+	busy := newNoopActivatedActor(t, wheel, sweeper, "busy", 10*time.Millisecond, func() {
+		busyGCd.Store(true)
+	})
+	newNoopActivatedActor(t, wheel, sweeper, "idle", 10*time.Millisecond, func() {
+		idleGCd.Store(true)
+	})
+
+	// Simulate a long running invocation.
+	busy.Lock()
+	require.Eventually(t, idleGCd.Load, 5*time.Second, time.Millisecond)
+	require.False(t, busyGCd.Load())
+
+	busy.Unlock()
+	require.Eventually(t, busyGCd.Load, 5*time.Second, time.Millisecond)
+}
+
+// runtimeTimerActor replicates how activated actors were GC'd before the timing wheel
+// was introduced: every actor owned a runtime timer that every invocation reset. It is
+// only used to benchmark the two approaches against each other.
+type runtimeTimerActor struct {
+	sync.Mutex
+
+	// The remaining state of an activation, so that the activations cost the same to
+	// create as activatedActors apart from the GC mechanism.
+	log       *slog.Logger
+	reference types.ActorReferenceVirtual
+	timers    *actorTimers
+
+	a          ActorBytes
+	closed     bool
+	lastInvoke time.Time
+	gcAfter    time.Duration
+	gcTimer    *time.Timer
+}
+
+func newRuntimeTimerActor(
+	tb testing.TB,
+	actorID string,
+	gcAfter time.Duration,
+	onGc func(),
+) *runtimeTimerActor {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", actorID, 1)
+	require.NoError(tb, err)
+	r := &runtimeTimerActor{
+		log:        slog.Default().With(slog.String("module", "activatedActor")),
+		reference:  ref,
+		timers:     newActorTimers(nil),
+		a:          noopActor{},
+		lastInvoke: time.Now(),
+		gcAfter:    gcAfter,
+	}
+
+	var gcFunc func()
+	gcFunc = func() {
+		r.Lock()
+		defer r.Unlock()
+
+		if r.closed {
+			return
+		}
+		if time.Since(r.lastInvoke) > gcAfter {
+			r.a.Invoke(context.Background(), wapcutils.ShutdownOperationName, nil)
+			r.closed = true
+			r.timers.close()
+			r.a.Close(context.Background())
+			onGc()
+		} else {
+			time.AfterFunc(gcAfter, gcFunc)
+		}
+	}
+	r.gcTimer = time.AfterFunc(gcAfter, gcFunc)
+
+	_, err = r.invoke(context.Background(), wapcutils.StartupOperationName, nil)
+	require.NoError(tb, err)
+	return r
+}
+
+// invoke mirrors activatedActor.invoke, including converting the response to a stream.
+func (r *runtimeTimerActor) invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+) (io.ReadCloser, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.lastInvoke = time.Now()
+	r.gcTimer.Reset(r.gcAfter)
+	resp, err := r.a.Invoke(ctx, operation, payload)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewBuffer(resp)), nil
+}
+
+// BenchmarkActivatedActorGC compares the cost of invoking and GC'ing activated actors
+// when each of them owns a runtime timer (the previous implementation) against the
+// shared timing wheel and idle sweeper, with 1M activated actors.
+func BenchmarkActivatedActorGC(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("invoke/runtime", func(b *testing.B) {
+		actors := make([]*runtimeTimerActor, 0, benchmarkNumActors)
+		for i := 0; i < benchmarkNumActors; i++ {
+			actors = append(actors, newRuntimeTimerActor(b, fmt.Sprintf("actor-%d", i), time.Hour, func() {}))
+		}
+		defer func() {
+			for _, actor := range actors {
+				actor.gcTimer.Stop()
+			}
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := actors[i%len(actors)].invoke(ctx, "noop", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp.Close()
+		}
+	})
+
+	b.Run("invoke/wheel", func(b *testing.B) {
+		wheel := newTimingWheel(
+			defaultTimingWheelTick, defaultTimingWheelNumSlots, defaultTimingWheelNumLevels)
+		wheel.start()
+		defer wheel.close()
+		sweeper := newIdleActorSweeper(wheel, time.Hour)
+		sweeper.start()
+		defer sweeper.close()
+
+		actors := make([]*activatedActor, 0, benchmarkNumActors)
+		for i := 0; i < benchmarkNumActors; i++ {
+			actors = append(actors, newNoopActivatedActor(
+				b, wheel, sweeper, fmt.Sprintf("actor-%d", i), time.Hour, func() {}))
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, resp, err := actors[i%len(actors)].invoke(ctx, "noop", nil, false, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp.Close()
+		}
+	})
+
+	// Every iteration activates 1M actors and waits for all of them to be GC'd.
+	b.Run("gc/runtime", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			wg.Add(benchmarkNumActors)
+			for j := 0; j < benchmarkNumActors; j++ {
+				newRuntimeTimerActor(b, fmt.Sprintf("actor-%d", j), 10*time.Millisecond, wg.Done)
+			}
+			wg.Wait()
+		}
+	})
+
+	b.Run("gc/wheel", func(b *testing.B) {
+		wheel := newTimingWheel(
+			defaultTimingWheelTick, defaultTimingWheelNumSlots, defaultTimingWheelNumLevels)
+		wheel.start()
+		defer wheel.close()
+		sweeper := newIdleActorSweeper(wheel, 10*time.Millisecond)
+		sweeper.start()
+		defer sweeper.close()
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			wg.Add(benchmarkNumActors)
+			for j := 0; j < benchmarkNumActors; j++ {
+				newNoopActivatedActor(
+					b, wheel, sweeper, fmt.Sprintf("actor-%d", j), 10*time.Millisecond, wg.Done)
+			}
+			wg.Wait()
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package virtual
+
+import (
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// The records that the async invocation queue and the reminder service store in their
+// kv.Store are encoded with the binary encoding described in registry/kv/record.go. Every
+// record type has its own schema version which must be incremented any time its fields
+// change so that records written with older versions can still be decoded.
+var (
+	recordTypeAsyncInvocation = kv.RecordType{ID: 1, Name: "asyncInvocation", Version: 1}
+	recordTypeAsyncQueueState = kv.RecordType{ID: 2, Name: "asyncQueueState", Version: 1}
+	recordTypeReminder        = kv.RecordType{ID: 3, Name: "reminder", Version: 1}
+	recordTypeReminderLease   = kv.RecordType{ID: 4, Name: "reminderLease", Version: 1}
+)
+
+func encodeAsyncInvocation(inv asyncInvocation) []byte {
+	e := kv.NewRecordEncoder(
+		recordTypeAsyncInvocation,
+		128+len(inv.Payload)+len(inv.CreateIfNotExist.InstantiatePayload))
+	e.PutString(inv.Namespace)
+	e.PutString(inv.ActorID)
+	e.PutString(inv.ModuleID)
+	e.PutString(inv.Operation)
+	e.PutBytes(inv.Payload)
+	putCreateIfNotExist(e, inv.CreateIfNotExist)
+	e.PutUvarint(uint64(inv.Attempts))
+	e.PutString(inv.LastError)
+	return e.Bytes()
+}
+
+func decodeAsyncInvocation(b []byte) (asyncInvocation, error) {
+	d, err := kv.NewRecordDecoder(b, recordTypeAsyncInvocation)
+	if err != nil {
+		return asyncInvocation{}, err
+	}
+	var inv asyncInvocation
+	inv.Namespace = d.ReadString()
+	inv.ActorID = d.ReadString()
+	inv.ModuleID = d.ReadString()
+	inv.Operation = d.ReadString()
+	inv.Payload = d.ReadBytes()
+	inv.CreateIfNotExist = readCreateIfNotExist(d)
+	inv.Attempts = int(d.ReadUvarint())
+	inv.LastError = d.ReadString()
+	if err := d.Finish(); err != nil {
+		return asyncInvocation{}, err
+	}
+	return inv, nil
+}
+
+func encodeAsyncQueueState(state asyncQueueState) []byte {
+	e := kv.NewRecordEncoder(recordTypeAsyncQueueState, 32+len(state.LeaseOwner))
+	e.PutVarint(state.NextSeq)
+	e.PutVarint(state.NextAttemptAt)
+	e.PutString(state.LeaseOwner)
+	e.PutVarint(state.LeaseExpiresAt)
+	return e.Bytes()
+}
+
+func decodeAsyncQueueState(b []byte) (asyncQueueState, error) {
+	d, err := kv.NewRecordDecoder(b, recordTypeAsyncQueueState)
+	if err != nil {
+		return asyncQueueState{}, err
+	}
+	var state asyncQueueState
+	state.NextSeq = d.ReadVarint()
+	state.NextAttemptAt = d.ReadVarint()
+	state.LeaseOwner = d.ReadString()
+	state.LeaseExpiresAt = d.ReadVarint()
+	if err := d.Finish(); err != nil {
+		return asyncQueueState{}, err
+	}
+	return state, nil
+}
+
+func encodeReminderRecord(record reminderRecord) []byte {
+	r := record.Reminder
+	e := kv.NewRecordEncoder(
+		recordTypeReminder,
+		128+len(r.Payload)+len(r.CreateIfNotExist.InstantiatePayload))
+	e.PutString(record.Namespace)
+	e.PutString(record.ActorID)
+	e.PutString(record.ModuleID)
+	e.PutString(r.Name)
+	e.PutString(r.Operation)
+	e.PutBytes(r.Payload)
+	e.PutVarint(int64(r.AfterMillis))
+	e.PutVarint(int64(r.PeriodMillis))
+	putCreateIfNotExist(e, r.CreateIfNotExist)
+	e.PutVarint(record.NextFireAt)
+	e.PutUvarint(uint64(record.Attempts))
+	return e.Bytes()
+}
+
+func decodeReminderRecord(b []byte) (reminderRecord, error) {
+	d, err := kv.NewRecordDecoder(b, recordTypeReminder)
+	if err != nil {
+		return reminderRecord{}, err
+	}
+	var record reminderRecord
+	record.Namespace = d.ReadString()
+	record.ActorID = d.ReadString()
+	record.ModuleID = d.ReadString()
+	record.Reminder.Name = d.ReadString()
+	record.Reminder.Operation = d.ReadString()
+	record.Reminder.Payload = d.ReadBytes()
+	record.Reminder.AfterMillis = int(d.ReadVarint())
+	record.Reminder.PeriodMillis = int(d.ReadVarint())
+	record.Reminder.CreateIfNotExist = readCreateIfNotExist(d)
+	record.NextFireAt = d.ReadVarint()
+	record.Attempts = int(d.ReadUvarint())
+	if err := d.Finish(); err != nil {
+		return reminderRecord{}, err
+	}
+	return record, nil
+}
+
+func encodeReminderLease(lease reminderLease) []byte {
+	e := kv.NewRecordEncoder(recordTypeReminderLease, 16+len(lease.Owner))
+	e.PutString(lease.Owner)
+	e.PutVarint(lease.ExpiresAt)
+	return e.Bytes()
+}
+
+func decodeReminderLease(b []byte) (reminderLease, error) {
+	d, err := kv.NewRecordDecoder(b, recordTypeReminderLease)
+	if err != nil {
+		return reminderLease{}, err
+	}
+	var lease reminderLease
+	lease.Owner = d.ReadString()
+	lease.ExpiresAt = d.ReadVarint()
+	if err := d.Finish(); err != nil {
+		return reminderLease{}, err
+	}
+	return lease, nil
+}
+
+func putCreateIfNotExist(e *kv.RecordEncoder, c types.CreateIfNotExist) {
+	e.PutUvarint(c.Options.ExtraReplicas)
+	e.PutString(string(c.Options.ReplicationStrategy))
+	e.PutVarint(int64(c.Options.RetryPolicy.PerAttemptTimeout))
+	e.PutUvarint(uint64(c.Options.RetryPolicy.MaxNumRetries))
+	e.PutVarint(int64(c.Options.RetryPolicy.InitialBackoff))
+	e.PutVarint(int64(c.Options.RetryPolicy.MaxBackoff))
+	e.PutFloat64(c.Options.RetryPolicy.HedgeAfterPercentile)
+	e.PutBytes(c.InstantiatePayload)
+}
+
+func readCreateIfNotExist(d *kv.RecordDecoder) types.CreateIfNotExist {
+	var c types.CreateIfNotExist
+	c.Options.ExtraReplicas = d.ReadUvarint()
+	c.Options.ReplicationStrategy = types.ReplicaSelectionStrategy(d.ReadString())
+	c.Options.RetryPolicy.PerAttemptTimeout = time.Duration(d.ReadVarint())
+	c.Options.RetryPolicy.MaxNumRetries = uint(d.ReadUvarint())
+	c.Options.RetryPolicy.InitialBackoff = time.Duration(d.ReadVarint())
+	c.Options.RetryPolicy.MaxBackoff = time.Duration(d.ReadVarint())
+	c.Options.RetryPolicy.HedgeAfterPercentile = d.ReadFloat64()
+	c.InstantiatePayload = d.ReadBytes()
+	return c
+}
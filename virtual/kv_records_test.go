@@ -0,0 +1,79 @@
+package virtual
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVRecordEncodingRoundTrip(t *testing.T) {
+	create := types.CreateIfNotExist{
+		Options: types.ActorOptions{
+			ExtraReplicas:       1,
+			ReplicationStrategy: types.ReplicaSelectionStrategySorted,
+			RetryPolicy: types.RetryPolicy{
+				PerAttemptTimeout:    time.Second,
+				MaxNumRetries:        3,
+				InitialBackoff:       time.Millisecond,
+				MaxBackoff:           time.Second,
+				HedgeAfterPercentile: 0.99,
+			},
+		},
+		InstantiatePayload: []byte("instantiate"),
+	}
+
+	inv := asyncInvocation{
+		Namespace:        "ns-1",
+		ActorID:          "a",
+		ModuleID:         "test-module",
+		Operation:        "inc",
+		Payload:          []byte{0, 1, 2},
+		CreateIfNotExist: create,
+		Attempts:         2,
+		LastError:        "failed",
+	}
+	decodedInv, err := decodeAsyncInvocation(encodeAsyncInvocation(inv))
+	require.NoError(t, err)
+	require.Equal(t, inv, decodedInv)
+
+	state := asyncQueueState{
+		NextSeq:        10,
+		NextAttemptAt:  1 << 40,
+		LeaseOwner:     "server1-123",
+		LeaseExpiresAt: 1 << 41,
+	}
+	decodedState, err := decodeAsyncQueueState(encodeAsyncQueueState(state))
+	require.NoError(t, err)
+	require.Equal(t, state, decodedState)
+
+	record := reminderRecord{
+		Namespace: "ns-1",
+		ActorID:   "a",
+		ModuleID:  "test-module",
+		Reminder: types.Reminder{
+			Name:             "reminder",
+			Operation:        "inc",
+			Payload:          []byte("payload"),
+			AfterMillis:      100,
+			PeriodMillis:     1000,
+			CreateIfNotExist: create,
+		},
+		NextFireAt: 1 << 40,
+		Attempts:   1,
+	}
+	decodedRecord, err := decodeReminderRecord(encodeReminderRecord(record))
+	require.NoError(t, err)
+	require.Equal(t, record, decodedRecord)
+
+	lease := reminderLease{Owner: "server1-123", ExpiresAt: 1 << 40}
+	decodedLease, err := decodeReminderLease(encodeReminderLease(lease))
+	require.NoError(t, err)
+	require.Equal(t, lease, decodedLease)
+
+	// Decoding a record as the wrong type should fail.
+	_, err = decodeReminderLease(encodeAsyncQueueState(state))
+	require.Error(t, err)
+}
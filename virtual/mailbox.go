@@ -0,0 +1,245 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// MailboxStats contains statistics about the invocations that were queued in actor
+// mailboxes.
+type MailboxStats struct {
+	// Depth is the number of invocations that are currently waiting in the mailbox (not
+	// including the invocation that is currently running, if any).
+	Depth int
+	// NumInvocations is the number of invocations that were accepted by the mailbox.
+	NumInvocations int64
+	// NumRejected is the number of invocations that were rejected because the mailbox
+	// was full.
+	NumRejected int64
+	// TotalWait is the total amount of time that accepted invocations spent waiting in the
+	// mailbox before they started running.
+	TotalWait time.Duration
+	// MaxWait is the longest amount of time that any invocation spent waiting in the
+	// mailbox.
+	MaxWait time.Duration
+}
+
+// mailboxStats tracks MailboxStats with atomics so that they can be updated by every
+// mailbox and read at any time without any locking.
+type mailboxStats struct {
+	depth          int64
+	numInvocations int64
+	numRejected    int64
+	totalWaitNanos int64
+	maxWaitNanos   int64
+}
+
+func (m *mailboxStats) recordAccepted(wait time.Duration) {
+	atomic.AddInt64(&m.numInvocations, 1)
+	atomic.AddInt64(&m.totalWaitNanos, int64(wait))
+	for {
+		max := atomic.LoadInt64(&m.maxWaitNanos)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&m.maxWaitNanos, max, int64(wait)) {
+			return
+		}
+	}
+}
+
+func (m *mailboxStats) snapshot() MailboxStats {
+	return MailboxStats{
+		Depth:          int(atomic.LoadInt64(&m.depth)),
+		NumInvocations: atomic.LoadInt64(&m.numInvocations),
+		NumRejected:    atomic.LoadInt64(&m.numRejected),
+		TotalWait:      time.Duration(atomic.LoadInt64(&m.totalWaitNanos)),
+		MaxWait:        time.Duration(atomic.LoadInt64(&m.maxWaitNanos)),
+	}
+}
+
+// actorMailbox serializes the invocations of a single activated actor. Invocations are
+// handed the actor in the order they arrived in, and at most maxDepth invocations can be
+// waiting for their turn at once. Any invocations beyond that are rejected with a
+// MailboxFullErr instead of piling up goroutines on the server.
+//
+// Exclusive invocations run one at a time, while consecutive shared (read-only)
+// invocations run concurrently with each other. A shared invocation that arrives while an
+// exclusive one is waiting queues up behind it so that a steady stream of reads can't
+// starve writes.
+type actorMailbox struct {
+	// Accessed atomically, kept as the first field to guarantee 64-bit alignment.
+	stats mailboxStats
+
+	sync.Mutex
+
+	_numHolders int
+	_exclusive  bool
+	// _holders counts the invocations that currently hold the mailbox by the ID of their
+	// call chain.
+	_holders map[string]int
+	_waiters []mailboxWaiter
+
+	id       types.NamespacedActorID
+	maxDepth int
+	// envStats are the stats aggregated across every mailbox in the environment.
+	envStats *mailboxStats
+}
+
+type mailboxWaiter struct {
+	turn      chan struct{}
+	chainID   string
+	exclusive bool
+}
+
+func newActorMailbox(
+	id types.NamespacedActorID,
+	maxDepth int,
+	envStats *mailboxStats,
+) *actorMailbox {
+	return &actorMailbox{
+		_holders: make(map[string]int),
+		id:       id,
+		maxDepth: maxDepth,
+		envStats: envStats,
+	}
+}
+
+// acquire waits until it's the caller's turn to invoke the actor, either exclusively or
+// shared with other non-exclusive invocations. Callers must call release with the same
+// context once the invocation is done if (and only if) acquire did not return an error.
+func (m *actorMailbox) acquire(ctx context.Context, exclusive bool) error {
+	chain, _ := callChainFromContext(ctx)
+
+	m.Lock()
+	if len(m._waiters) == 0 && m.canAcquireWithLock(exclusive) {
+		m.acquireWithLock(chain.ID, exclusive)
+		m.Unlock()
+		m.recordAccepted(0)
+		return nil
+	}
+
+	if len(m._waiters) >= m.maxDepth {
+		m.Unlock()
+		atomic.AddInt64(&m.stats.numRejected, 1)
+		atomic.AddInt64(&m.envStats.numRejected, 1)
+		return NewMailboxFullError(fmt.Errorf(
+			"mailbox for actor: %s is full with %d pending invocations", m.id, m.maxDepth))
+	}
+
+	turn := make(chan struct{})
+	m._waiters = append(m._waiters, mailboxWaiter{
+		turn:      turn,
+		chainID:   chain.ID,
+		exclusive: exclusive,
+	})
+	m.Unlock()
+	m.addDepth(1)
+
+	start := time.Now()
+	select {
+	case <-turn:
+		m.recordAccepted(time.Since(start))
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.Lock()
+	for i, waiter := range m._waiters {
+		if waiter.turn == turn {
+			m._waiters = append(m._waiters[:i], m._waiters[i+1:]...)
+			// The cancelled invocation may have been the exclusive invocation that the
+			// shared invocations behind it were waiting for.
+			numHandedOver := m.handOverWithLock()
+			m.Unlock()
+			m.addDepth(-1 - int64(numHandedOver))
+			return ctx.Err()
+		}
+	}
+	m.Unlock()
+
+	// The caller was given its turn concurrently with the context being cancelled, hand
+	// it over to the next invocation in line.
+	m.release(ctx)
+	return ctx.Err()
+}
+
+// release gives up the caller's turn and hands the actor over to the next invocations in
+// line, if there are any.
+func (m *actorMailbox) release(ctx context.Context) {
+	chain, _ := callChainFromContext(ctx)
+
+	m.Lock()
+	m._numHolders--
+	if m._numHolders == 0 {
+		m._exclusive = false
+	}
+	if m._holders[chain.ID] <= 1 {
+		delete(m._holders, chain.ID)
+	} else {
+		m._holders[chain.ID]--
+	}
+	numHandedOver := m.handOverWithLock()
+	m.Unlock()
+	m.addDepth(-int64(numHandedOver))
+}
+
+// isHeldBy returns whether the mailbox is currently held by an invocation that is part of
+// the call chain with the provided ID.
+func (m *actorMailbox) isHeldBy(chainID string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return chainID != "" && m._holders[chainID] > 0
+}
+
+// isHeldExclusivelyBy returns whether the mailbox is currently held exclusively by an
+// invocation that is part of the call chain with the provided ID.
+func (m *actorMailbox) isHeldExclusivelyBy(chainID string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return chainID != "" && m._exclusive && m._holders[chainID] > 0
+}
+
+func (m *actorMailbox) canAcquireWithLock(exclusive bool) bool {
+	if exclusive {
+		return m._numHolders == 0
+	}
+	return !m._exclusive
+}
+
+func (m *actorMailbox) acquireWithLock(chainID string, exclusive bool) {
+	m._numHolders++
+	m._exclusive = exclusive
+	m._holders[chainID]++
+}
+
+// handOverWithLock gives the mailbox to as many of the waiters at the front of the line as
+// possible and returns how many of them were handed the mailbox.
+func (m *actorMailbox) handOverWithLock() int {
+	numHandedOver := 0
+	for len(m._waiters) > 0 {
+		next := m._waiters[0]
+		if !m.canAcquireWithLock(next.exclusive) {
+			break
+		}
+
+		m._waiters[0] = mailboxWaiter{}
+		m._waiters = m._waiters[1:]
+		m.acquireWithLock(next.chainID, next.exclusive)
+		close(next.turn)
+		numHandedOver++
+	}
+	return numHandedOver
+}
+
+func (m *actorMailbox) addDepth(delta int64) {
+	atomic.AddInt64(&m.stats.depth, delta)
+	atomic.AddInt64(&m.envStats.depth, delta)
+}
+
+func (m *actorMailbox) recordAccepted(wait time.Duration) {
+	m.stats.recordAccepted(wait)
+	m.envStats.recordAccepted(wait)
+}
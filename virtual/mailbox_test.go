@@ -0,0 +1,334 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActorMailbox tests that invocations are handed the mailbox in the order they
+// arrived in, that invocations are rejected once the mailbox is full, and that cancelled
+// invocations are removed from the mailbox.
+func TestActorMailbox(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		envStats = &mailboxStats{}
+		id       = types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+		mailbox  = newActorMailbox(id, 3, envStats)
+	)
+	require.NoError(t, mailbox.acquire(ctx, true))
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 2; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, mailbox.acquire(ctx, true))
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			mailbox.release(ctx)
+		}()
+		// Wait for each invocation to be queued so the order is deterministic.
+		require.Eventually(t, func() bool {
+			return mailbox.stats.snapshot().Depth == i+1
+		}, 10*time.Second, time.Millisecond)
+	}
+
+	// Cancelled invocations give up their spot in the mailbox.
+	cancelledCtx, cc := context.WithCancel(ctx)
+	cancelledErrCh := make(chan error, 1)
+	go func() {
+		cancelledErrCh <- mailbox.acquire(cancelledCtx, true)
+	}()
+	require.Eventually(t, func() bool {
+		return mailbox.stats.snapshot().Depth == 3
+	}, 10*time.Second, time.Millisecond)
+
+	// The mailbox is full.
+	err := mailbox.acquire(ctx, true)
+	require.True(t, IsMailboxFullError(err), err)
+
+	cc()
+	require.ErrorIs(t, <-cancelledErrCh, context.Canceled)
+	require.Equal(t, 2, mailbox.stats.snapshot().Depth)
+
+	mailbox.release(ctx)
+	wg.Wait()
+	require.Equal(t, []int{0, 1}, order)
+
+	stats := mailbox.stats.snapshot()
+	require.Equal(t, 0, stats.Depth)
+	require.Equal(t, int64(3), stats.NumInvocations)
+	require.Equal(t, int64(1), stats.NumRejected)
+	require.True(t, stats.TotalWait > 0)
+	require.True(t, stats.MaxWait > 0)
+	require.Equal(t, stats, envStats.snapshot())
+
+	// The mailbox can be acquired immediately once it has been drained.
+	require.NoError(t, mailbox.acquire(ctx, true))
+	mailbox.release(ctx)
+}
+
+// TestActorMailboxShared tests that shared invocations hold the mailbox concurrently with
+// each other but never with exclusive invocations, and that shared invocations queue up
+// behind waiting exclusive invocations instead of starving them.
+func TestActorMailboxShared(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		ctxA     = withCallChain(ctx, callChain{ID: "a"})
+		ctxB     = withCallChain(ctx, callChain{ID: "b"})
+		ctxC     = withCallChain(ctx, callChain{ID: "c"})
+		ctxD     = withCallChain(ctx, callChain{ID: "d"})
+		envStats = &mailboxStats{}
+		id       = types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+		mailbox  = newActorMailbox(id, 3, envStats)
+	)
+	require.NoError(t, mailbox.acquire(ctxA, false))
+	require.NoError(t, mailbox.acquire(ctxB, false))
+	require.True(t, mailbox.isHeldBy("a"))
+	require.True(t, mailbox.isHeldBy("b"))
+	require.False(t, mailbox.isHeldExclusivelyBy("a"))
+
+	exclusiveCh := make(chan error, 1)
+	go func() {
+		exclusiveCh <- mailbox.acquire(ctxC, true)
+	}()
+	require.Eventually(t, func() bool {
+		return mailbox.stats.snapshot().Depth == 1
+	}, 10*time.Second, time.Millisecond)
+
+	sharedCh := make(chan error, 1)
+	go func() {
+		sharedCh <- mailbox.acquire(ctxD, false)
+	}()
+	require.Eventually(t, func() bool {
+		return mailbox.stats.snapshot().Depth == 2
+	}, 10*time.Second, time.Millisecond)
+
+	// The exclusive invocation only gets its turn once every shared invocation is done.
+	mailbox.release(ctxA)
+	require.False(t, mailbox.isHeldBy("a"))
+	select {
+	case <-exclusiveCh:
+		t.Fatal("exclusive invocation should wait for shared invocations")
+	case <-time.After(10 * time.Millisecond):
+	}
+	mailbox.release(ctxB)
+	require.NoError(t, <-exclusiveCh)
+	require.True(t, mailbox.isHeldBy("c"))
+	require.True(t, mailbox.isHeldExclusivelyBy("c"))
+
+	select {
+	case <-sharedCh:
+		t.Fatal("shared invocation should wait for exclusive invocation")
+	case <-time.After(10 * time.Millisecond):
+	}
+	mailbox.release(ctxC)
+	require.NoError(t, <-sharedCh)
+	require.True(t, mailbox.isHeldBy("d"))
+	require.False(t, mailbox.isHeldExclusivelyBy("d"))
+	mailbox.release(ctxD)
+
+	require.False(t, mailbox.isHeldBy("d"))
+	require.Equal(t, 0, mailbox.stats.snapshot().Depth)
+	require.Equal(t, int64(4), mailbox.stats.snapshot().NumInvocations)
+}
+
+// TestMailboxFull tests that invocations of a busy actor are rejected once its mailbox is
+// full and that the mailbox stats are exposed by the environment.
+func TestMailboxFull(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		reg  = localregistry.NewLocalRegistry("test-server-id")
+		opts = defaultOptsGoByte
+	)
+	defer reg.Close(ctx)
+
+	opts.MaxActorMailboxDepth = 2
+	env, err := NewEnvironment(ctx, "serverID1", reg, newTestModuleStore(), nil, opts)
+	require.NoError(t, err)
+	defer env.Close(ctx)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	invoke := func(operation string, payload []byte) error {
+		_, err := env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", operation, payload, types.CreateIfNotExist{})
+		return err
+	}
+	_, ok := env.ActorMailboxStats("ns-1", "a", "test-module")
+	require.False(t, ok)
+	require.NoError(t, invoke("inc", nil))
+
+	// Occupy the actor and then fill up its mailbox.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, invoke("sleep", []byte("100")))
+		}()
+		require.Eventually(t, func() bool {
+			stats, ok := env.ActorMailboxStats("ns-1", "a", "test-module")
+			return ok && stats.NumInvocations+int64(stats.Depth) == int64(i+2)
+		}, 10*time.Second, time.Millisecond)
+	}
+
+	err = invoke("inc", nil)
+	require.True(t, IsMailboxFullError(err), err)
+	wg.Wait()
+
+	stats, ok := env.ActorMailboxStats("ns-1", "a", "test-module")
+	require.True(t, ok)
+	require.Equal(t, 0, stats.Depth)
+	require.Equal(t, int64(4), stats.NumInvocations)
+	require.Equal(t, int64(1), stats.NumRejected)
+	require.True(t, stats.MaxWait >= 100*time.Millisecond)
+	require.Equal(t, int64(1), env.MailboxStats().NumRejected)
+
+	// The actor accepts invocations again once its mailbox has drained.
+	require.NoError(t, invoke("inc", nil))
+}
+
+type readOnlyTestModule struct{}
+
+func (tm readOnlyTestModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return &readOnlyTestActor{}, nil
+}
+
+func (tm readOnlyTestModule) Close(ctx context.Context) error {
+	return nil
+}
+
+type readOnlyTestActor struct {
+	numReading    int64
+	maxNumReading int64
+	numWriting    int64
+}
+
+func (ta *readOnlyTestActor) MemoryUsageBytes() int {
+	return 0
+}
+
+func (ta *readOnlyTestActor) IsReadOnly(operation string) bool {
+	return operation == "read"
+}
+
+func (ta *readOnlyTestActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+) ([]byte, error) {
+	switch operation {
+	case "read":
+		numReading := atomic.AddInt64(&ta.numReading, 1)
+		defer atomic.AddInt64(&ta.numReading, -1)
+		for {
+			max := atomic.LoadInt64(&ta.maxNumReading)
+			if numReading <= max || atomic.CompareAndSwapInt64(&ta.maxNumReading, max, numReading) {
+				break
+			}
+		}
+		if atomic.LoadInt64(&ta.numWriting) != 0 {
+			return nil, errors.New("read ran concurrently with a write")
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	case "write":
+		if atomic.AddInt64(&ta.numWriting, 1) != 1 || atomic.LoadInt64(&ta.numReading) != 0 {
+			return nil, errors.New("write ran concurrently with another invocation")
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&ta.numWriting, -1)
+		return nil, nil
+	case "getMaxNumReading":
+		return []byte(strconv.FormatInt(atomic.LoadInt64(&ta.maxNumReading), 10)), nil
+	default:
+		return nil, nil
+	}
+}
+
+func (ta *readOnlyTestActor) Close(ctx context.Context) error {
+	return nil
+}
+
+// TestReadOnlyOperations tests that read-only invocations of an actor run concurrently with
+// each other but never concurrently with invocations of any other operation.
+func TestReadOnlyOperations(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry("test-server-id")
+	)
+	defer reg.Close(ctx)
+
+	env, err := NewEnvironment(ctx, "serverID1", reg, newTestModuleStore(), nil, defaultOptsGoByte)
+	require.NoError(t, err)
+	defer env.Close(ctx)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, readOnlyTestModule{}))
+
+	invoke := func(operation string) ([]byte, error) {
+		return env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", operation, nil, types.CreateIfNotExist{})
+	}
+
+	// Concurrent reads run in parallel.
+	var (
+		numReads = 10
+		start    = time.Now()
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < numReads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := invoke("read")
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.True(t, time.Since(start) < time.Duration(numReads)*50*time.Millisecond)
+
+	result, err := invoke("getMaxNumReading")
+	require.NoError(t, err)
+	maxNumReading, err := strconv.Atoi(string(result))
+	require.NoError(t, err)
+	require.True(t, maxNumReading > 1, maxNumReading)
+
+	// Writes never run concurrently with reads or other writes.
+	for i := 0; i < numReads; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := invoke("read")
+			require.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := invoke("write")
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
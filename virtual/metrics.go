@@ -0,0 +1,173 @@
+package virtual
+
+import (
+	"time"
+
+	"github.com/richardartoul/nola/virtual/metrics"
+)
+
+const (
+	// invocationKindInvoke labels invocations made with InvokeActor (that are routed to
+	// whichever server the actor is activated on).
+	invocationKindInvoke = "invoke"
+	// invocationKindDirect labels invocations made with InvokeActorDirect (that are
+	// executed by the actors activated on this server).
+	invocationKindDirect = "direct"
+
+	shedReasonMemory    = "memory"
+	shedReasonRebalance = "rebalance"
+
+	// otherLabelValue replaces the values of labels that come from the caller when they
+	// can't be trusted to be bounded, like the module of an invocation that failed
+	// because the module doesn't exist.
+	otherLabelValue = "other"
+)
+
+// environmentMetrics contains the metrics that are emitted by an environment and its
+// activations.
+type environmentMetrics struct {
+	invocations         *metrics.Counter
+	invocationLatency   *metrics.Histogram
+	activations         *metrics.Counter
+	gcs                 *metrics.Counter
+	sheds               *metrics.Counter
+	blacklistHits       *metrics.Counter
+	activationCache     *metrics.Counter
+	registryCallLatency *metrics.Histogram
+	heartbeatFailures   *metrics.Counter
+	idempotentReplays   *metrics.Counter
+	retries             *metrics.Counter
+	hedgedRequests      *metrics.Counter
+	hedgedRequestWins   *metrics.Counter
+}
+
+func newEnvironmentMetrics(reg *metrics.Registry) *environmentMetrics {
+	return &environmentMetrics{
+		invocations: reg.NewCounter(
+			"nola_invocations_total",
+			"Number of actor invocations.",
+			"kind", "namespace", "module", "operation", "result"),
+		invocationLatency: reg.NewHistogram(
+			"nola_invocation_duration_seconds",
+			"Latency of actor invocations until the response starts streaming.",
+			metrics.DefaultLatencyBuckets,
+			"kind", "namespace", "module", "operation"),
+		activations: reg.NewCounter(
+			"nola_actor_activations_total",
+			"Number of actors activated on this server.",
+			"namespace", "module"),
+		gcs: reg.NewCounter(
+			"nola_actor_gcs_total",
+			"Number of actors that were garbage collected because they were idle."),
+		sheds: reg.NewCounter(
+			"nola_actor_sheds_total",
+			"Number of actors that were shed from this server.",
+			"reason"),
+		blacklistHits: reg.NewCounter(
+			"nola_blacklist_hits_total",
+			"Number of invocations that were rejected because the actor was shed from this server."),
+		activationCache: reg.NewCounter(
+			"nola_activation_cache_requests_total",
+			"Number of activation cache lookups.",
+			"result"),
+		registryCallLatency: reg.NewHistogram(
+			"nola_registry_call_duration_seconds",
+			"Latency of registry calls.",
+			metrics.DefaultLatencyBuckets,
+			"method", "result"),
+		heartbeatFailures: reg.NewCounter(
+			"nola_heartbeat_failures_total",
+			"Number of failed heartbeats to the registry."),
+		idempotentReplays: reg.NewCounter(
+			"nola_idempotent_replays_total",
+			"Number of invocations that returned the recorded response of an earlier invocation with the same idempotency key."),
+		retries: reg.NewCounter(
+			"nola_invocation_retries_total",
+			"Number of failed invocation attempts that were retried, by how the error was classified.",
+			"class"),
+		hedgedRequests: reg.NewCounter(
+			"nola_hedged_requests_total",
+			"Number of requests that were hedged to a different replica because they exceeded the latency threshold."),
+		hedgedRequestWins: reg.NewCounter(
+			"nola_hedged_request_wins_total",
+			"Number of hedged invocations by which of the requests responded first.",
+			"winner"),
+	}
+}
+
+// recordInvocation records an invocation. isModuleLoaded reports whether the module was
+// loaded by this server, in which case namespace and moduleID are known to be bounded
+// even if the invocation failed. Otherwise they're only recorded if the invocation
+// succeeded (which means that the server that executed it resolved them) so that
+// invalid requests can't create an unbounded number of series. The operation is only
+// recorded if the invocation succeeded for the same reason.
+func (m *environmentMetrics) recordInvocation(
+	kind string,
+	namespace string,
+	moduleID string,
+	operation string,
+	isModuleLoaded func(namespace, moduleID string) bool,
+	start time.Time,
+	err error,
+) {
+	if err != nil {
+		operation = otherLabelValue
+		if !isModuleLoaded(namespace, moduleID) {
+			namespace, moduleID = otherLabelValue, otherLabelValue
+		}
+	}
+	m.invocations.Inc(kind, namespace, moduleID, operation, metricsResult(err))
+	m.invocationLatency.Observe(
+		time.Since(start).Seconds(), kind, namespace, moduleID, operation)
+}
+
+func (m *environmentMetrics) recordRegistryCall(method string, start time.Time, err error) {
+	m.registryCallLatency.Observe(time.Since(start).Seconds(), method, metricsResult(err))
+}
+
+func metricsResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// registerEnvironmentMetricFuncs registers the metrics that are collected from the
+// environment's state whenever the metrics are scraped.
+func registerEnvironmentMetricFuncs(reg *metrics.Registry, env *environment) {
+	reg.NewGaugeFunc(
+		"nola_activated_actors",
+		"Number of actors that are currently activated on this server.",
+		func() float64 { return float64(env.NumActivatedActors()) })
+	reg.NewGaugeFunc(
+		"nola_actor_memory_bytes",
+		"Memory used by the actors activated on this server.",
+		func() float64 { return float64(env.activations.memUsageBytes()) })
+	reg.NewGaugeVecFunc(
+		"nola_namespace_actor_memory_bytes",
+		"Memory used by the actors activated on this server, by namespace.",
+		[]string{"namespace"},
+		func() []metrics.Sample {
+			usage := env.activations.memUsageBytesByNamespace()
+			samples := make([]metrics.Sample, 0, len(usage))
+			for namespace, bytes := range usage {
+				samples = append(samples, metrics.Sample{
+					LabelValues: []string{namespace},
+					Value:       float64(bytes),
+				})
+			}
+			return samples
+		})
+	reg.NewGaugeFunc(
+		"nola_mailbox_depth",
+		"Number of invocations that are waiting in actor mailboxes.",
+		func() float64 { return float64(env.MailboxStats().Depth) })
+	reg.NewCounterFunc(
+		"nola_mailbox_rejections_total",
+		"Number of invocations that were rejected because an actor's mailbox was full.",
+		func() float64 { return float64(env.MailboxStats().NumRejected) })
+	reg.NewCounterFunc(
+		"nola_mailbox_wait_seconds_total",
+		"Total time that invocations spent waiting in actor mailboxes.",
+		func() float64 { return env.MailboxStats().TotalWait.Seconds() })
+}
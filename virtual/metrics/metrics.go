@@ -0,0 +1,476 @@
+// Package metrics implements a small, dependency-free metrics registry whose metrics can be
+// scraped by Prometheus. Metrics are exposed using the Prometheus text exposition format
+// (see Registry.WriteTo and Registry.ServeHTTP).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets are the default histogram buckets for latencies in seconds.
+var DefaultLatencyBuckets = []float64{
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+
+	// labelValuesSeparator separates the label values in series keys. It's not valid
+	// UTF-8 so it can't appear in any (reasonable) label value.
+	labelValuesSeparator = "\xff"
+)
+
+// Registry contains a set of metrics.
+type Registry struct {
+	sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	desc() *desc
+	write(w *bufio.Writer)
+}
+
+type desc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+// NewRegistry returns a new Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(m metric) {
+	r.Lock()
+	defer r.Unlock()
+	name := m.desc().name
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric: %s is already registered", name))
+	}
+	r.metrics[name] = m
+}
+
+// NewCounter registers a counter with the provided label names.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{vec: newVec(&desc{name, help, typeCounter, labelNames}, newFloatSeries)}
+	r.register(c)
+	c.vec.init()
+	return c
+}
+
+// NewGauge registers a gauge with the provided label names.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{vec: newVec(&desc{name, help, typeGauge, labelNames}, newFloatSeries)}
+	r.register(g)
+	g.vec.init()
+	return g
+}
+
+// NewHistogram registers a histogram with the provided (sorted) buckets and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets for histogram: %s are not sorted", name))
+	}
+	h := &Histogram{
+		vec: newVec(&desc{name, help, typeHistogram, labelNames}, func() *histogramSeries {
+			return &histogramSeries{counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+	r.register(h)
+	h.vec.init()
+	return h
+}
+
+// Sample is the value of a single series of a metric that is collected by a function.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by fn whenever the metrics
+// are collected.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.NewCounterVecFunc(name, help, nil, func() []Sample {
+		return []Sample{{Value: fn()}}
+	})
+}
+
+// NewCounterVecFunc is the same as NewCounterFunc, except fn returns a sample for each
+// combination of label values.
+func (r *Registry) NewCounterVecFunc(name, help string, labelNames []string, fn func() []Sample) {
+	r.register(&funcMetric{d: &desc{name, help, typeCounter, labelNames}, fn: fn})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn whenever the metrics are
+// collected.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.NewGaugeVecFunc(name, help, nil, func() []Sample {
+		return []Sample{{Value: fn()}}
+	})
+}
+
+// NewGaugeVecFunc is the same as NewGaugeFunc, except fn returns a sample for each
+// combination of label values.
+func (r *Registry) NewGaugeVecFunc(name, help string, labelNames []string, fn func() []Sample) {
+	r.register(&funcMetric{d: &desc{name, help, typeGauge, labelNames}, fn: fn})
+}
+
+// WriteTo writes every metric in the registry to w using the Prometheus text exposition
+// format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].desc().name < metrics[j].desc().name
+	})
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		d := m.desc()
+		fmt.Fprintf(bw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", d.name, d.metricType)
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics in the registry using the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Counter is a metric whose value only goes up.
+type Counter struct {
+	vec *vec[*floatSeries]
+}
+
+// Inc increments the series with the provided label values by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the provided label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter: %s cannot decrease", c.vec.d.name))
+	}
+	c.vec.get(labelValues).add(v)
+}
+
+// Value returns the current value of the series with the provided label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	if s, ok := c.vec.lookup(labelValues); ok {
+		return s.value()
+	}
+	return 0
+}
+
+func (c *Counter) desc() *desc { return c.vec.d }
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.vec.each(func(labelValues []string, s *floatSeries) {
+		writeSample(w, c.vec.d.name, c.vec.d.labelNames, labelValues, "", "", s.value())
+	})
+}
+
+// Gauge is a metric whose value can go up and down.
+type Gauge struct {
+	vec *vec[*floatSeries]
+}
+
+// Set sets the series with the provided label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	atomic.StoreUint64(&g.vec.get(labelValues).bits, math.Float64bits(v))
+}
+
+// Add adds v to the series with the provided label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.vec.get(labelValues).add(v)
+}
+
+// Value returns the current value of the series with the provided label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	if s, ok := g.vec.lookup(labelValues); ok {
+		return s.value()
+	}
+	return 0
+}
+
+func (g *Gauge) desc() *desc { return g.vec.d }
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.vec.each(func(labelValues []string, s *floatSeries) {
+		writeSample(w, g.vec.d.name, g.vec.d.labelNames, labelValues, "", "", s.value())
+	})
+}
+
+// Histogram is a metric that counts observations in buckets.
+type Histogram struct {
+	vec     *vec[*histogramSeries]
+	buckets []float64
+}
+
+// Observe records v in the series with the provided label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	s := h.vec.get(labelValues)
+	// Buckets are stored non-cumulatively and accumulated when they're written.
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		atomic.AddUint64(&s.counts[i], 1)
+	}
+	atomic.AddUint64(&s.count, 1)
+	s.sum.add(v)
+}
+
+// Count returns the number of observations in the series with the provided label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	if s, ok := h.vec.lookup(labelValues); ok {
+		return atomic.LoadUint64(&s.count)
+	}
+	return 0
+}
+
+func (h *Histogram) desc() *desc { return h.vec.d }
+
+func (h *Histogram) write(w *bufio.Writer) {
+	d := h.vec.d
+	h.vec.each(func(labelValues []string, s *histogramSeries) {
+		// Load the total count first so that it's never less than the buckets, which
+		// are incremented before it.
+		count := atomic.LoadUint64(&s.count)
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			cumulative += atomic.LoadUint64(&s.counts[i])
+			if cumulative > count {
+				cumulative = count
+			}
+			writeSample(
+				w, d.name+"_bucket", d.labelNames, labelValues,
+				"le", formatFloat(upperBound), float64(cumulative))
+		}
+		writeSample(w, d.name+"_bucket", d.labelNames, labelValues, "le", "+Inf", float64(count))
+		writeSample(w, d.name+"_sum", d.labelNames, labelValues, "", "", s.sum.value())
+		writeSample(w, d.name+"_count", d.labelNames, labelValues, "", "", float64(count))
+	})
+}
+
+type funcMetric struct {
+	d  *desc
+	fn func() []Sample
+}
+
+func (f *funcMetric) desc() *desc { return f.d }
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	samples := f.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, labelValuesSeparator) <
+			strings.Join(samples[j].LabelValues, labelValuesSeparator)
+	})
+	for _, sample := range samples {
+		if len(sample.LabelValues) != len(f.d.labelNames) {
+			panic(fmt.Sprintf(
+				"metric: %s has %d label names, but sample has %d label values",
+				f.d.name, len(f.d.labelNames), len(sample.LabelValues)))
+		}
+		writeSample(w, f.d.name, f.d.labelNames, sample.LabelValues, "", "", sample.Value)
+	}
+}
+
+// vec contains every series of a metric by their label values.
+type vec[S any] struct {
+	sync.RWMutex
+	d         *desc
+	newSeries func() S
+	series    map[string]S
+}
+
+func newVec[S any](d *desc, newSeries func() S) *vec[S] {
+	return &vec[S]{d: d, newSeries: newSeries, series: make(map[string]S)}
+}
+
+// lookup returns the series with the provided label values, if it exists.
+func (v *vec[S]) lookup(labelValues []string) (S, bool) {
+	key := v.key(labelValues)
+	v.RLock()
+	defer v.RUnlock()
+	s, ok := v.series[key]
+	return s, ok
+}
+
+// get returns the series with the provided label values, creating it if necessary.
+func (v *vec[S]) get(labelValues []string) S {
+	if s, ok := v.lookup(labelValues); ok {
+		return s
+	}
+
+	key := v.key(labelValues)
+	v.Lock()
+	defer v.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	s := v.newSeries()
+	v.series[key] = s
+	return s
+}
+
+// init creates the series of metrics without labels so that they're reported (as zero)
+// before they're first updated.
+func (v *vec[S]) init() {
+	if len(v.d.labelNames) == 0 {
+		v.get(nil)
+	}
+}
+
+func (v *vec[S]) key(labelValues []string) string {
+	if len(labelValues) != len(v.d.labelNames) {
+		panic(fmt.Sprintf(
+			"metric: %s has %d label names, but got %d label values",
+			v.d.name, len(v.d.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, labelValuesSeparator)
+}
+
+func (v *vec[S]) each(fn func(labelValues []string, s S)) {
+	v.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	v.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.RLock()
+		s := v.series[key]
+		v.RUnlock()
+
+		var labelValues []string
+		if len(v.d.labelNames) > 0 {
+			labelValues = strings.Split(key, labelValuesSeparator)
+		}
+		fn(labelValues, s)
+	}
+}
+
+type floatSeries struct {
+	bits uint64
+}
+
+func newFloatSeries() *floatSeries {
+	return &floatSeries{}
+}
+
+func (s *floatSeries) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&s.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (s *floatSeries) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+type histogramSeries struct {
+	// Accessed atomically, kept as the first field to guarantee 64-bit alignment.
+	count  uint64
+	sum    floatSeries
+	counts []uint64
+}
+
+func writeSample(
+	w *bufio.Writer,
+	name string,
+	labelNames []string,
+	labelValues []string,
+	extraLabelName string,
+	extraLabelValue string,
+	value float64,
+) {
+	w.WriteString(name)
+	if len(labelNames) > 0 || extraLabelName != "" {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, labelName, labelValues[i])
+		}
+		if extraLabelName != "" {
+			if len(labelNames) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, extraLabelName, extraLabelValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func writeLabel(w *bufio.Writer, name, value string) {
+	w.WriteString(name)
+	w.WriteString(`="`)
+	w.WriteString(labelValueEscaper.Replace(value))
+	w.WriteByte('"')
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	counter := r.NewCounter("requests_total", "Total number of requests.", "method", "result")
+	counter.Inc("get", "success")
+	counter.Inc("get", "success")
+	counter.Add(0.5, "put", "error")
+	require.Equal(t, float64(2), counter.Value("get", "success"))
+	require.Equal(t, float64(0), counter.Value("get", "error"))
+
+	gauge := r.NewGauge("in_flight", "Number of in-flight requests.")
+	gauge.Set(3)
+	gauge.Add(-1)
+	require.Equal(t, float64(2), gauge.Value())
+
+	histogram := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	histogram.Observe(0.05, "get")
+	histogram.Observe(0.5, "get")
+	histogram.Observe(5, "get")
+	require.Equal(t, uint64(3), histogram.Count("get"))
+	require.Equal(t, uint64(0), histogram.Count("put"))
+
+	r.NewGaugeFunc("memory_bytes", "Memory\nusage.", func() float64 { return 1024 })
+	r.NewCounterVecFunc("events_total", "Events.", []string{"kind"}, func() []Sample {
+		return []Sample{
+			{LabelValues: []string{`b"\`}, Value: 2},
+			{LabelValues: []string{"a"}, Value: 1},
+		}
+	})
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	require.Equal(t, `# HELP events_total Events.
+# TYPE events_total counter
+events_total{kind="a"} 1
+events_total{kind="b\"\\"} 2
+# HELP in_flight Number of in-flight requests.
+# TYPE in_flight gauge
+in_flight 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="get",le="0.1"} 1
+latency_seconds_bucket{method="get",le="1"} 2
+latency_seconds_bucket{method="get",le="+Inf"} 3
+latency_seconds_sum{method="get"} 5.55
+latency_seconds_count{method="get"} 3
+# HELP memory_bytes Memory\nusage.
+# TYPE memory_bytes gauge
+memory_bytes 1024
+# HELP requests_total Total number of requests.
+# TYPE requests_total counter
+requests_total{method="get",result="success"} 2
+requests_total{method="put",result="error"} 0.5
+`, buf.String())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, buf.String(), w.Body.String())
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("requests_total", "Total number of requests.", "method")
+
+	// Duplicate names.
+	require.Panics(t, func() { r.NewGauge("requests_total", "") })
+	// Wrong number of label values.
+	require.Panics(t, func() { counter.Inc() })
+	require.Panics(t, func() { counter.Inc("get", "extra") })
+	// Unsorted buckets.
+	require.Panics(t, func() { r.NewHistogram("latency_seconds", "", []float64{1, 0.1}) })
+}
+
+func TestRegistryMetricsWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Total number of requests.")
+	r.NewCounter("errors_total", "Total number of errors.", "kind")
+
+	// Metrics without labels are reported before they're updated.
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, `# HELP errors_total Total number of errors.
+# TYPE errors_total counter
+# HELP requests_total Total number of requests.
+# TYPE requests_total counter
+requests_total 0
+`, buf.String())
+}
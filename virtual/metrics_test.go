@@ -0,0 +1,96 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/metrics"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetricsEndpoint ensures that the environment's metrics are updated as actors are
+// invoked and that they're served by the server's /metrics endpoint.
+func TestMetricsEndpoint(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		metricsReg  = metrics.NewRegistry()
+		port        = getFreePort(t)
+		opts        = defaultOptsGoByte
+	)
+	defer reg.Close(ctx)
+
+	opts.Metrics = metricsReg
+	opts.Discovery.Port = port
+	opts.ForceRemoteProcedureCalls = true
+	env, err := NewEnvironment(ctx, "serverID1", reg, moduleStore, NewHTTPClient(), opts)
+	require.NoError(t, err)
+	defer env.Close(ctx)
+	require.Equal(t, metricsReg, env.Metrics())
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	server := NewServer(moduleStore, env)
+	go server.Start(port)
+	defer server.Stop(ctx)
+	addr := net.JoinHostPort(Localhost, strconv.Itoa(port))
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "unknown", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+	for i := 0; i < 3; i++ {
+		// Invalid requests shouldn't create new series.
+		_, err = env.InvokeActor(
+			ctx, fmt.Sprintf("ns-%d", i+2), "a", fmt.Sprintf("module-%d", i), "unknown", nil,
+			types.CreateIfNotExist{})
+		require.Error(t, err)
+	}
+	require.NoError(t, env.Heartbeat())
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, sample := range []string{
+		`nola_invocations_total{kind="invoke",namespace="ns-1",module="test-module",operation="inc",result="success"} 2`,
+		`nola_invocations_total{kind="invoke",namespace="ns-1",module="test-module",operation="other",result="error"} 1`,
+		`nola_invocations_total{kind="invoke",namespace="other",module="other",operation="other",result="error"} 3`,
+		`nola_invocations_total{kind="direct",namespace="ns-1",module="test-module",operation="inc",result="success"} 2`,
+		`nola_invocation_duration_seconds_count{kind="invoke",namespace="ns-1",module="test-module",operation="inc"} 2`,
+		`nola_actor_activations_total{namespace="ns-1",module="test-module"} 1`,
+		`nola_activated_actors 1`,
+		// One for each of the actors.
+		`nola_activation_cache_requests_total{result="miss"} 4`,
+		// The initial heartbeat and the one that was forced.
+		`nola_registry_call_duration_seconds_count{method="Heartbeat",result="success"} 2`,
+		`nola_heartbeat_failures_total 0`,
+	} {
+		require.Contains(t, string(body), sample+"\n")
+	}
+	require.NotContains(t, string(body), `operation="unknown"`)
+	require.NotContains(t, string(body), `module="module-0"`)
+}
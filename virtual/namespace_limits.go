@@ -0,0 +1,56 @@
+package virtual
+
+import (
+	"sync"
+	"time"
+)
+
+// namespaceRateLimiter enforces this server's share of
+// NamespaceLimits.MaxInvocationsPerSecond with a token bucket per namespace. The burst
+// size of each bucket is equal to its rate so that a namespace can use up to one second
+// worth of invocations at once.
+type namespaceRateLimiter struct {
+	sync.Mutex
+
+	_buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newNamespaceRateLimiter() *namespaceRateLimiter {
+	return &namespaceRateLimiter{
+		_buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow returns true if the namespace can perform another invocation without exceeding
+// ratePerSecond, and consumes a token if so.
+func (l *namespaceRateLimiter) allow(namespace string, ratePerSecond int, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	burst := float64(ratePerSecond)
+	bucket, ok := l._buckets[namespace]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, lastRefill: now}
+		l._buckets[namespace] = bucket
+	}
+
+	if elapsed := now.Sub(bucket.lastRefill); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * float64(ratePerSecond)
+		bucket.lastRefill = now
+	}
+	if bucket.tokens > burst {
+		// Also handles the rate being lowered since the last invocation.
+		bucket.tokens = burst
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -47,6 +47,18 @@ func (m *HashRing) Add(keys ...string) {
 	sort.Ints(m.keys)
 }
 
+// AddWithReplicas is the same as Add, except it allows the number of replicas
+// to be specified for the key instead of using the ring's default. This is useful
+// for giving some keys a larger share of the ring than others.
+func (m *HashRing) AddWithReplicas(key string, replicas int) {
+	for i := 0; i < replicas; i++ {
+		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		m.keys = append(m.keys, hash)
+		m.hashMap[hash] = key
+	}
+	sort.Ints(m.keys)
+}
+
 // Get gets the closest item in the hash to the provided key.
 func (m *HashRing) Get(key string) string {
 	if m.IsEmpty() {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -26,6 +27,14 @@ const (
 	DNS_ACTOR_GENERATION = 1
 	// Must be at least 1 because <= 0 is not a legal versionstamp
 	DNSVersionStamp = 1
+
+	// hashRingReplicas is the number of replicas each address is assigned
+	// in the hash ring by default.
+	hashRingReplicas = 64
+	// maxWeightMultiplier caps how many times more replicas a heavily
+	// weighted address can be assigned compared to the lightest one so that
+	// extreme weights don't blow up the size of the hash ring.
+	maxWeightMultiplier = 16
 )
 
 // DNSResolver is the interface that must be implemented by a resolver
@@ -45,8 +54,11 @@ type dnsRegistry struct {
 	opts     DNSRegistryOptions
 
 	// State.
-	addresses []registry.Address
-	hashRing  *HashRing
+	addresses         []registry.Address
+	ringMembers       []string
+	hashRing          *HashRing
+	membershipVersion int64
+	changes           *registry.ActivationChangeFeed
 
 	// Shutdown logic.
 	discoveryRunning bool
@@ -102,6 +114,7 @@ func NewDNSRegistryFromResolver(
 		resolver: resolver,
 		host:     host,
 		opts:     opts,
+		changes:  registry.NewActivationChangeFeed(),
 
 		closeCh:  make(chan struct{}),
 		closedCh: make(chan struct{}),
@@ -144,6 +157,54 @@ func (d *dnsRegistry) EnsureActivation(
 		[]types.ActorReference{ref}, DNSVersionStamp, DNSServerID), nil
 }
 
+func (d *dnsRegistry) EnsureActivations(
+	ctx context.Context,
+	reqs []registry.EnsureActivationRequest,
+) ([]registry.EnsureActivationResult, error) {
+	// Placement is computed locally so there is nothing to gain from batching.
+	results := make([]registry.EnsureActivationResult, 0, len(reqs))
+	for _, req := range reqs {
+		result, err := d.EnsureActivation(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// MigrateActor is not supported because actor placement is determined entirely by the
+// consistent hash ring.
+func (d *dnsRegistry) MigrateActor(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	targetServerID string,
+) (registry.MigrateActorResult, error) {
+	return registry.MigrateActorResult{}, fmt.Errorf(
+		"MigrateActor: not supported by dnsregistry since actor placement is determined by the hash ring")
+}
+
+// LookupActivation returns the server that owns the actor according to the hash ring.
+// Actors are always "activated" on the server that owns them.
+func (d *dnsRegistry) LookupActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	result, err := d.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		Namespace: namespace,
+		ModuleID:  moduleID,
+		ActorID:   actorID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("LookupActivation: %w", err)
+	}
+	return result.References, nil
+}
+
 func (d *dnsRegistry) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
@@ -156,18 +217,62 @@ func (d *dnsRegistry) Heartbeat(
 	serverID string,
 	heartbeatState registry.HeartbeatState,
 ) (registry.HeartbeatResult, error) {
+	d.RLock()
+	membershipVersion := d.membershipVersion
+	d.RUnlock()
+
 	return registry.HeartbeatResult{
 		VersionStamp: DNSVersionStamp,
 		// Must be at least 1 so heartbeat.Versionstamp + TTL > DNSVersionStamp
 		HeartbeatTTL:  1,
 		ServerVersion: DNSServerVersion,
+		// Environments use this to detect that the hash ring has changed and that
+		// some of their activated actors may now be owned by a different server.
+		MembershipVersion: membershipVersion,
 	}, nil
 }
 
+func (d *dnsRegistry) Watch(ctx context.Context) (<-chan registry.ActivationChange, error) {
+	ch, err := d.changes.Subscribe(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Watch: error subscribing: %w", err)
+	}
+	return ch, nil
+}
+
+// GetClusterSettings returns the default settings. The dnsregistry doesn't track server
+// liveness with heartbeats (cluster membership is determined by DNS) so the settings
+// only control how often environments heartbeat.
+func (d *dnsRegistry) GetClusterSettings(ctx context.Context) (registry.ClusterSettings, error) {
+	return registry.DefaultClusterSettings(), nil
+}
+
+func (d *dnsRegistry) SetClusterSettings(ctx context.Context, settings registry.ClusterSettings) error {
+	return fmt.Errorf("SetClusterSettings: not supported by dnsregistry since it has no shared storage")
+}
+
+// GetNamespaceLimits returns no limits since the dnsregistry has no shared storage to
+// enforce them with.
+func (d *dnsRegistry) GetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+) (registry.NamespaceLimits, error) {
+	return registry.NamespaceLimits{}, nil
+}
+
+func (d *dnsRegistry) SetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+	limits registry.NamespaceLimits,
+) error {
+	return fmt.Errorf("SetNamespaceLimits: not supported by dnsregistry since it has no shared storage")
+}
+
 func (d *dnsRegistry) Close(ctx context.Context) error {
 	d.log.Info("Shutting down")
 	close(d.closeCh)
 	<-d.closedCh
+	d.changes.Close()
 	d.log.Info("Done shutting down")
 	return nil
 }
@@ -185,30 +290,48 @@ func (d *dnsRegistry) discover() error {
 	// crc32.ChecksumIEEE because thats the default groupcache uses
 	// https://github.com/golang/groupcache/blob/41bb18bfe9da5321badc438f91158cd790a33aa3/http.go#L72
 	// should investigate if we should pick a different value.
-	var ()
-	hashRing := NewHashRing(64, crc32.ChecksumIEEE)
-	ipStrs := make([]string, 0, len(addresses))
-	for _, addr := range addresses {
+	hashRing := NewHashRing(hashRingReplicas, crc32.ChecksumIEEE)
+	ringMembers := make([]string, 0, len(addresses))
+	replicasByAddress := replicasForAddresses(addresses)
+	for i, addr := range addresses {
+		var ipStr string
 		if addr.IP.To4() != nil {
-			ipStrs = append(ipStrs, fmt.Sprintf("%s:%d", addr.IP.To4().String(), addr.Port))
+			ipStr = fmt.Sprintf("%s:%d", addr.IP.To4().String(), addr.Port)
 		} else if addr.IP.To16() != nil {
-			ipStrs = append(ipStrs, fmt.Sprintf("[%s]:%d", addr.IP.To16().String(), addr.Port))
+			ipStr = fmt.Sprintf("[%s]:%d", addr.IP.To16().String(), addr.Port)
 		} else {
 			d.log.Info("[invariant violated] IP is not IP4 or IP6, skipping", slog.Any("ip", addr))
+			continue
 		}
+		hashRing.AddWithReplicas(ipStr, replicasByAddress[i])
+		// Include the number of replicas so that weight changes are also considered
+		// a membership change since they change which server owns which actors.
+		ringMembers = append(ringMembers, fmt.Sprintf("%s@%d", ipStr, replicasByAddress[i]))
 	}
-	hashRing.Add(ipStrs...)
+	sort.Strings(ringMembers)
 
 	d.Lock()
 	oldAddresses := d.addresses
+	membershipChanged := !stringSlicesEqual(d.ringMembers, ringMembers)
+	if membershipChanged {
+		d.membershipVersion++
+	}
+	membershipVersion := d.membershipVersion
 	d.addresses = addresses
+	d.ringMembers = ringMembers
 	d.hashRing = hashRing
 	d.Unlock()
 
-	if len(d.addresses) != len(oldAddresses) {
+	if membershipChanged {
 		d.log.Info(
 			"discovered new IP addresses",
-			slog.Any("prev", oldAddresses), slog.Any("curr", addresses))
+			slog.Any("prev", oldAddresses), slog.Any("curr", addresses),
+			slog.Int64("membership_version", membershipVersion))
+
+		// Placement is a pure function of the hash ring so there is no way to tell
+		// which actors moved without recomputing every placement. Just tell watchers
+		// to discard everything they have cached.
+		d.changes.Publish(registry.ActivationChange{Type: registry.ActivationChangeTypeReset})
 	}
 
 	return nil
@@ -236,6 +359,50 @@ func (d *dnsRegistry) discoveryLoop() {
 	}
 }
 
+// replicasForAddresses returns the number of hash ring replicas that should be
+// assigned to each of the addresses based on their relative weights. The address
+// with the lowest weight is assigned the default number of replicas and every other
+// address is assigned proportionally more (up to a limit) so that its share of the
+// ring matches its weight.
+func replicasForAddresses(addresses []registry.Address) []int {
+	minWeight := 0
+	for _, addr := range addresses {
+		w := addressWeight(addr)
+		if minWeight == 0 || w < minWeight {
+			minWeight = w
+		}
+	}
+
+	replicas := make([]int, 0, len(addresses))
+	for _, addr := range addresses {
+		r := hashRingReplicas * addressWeight(addr) / minWeight
+		if r > hashRingReplicas*maxWeightMultiplier {
+			r = hashRingReplicas * maxWeightMultiplier
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+func addressWeight(addr registry.Address) int {
+	if addr.Weight <= 0 {
+		return 1
+	}
+	return addr.Weight
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type constResolver struct {
 	sync.Mutex
 	addresses []registry.Address
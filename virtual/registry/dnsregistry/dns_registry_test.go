@@ -2,6 +2,7 @@ package dnsregistry
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"strings"
 	"testing"
@@ -100,3 +101,83 @@ func TestDNSRegistrySingleNode(t *testing.T) {
 	require.Equal(t, DNSServerID, activations.References[0].Physical.ServerID)
 	require.Equal(t, DNSServerVersion, activations.References[0].Physical.ServerVersion)
 }
+
+// TestDNSRegistryMembershipVersion tests that the membership version returned by Heartbeat
+// is only incremented when the set of servers in the hash ring actually changes.
+func TestDNSRegistryMembershipVersion(t *testing.T) {
+	resolver := newConstResolver([]registry.Address{
+		{IP: net.ParseIP("127.0.0.1"), Port: 9090},
+		{IP: net.ParseIP("127.0.0.2"), Port: 9090},
+	})
+	reg, err := NewDNSRegistryFromResolver(resolver, "test", DNSRegistryOptions{
+		ResolveEvery: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() {
+		if err := reg.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	result, err := reg.Heartbeat(context.Background(), "serverID", registry.HeartbeatState{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), result.MembershipVersion)
+
+	// Same set of servers in a different order should not be considered a membership change.
+	resolver.setIPs([]registry.Address{
+		{IP: net.ParseIP("127.0.0.2"), Port: 9090},
+		{IP: net.ParseIP("127.0.0.1"), Port: 9090},
+	})
+	time.Sleep(100 * time.Millisecond)
+	result, err = reg.Heartbeat(context.Background(), "serverID", registry.HeartbeatState{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), result.MembershipVersion)
+
+	// Same number of servers, but one of them has changed.
+	resolver.setIPs([]registry.Address{
+		{IP: net.ParseIP("127.0.0.1"), Port: 9090},
+		{IP: net.ParseIP("127.0.0.3"), Port: 9090},
+	})
+	for {
+		result, err = reg.Heartbeat(context.Background(), "serverID", registry.HeartbeatState{})
+		require.NoError(t, err)
+		if result.MembershipVersion == 2 {
+			break
+		}
+		require.Equal(t, int64(1), result.MembershipVersion)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestDNSRegistryWeights tests that addresses with a higher weight are assigned
+// proportionally more actors.
+func TestDNSRegistryWeights(t *testing.T) {
+	resolver := newConstResolver([]registry.Address{
+		{IP: net.ParseIP("127.0.0.1"), Port: 9090, Weight: 1},
+		{IP: net.ParseIP("127.0.0.2"), Port: 9091, Weight: 4},
+	})
+	reg, err := NewDNSRegistryFromResolver(resolver, "test", DNSRegistryOptions{})
+	require.NoError(t, err)
+	defer func() {
+		if err := reg.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	counts := map[string]int{}
+	for i := 0; i < 10_000; i++ {
+		activations, err := reg.EnsureActivation(context.Background(), registry.EnsureActivationRequest{
+			Namespace: "ns1",
+			ActorID:   fmt.Sprintf("a-%d", i),
+			ModuleID:  "test-module",
+		})
+		require.NoError(t, err)
+		counts[activations.References[0].Physical.ServerState.Address]++
+	}
+
+	// Consistent hashing is not perfectly uniform so just make sure the heavier
+	// address received significantly more actors.
+	require.Equal(t, 2, len(counts))
+	ratio := float64(counts["127.0.0.2:9091"]) / float64(counts["127.0.0.1:9090"])
+	require.True(t, ratio > 1.5, "ratio: %f", ratio)
+}
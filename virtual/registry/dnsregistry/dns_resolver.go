@@ -3,6 +3,11 @@ package dnsregistry
 import (
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/registry"
 )
@@ -32,3 +37,230 @@ func (d *dnsResolver) LookupIP(host string) ([]registry.Address, error) {
 
 	return addrs, nil
 }
+
+type srvResolver struct {
+	service string
+	proto   string
+
+	// Var so they can be replaced in tests.
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+	lookupIP  func(host string) ([]net.IP, error)
+}
+
+// NewSRVResolver returns a new DNSResolver that discovers servers by looking up
+// the SRV records for the host instead of its A/AAAA records. Unlike the resolver
+// returned by NewDNSResolver, this allows every server to listen on a different
+// port (as advertised by the SRV record) and to have a different weight.
+//
+// The service and proto arguments are passed directly to net.LookupSRV, so if
+// both are empty then the host is looked up directly. This is usually what is
+// required for Kubernetes headless services, for example:
+// "_grpc._tcp.nola.default.svc.cluster.local".
+func NewSRVResolver(service, proto string) DNSResolver {
+	return &srvResolver{
+		service:   service,
+		proto:     proto,
+		lookupSRV: net.LookupSRV,
+		lookupIP:  net.LookupIP,
+	}
+}
+
+func (s *srvResolver) LookupIP(host string) ([]registry.Address, error) {
+	_, srvs, err := s.lookupSRV(s.service, s.proto, host)
+	if err != nil {
+		return nil, fmt.Errorf("error in net.LookupSRV: %w", err)
+	}
+
+	addrs := make([]registry.Address, 0, len(srvs))
+	for _, srv := range srvs {
+		ips, err := s.lookupIP(srv.Target)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error in net.LookupIP for SRV target: %s, err: %w", srv.Target, err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, registry.Address{
+				IP:     ip,
+				Port:   int(srv.Port),
+				Weight: int(srv.Weight),
+			})
+		}
+	}
+
+	return addrs, nil
+}
+
+type staticResolver struct {
+	entries []resolverEntry
+
+	// Var so it can be replaced in tests.
+	lookupIP func(host string) ([]net.IP, error)
+}
+
+// NewStaticResolver returns a new DNSResolver that always resolves to the provided
+// list of servers, regardless of the host it is asked to resolve. Each entry must
+// be in the format "host:port", optionally followed by whitespace and a weight, for
+// example: "10.0.0.1:9090" or "nola-1:9091 2". Hostnames are resolved every time
+// the resolver is invoked.
+//
+// This is useful for environments like docker-compose where the set of servers is
+// known ahead of time, but each one may listen on a different port.
+func NewStaticResolver(entries []string) (DNSResolver, error) {
+	parsed, err := parseResolverEntries(entries)
+	if err != nil {
+		return nil, fmt.Errorf("NewStaticResolver: %w", err)
+	}
+
+	return &staticResolver{
+		entries:  parsed,
+		lookupIP: net.LookupIP,
+	}, nil
+}
+
+func (s *staticResolver) LookupIP(host string) ([]registry.Address, error) {
+	return resolveEntries(s.entries, s.lookupIP)
+}
+
+type fileResolver struct {
+	sync.Mutex
+
+	path string
+
+	// Var so it can be replaced in tests.
+	lookupIP func(host string) ([]net.IP, error)
+
+	// State.
+	modTime time.Time
+	size    int64
+	entries []resolverEntry
+}
+
+// NewFileResolver returns a new DNSResolver that reads the list of servers from
+// the file at the provided path. The file must contain one entry per line in the
+// same format accepted by NewStaticResolver. Empty lines and lines starting with
+// '#' are ignored.
+//
+// The file is checked for modifications every time the resolver is invoked (I.E
+// every DNSRegistryOptions.ResolveEvery) and reloaded if it changed. If the file
+// can't be read or parsed then an error is returned and the registry will keep
+// using the last successfully resolved set of servers.
+func NewFileResolver(path string) (DNSResolver, error) {
+	f := &fileResolver{
+		path:     path,
+		lookupIP: net.LookupIP,
+	}
+	if err := f.maybeReload(); err != nil {
+		return nil, fmt.Errorf("NewFileResolver: %w", err)
+	}
+	return f, nil
+}
+
+func (f *fileResolver) LookupIP(host string) ([]registry.Address, error) {
+	if err := f.maybeReload(); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	entries := f.entries
+	f.Unlock()
+
+	return resolveEntries(entries, f.lookupIP)
+}
+
+func (f *fileResolver) maybeReload() error {
+	f.Lock()
+	defer f.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("error stating resolver file: %s, err: %w", f.path, err)
+	}
+	if f.entries != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		// File has not changed since it was last loaded.
+		return nil
+	}
+
+	contents, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("error reading resolver file: %s, err: %w", f.path, err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	entries, err := parseResolverEntries(lines)
+	if err != nil {
+		return fmt.Errorf("error parsing resolver file: %s, err: %w", f.path, err)
+	}
+
+	f.entries = entries
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+type resolverEntry struct {
+	host   string
+	port   int
+	weight int
+}
+
+func parseResolverEntries(entries []string) ([]resolverEntry, error) {
+	parsed := make([]resolverEntry, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid entry: %q, expected format is: host:port [weight]", entry)
+		}
+
+		host, portStr, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry: %q, err: %w", entry, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 {
+			return nil, fmt.Errorf("invalid port in entry: %q", entry)
+		}
+
+		var weight int
+		if len(fields) == 2 {
+			weight, err = strconv.Atoi(fields[1])
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in entry: %q", entry)
+			}
+		}
+
+		parsed = append(parsed, resolverEntry{host: host, port: port, weight: weight})
+	}
+
+	return parsed, nil
+}
+
+func resolveEntries(
+	entries []resolverEntry,
+	lookupIP func(host string) ([]net.IP, error),
+) ([]registry.Address, error) {
+	addrs := make([]registry.Address, 0, len(entries))
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry.host); ip != nil {
+			addrs = append(addrs, registry.Address{IP: ip, Port: entry.port, Weight: entry.weight})
+			continue
+		}
+
+		ips, err := lookupIP(entry.host)
+		if err != nil {
+			return nil, fmt.Errorf("error in net.LookupIP for host: %s, err: %w", entry.host, err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, registry.Address{IP: ip, Port: entry.port, Weight: entry.weight})
+		}
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,98 @@
+package dnsregistry
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSRVResolver(t *testing.T) {
+	resolver := NewSRVResolver("", "").(*srvResolver)
+	resolver.lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		require.Equal(t, "_nola._tcp.example.com", name)
+		return name, []*net.SRV{
+			{Target: "a.example.com.", Port: 9090, Weight: 1},
+			{Target: "b.example.com.", Port: 9091, Weight: 3},
+		}, nil
+	}
+	resolver.lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "a.example.com.":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "b.example.com.":
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		default:
+			return nil, errors.New("unknown host")
+		}
+	}
+
+	addrs, err := resolver.LookupIP("_nola._tcp.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []registry.Address{
+		{IP: net.ParseIP("10.0.0.1"), Port: 9090, Weight: 1},
+		{IP: net.ParseIP("10.0.0.2"), Port: 9091, Weight: 3},
+	}, addrs)
+}
+
+func TestStaticResolver(t *testing.T) {
+	_, err := NewStaticResolver([]string{"10.0.0.1"})
+	require.Error(t, err)
+	_, err = NewStaticResolver([]string{"10.0.0.1:abc"})
+	require.Error(t, err)
+	_, err = NewStaticResolver([]string{"10.0.0.1:9090 abc"})
+	require.Error(t, err)
+
+	resolver, err := NewStaticResolver([]string{"10.0.0.1:9090", "[::1]:9091 2", "nola-3:9092"})
+	require.NoError(t, err)
+	resolver.(*staticResolver).lookupIP = func(host string) ([]net.IP, error) {
+		require.Equal(t, "nola-3", host)
+		return []net.IP{net.ParseIP("10.0.0.3")}, nil
+	}
+
+	addrs, err := resolver.LookupIP("ignored")
+	require.NoError(t, err)
+	require.Equal(t, []registry.Address{
+		{IP: net.ParseIP("10.0.0.1"), Port: 9090},
+		{IP: net.ParseIP("::1"), Port: 9091, Weight: 2},
+		{IP: net.ParseIP("10.0.0.3"), Port: 9092},
+	}, addrs)
+}
+
+func TestFileResolverReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\n10.0.0.1:9090\n\n10.0.0.2:9091\n"), 0644))
+
+	resolver, err := NewFileResolver(path)
+	require.NoError(t, err)
+
+	addrs, err := resolver.LookupIP("ignored")
+	require.NoError(t, err)
+	require.Equal(t, []registry.Address{
+		{IP: net.ParseIP("10.0.0.1"), Port: 9090},
+		{IP: net.ParseIP("10.0.0.2"), Port: 9091},
+	}, addrs)
+
+	// Make sure the modification time changes even on file systems with coarse timestamps.
+	require.NoError(t, os.WriteFile(path, []byte("10.0.0.3:9092 5\n"), 0644))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	addrs, err = resolver.LookupIP("ignored")
+	require.NoError(t, err)
+	require.Equal(t, []registry.Address{
+		{IP: net.ParseIP("10.0.0.3"), Port: 9092, Weight: 5},
+	}, addrs)
+
+	// Invalid file should return an error so the registry keeps the previous addresses.
+	require.NoError(t, os.WriteFile(path, []byte("not-valid\n"), 0644))
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	_, err = resolver.LookupIP("ignored")
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// NamespaceLimitExceededErr indicates that an operation was rejected because it would
+// exceed one of the limits configured for the namespace (see NamespaceLimits). It
+// implements the HTTPError interface of the virtual package so it maps to HTTP 429.
+type NamespaceLimitExceededErr struct {
+	err error
+}
+
+// NewNamespaceLimitExceededError creates a new NamespaceLimitExceededErr.
+func NewNamespaceLimitExceededError(err error) error {
+	return NamespaceLimitExceededErr{err: err}
+}
+
+func (n NamespaceLimitExceededErr) Error() string {
+	return fmt.Sprintf("NamespaceLimitExceededError: %s", n.err.Error())
+}
+
+func (n NamespaceLimitExceededErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*NamespaceLimitExceededErr)
+	_, ok2 := target.(NamespaceLimitExceededErr)
+	return ok1 || ok2
+}
+
+func (n NamespaceLimitExceededErr) HTTPStatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// IsNamespaceLimitExceededError returns a boolean indicating whether the error was caused
+// by the operation exceeding one of the namespace's limits.
+func IsNamespaceLimitExceededError(err error) bool {
+	return errors.Is(err, NamespaceLimitExceededErr{})
+}
+
+// ActorNotFoundErr indicates that an operation that requires an existing actor (like
+// MigrateActor) targeted an actor that doesn't exist. It implements the HTTPError
+// interface of the virtual package so it maps to HTTP 404.
+type ActorNotFoundErr struct {
+	err error
+}
+
+// NewActorNotFoundError creates a new ActorNotFoundErr.
+func NewActorNotFoundError(err error) error {
+	return ActorNotFoundErr{err: err}
+}
+
+func (a ActorNotFoundErr) Error() string {
+	return fmt.Sprintf("ActorNotFoundError: %s", a.err.Error())
+}
+
+func (a ActorNotFoundErr) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+
+	_, ok1 := target.(*ActorNotFoundErr)
+	_, ok2 := target.(ActorNotFoundErr)
+	return ok1 || ok2
+}
+
+func (a ActorNotFoundErr) HTTPStatusCode() int {
+	return http.StatusNotFound
+}
+
+// IsActorNotFoundError returns a boolean indicating whether the error was caused by the
+// operation targeting an actor that doesn't exist.
+func IsActorNotFoundError(err error) bool {
+	return errors.Is(err, ActorNotFoundErr{})
+}
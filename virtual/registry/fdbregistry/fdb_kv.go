@@ -79,6 +79,14 @@ func (tr *fdbTransaction) Get(
 	return v, true, nil
 }
 
+func (tr *fdbTransaction) Delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	tr.tr.Clear(fdb.Key(k))
+	return nil
+}
+
 func (tr *fdbTransaction) IterPrefix(
 	ctx context.Context,
 	prefix []byte,
@@ -101,6 +109,25 @@ func (tr *fdbTransaction) IterPrefix(
 	return nil
 }
 
+func (tr *fdbTransaction) IterRange(
+	ctx context.Context,
+	start, end []byte,
+	fn func(k, v []byte) error,
+) error {
+	keyRange := fdb.KeyRange{Begin: fdb.Key(start), End: fdb.Key(end)}
+	iter := tr.tr.GetRange(keyRange, fdb.RangeOptions{}).Iterator()
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return err
+		}
+		if err := fn(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (tr *fdbTransaction) GetVersionStamp() (int64, error) {
 	readV, err := tr.tr.GetReadVersion().Get()
 	if err != nil {
@@ -1,6 +1,9 @@
 package fdbregistry
 
-import "github.com/richardartoul/nola/virtual/registry"
+import (
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+)
 
 // NewFoundationDBRegistry creates a new FoundationDB backed registry.
 func NewFoundationDBRegistry(
@@ -20,3 +23,10 @@ func NewFoundationDBRegistry(
 			DisableHighConflictOperations: true,
 		}), nil
 }
+
+// NewFoundationDBKV creates a new FoundationDB backed kv.Store. It can be used as the
+// store for functionality built on top of kv.Store (like async invocations) so that it
+// is shared by every server in the cluster.
+func NewFoundationDBKV(clusterFile string) (kv.Store, error) {
+	return newFDBKV(clusterFile)
+}
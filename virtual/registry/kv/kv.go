@@ -16,7 +16,11 @@ type Store interface {
 type Transaction interface {
 	Put(ctx context.Context, key []byte, value []byte) error
 	Get(ctx context.Context, key []byte) ([]byte, bool, error)
+	// Delete removes the key (if it exists).
+	Delete(ctx context.Context, key []byte) error
 	IterPrefix(ctx context.Context, prefix []byte, fn func(k, v []byte) error) error
+	// IterRange iterates (in order) over every key that is >= start and < end.
+	IterRange(ctx context.Context, start, end []byte, fn func(k, v []byte) error) error
 	// Monotonically increase number that should increase at a rate of ~ 1 million
 	// per second.
 	GetVersionStamp() (int64, error)
@@ -0,0 +1,219 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Records stored in a Store are encoded with a compact binary format instead of JSON so
+// that hot transactions don't spend most of their CPU time encoding and decoding the
+// records they touch.
+//
+// Every record starts with a two byte header:
+//
+//	[schema version (1 byte)][record type (1 byte)][fields...]
+//
+// The schema version must be incremented any time the fields of the record change so that
+// the decoders can continue to read records written with older versions of the schema.
+// Fields are encoded in order using varints for integers (and the bits of floats) and
+// length-prefixed bytes for strings and byte slices.
+
+// ErrRecordTruncated is returned when a record ends before all of its fields were decoded.
+var ErrRecordTruncated = errors.New("record truncated")
+
+// RecordType describes a type of record.
+type RecordType struct {
+	// ID is stored in every record so that decoding a record of the wrong type fails
+	// instead of returning garbage. It must be unique among the records that the
+	// decoder could encounter.
+	ID byte
+	// Name is used in error messages.
+	Name string
+	// Version is the schema version used to encode new records. Records with any version
+	// between 1 and Version can be decoded.
+	Version byte
+}
+
+func (t RecordType) String() string {
+	return t.Name
+}
+
+// RecordEncoder encodes the fields of a record in order.
+type RecordEncoder struct {
+	buf []byte
+}
+
+// NewRecordEncoder creates a new RecordEncoder for a record of type t. sizeHint is the
+// expected size of the record's fields.
+func NewRecordEncoder(t RecordType, sizeHint int) *RecordEncoder {
+	buf := make([]byte, 0, 2+sizeHint)
+	buf = append(buf, t.Version, t.ID)
+	return &RecordEncoder{buf: buf}
+}
+
+// Bytes returns the encoded record.
+func (e *RecordEncoder) Bytes() []byte {
+	return e.buf
+}
+
+// PutUvarint encodes v.
+func (e *RecordEncoder) PutUvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// PutVarint encodes v.
+func (e *RecordEncoder) PutVarint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+// PutString encodes s.
+func (e *RecordEncoder) PutString(s string) {
+	e.PutUvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// PutBool encodes b.
+func (e *RecordEncoder) PutBool(b bool) {
+	if b {
+		e.PutUvarint(1)
+	} else {
+		e.PutUvarint(0)
+	}
+}
+
+// PutFloat64 encodes f.
+func (e *RecordEncoder) PutFloat64(f float64) {
+	e.PutUvarint(math.Float64bits(f))
+}
+
+// PutBytes encodes b.
+func (e *RecordEncoder) PutBytes(b []byte) {
+	e.PutUvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// RecordDecoder decodes the fields of a record in order. The first error that is
+// encountered is retained and every subsequent read returns the zero value so that
+// callers only need to check for an error once by calling Finish().
+type RecordDecoder struct {
+	t       RecordType
+	version byte
+	buf     []byte
+	err     error
+}
+
+// NewRecordDecoder creates a new RecordDecoder for b, which must contain a record of
+// type t.
+func NewRecordDecoder(b []byte, t RecordType) (*RecordDecoder, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("error decoding %s: %w", t, ErrRecordTruncated)
+	}
+	version := b[0]
+	if version < 1 || version > t.Version {
+		return nil, fmt.Errorf(
+			"error decoding %s: unsupported schema version: %d", t, version)
+	}
+	if id := b[1]; id != t.ID {
+		return nil, fmt.Errorf(
+			"[invariant violated] error decoding %s: unexpected record type: %d", t, id)
+	}
+	return &RecordDecoder{t: t, version: version, buf: b[2:]}, nil
+}
+
+// Version returns the schema version the record was encoded with.
+func (d *RecordDecoder) Version() byte {
+	return d.version
+}
+
+// Err returns the first error that was encountered while decoding, if any.
+func (d *RecordDecoder) Err() error {
+	return d.err
+}
+
+// ReadUvarint decodes a uint64.
+func (d *RecordDecoder) ReadUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrRecordTruncated
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// ReadVarint decodes an int64.
+func (d *RecordDecoder) ReadVarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrRecordTruncated
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// ReadLength decodes a length and makes sure that it can't possibly exceed the number
+// of bytes remaining so corrupt records can't trigger huge allocations.
+func (d *RecordDecoder) ReadLength() int {
+	l := d.ReadUvarint()
+	if d.err != nil {
+		return 0
+	}
+	if l > uint64(len(d.buf)) {
+		d.err = ErrRecordTruncated
+		return 0
+	}
+	return int(l)
+}
+
+// ReadBool decodes a bool.
+func (d *RecordDecoder) ReadBool() bool {
+	return d.ReadUvarint() != 0
+}
+
+// ReadFloat64 decodes a float64.
+func (d *RecordDecoder) ReadFloat64() float64 {
+	return math.Float64frombits(d.ReadUvarint())
+}
+
+// ReadBytes decodes a []byte.
+func (d *RecordDecoder) ReadBytes() []byte {
+	l := d.ReadLength()
+	if d.err != nil {
+		return nil
+	}
+	b := append([]byte(nil), d.buf[:l]...)
+	d.buf = d.buf[l:]
+	return b
+}
+
+// ReadString decodes a string.
+func (d *RecordDecoder) ReadString() string {
+	l := d.ReadLength()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.buf[:l])
+	d.buf = d.buf[l:]
+	return s
+}
+
+// Finish returns an error if decoding any of the fields failed, or if the record
+// contains more fields than were decoded.
+func (d *RecordDecoder) Finish() error {
+	if d.err != nil {
+		return fmt.Errorf("error decoding %s: %w", d.t, d.err)
+	}
+	if len(d.buf) > 0 {
+		return fmt.Errorf("error decoding %s: %d trailing bytes", d.t, len(d.buf))
+	}
+	return nil
+}
@@ -2,10 +2,12 @@ package registry
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/richardartoul/nola/virtual/registry/kv"
@@ -17,14 +19,36 @@ import (
 )
 
 const (
-	// HeartbeatTTL is the maximum amount of time between server heartbeats before
-	// the registry will consider a server as dead.
+	// HeartbeatTTL is the default maximum amount of time between server heartbeats
+	// before the registry will consider a server as dead.
 	//
-	// TODO: Should be configurable.
-	HeartbeatTTL = 5 * time.Second
+	// Deprecated: The TTL is configured per cluster (see ClusterSettings), use
+	// DefaultHeartbeatTTL instead.
+	HeartbeatTTL = DefaultHeartbeatTTL
 
 	// 2GiB, see KVRegistryOptions.RebalanceMemoryThreshold for more details.
 	DefaultRebalanceMemoryThreshold = 1 << 31
+	// 10%, see KVRegistryOptions.RebalanceMemoryUtilizationThreshold for more details.
+	DefaultRebalanceMemoryUtilizationThreshold = 0.1
+	// 25%, see KVRegistryOptions.RebalanceActorCountThreshold for more details.
+	DefaultRebalanceActorCountThreshold = 0.25
+	// DefaultMaxActorsToShedPerRequest is the default value for
+	// KVRegistryOptions.MaxActorsToShedPerRequest.
+	DefaultMaxActorsToShedPerRequest = 100
+	// DefaultActorCountRebalanceInterval is the default value for
+	// KVRegistryOptions.ActorCountRebalanceInterval.
+	DefaultActorCountRebalanceInterval = 30 * time.Second
+
+	// DefaultCompactionInterval is the default value for
+	// KVRegistryOptions.CompactionInterval.
+	DefaultCompactionInterval = time.Minute
+	// DefaultCompactServersAfter is the default value for
+	// KVRegistryOptions.CompactServersAfter.
+	DefaultCompactServersAfter = 10 * time.Minute
+
+	// serverLivenessPollInterval controls how often the registry checks for servers
+	// whose heartbeats have expired so it can notify watchers.
+	serverLivenessPollInterval = time.Second
 )
 
 var (
@@ -45,6 +69,27 @@ type kvRegistry struct {
 	kv                  kv.Store
 	opts                KVRegistryOptions
 	serverID            string
+
+	// changes is used to notify watchers of activation changes. Changes are recorded
+	// in the change log stored in the KV store (see kv_registry_changes.go) and are only
+	// published once they're read back from it so that watchers are notified of the
+	// changes made by every instance of the registry, not just this one.
+	changes *ActivationChangeFeed
+	// changeLogWriterID and changeLogSeq make the keys of the change log entries written
+	// by this instance unique.
+	changeLogWriterID string
+	changeLogSeq      atomic.Uint64
+	// serverActivationsBackfilled is set once every activation in the registry is known
+	// to be in the server activations index (see backfillServerActivations).
+	serverActivationsBackfilled atomic.Bool
+
+	// Background goroutines (server liveness and change log polling, compaction) /
+	// shutdown logic.
+	pollersMu      sync.Mutex
+	pollersStarted bool
+	closeOnce      sync.Once
+	closeCh        chan struct{}
+	backgroundWg   sync.WaitGroup
 }
 
 // KVRegistryOptions contains the options for the KVRegistry.
@@ -61,10 +106,37 @@ type KVRegistryOptions struct {
 	// decisions based on memory usage.
 	RebalanceMemoryThreshold int
 
+	// RebalanceMemoryUtilizationThreshold is the same as RebalanceMemoryThreshold except
+	// it is used instead when every live server reports its memory limit, in which case
+	// servers are balanced based on memory utilization instead of absolute memory usage
+	// so that smaller servers are not assigned as much memory as larger ones. It is
+	// expressed as a fraction of each server's memory limit.
+	RebalanceMemoryUtilizationThreshold float64
+
 	// DisableMemoryRebalancing will disable rebalancing actors based on memory
 	// usage if set.
 	DisableMemoryRebalancing bool
 
+	// DisableActorCountRebalancing will disable proactively rebalancing actors based
+	// on the number of activated actors if set. Without it, actors are only placed on
+	// new servers as they're activated so new servers take a long time to take on their
+	// share of the load.
+	DisableActorCountRebalancing bool
+	// RebalanceActorCountThreshold controls how far above the cluster's average number of
+	// activated actors (per CPU core, if every server reports it) a server must be before
+	// the registry asks it to shed actors. It is expressed as a fraction of the average.
+	// Defaults to DefaultRebalanceActorCountThreshold.
+	RebalanceActorCountThreshold float64
+	// MaxActorsToShedPerRequest bounds the number of actors a server is asked to shed with
+	// each heartbeat. Defaults to DefaultMaxActorsToShedPerRequest.
+	MaxActorsToShedPerRequest int
+	// ActorCountRebalanceInterval is the minimum amount of time between requests for the
+	// same server to shed actors. Only the server with the most actors is asked to shed
+	// actors at any given moment, so combined with MaxActorsToShedPerRequest this limits
+	// how quickly actors move around the cluster so that rebalancing doesn't cause a
+	// thundering herd of re-activations. Defaults to DefaultActorCountRebalanceInterval.
+	ActorCountRebalanceInterval time.Duration
+
 	// MinSuccessiveHeartbeatsBeforeAllowActivations is the minimum number of
 	// successive heartbeats the registry must receive from any serverID before
 	// it will allow EnsureActivation() calls to succeed for any actor. This is
@@ -76,6 +148,28 @@ type KVRegistryOptions struct {
 	// from all the servers in the cluster.
 	MinSuccessiveHeartbeatsBeforeAllowActivations int
 
+	// DisableCompaction disables the background compaction pass that removes servers
+	// that have been dead for longer than CompactServersAfter (as well as any actor
+	// activations that still reference them) from the registry. The pass also trims
+	// the change log used to implement Watch, which grows unbounded without it.
+	DisableCompaction bool
+
+	// CompactionInterval controls how often the background compaction pass runs.
+	// Defaults to DefaultCompactionInterval.
+	CompactionInterval time.Duration
+
+	// CompactServersAfter is how long a server must have gone without heartbeating
+	// before it is removed from the registry by the compaction pass. Defaults to
+	// DefaultCompactServersAfter. Servers are never compacted until they've gone
+	// without heartbeating for at least twice the cluster's HeartbeatTTL.
+	CompactServersAfter time.Duration
+
+	// ClusterSettings are the settings that are stored in the registry by the first
+	// heartbeat if the cluster doesn't have any settings stored yet. Once stored, they
+	// can only be modified with SetClusterSettings so that every server in the cluster
+	// agrees on them. Defaults to DefaultClusterSettings().
+	ClusterSettings ClusterSettings
+
 	// Logger is a logging instance used for logging messages.
 	// If no logger is provided, the default logger from the slog
 	// package (slog.Default()) will be used.
@@ -96,12 +190,49 @@ func NewKVRegistry(
 	if opts.RebalanceMemoryThreshold <= 0 {
 		opts.RebalanceMemoryThreshold = DefaultRebalanceMemoryThreshold
 	}
+	if opts.RebalanceMemoryUtilizationThreshold <= 0 {
+		opts.RebalanceMemoryUtilizationThreshold = DefaultRebalanceMemoryUtilizationThreshold
+	}
+	if opts.RebalanceActorCountThreshold <= 0 {
+		opts.RebalanceActorCountThreshold = DefaultRebalanceActorCountThreshold
+	}
+	if opts.MaxActorsToShedPerRequest <= 0 {
+		opts.MaxActorsToShedPerRequest = DefaultMaxActorsToShedPerRequest
+	}
+	if opts.ActorCountRebalanceInterval <= 0 {
+		opts.ActorCountRebalanceInterval = DefaultActorCountRebalanceInterval
+	}
+	if opts.CompactionInterval <= 0 {
+		opts.CompactionInterval = DefaultCompactionInterval
+	}
+	if opts.CompactServersAfter <= 0 {
+		opts.CompactServersAfter = DefaultCompactServersAfter
+	}
+	if opts.ClusterSettings.HeartbeatTTL <= 0 {
+		opts.ClusterSettings.HeartbeatTTL = DefaultHeartbeatTTL
+	}
+	if opts.ClusterSettings.HeartbeatInterval <= 0 {
+		opts.ClusterSettings.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if err := opts.ClusterSettings.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid ClusterSettings: %v", err))
+	}
 
-	return NewValidatedRegistry(&kvRegistry{
+	k := &kvRegistry{
 		kv:       kv,
 		opts:     opts,
 		serverID: serverID,
-	})
+		changes:  NewActivationChangeFeed(),
+		closeCh:  make(chan struct{}),
+
+		changeLogWriterID: fmt.Sprintf("%s-%d", serverID, time.Now().UnixNano()),
+	}
+	if !opts.DisableCompaction {
+		k.backgroundWg.Add(1)
+		go k.compactionLoop()
+	}
+
+	return NewValidatedRegistry(k)
 }
 
 func (k *kvRegistry) RegisterModule(
@@ -126,23 +257,23 @@ func (k *kvRegistry) RegisterModule(
 			Bytes: moduleBytes,
 			Opts:  opts,
 		}
-		marshaled, err := json.Marshal(&rm)
+
+		limits, err := getNamespaceLimits(ctx, tr, namespace)
 		if err != nil {
 			return nil, err
 		}
-
-		for i := 0; len(marshaled) > 0; i++ {
-			// Maximum value size in FoundationDB is 100_000, so split anything larger
-			// over multiple KV pairs.
-			numBytes := 99_999
-			if len(marshaled) < numBytes {
-				numBytes = len(marshaled)
+		if limits.MaxModuleBytes > 0 {
+			err := incrementNamespaceUsage(
+				ctx, tr, namespace, namespaceUsageModuleBytes,
+				limits.MaxModuleBytes, len(encodeRegisteredModule(rm)),
+				func() (int, error) { return countNamespaceModuleBytes(ctx, tr, namespace) })
+			if err != nil {
+				return nil, err
 			}
-			toWrite := marshaled[:numBytes]
-			tr.Put(ctx, getModulePartKey(namespace, moduleID, i), toWrite)
-			marshaled = marshaled[numBytes:]
 		}
-		return RegisterModuleResult{}, err
+
+		putModule(ctx, tr, namespace, moduleID, rm, 0)
+		return RegisterModuleResult{}, nil
 	})
 	if err != nil {
 		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error: %w", err)
@@ -161,25 +292,28 @@ func (k *kvRegistry) GetModule(
 	r, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
 		var (
 			moduleBytes []byte
-			i           = 0
+			numParts    = 0
 		)
 		err := tr.IterPrefix(ctx, key, func(k, v []byte) error {
 			moduleBytes = append(moduleBytes, v...)
-			i++
+			numParts++
 			return nil
 		})
 		if err != nil {
 			return ModuleOptions{}, err
 		}
-		if i == 0 {
+		if numParts == 0 {
 			return ModuleOptions{}, fmt.Errorf(
 				"error getting module: %s, does not exist in namespace: %s",
 				moduleID, namespace)
 		}
 
-		rm := registeredModule{}
-		if err := json.Unmarshal(moduleBytes, &rm); err != nil {
-			return ModuleOptions{}, fmt.Errorf("error unmarshaling stored module: %w", err)
+		rm, err := decodeRegisteredModule(moduleBytes)
+		if err != nil {
+			return ModuleOptions{}, fmt.Errorf("error decoding stored module: %w", err)
+		}
+		if rm.needsMigration {
+			putModule(ctx, tr, namespace, moduleID, rm, numParts)
 		}
 		return rm, nil
 	})
@@ -191,6 +325,37 @@ func (k *kvRegistry) GetModule(
 	return result.Bytes, result.Opts, nil
 }
 
+// putModule stores the module split into as many parts as required. numExistingParts
+// is the number of parts currently stored for the module so that any that are no longer
+// required (because the module is being rewritten with a more compact encoding) are
+// deleted.
+func putModule(
+	ctx context.Context,
+	tr kv.Transaction,
+	namespace,
+	moduleID string,
+	rm registeredModule,
+	numExistingParts int,
+) {
+	encoded := encodeRegisteredModule(rm)
+
+	i := 0
+	for ; len(encoded) > 0; i++ {
+		// Maximum value size in FoundationDB is 100_000, so split anything larger
+		// over multiple KV pairs.
+		numBytes := 99_999
+		if len(encoded) < numBytes {
+			numBytes = len(encoded)
+		}
+		toWrite := encoded[:numBytes]
+		tr.Put(ctx, getModulePartKey(namespace, moduleID, i), toWrite)
+		encoded = encoded[numBytes:]
+	}
+	for ; i < numExistingParts; i++ {
+		tr.Delete(ctx, getModulePartKey(namespace, moduleID, i))
+	}
+}
+
 func (k *kvRegistry) createActor(
 	ctx context.Context,
 	tr kv.Transaction,
@@ -210,17 +375,25 @@ func (k *kvRegistry) createActor(
 			actorID, namespace)
 	}
 
+	limits, err := getNamespaceLimits(ctx, tr, namespace)
+	if err != nil {
+		return CreateActorResult{}, err
+	}
+	if limits.MaxActors > 0 {
+		err := incrementNamespaceUsage(
+			ctx, tr, namespace, namespaceUsageActors, limits.MaxActors, 1,
+			func() (int, error) { return countNamespaceActors(ctx, tr, namespace) })
+		if err != nil {
+			return CreateActorResult{}, err
+		}
+	}
+
 	ra := registeredActor{
 		Opts:       opts,
 		ModuleID:   moduleID,
 		Generation: 1,
 	}
-	marshaled, err := json.Marshal(&ra)
-	if err != nil {
-		return CreateActorResult{}, err
-	}
-
-	tr.Put(ctx, actorKey, marshaled)
+	tr.Put(ctx, actorKey, encodeRegisteredActor(ra))
 	return CreateActorResult{}, nil
 }
 
@@ -228,120 +401,229 @@ func (k *kvRegistry) EnsureActivation(
 	ctx context.Context,
 	req EnsureActivationRequest,
 ) (EnsureActivationResult, error) {
-	actorKey := getActorKey(req.Namespace, req.ActorID, req.ModuleID)
-
-	// Perform a transaction to ensure atomicity.
-	references, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
-		// First, check if the actor exists already, and if not create it.
-		ra, err := k.getOrCreateActor(ctx, req, actorKey, tr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get/create actor: %w", err)
-		}
+	results, err := k.ensureActivations(ctx, []EnsureActivationRequest{req})
+	if err != nil {
+		return EnsureActivationResult{}, fmt.Errorf("EnsureActivation: error: %w", err)
+	}
+	return results[0], nil
+}
 
-		// Next we try to get unblacklisted servers where the actor is currently running.
-		// Because we don't activate an actor in a new server unless there are not enough replicas
+func (k *kvRegistry) EnsureActivations(
+	ctx context.Context,
+	reqs []EnsureActivationRequest,
+) ([]EnsureActivationResult, error) {
+	results, err := k.ensureActivations(ctx, reqs)
+	if err != nil {
+		return nil, fmt.Errorf("EnsureActivations: error: %w", err)
+	}
+	return results, nil
+}
 
+// ensureActivations ensures the activation of all the provided actors within a single
+// transaction. The requests are processed in order so the rules for each individual
+// actor are exactly the same as if EnsureActivation had been called once per request.
+func (k *kvRegistry) ensureActivations(
+	ctx context.Context,
+	reqs []EnsureActivationRequest,
+) ([]EnsureActivationResult, error) {
+	// Perform a transaction to ensure atomicity.
+	results, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
 		// Get the version stamp for validations of Heartbeat TTLs.
 		vs, err := tr.GetVersionStamp()
 		if err != nil {
 			return nil, fmt.Errorf("error getting versionstamp: %w", err)
 		}
-		// Convert blacklisted server IDs to a set for efficient lookup.
-		isServerIDBlacklisted := types.StringSliceToSet(req.BlacklistedServerIDs)
 
-		// Get servers from currently running actor activations
-		refs, activations, err := k.getExistingUnblacklistedActivations(ctx, tr, req, isServerIDBlacklisted, vs, ra)
+		settings, _, err := k.getClusterSettings(ctx, tr)
 		if err != nil {
-			return nil, fmt.Errorf("failed getting existing unblacklisted references from the kv store: %w", err)
+			return nil, err
 		}
 
-		// We reset activations because the activations slice may have been filtered to
-		// exclude activations associated with blacklisted server IDs.
-		ra.Activations = activations
-
-		// If we already have enough replicas, return the references.
-		if uint64(len(refs)) >= 1+req.ExtraReplicas {
-			return NewEnsureActivationResult(refs, vs, k.serverID), nil
+		var (
+			batch   = &activationBatch{vs: vs, settings: settings}
+			results = make([]EnsureActivationResult, 0, len(reqs))
+		)
+		for _, req := range reqs {
+			result, reqChanges, err := k.ensureActivationWithTransaction(ctx, tr, req, batch)
+			if err != nil {
+				if len(reqs) > 1 {
+					return nil, fmt.Errorf(
+						"error ensuring activation of actor: %s::%s:%s: %w",
+						req.Namespace, req.ModuleID, req.ActorID, err)
+				}
+				return nil, err
+			}
+			results = append(results, result)
+			k.recordChanges(ctx, tr, vs, reqChanges...)
 		}
+		return results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		// We need to create a new activation because we don't have the desired number of replicas.
-		// This can happen in the following scenarios:
-		//   1. There is no existing activation for the actor.
-		//   2. One or more of the servers where the actor is currently activated has stopped heartbeating.
-		//   3. One or more of the servers where the actor is currently activated has blacklisted the actor, typically for load balancing purposes.
+	return results.([]EnsureActivationResult), nil
+}
+
+// activationBatch contains the state that is shared by all the EnsureActivation requests
+// that are processed within the same transaction.
+type activationBatch struct {
+	vs       int64
+	settings ClusterSettings
+	// liveServers is loaded lazily the first time a request in the batch needs to
+	// activate an actor. It is then kept up to date as actors are activated so that
+	// subsequent requests in the same batch are balanced properly even if
+	// DisableHighConflictOperations is set.
+	liveServers       []serverState
+	liveServersLoaded bool
+}
 
-		// First to see where the new replicas should be activated we need to get a list of all available servers.
-		liveServers, err := getLiveServers(ctx, vs, tr)
+func (b *activationBatch) getLiveServers(
+	ctx context.Context,
+	tr kv.Transaction,
+) ([]serverState, error) {
+	if !b.liveServersLoaded {
+		liveServers, err := getLiveServers(ctx, b.vs, b.settings.HeartbeatTTL, tr)
 		if err != nil {
-			return fmt.Errorf("failed to get live servers: %w", err), err
-		}
-		if len(liveServers) == 0 {
-			return nil, fmt.Errorf("0 live servers available for new activation")
+			return nil, err
 		}
+		b.liveServers = liveServers
+		b.liveServersLoaded = true
+	}
 
-		// Then, we find the maximum number of heartbeats among live servers, to ensure there are no stale entries.
-		maxNumHeartbeats := findMaxNumHeartbeats(liveServers)
+	// Return a copy because pickServersForActivation sorts the slice in place.
+	return append([]serverState(nil), b.liveServers...), nil
+}
 
-		// Check if the maximum number of heartbeats satisfies the required threshold.
-		if maxNumHeartbeats < k.opts.MinSuccessiveHeartbeatsBeforeAllowActivations {
-			return nil, fmt.Errorf(
-				"maxNumHeartbeats: %d < MinSuccessiveHeartbeatsBeforeAllowActivations(%d)",
-				maxNumHeartbeats, k.opts.MinSuccessiveHeartbeatsBeforeAllowActivations)
+func (b *activationBatch) recordActivation(serverID string) {
+	for i := range b.liveServers {
+		if b.liveServers[i].ServerID == serverID {
+			b.liveServers[i].HeartbeatState.NumActivatedActors++
+			return
 		}
+	}
+}
+
+func (k *kvRegistry) ensureActivationWithTransaction(
+	ctx context.Context,
+	tr kv.Transaction,
+	req EnsureActivationRequest,
+	batch *activationBatch,
+) (EnsureActivationResult, []ActivationChange, error) {
+	actorKey := getActorKey(req.Namespace, req.ActorID, req.ModuleID)
+
+	// First, check if the actor exists already, and if not create it.
+	ra, err := k.getOrCreateActor(ctx, req, actorKey, tr)
+	if err != nil {
+		return EnsureActivationResult{}, nil, fmt.Errorf("failed to get/create actor: %w", err)
+	}
+
+	// Next we try to get unblacklisted servers where the actor is currently running.
+	// Because we don't activate an actor in a new server unless there are not enough replicas
+
+	vs := batch.vs
+	// Convert blacklisted server IDs to a set for efficient lookup.
+	isServerIDBlacklisted := types.StringSliceToSet(req.BlacklistedServerIDs)
+
+	// Get servers from currently running actor activations
+	refs, activations, err := k.getExistingUnblacklistedActivations(
+		ctx, tr, req, isServerIDBlacklisted, vs, batch.settings.HeartbeatTTL, ra)
+	if err != nil {
+		return EnsureActivationResult{}, nil, fmt.Errorf("failed getting existing unblacklisted references from the kv store: %w", err)
+	}
 
-		// We create a set with the unblacklisted existing servers,
-		// to avoid filling the selection with servers that are already selected
-		isActivatedOnServer := make(map[string]bool, len(activations))
-		for _, ref := range refs {
-			isActivatedOnServer[ref.Physical.ServerID] = true
+	// We reset activations because the activations slice may have been filtered to
+	// exclude activations associated with blacklisted server IDs.
+	prevActivations := ra.Activations
+	ra.Activations = activations
+
+	// If we already have enough replicas, return the references.
+	if uint64(len(refs)) >= 1+req.ExtraReplicas {
+		if ra.needsMigration {
+			// Nothing changed, but rewrite the actor anyways so that legacy records are
+			// migrated as they're accessed. Restore the original activations since the
+			// filtered ones only matter for this request.
+			ra.Activations = prevActivations
+			tr.Put(ctx, actorKey, encodeRegisteredActor(ra))
 		}
-		// Pick the remaining servers needed to comply with the replication criteria.
-		selected, selectionReason := pickServersForActivation(
-			(1+req.ExtraReplicas)-uint64(len(refs)),
-			liveServers,
-			k.opts,
-			isServerIDBlacklisted,
-			req.CachedActivationServerIDs,
-			isActivatedOnServer,
-		)
+		return NewEnsureActivationResult(refs, vs, k.serverID), nil, nil
+	}
 
-		// For every select server, updates the required information to reflect the activation,
-		// creates a reference for it, and adds it to the 'refs' result.
-		for _, server := range selected {
-			if err := k.activateActor(ctx, tr, server, &ra); err != nil {
-				return nil, fmt.Errorf("failed activating actor: %w", err)
-			}
-			k.opts.Logger.Info(
-				"activated actor on server",
-				slog.String("actor_id", fmt.Sprintf("%s::%s:%s", req.Namespace, req.ModuleID, req.ActorID)),
-				slog.String("server_id", server.ServerID),
-				slog.String("server_address", server.HeartbeatState.Address),
-				slog.String("selection_reason", selectionReason),
-			)
-
-			ref, err := types.NewActorReference(
-				server.ServerID, server.ServerVersion, req.Namespace, ra.ModuleID, req.ActorID, ra.Generation, types.ServerState{Address: server.HeartbeatState.Address})
-			if err != nil {
-				return nil, fmt.Errorf("error creating new actor reference: %w", err)
-			}
+	// We need to create a new activation because we don't have the desired number of replicas.
+	// This can happen in the following scenarios:
+	//   1. There is no existing activation for the actor.
+	//   2. One or more of the servers where the actor is currently activated has stopped heartbeating.
+	//   3. One or more of the servers where the actor is currently activated has blacklisted the actor, typically for load balancing purposes.
+
+	// First to see where the new replicas should be activated we need to get a list of all available servers.
+	liveServers, err := batch.getLiveServers(ctx, tr)
+	if err != nil {
+		return EnsureActivationResult{}, nil, fmt.Errorf("failed to get live servers: %w", err)
+	}
+	if len(liveServers) == 0 {
+		return EnsureActivationResult{}, nil, fmt.Errorf("0 live servers available for new activation")
+	}
 
-			refs = append(refs, ref)
+	// Then, we find the maximum number of heartbeats among live servers, to ensure there are no stale entries.
+	maxNumHeartbeats := findMaxNumHeartbeats(liveServers)
+
+	// Check if the maximum number of heartbeats satisfies the required threshold.
+	if maxNumHeartbeats < k.opts.MinSuccessiveHeartbeatsBeforeAllowActivations {
+		return EnsureActivationResult{}, nil, fmt.Errorf(
+			"maxNumHeartbeats: %d < MinSuccessiveHeartbeatsBeforeAllowActivations(%d)",
+			maxNumHeartbeats, k.opts.MinSuccessiveHeartbeatsBeforeAllowActivations)
+	}
+
+	// We create a set with the unblacklisted existing servers,
+	// to avoid filling the selection with servers that are already selected
+	isActivatedOnServer := make(map[string]bool, len(activations))
+	for _, ref := range refs {
+		isActivatedOnServer[ref.Physical.ServerID] = true
+	}
+	// Pick the remaining servers needed to comply with the replication criteria.
+	selected, selectionReason := pickServersForActivation(
+		(1+req.ExtraReplicas)-uint64(len(refs)),
+		liveServers,
+		k.opts,
+		isServerIDBlacklisted,
+		req.CachedActivationServerIDs,
+		isActivatedOnServer,
+	)
+
+	// For every select server, updates the required information to reflect the activation,
+	// creates a reference for it, and adds it to the 'refs' result.
+	for _, server := range selected {
+		if err := k.activateActor(ctx, tr, server, req, &ra); err != nil {
+			return EnsureActivationResult{}, nil, fmt.Errorf("failed activating actor: %w", err)
 		}
+		batch.recordActivation(server.ServerID)
+		k.opts.Logger.Info(
+			"activated actor on server",
+			slog.String("actor_id", fmt.Sprintf("%s::%s:%s", req.Namespace, req.ModuleID, req.ActorID)),
+			slog.String("server_id", server.ServerID),
+			slog.String("server_address", server.HeartbeatState.Address),
+			slog.String("selection_reason", selectionReason),
+		)
 
-		// Store the newly updated actor, to reflect the latest changes of its activations.
-		marshaled, err := json.Marshal(&ra)
+		ref, err := types.NewActorReference(
+			server.ServerID, server.ServerVersion, req.Namespace, ra.ModuleID, req.ActorID, ra.Generation, types.ServerState{Address: server.HeartbeatState.Address})
 		if err != nil {
-			return nil, fmt.Errorf("error marshaling activation: %w", err)
+			return EnsureActivationResult{}, nil, fmt.Errorf("error creating new actor reference: %w", err)
 		}
-		tr.Put(ctx, actorKey, marshaled)
 
-		return NewEnsureActivationResult(refs, vs, k.serverID), nil
-	})
-	if err != nil {
-		return EnsureActivationResult{}, fmt.Errorf("EnsureActivation: error: %w", err)
+		refs = append(refs, ref)
 	}
 
-	return references.(EnsureActivationResult), nil
+	// Store the newly updated actor, to reflect the latest changes of its activations.
+	tr.Put(ctx, actorKey, encodeRegisteredActor(ra))
+
+	changes := movedActivationChanges(req, prevActivations, ra.Activations)
+	for _, change := range changes {
+		if !hasActivationOnServer(ra.Activations, change.ServerID) {
+			tr.Delete(ctx, getServerActivationKey(change.ServerID, req.Namespace, req.ModuleID, req.ActorID))
+		}
+	}
+	return NewEnsureActivationResult(refs, vs, k.serverID), changes, nil
 }
 
 // getOrCreateActor retrieves an existing actor from the registry or creates a new one if it doesn't exist.
@@ -379,10 +661,28 @@ func (k *kvRegistry) getOrCreateActor(
 			"[invariant violated] error ensuring activation of actor with ID: %s, does not exist in namespace: %s, err: %w",
 			req.ActorID, req.Namespace, errActorDoesNotExist)
 	}
+	k.indexLegacyActivations(ctx, tr, req, ra)
 
 	return ra, nil
 }
 
+// indexLegacyActivations indexes the activations of actors whose records predate the
+// server activations index. It must be called by every transaction that is about to
+// rewrite the actor's record.
+func (k *kvRegistry) indexLegacyActivations(
+	ctx context.Context,
+	tr kv.Transaction,
+	req EnsureActivationRequest,
+	ra registeredActor,
+) {
+	if !ra.needsMigration {
+		return
+	}
+	for _, a := range ra.Activations {
+		tr.Put(ctx, getServerActivationKey(a.ServerID, req.Namespace, req.ModuleID, req.ActorID), nil)
+	}
+}
+
 // getExistingUnblacklistedActivations retrieves existing unblacklisted activations for a given actor from the registry.
 // It iterates through the current activations and converts them into actor references until the desired number of replicas is achieved.
 // For each activation, it checks if the server is still alive and within the heartbeat TTL.
@@ -392,6 +692,7 @@ func (k *kvRegistry) getExistingUnblacklistedActivations(
 	req EnsureActivationRequest,
 	isServerIDBlacklisted map[string]bool,
 	vs int64,
+	heartbeatTTL time.Duration,
 	ra registeredActor,
 ) ([]types.ActorReference, []activation, error) {
 	var (
@@ -422,11 +723,11 @@ func (k *kvRegistry) getExistingUnblacklistedActivations(
 
 		// Server exists.
 
-		var server serverState
-		if err := json.Unmarshal(v, &server); err != nil {
-			return nil, nil, fmt.Errorf("error unmarsaling server state with ID: %s", req.ActorID)
+		server, err := decodeServerState(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding server state with ID: %s: %w", a.ServerID, err)
 		}
-		if versionSince(vs, server.LastHeartbeatedAt) > HeartbeatTTL {
+		if versionSince(vs, server.LastHeartbeatedAt) > heartbeatTTL {
 			// Server "exists" but has not heartbeated recently. Assume its dead and ignore this activation.
 			continue
 		}
@@ -462,18 +763,23 @@ func findMaxNumHeartbeats(servers []serverState) int {
 // activateActor updates the registry to indicate that a server has a newly activated actor.
 // This function is responsible for updating the necessary information in the registry to reflect the activation
 // of an actor on a specific server.
-func (k *kvRegistry) activateActor(ctx context.Context, tr kv.Transaction, server serverState, ra *registeredActor) error {
+func (k *kvRegistry) activateActor(
+	ctx context.Context,
+	tr kv.Transaction,
+	server serverState,
+	req EnsureActivationRequest,
+	ra *registeredActor,
+) error {
 	a := newActivation(server.ServerID, server.ServerVersion)
 	ra.Activations = append(ra.Activations, a)
 
+	// Index the activation by server so that it can be cleaned up efficiently by the
+	// compaction pass once the server is dead without scanning every actor.
+	tr.Put(ctx, getServerActivationKey(server.ServerID, req.Namespace, req.ModuleID, req.ActorID), nil)
+
 	if !k.opts.DisableHighConflictOperations {
 		server.HeartbeatState.NumActivatedActors++
-		marshaled, err := json.Marshal(&server)
-		if err != nil {
-			return fmt.Errorf("error marshaling server state: %w", err)
-		}
-
-		tr.Put(ctx, getServerKey(server.ServerID), marshaled)
+		tr.Put(ctx, getServerKey(server.ServerID), encodeServerState(server))
 	}
 
 	return nil
@@ -512,6 +818,16 @@ func (k *kvRegistry) Heartbeat(
 	key := getServerKey(serverID)
 	var serverVersion int64
 	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		settings, settingsStored, err := k.getClusterSettings(ctx, tr)
+		if err != nil {
+			return nil, err
+		}
+		if !settingsStored {
+			// First heartbeat in the cluster, store the settings so every server that
+			// joins the cluster afterwards uses the same ones.
+			tr.Put(ctx, getClusterSettingsKey(), encodeClusterSettings(settings))
+		}
+
 		// First do all the logic to update the server's heartbeat state.
 		v, ok, err := tr.Get(ctx, key)
 		if err != nil {
@@ -524,10 +840,23 @@ func (k *kvRegistry) Heartbeat(
 			if err != nil {
 				return nil, fmt.Errorf("error getting versionstamp: %w", err)
 			}
-			state = newServerState(serverID, 1, heartbeatState, vs)
+
+			// If the server was compacted previously, make sure it resumes with a
+			// version that is higher than any version it was ever assigned before.
+			serverVersion := int64(1)
+			tombstone, ok, err := getServerTombstone(ctx, tr, serverID)
+			if err != nil {
+				return nil, fmt.Errorf("error getting server tombstone: %w", err)
+			}
+			if ok {
+				serverVersion = tombstone.ServerVersion + 1
+				tr.Delete(ctx, getServerTombstoneKey(serverID))
+			}
+			state = newServerState(serverID, serverVersion, heartbeatState, vs)
 		} else {
-			if err := json.Unmarshal(v, &state); err != nil {
-				return nil, fmt.Errorf("error unmarshaling server state: %w", err)
+			state, err = decodeServerState(v)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding server state: %w", err)
 			}
 		}
 
@@ -536,7 +865,16 @@ func (k *kvRegistry) Heartbeat(
 			return nil, fmt.Errorf("error getting versionstamp: %w", err)
 		}
 		timeSinceLastHeartbeat := versionSince(vs, state.LastHeartbeatedAt)
-		if timeSinceLastHeartbeat >= HeartbeatTTL {
+		if timeSinceLastHeartbeat >= settings.HeartbeatTTL {
+			if ok {
+				// The server existed previously, but its heartbeat expired so any
+				// activations associated with its previous version are stale.
+				k.recordChanges(ctx, tr, vs, ActivationChange{
+					Type:          ActivationChangeTypeServerDied,
+					ServerID:      serverID,
+					ServerVersion: state.ServerVersion,
+				})
+			}
 			state.ServerVersion++
 		}
 
@@ -545,12 +883,7 @@ func (k *kvRegistry) Heartbeat(
 		state.HeartbeatState = heartbeatState
 		state.NumHeartbeats++
 
-		marshaled, err := json.Marshal(&state)
-		if err != nil {
-			return nil, fmt.Errorf("error marshaling server state: %w", err)
-		}
-
-		tr.Put(ctx, key, marshaled)
+		tr.Put(ctx, key, encodeServerState(state))
 
 		// Next, check if we should ask the server to shed some load to force
 		// rebalancing.
@@ -559,7 +892,7 @@ func (k *kvRegistry) Heartbeat(
 		// package directly, but right now its tested in environment.go and
 		// examples/leaderregistry/main_test.go
 
-		liveServers, err := getLiveServers(ctx, vs, tr)
+		liveServers, err := getLiveServers(ctx, vs, settings.HeartbeatTTL, tr)
 		if err != nil {
 			return nil, fmt.Errorf("error getting live servers during heartbeat for load balancing: %w", err)
 		}
@@ -567,31 +900,152 @@ func (k *kvRegistry) Heartbeat(
 		result := HeartbeatResult{
 			VersionStamp: vs,
 			// VersionStamp corresponds to ~ 1 million increments per second.
-			HeartbeatTTL:  int64(HeartbeatTTL.Microseconds()),
-			ServerVersion: serverVersion,
+			HeartbeatTTL:      settings.HeartbeatTTL.Microseconds(),
+			HeartbeatInterval: settings.HeartbeatInterval.Microseconds(),
+			ServerVersion:     serverVersion,
+			NumLiveServers:    len(liveServers),
 		}
-
-		min, max := minMaxMemUsage(liveServers)
-		delta := max.HeartbeatState.UsedMemory - min.HeartbeatState.UsedMemory
-		if delta > k.opts.RebalanceMemoryThreshold && max.ServerID == serverID {
-			// If the server currently heartbeating is also the server with the highest memory usage
-			// and its memory usage delta vs. the server with the lowest memory usage is above the
-			// threshold, ask it to shed some actors to balance memory usage.
-			result.MemoryBytesToShed = int64(delta)
+		maxMemServerID, memBytesToShed := memoryImbalance(liveServers, k.opts)
+		if maxMemServerID == serverID {
+			// Only the server with the highest memory usage is asked to shed memory.
+			result.MemoryBytesToShed = memBytesToShed
+		}
+		result.NamespaceLimits, err = getAllNamespaceLimits(ctx, tr)
+		if err != nil {
+			return nil, fmt.Errorf("error getting namespace limits: %w", err)
+		}
+		if memBytesToShed == 0 {
+			// Memory balancing takes precedence since shedding actors to balance memory
+			// usage will also affect the number of actors on each server. This has to
+			// consider the whole cluster and not just the server that is heartbeating,
+			// otherwise the two would fight each other and actors shed by the server
+			// with the most memory usage would immediately be shed again by whichever
+			// server ended up with the most actors.
+			result.NumActorsToShed = numActorsToShed(vs, state, liveServers, k.opts)
+			if result.NumActorsToShed > 0 {
+				state.LastShedRequestedAt = vs
+				tr.Put(ctx, key, encodeServerState(state))
+			}
 		}
-
 		return result, nil
 	})
 	if err != nil {
 		return HeartbeatResult{}, fmt.Errorf("Heartbeat: error: %w", err)
 	}
+
 	return result.(HeartbeatResult), nil
 }
 
+func (k *kvRegistry) Watch(ctx context.Context) (<-chan ActivationChange, error) {
+	k.pollersMu.Lock()
+	defer k.pollersMu.Unlock()
+
+	// The change log and the servers' liveness are only polled once someone is actually
+	// interested. The cursor is created before subscribing so that every change that is
+	// recorded after Watch returns is delivered.
+	var cursor *changeLogCursor
+	if !k.pollersStarted {
+		var err error
+		cursor, err = k.newChangeLogCursor(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Watch: error reading change log: %w", err)
+		}
+	}
+
+	ch, err := k.changes.Subscribe(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Watch: error subscribing: %w", err)
+	}
+
+	if !k.pollersStarted {
+		k.pollersStarted = true
+		k.backgroundWg.Add(2)
+		go k.pollChangeLogLoop(cursor)
+		// Servers whose heartbeats expire never tell us that they died, so we need to
+		// poll for them too.
+		go k.pollServerLivenessLoop()
+	}
+
+	return ch, nil
+}
+
 func (k *kvRegistry) Close(ctx context.Context) error {
+	k.closeOnce.Do(func() {
+		close(k.closeCh)
+	})
+	k.backgroundWg.Wait()
+	k.changes.Close()
 	return k.kv.Close(ctx)
 }
 
+// pollServerLivenessLoop periodically checks which servers are alive and publishes a
+// ServerDied change for every server that was alive in the previous iteration, but has
+// since stopped heartbeating (or whose version has changed).
+func (k *kvRegistry) pollServerLivenessLoop() {
+	defer k.backgroundWg.Done()
+
+	var (
+		ticker = time.NewTicker(serverLivenessPollInterval)
+		prev   map[string]int64
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.closeCh:
+			return
+		}
+
+		curr, err := k.getLiveServerVersions(context.Background())
+		if err != nil {
+			k.opts.Logger.Error(
+				"error polling server liveness for watchers",
+				slog.String("error", err.Error()))
+			continue
+		}
+
+		var changes []ActivationChange
+		for serverID, serverVersion := range prev {
+			if currVersion, ok := curr[serverID]; !ok || currVersion != serverVersion {
+				changes = append(changes, ActivationChange{
+					Type:          ActivationChangeTypeServerDied,
+					ServerID:      serverID,
+					ServerVersion: serverVersion,
+				})
+			}
+		}
+		k.changes.Publish(changes...)
+		prev = curr
+	}
+}
+
+func (k *kvRegistry) getLiveServerVersions(ctx context.Context) (map[string]int64, error) {
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		settings, _, err := k.getClusterSettings(ctx, tr)
+		if err != nil {
+			return nil, err
+		}
+		liveServers, err := getLiveServers(ctx, vs, settings.HeartbeatTTL, tr)
+		if err != nil {
+			return nil, fmt.Errorf("error getting live servers: %w", err)
+		}
+
+		versions := make(map[string]int64, len(liveServers))
+		for _, server := range liveServers {
+			versions[server.ServerID] = server.ServerVersion
+		}
+		return versions, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(map[string]int64), nil
+}
+
 func (k *kvRegistry) UnsafeWipeAll() error {
 	return k.kv.UnsafeWipeAll()
 }
@@ -625,9 +1079,9 @@ func (k *kvRegistry) getActor(
 		return registeredActor{}, false, nil
 	}
 
-	var ra registeredActor
-	if err := json.Unmarshal(actorBytes, &ra); err != nil {
-		return registeredActor{}, false, fmt.Errorf("error unmarshaling registered actor: %w", err)
+	ra, err := decodeRegisteredActor(actorBytes)
+	if err != nil {
+		return registeredActor{}, false, fmt.Errorf("error decoding registered actor: %w", err)
 	}
 
 	return ra, true, nil
@@ -653,16 +1107,40 @@ func getServersPrefix() []byte {
 	return tuple.Tuple{"servers"}.Pack()
 }
 
+func getServerActivationKey(serverID, namespace, moduleID, actorID string) []byte {
+	return tuple.Tuple{"server_activations", serverID, namespace, moduleID, actorID}.Pack()
+}
+
+func getServerActivationsPrefix(serverID string) []byte {
+	return tuple.Tuple{"server_activations", serverID}.Pack()
+}
+
+func getServerTombstoneKey(serverID string) []byte {
+	return tuple.Tuple{"server_tombstones", serverID}.Pack()
+}
+
+func getServerTombstonesPrefix() []byte {
+	return tuple.Tuple{"server_tombstones"}.Pack()
+}
+
 type registeredActor struct {
 	Opts        types.ActorOptions
 	ModuleID    string
 	Generation  uint64
 	Activations []activation
+
+	// needsMigration is true if the record was decoded from the legacy JSON encoding
+	// and should be rewritten. It is not persisted.
+	needsMigration bool
 }
 
 type registeredModule struct {
 	Bytes []byte
 	Opts  ModuleOptions
+
+	// needsMigration is true if the record was decoded from the legacy JSON encoding
+	// and should be rewritten. It is not persisted.
+	needsMigration bool
 }
 
 type serverState struct {
@@ -671,6 +1149,9 @@ type serverState struct {
 	HeartbeatState    HeartbeatState
 	LastHeartbeatedAt int64
 	NumHeartbeats     int
+	// LastShedRequestedAt is the versionstamp at which the server was last asked to shed
+	// actors to rebalance the number of actors across the cluster.
+	LastShedRequestedAt int64
 }
 
 func newServerState(
@@ -693,6 +1174,38 @@ type activation struct {
 	ServerVersion int64
 }
 
+// movedActivationChanges returns an ActorMoved change for every activation in prev
+// that is no longer present in curr.
+func movedActivationChanges(
+	req EnsureActivationRequest,
+	prev []activation,
+	curr []activation,
+) []ActivationChange {
+	var changes []ActivationChange
+	for _, p := range prev {
+		found := false
+		for _, c := range curr {
+			if p == c {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		changes = append(changes, ActivationChange{
+			Type:          ActivationChangeTypeActorMoved,
+			Namespace:     req.Namespace,
+			ModuleID:      req.ModuleID,
+			ActorID:       req.ActorID,
+			ServerID:      p.ServerID,
+			ServerVersion: p.ServerVersion,
+		})
+	}
+	return changes
+}
+
 func newActivation(serverID string, serverVersion int64) activation {
 	return activation{
 		ServerID:      serverID,
@@ -713,16 +1226,17 @@ func versionSince(curr, prev int64) time.Duration {
 func getLiveServers(
 	ctx context.Context,
 	versionStamp int64,
+	heartbeatTTL time.Duration,
 	tr kv.Transaction,
 ) ([]serverState, error) {
 	liveServers := []serverState{}
 	err := tr.IterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
-		var currServer serverState
-		if err := json.Unmarshal(v, &currServer); err != nil {
-			return fmt.Errorf("error unmarshaling server state: %w", err)
+		currServer, err := decodeServerState(v)
+		if err != nil {
+			return fmt.Errorf("error decoding server state: %w", err)
 		}
 
-		if versionSince(versionStamp, currServer.LastHeartbeatedAt) < HeartbeatTTL {
+		if versionSince(versionStamp, currServer.LastHeartbeatedAt) < heartbeatTTL {
 			liveServers = append(liveServers, currServer)
 		}
 		return nil
@@ -789,16 +1303,37 @@ func pickServersForActivation(
 		}
 	}
 
+	var (
+		capacity = getClusterCapacity(available)
+		// lessActors returns true if sI has fewer activated actors than sJ relative to
+		// the number of CPU cores each server has (if every server reports it).
+		lessActors = func(sI, sJ serverState) bool {
+			if capacity.cpu {
+				return sI.HeartbeatState.ActorsPerCPUCore() < sJ.HeartbeatState.ActorsPerCPUCore()
+			}
+			return sI.HeartbeatState.NumActivatedActors < sJ.HeartbeatState.NumActivatedActors
+		}
+	)
 	sort.Slice(available, func(i, j int) bool {
 		sI, sJ := available[i], available[j]
 		if opts.DisableMemoryRebalancing {
 			// Memory load balancing is disabled, so just look at number of activated
 			// actors.
-			return sI.HeartbeatState.NumActivatedActors < sJ.HeartbeatState.NumActivatedActors
+			return lessActors(sI, sJ)
 		}
 
 		// Memory load balancing is enabled so we need to look at memory usage *and*
 		// number of activated actors (as a tie breaker).
+		if capacity.memory {
+			// Every server reported its memory limit so compare utilization instead of
+			// absolute usage to avoid overloading smaller servers.
+			uI, uJ := sI.HeartbeatState.MemoryUtilization(), sJ.HeartbeatState.MemoryUtilization()
+			if math.Abs(uI-uJ) > opts.RebalanceMemoryUtilizationThreshold {
+				return uI < uJ
+			}
+			return lessActors(sI, sJ)
+		}
+
 		var (
 			minMemUsage = sI
 			maxMemUsage = sJ
@@ -810,7 +1345,7 @@ func pickServersForActivation(
 		if maxMemUsage.HeartbeatState.UsedMemory-minMemUsage.HeartbeatState.UsedMemory > opts.RebalanceMemoryThreshold {
 			return minMemUsage == sI
 		}
-		return sI.HeartbeatState.NumActivatedActors < sJ.HeartbeatState.NumActivatedActors
+		return lessActors(sI, sJ)
 	})
 
 	for _, server := range available {
@@ -826,6 +1361,97 @@ func pickServersForActivation(
 	return result, selectionReason(fromCache, fromHeartbeat)
 }
 
+// memoryImbalance returns the ID of the server with the highest memory usage (or memory
+// utilization, if every server reports its memory limit) and the number of bytes it should
+// shed to balance memory usage across the cluster, which is 0 if the cluster is balanced.
+func memoryImbalance(liveServers []serverState, opts KVRegistryOptions) (string, int64) {
+	if len(liveServers) == 0 {
+		return "", 0
+	}
+
+	if getClusterCapacity(liveServers).memory {
+		min, max := minMaxMemUtilization(liveServers)
+		delta := max.HeartbeatState.MemoryUtilization() - min.HeartbeatState.MemoryUtilization()
+		if delta > opts.RebalanceMemoryUtilizationThreshold {
+			// Shed enough memory to bring the server's utilization down to the utilization
+			// of the least utilized server, expressed in terms of this server's limit.
+			return max.ServerID, int64(delta * float64(max.HeartbeatState.MemoryLimitBytes))
+		}
+		return max.ServerID, 0
+	}
+
+	min, max := minMaxMemUsage(liveServers)
+	delta := max.HeartbeatState.UsedMemory - min.HeartbeatState.UsedMemory
+	if delta > opts.RebalanceMemoryThreshold {
+		// If the memory usage delta between the server with the highest memory usage and the
+		// server with the lowest memory usage is above the threshold, the former should shed
+		// some actors to balance memory usage.
+		return max.ServerID, int64(delta)
+	}
+	return max.ServerID, 0
+}
+
+// numActorsToShed returns the number of actors the provided server should shed to balance
+// the number of activated actors across the cluster. It is only > 0 if the server is the
+// one with the most actors (per CPU core, if every server reports it), it is above the
+// cluster's average by more than the configured threshold, and it hasn't been asked to
+// shed actors within the last ActorCountRebalanceInterval.
+func numActorsToShed(
+	vs int64,
+	server serverState,
+	liveServers []serverState,
+	opts KVRegistryOptions,
+) int {
+	if opts.DisableActorCountRebalancing || len(liveServers) < 2 {
+		return 0
+	}
+	if server.LastShedRequestedAt > 0 &&
+		versionSince(vs, server.LastShedRequestedAt) < opts.ActorCountRebalanceInterval {
+		return 0
+	}
+
+	var (
+		capacity = getClusterCapacity(liveServers)
+		load     = func(s serverState) float64 {
+			if capacity.cpu {
+				return s.HeartbeatState.ActorsPerCPUCore()
+			}
+			return float64(s.HeartbeatState.NumActivatedActors)
+		}
+		total   float64
+		maxLoad = liveServers[0]
+	)
+	for _, s := range liveServers {
+		total += load(s)
+		if load(s) > load(maxLoad) {
+			maxLoad = s
+		}
+	}
+	if maxLoad.ServerID != server.ServerID {
+		// Only ask one server to shed actors at a time.
+		return 0
+	}
+
+	var (
+		avg       = total / float64(len(liveServers))
+		threshold = avg * (1 + opts.RebalanceActorCountThreshold)
+	)
+	if load(server) <= threshold {
+		return 0
+	}
+
+	// Shed enough actors to bring the server down to the cluster's average.
+	excess := load(server) - avg
+	if capacity.cpu {
+		excess *= float64(server.HeartbeatState.NumCPUCores)
+	}
+	n := int(excess)
+	if n > opts.MaxActorsToShedPerRequest {
+		n = opts.MaxActorsToShedPerRequest
+	}
+	return n
+}
+
 func minMaxMemUsage(available []serverState) (serverState, serverState) {
 	if len(available) == 0 {
 		panic("[invariant violated] pickServerForActivation should not be called with empty slice")
@@ -847,6 +1473,48 @@ func minMaxMemUsage(available []serverState) (serverState, serverState) {
 	return minMemUsage, maxMemUsage
 }
 
+func minMaxMemUtilization(available []serverState) (serverState, serverState) {
+	if len(available) == 0 {
+		panic("[invariant violated] minMaxMemUtilization should not be called with empty slice")
+	}
+
+	var (
+		minUtilization = available[0]
+		maxUtilization = available[0]
+	)
+	for _, s := range available {
+		if s.HeartbeatState.MemoryUtilization() < minUtilization.HeartbeatState.MemoryUtilization() {
+			minUtilization = s
+		}
+		if s.HeartbeatState.MemoryUtilization() > maxUtilization.HeartbeatState.MemoryUtilization() {
+			maxUtilization = s
+		}
+	}
+
+	return minUtilization, maxUtilization
+}
+
+// clusterCapacity describes which capacity dimensions are reported by every live server.
+// Balancing decisions are only based on utilization for a given dimension if every server
+// reports it since utilization can't be compared to absolute values.
+type clusterCapacity struct {
+	memory bool
+	cpu    bool
+}
+
+func getClusterCapacity(servers []serverState) clusterCapacity {
+	capacity := clusterCapacity{memory: len(servers) > 0, cpu: len(servers) > 0}
+	for _, s := range servers {
+		if s.HeartbeatState.MemoryLimitBytes <= 0 {
+			capacity.memory = false
+		}
+		if s.HeartbeatState.NumCPUCores <= 0 {
+			capacity.cpu = false
+		}
+	}
+	return capacity
+}
+
 // selectionReason determines the reason for the server selection based on the provided flags.
 // It returns a string indicating whether the selection is from cache, heartbeat, both, or none.
 func selectionReason(fromCache bool, fromHeartbeat bool) string {
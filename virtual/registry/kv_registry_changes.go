@@ -0,0 +1,217 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// changeLogPollInterval controls how often registries with watchers poll the change
+	// log for changes made by other instances of the registry.
+	changeLogPollInterval = 250 * time.Millisecond
+	// changeLogLookback is how far behind the most recent versionstamp the change log
+	// is re-scanned on every poll. Entries are keyed by the versionstamp at which their
+	// transaction started, not the one at which it committed, so an entry can become
+	// visible after entries with higher versionstamps. This must be longer than the
+	// longest transaction the KV store allows (5s for FoundationDB).
+	changeLogLookback = 10 * time.Second
+	// changeLogRetention is how long entries are retained in the change log before they
+	// are removed by the compaction pass.
+	changeLogRetention = 10 * time.Minute
+)
+
+// changeLogEntry is a single ActivationChange stored in the change log.
+type changeLogEntry struct {
+	VersionStamp int64
+	Change       ActivationChange
+}
+
+// recordChanges appends the provided changes to the change log as part of tr so that
+// they're delivered to the watchers of every instance of the registry if (and only if)
+// the transaction commits.
+func (k *kvRegistry) recordChanges(
+	ctx context.Context,
+	tr kv.Transaction,
+	vs int64,
+	changes ...ActivationChange,
+) {
+	for _, change := range changes {
+		key := getActivationChangeKey(vs, k.changeLogWriterID, k.changeLogSeq.Add(1))
+		tr.Put(ctx, key, encodeChangeLogEntry(changeLogEntry{VersionStamp: vs, Change: change}))
+	}
+}
+
+// changeLogCursor tracks the position of a poller in the change log.
+type changeLogCursor struct {
+	// start is the versionstamp from which the next poll will scan the change log.
+	start int64
+	// seen contains the versionstamp of every entry >= start that was already
+	// published, keyed by the entry's key.
+	seen map[string]int64
+}
+
+// newChangeLogCursor returns a cursor positioned at the end of the change log so that
+// only the changes that are recorded after the call are published.
+func (k *kvRegistry) newChangeLogCursor(ctx context.Context) (*changeLogCursor, error) {
+	c := &changeLogCursor{seen: make(map[string]int64)}
+	if _, err := k.pollChangeLog(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// pollChangeLogLoop periodically publishes the changes recorded in the change log (by
+// any instance of the registry) since the previous iteration.
+func (k *kvRegistry) pollChangeLogLoop(c *changeLogCursor) {
+	defer k.backgroundWg.Done()
+
+	ticker := time.NewTicker(changeLogPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.closeCh:
+			return
+		}
+
+		changes, err := k.pollChangeLog(context.Background(), c)
+		if err != nil {
+			k.opts.Logger.Error(
+				"error polling change log for watchers",
+				slog.String("error", err.Error()))
+			continue
+		}
+		k.changes.Publish(changes...)
+	}
+}
+
+// pollChangeLog returns every entry in the change log that hasn't been seen by c yet and
+// advances c.
+func (k *kvRegistry) pollChangeLog(
+	ctx context.Context,
+	c *changeLogCursor,
+) ([]ActivationChange, error) {
+	type keyedEntry struct {
+		key   string
+		entry changeLogEntry
+	}
+	type pollResult struct {
+		vs      int64
+		entries []keyedEntry
+	}
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		var entries []keyedEntry
+		err = tr.IterRange(
+			ctx, getActivationChangesKeyFrom(c.start), getActivationChangesEnd(),
+			func(key, v []byte) error {
+				if _, ok := c.seen[string(key)]; ok {
+					return nil
+				}
+				entry, err := decodeChangeLogEntry(v)
+				if err != nil {
+					return fmt.Errorf("error decoding change log entry: %w", err)
+				}
+				entries = append(entries, keyedEntry{key: string(key), entry: entry})
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+		return pollResult{vs: vs, entries: entries}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		poll    = result.(pollResult)
+		changes = make([]ActivationChange, 0, len(poll.entries))
+	)
+	for _, e := range poll.entries {
+		c.seen[e.key] = e.entry.VersionStamp
+		changes = append(changes, e.entry.Change)
+	}
+
+	if start := poll.vs - changeLogLookback.Microseconds(); start > c.start {
+		c.start = start
+		for key, vs := range c.seen {
+			if vs < c.start {
+				delete(c.seen, key)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// compactChangeLog removes the entries that are older than changeLogRetention from the
+// change log.
+func (k *kvRegistry) compactChangeLog(ctx context.Context) (int, error) {
+	var numRemoved int
+	for {
+		if err := ctx.Err(); err != nil {
+			return numRemoved, err
+		}
+
+		result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+			vs, err := tr.GetVersionStamp()
+			if err != nil {
+				return nil, fmt.Errorf("error getting versionstamp: %w", err)
+			}
+
+			var (
+				toDelete [][]byte
+				end      = getActivationChangesKeyFrom(vs - changeLogRetention.Microseconds())
+			)
+			err = tr.IterRange(ctx, getActivationChangesKeyFrom(0), end, func(key, _ []byte) error {
+				toDelete = append(toDelete, append([]byte(nil), key...))
+				if len(toDelete) >= compactionBatchSize {
+					return errCompactionBatchFull
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errCompactionBatchFull) {
+				return nil, err
+			}
+
+			for _, key := range toDelete {
+				tr.Delete(ctx, key)
+			}
+			return len(toDelete), nil
+		})
+		if err != nil {
+			return numRemoved, err
+		}
+
+		numRemoved += result.(int)
+		if result.(int) < compactionBatchSize {
+			return numRemoved, nil
+		}
+	}
+}
+
+func getActivationChangeKey(vs int64, writerID string, seq uint64) []byte {
+	return tuple.Tuple{"activation_changes", vs, writerID, seq}.Pack()
+}
+
+// getActivationChangesKeyFrom returns the key that sorts before every change log entry
+// recorded at (or after) vs.
+func getActivationChangesKeyFrom(vs int64) []byte {
+	return tuple.Tuple{"activation_changes", vs}.Pack()
+}
+
+// getActivationChangesEnd returns the key that sorts after every change log entry.
+func getActivationChangesEnd() []byte {
+	return append(tuple.Tuple{"activation_changes"}.Pack(), 0xFF)
+}
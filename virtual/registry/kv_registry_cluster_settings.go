@@ -0,0 +1,61 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+)
+
+func (k *kvRegistry) GetClusterSettings(ctx context.Context) (ClusterSettings, error) {
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		settings, _, err := k.getClusterSettings(ctx, tr)
+		return settings, err
+	})
+	if err != nil {
+		return ClusterSettings{}, fmt.Errorf("GetClusterSettings: error: %w", err)
+	}
+	return result.(ClusterSettings), nil
+}
+
+func (k *kvRegistry) SetClusterSettings(ctx context.Context, settings ClusterSettings) error {
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("SetClusterSettings: invalid settings: %w", err)
+	}
+
+	_, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		tr.Put(ctx, getClusterSettingsKey(), encodeClusterSettings(settings))
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("SetClusterSettings: error: %w", err)
+	}
+	return nil
+}
+
+// getClusterSettings returns the settings stored in the registry. If none have been
+// stored yet, the settings the registry was configured with are returned instead and
+// ok is false.
+func (k *kvRegistry) getClusterSettings(
+	ctx context.Context,
+	tr kv.Transaction,
+) (settings ClusterSettings, ok bool, err error) {
+	v, ok, err := tr.Get(ctx, getClusterSettingsKey())
+	if err != nil {
+		return ClusterSettings{}, false, fmt.Errorf("error getting cluster settings: %w", err)
+	}
+	if !ok {
+		return k.opts.ClusterSettings, false, nil
+	}
+
+	settings, err = decodeClusterSettings(v)
+	if err != nil {
+		return ClusterSettings{}, false, fmt.Errorf("error decoding cluster settings: %w", err)
+	}
+	return settings, true, nil
+}
+
+func getClusterSettingsKey() []byte {
+	return tuple.Tuple{"cluster_settings"}.Pack()
+}
@@ -0,0 +1,496 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// compactionBatchSize is the maximum number of activations that will be removed
+	// in a single transaction by the compaction pass to keep transactions small.
+	compactionBatchSize = 128
+	// serverTombstoneRetention is how long a tombstone is retained after a server is
+	// compacted. While the tombstone exists, a server that resumes heartbeating will be
+	// assigned a version that is higher than any version it was assigned previously.
+	serverTombstoneRetention = 24 * time.Hour
+)
+
+var errCompactionBatchFull = errors.New("compaction batch full")
+
+// serverTombstone is stored in place of a server's state once the server has been
+// compacted so that its version is never reused.
+type serverTombstone struct {
+	ServerVersion int64
+	CompactedAt   int64
+}
+
+// compactionResult summarizes the work performed by a single compaction pass.
+type compactionResult struct {
+	numServersCompacted      int
+	numActivationsRemoved    int
+	numTombstonesCompacted   int
+	numChangesCompacted      int
+	numActivationsBackfilled int
+}
+
+func (k *kvRegistry) compactionLoop() {
+	defer k.backgroundWg.Done()
+
+	ticker := time.NewTicker(k.opts.CompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.closeCh:
+			return
+		}
+
+		ctx, cc := context.WithTimeout(context.Background(), k.opts.CompactionInterval)
+		result, err := k.compact(ctx)
+		cc()
+		if err != nil {
+			k.opts.Logger.Error(
+				"error compacting registry",
+				slog.String("error", err.Error()))
+			continue
+		}
+		if result.numServersCompacted > 0 || result.numTombstonesCompacted > 0 ||
+			result.numChangesCompacted > 0 || result.numActivationsBackfilled > 0 {
+			k.opts.Logger.Info(
+				"compacted registry",
+				slog.Int("num_servers_compacted", result.numServersCompacted),
+				slog.Int("num_activations_removed", result.numActivationsRemoved),
+				slog.Int("num_tombstones_compacted", result.numTombstonesCompacted),
+				slog.Int("num_changes_compacted", result.numChangesCompacted),
+				slog.Int("num_activations_backfilled", result.numActivationsBackfilled))
+		}
+	}
+}
+
+// compact removes servers that have not heartbeated in more than CompactServersAfter
+// from the registry, as well as every activation that still references them, so that
+// the cost of operations that scan all the servers (like getLiveServers) does not grow
+// unbounded in long-lived clusters where servers come and go. It also removes old
+// server tombstones and change log entries.
+func (k *kvRegistry) compact(ctx context.Context) (compactionResult, error) {
+	var result compactionResult
+
+	// Dead servers can only be compacted once every activation is indexed, otherwise the
+	// activations that aren't would keep referencing them forever.
+	numBackfilled, err := k.backfillServerActivations(ctx)
+	result.numActivationsBackfilled = numBackfilled
+	if err != nil {
+		return result, fmt.Errorf("error backfilling server activations: %w", err)
+	}
+
+	deadServerIDs, err := k.getCompactableServerIDs(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error getting compactable servers: %w", err)
+	}
+
+	for _, serverID := range deadServerIDs {
+		// Activations are removed in small batches (one transaction each) so the
+		// server may take multiple transactions to fully compact.
+		for {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+
+			numRemoved, done, err := k.compactServer(ctx, serverID)
+			if err != nil {
+				return result, fmt.Errorf("error compacting server: %s: %w", serverID, err)
+			}
+			result.numActivationsRemoved += numRemoved
+			if done {
+				result.numServersCompacted++
+				break
+			}
+		}
+	}
+
+	numTombstones, err := k.compactTombstones(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error compacting tombstones: %w", err)
+	}
+	result.numTombstonesCompacted = numTombstones
+
+	numChanges, err := k.compactChangeLog(ctx)
+	result.numChangesCompacted = numChanges
+	if err != nil {
+		return result, fmt.Errorf("error compacting change log: %w", err)
+	}
+
+	return result, nil
+}
+
+func (k *kvRegistry) getCompactableServerIDs(ctx context.Context) ([]string, error) {
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		settings, _, err := k.getClusterSettings(ctx, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		var compactable []string
+		err = tr.IterPrefix(ctx, getServersPrefix(), func(_, v []byte) error {
+			server, err := decodeServerState(v)
+			if err != nil {
+				return fmt.Errorf("error decoding server state: %w", err)
+			}
+			if k.isCompactable(vs, server, settings) {
+				compactable = append(compactable, server.ServerID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return compactable, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]string), nil
+}
+
+// compactServer removes (up to compactionBatchSize) activations that reference the
+// provided server. Once there are none left, the server itself is replaced with a
+// tombstone and done is true.
+func (k *kvRegistry) compactServer(
+	ctx context.Context,
+	serverID string,
+) (numRemoved int, done bool, err error) {
+	_, err = k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		numRemoved, done = 0, false
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		settings, _, err := k.getClusterSettings(ctx, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check again within the transaction in case the server resumed heartbeating.
+		server, ok, err := getServer(ctx, tr, serverID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || !k.isCompactable(vs, server, settings) {
+			done = true
+			return nil, nil
+		}
+
+		var indexKeys [][]byte
+		err = tr.IterPrefix(ctx, getServerActivationsPrefix(serverID), func(key, _ []byte) error {
+			if len(indexKeys) >= compactionBatchSize {
+				return errCompactionBatchFull
+			}
+			indexKeys = append(indexKeys, append([]byte(nil), key...))
+			return nil
+		})
+		if err != nil && !errors.Is(err, errCompactionBatchFull) {
+			return nil, fmt.Errorf("error iterating server activations: %w", err)
+		}
+
+		for _, indexKey := range indexKeys {
+			if err := k.removeActivationsForServer(ctx, tr, serverID, indexKey); err != nil {
+				return nil, err
+			}
+			tr.Delete(ctx, indexKey)
+			numRemoved++
+		}
+
+		if len(indexKeys) < compactionBatchSize {
+			// No activations left, replace the server with a tombstone.
+			tr.Put(ctx, getServerTombstoneKey(serverID), encodeServerTombstone(serverTombstone{
+				ServerVersion: server.ServerVersion,
+				CompactedAt:   vs,
+			}))
+			tr.Delete(ctx, getServerKey(serverID))
+			done = true
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return numRemoved, done, nil
+}
+
+// removeActivationsForServer removes all of the activations that reference serverID
+// from the actor identified by the provided server activation index key.
+func (k *kvRegistry) removeActivationsForServer(
+	ctx context.Context,
+	tr kv.Transaction,
+	serverID string,
+	indexKey []byte,
+) error {
+	t, err := tuple.Unpack(indexKey)
+	if err != nil {
+		return fmt.Errorf("error unpacking server activation key: %w", err)
+	}
+	if len(t) != 5 {
+		return fmt.Errorf("[invariant violated] malformed server activation key: %v", t)
+	}
+	namespace, okNS := t[2].(string)
+	moduleID, okModule := t[3].(string)
+	actorID, okActor := t[4].(string)
+	if !okNS || !okModule || !okActor {
+		return fmt.Errorf("[invariant violated] malformed server activation key: %v", t)
+	}
+
+	actorKey := getActorKey(namespace, actorID, moduleID)
+	ra, ok, err := k.getActor(ctx, tr, actorKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	activations := make([]activation, 0, len(ra.Activations))
+	for _, a := range ra.Activations {
+		if a.ServerID != serverID {
+			activations = append(activations, a)
+		}
+	}
+	if len(activations) == len(ra.Activations) {
+		return nil
+	}
+	ra.Activations = activations
+
+	tr.Put(ctx, actorKey, encodeRegisteredActor(ra))
+	return nil
+}
+
+func (k *kvRegistry) compactTombstones(ctx context.Context) (int, error) {
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		var toDelete [][]byte
+		err = tr.IterPrefix(ctx, getServerTombstonesPrefix(), func(key, v []byte) error {
+			tombstone, err := decodeServerTombstone(v)
+			if err != nil {
+				return fmt.Errorf("error decoding server tombstone: %w", err)
+			}
+			if versionSince(vs, tombstone.CompactedAt) > serverTombstoneRetention {
+				toDelete = append(toDelete, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range toDelete {
+			tr.Delete(ctx, key)
+		}
+		return len(toDelete), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int), nil
+}
+
+// backfillServerActivations adds the activations of the actors that were written before
+// the server activations index existed (or that were never rewritten since) to the index.
+// It scans every key in the registry once, in batches of compactionBatchSize keys, and
+// persists its progress so that the scan resumes where it left off in the next pass if
+// ctx expires.
+func (k *kvRegistry) backfillServerActivations(ctx context.Context) (int, error) {
+	if k.serverActivationsBackfilled.Load() {
+		return 0, nil
+	}
+
+	var numBackfilled int
+	for {
+		if err := ctx.Err(); err != nil {
+			return numBackfilled, err
+		}
+
+		var (
+			numIndexed int
+			done       bool
+		)
+		_, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+			// Reset in case the transaction is retried.
+			numIndexed, done = 0, false
+
+			cursor, ok, err := tr.Get(ctx, getServerActivationsBackfillKey())
+			if err != nil {
+				return nil, fmt.Errorf("error getting server activations backfill cursor: %w", err)
+			}
+			if !ok {
+				cursor = []byte{0x00}
+			}
+
+			var (
+				lastKey []byte
+				numKeys int
+				actors  []backfilledActor
+			)
+			err = tr.IterRange(ctx, cursor, serverActivationsBackfillEnd, func(key, v []byte) error {
+				if numKeys >= compactionBatchSize {
+					return errCompactionBatchFull
+				}
+				numKeys++
+				lastKey = append(lastKey[:0], key...)
+
+				actorKey, ok := unpackActorKey(key)
+				if !ok {
+					return nil
+				}
+				ra, err := decodeRegisteredActor(v)
+				if err != nil {
+					return fmt.Errorf("error decoding registered actor: %w", err)
+				}
+				actorKey.activations = ra.Activations
+				actors = append(actors, actorKey)
+				return nil
+			})
+			if err != nil && !errors.Is(err, errCompactionBatchFull) {
+				return nil, fmt.Errorf("error iterating registry: %w", err)
+			}
+
+			for _, actor := range actors {
+				for _, a := range actor.activations {
+					tr.Put(ctx, getServerActivationKey(
+						a.ServerID, actor.namespace, actor.moduleID, actor.actorID), nil)
+					numIndexed++
+				}
+			}
+
+			if numKeys < compactionBatchSize {
+				// Store a cursor that is past the end of the scan so the backfill is never
+				// performed again.
+				tr.Put(ctx, getServerActivationsBackfillKey(), serverActivationsBackfillEnd)
+				done = true
+			} else {
+				tr.Put(ctx, getServerActivationsBackfillKey(), append(lastKey, 0x00))
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return numBackfilled, err
+		}
+
+		numBackfilled += numIndexed
+		if done {
+			k.serverActivationsBackfilled.Store(true)
+			return numBackfilled, nil
+		}
+	}
+}
+
+// backfilledActor is an actor found by backfillServerActivations.
+type backfilledActor struct {
+	namespace   string
+	moduleID    string
+	actorID     string
+	activations []activation
+}
+
+// unpackActorKey returns the actor identified by key if it is an actor key (see
+// getActorKey).
+func unpackActorKey(key []byte) (backfilledActor, bool) {
+	t, err := tuple.Unpack(key)
+	if err != nil || len(t) != 5 {
+		return backfilledActor{}, false
+	}
+	namespace, okNS := t[0].(string)
+	actors, okActors := t[1].(string)
+	moduleID, okModule := t[2].(string)
+	actorID, okActor := t[3].(string)
+	state, okState := t[4].(string)
+	if !okNS || !okActors || !okModule || !okActor || !okState ||
+		actors != "actors" || state != "state" {
+		return backfilledActor{}, false
+	}
+	return backfilledActor{namespace: namespace, moduleID: moduleID, actorID: actorID}, true
+}
+
+func (k *kvRegistry) isCompactable(vs int64, server serverState, settings ClusterSettings) bool {
+	compactAfter := k.opts.CompactServersAfter
+	if minCompactAfter := 2 * settings.HeartbeatTTL; compactAfter < minCompactAfter {
+		// Never compact servers that could still be considered alive.
+		compactAfter = minCompactAfter
+	}
+	return versionSince(vs, server.LastHeartbeatedAt) > compactAfter
+}
+
+func getServer(
+	ctx context.Context,
+	tr kv.Transaction,
+	serverID string,
+) (serverState, bool, error) {
+	v, ok, err := tr.Get(ctx, getServerKey(serverID))
+	if err != nil {
+		return serverState{}, false, fmt.Errorf("error getting server state: %w", err)
+	}
+	if !ok {
+		return serverState{}, false, nil
+	}
+
+	server, err := decodeServerState(v)
+	if err != nil {
+		return serverState{}, false, fmt.Errorf("error decoding server state: %w", err)
+	}
+	return server, true, nil
+}
+
+func getServerTombstone(
+	ctx context.Context,
+	tr kv.Transaction,
+	serverID string,
+) (serverTombstone, bool, error) {
+	v, ok, err := tr.Get(ctx, getServerTombstoneKey(serverID))
+	if err != nil {
+		return serverTombstone{}, false, err
+	}
+	if !ok {
+		return serverTombstone{}, false, nil
+	}
+
+	tombstone, err := decodeServerTombstone(v)
+	if err != nil {
+		return serverTombstone{}, false, fmt.Errorf("error decoding server tombstone: %w", err)
+	}
+	return tombstone, true, nil
+}
+
+// serverActivationsBackfillEnd sorts after every key in the registry since they're all
+// tuples.
+var serverActivationsBackfillEnd = []byte{0xFF}
+
+func getServerActivationsBackfillKey() []byte {
+	return tuple.Tuple{"server_activations_backfill"}.Pack()
+}
+
+func hasActivationOnServer(activations []activation, serverID string) bool {
+	for _, a := range activations {
+		if a.ServerID == serverID {
+			return true
+		}
+	}
+	return false
+}
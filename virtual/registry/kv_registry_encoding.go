@@ -0,0 +1,340 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// Records stored in the KV registry are encoded with the binary encoding described in
+// kv/record.go instead of JSON so that the (very hot) EnsureActivation and Heartbeat
+// transactions don't spend most of their CPU time encoding and decoding the records they
+// touch. Every record type has its own schema version which must be incremented any time
+// its fields change so that records written with older versions can still be decoded.
+//
+// Records written by older versions of the registry are JSON objects. The schema version
+// byte of the binary encoding can never be '{' so the decoders can always distinguish the
+// two and fall back to decoding JSON. Legacy records are rewritten using the binary
+// encoding whenever a transaction reads them (see needsMigration), so the JSON decoding
+// path can be removed once every record in a cluster has been touched.
+const legacyJSONRecordPrefix byte = '{'
+
+var (
+	recordTypeRegisteredActor  = kv.RecordType{ID: 1, Name: "registeredActor", Version: 1}
+	recordTypeServerState      = kv.RecordType{ID: 2, Name: "serverState", Version: 1}
+	recordTypeRegisteredModule = kv.RecordType{ID: 3, Name: "registeredModule", Version: 1}
+	recordTypeServerTombstone  = kv.RecordType{ID: 4, Name: "serverTombstone", Version: 1}
+	recordTypeClusterSettings  = kv.RecordType{ID: 5, Name: "clusterSettings", Version: 1}
+	recordTypeNamespaceLimits  = kv.RecordType{ID: 6, Name: "namespaceLimits", Version: 1}
+	recordTypeNamespaceUsage   = kv.RecordType{ID: 7, Name: "namespaceUsage", Version: 1}
+	recordTypeChangeLogEntry   = kv.RecordType{ID: 8, Name: "changeLogEntry", Version: 1}
+)
+
+// isLegacyRecord returns true if the record was encoded with JSON by an older version
+// of the registry and should be rewritten using the binary encoding.
+func isLegacyRecord(b []byte) bool {
+	return len(b) > 0 && b[0] == legacyJSONRecordPrefix
+}
+
+func encodeRegisteredActor(ra registeredActor) []byte {
+	e := newRecordEncoder(recordTypeRegisteredActor, 64+32*len(ra.Activations))
+	e.putActorOptions(ra.Opts)
+	e.PutString(ra.ModuleID)
+	e.PutUvarint(ra.Generation)
+	e.PutUvarint(uint64(len(ra.Activations)))
+	for _, a := range ra.Activations {
+		e.PutString(a.ServerID)
+		e.PutVarint(a.ServerVersion)
+	}
+	return e.Bytes()
+}
+
+func decodeRegisteredActor(b []byte) (registeredActor, error) {
+	var ra registeredActor
+	if isLegacyRecord(b) {
+		if err := json.Unmarshal(b, &ra); err != nil {
+			return registeredActor{}, fmt.Errorf("error unmarshaling legacy registered actor: %w", err)
+		}
+		ra.needsMigration = true
+		return ra, nil
+	}
+
+	d, err := newRecordDecoder(b, recordTypeRegisteredActor)
+	if err != nil {
+		return registeredActor{}, err
+	}
+	ra.Opts = d.actorOptions()
+	ra.ModuleID = d.ReadString()
+	ra.Generation = d.ReadUvarint()
+	numActivations := d.ReadLength()
+	if numActivations > 0 {
+		ra.Activations = make([]activation, 0, numActivations)
+	}
+	for i := 0; i < numActivations && d.Err() == nil; i++ {
+		ra.Activations = append(ra.Activations, activation{
+			ServerID:      d.ReadString(),
+			ServerVersion: d.ReadVarint(),
+		})
+	}
+	if err := d.Finish(); err != nil {
+		return registeredActor{}, err
+	}
+	return ra, nil
+}
+
+func encodeServerState(s serverState) []byte {
+	e := newRecordEncoder(recordTypeServerState, 64+len(s.ServerID)+len(s.HeartbeatState.Address))
+	e.PutString(s.ServerID)
+	e.PutVarint(s.ServerVersion)
+	e.PutVarint(int64(s.HeartbeatState.NumActivatedActors))
+	e.PutVarint(int64(s.HeartbeatState.UsedMemory))
+	e.PutString(s.HeartbeatState.Address)
+	e.PutVarint(s.LastHeartbeatedAt)
+	e.PutVarint(int64(s.NumHeartbeats))
+	e.PutVarint(int64(s.HeartbeatState.MemoryLimitBytes))
+	e.PutVarint(int64(s.HeartbeatState.NumCPUCores))
+	e.PutVarint(s.LastShedRequestedAt)
+	return e.Bytes()
+}
+
+func decodeServerState(b []byte) (serverState, error) {
+	var s serverState
+	if isLegacyRecord(b) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return serverState{}, fmt.Errorf("error unmarshaling legacy server state: %w", err)
+		}
+		return s, nil
+	}
+
+	d, err := newRecordDecoder(b, recordTypeServerState)
+	if err != nil {
+		return serverState{}, err
+	}
+	s.ServerID = d.ReadString()
+	s.ServerVersion = d.ReadVarint()
+	s.HeartbeatState.NumActivatedActors = int(d.ReadVarint())
+	s.HeartbeatState.UsedMemory = int(d.ReadVarint())
+	s.HeartbeatState.Address = d.ReadString()
+	s.LastHeartbeatedAt = d.ReadVarint()
+	s.NumHeartbeats = int(d.ReadVarint())
+	s.HeartbeatState.MemoryLimitBytes = int(d.ReadVarint())
+	s.HeartbeatState.NumCPUCores = int(d.ReadVarint())
+	s.LastShedRequestedAt = d.ReadVarint()
+	if err := d.Finish(); err != nil {
+		return serverState{}, err
+	}
+	return s, nil
+}
+
+func encodeRegisteredModule(rm registeredModule) []byte {
+	e := newRecordEncoder(recordTypeRegisteredModule, 16+len(rm.Bytes))
+	e.PutBytes(rm.Bytes)
+	e.PutBool(rm.Opts.Reentrant)
+	e.PutUvarint(uint64(len(rm.Opts.ReadOnlyOperations)))
+	for _, operation := range rm.Opts.ReadOnlyOperations {
+		e.PutString(operation)
+	}
+	return e.Bytes()
+}
+
+func decodeRegisteredModule(b []byte) (registeredModule, error) {
+	var rm registeredModule
+	if isLegacyRecord(b) {
+		if err := json.Unmarshal(b, &rm); err != nil {
+			return registeredModule{}, fmt.Errorf("error unmarshaling legacy registered module: %w", err)
+		}
+		rm.needsMigration = true
+		return rm, nil
+	}
+
+	d, err := newRecordDecoder(b, recordTypeRegisteredModule)
+	if err != nil {
+		return registeredModule{}, err
+	}
+	rm.Bytes = d.ReadBytes()
+	rm.Opts.Reentrant = d.ReadBool()
+	// Every operation takes up at least one byte so length() guards against corrupt counts.
+	numReadOnlyOperations := d.ReadLength()
+	for i := 0; i < numReadOnlyOperations && d.Err() == nil; i++ {
+		rm.Opts.ReadOnlyOperations = append(rm.Opts.ReadOnlyOperations, d.ReadString())
+	}
+	if err := d.Finish(); err != nil {
+		return registeredModule{}, err
+	}
+	return rm, nil
+}
+
+func encodeServerTombstone(t serverTombstone) []byte {
+	e := newRecordEncoder(recordTypeServerTombstone, 32)
+	e.PutVarint(t.ServerVersion)
+	e.PutVarint(t.CompactedAt)
+	return e.Bytes()
+}
+
+func decodeServerTombstone(b []byte) (serverTombstone, error) {
+	var t serverTombstone
+	if isLegacyRecord(b) {
+		if err := json.Unmarshal(b, &t); err != nil {
+			return serverTombstone{}, fmt.Errorf("error unmarshaling legacy server tombstone: %w", err)
+		}
+		return t, nil
+	}
+
+	d, err := newRecordDecoder(b, recordTypeServerTombstone)
+	if err != nil {
+		return serverTombstone{}, err
+	}
+	t.ServerVersion = d.ReadVarint()
+	t.CompactedAt = d.ReadVarint()
+	if err := d.Finish(); err != nil {
+		return serverTombstone{}, err
+	}
+	return t, nil
+}
+
+func encodeClusterSettings(settings ClusterSettings) []byte {
+	e := newRecordEncoder(recordTypeClusterSettings, 16)
+	e.PutVarint(int64(settings.HeartbeatTTL))
+	e.PutVarint(int64(settings.HeartbeatInterval))
+	return e.Bytes()
+}
+
+func decodeClusterSettings(b []byte) (ClusterSettings, error) {
+	d, err := newRecordDecoder(b, recordTypeClusterSettings)
+	if err != nil {
+		return ClusterSettings{}, err
+	}
+	var settings ClusterSettings
+	settings.HeartbeatTTL = time.Duration(d.ReadVarint())
+	settings.HeartbeatInterval = time.Duration(d.ReadVarint())
+	if err := d.Finish(); err != nil {
+		return ClusterSettings{}, err
+	}
+	return settings, nil
+}
+
+func encodeNamespaceLimits(limits NamespaceLimits) []byte {
+	e := newRecordEncoder(recordTypeNamespaceLimits, 16)
+	e.PutVarint(int64(limits.MaxActors))
+	e.PutVarint(int64(limits.MaxModuleBytes))
+	e.PutVarint(int64(limits.MaxActivatedMemoryBytes))
+	e.PutVarint(int64(limits.MaxInvocationsPerSecond))
+	return e.Bytes()
+}
+
+func decodeNamespaceLimits(b []byte) (NamespaceLimits, error) {
+	d, err := newRecordDecoder(b, recordTypeNamespaceLimits)
+	if err != nil {
+		return NamespaceLimits{}, err
+	}
+	var limits NamespaceLimits
+	limits.MaxActors = int(d.ReadVarint())
+	limits.MaxModuleBytes = int(d.ReadVarint())
+	limits.MaxActivatedMemoryBytes = int(d.ReadVarint())
+	limits.MaxInvocationsPerSecond = int(d.ReadVarint())
+	if err := d.Finish(); err != nil {
+		return NamespaceLimits{}, err
+	}
+	return limits, nil
+}
+
+func encodeNamespaceUsage(usage int64) []byte {
+	e := newRecordEncoder(recordTypeNamespaceUsage, 8)
+	e.PutVarint(usage)
+	return e.Bytes()
+}
+
+func decodeNamespaceUsage(b []byte) (int64, error) {
+	d, err := newRecordDecoder(b, recordTypeNamespaceUsage)
+	if err != nil {
+		return 0, err
+	}
+	usage := d.ReadVarint()
+	if err := d.Finish(); err != nil {
+		return 0, err
+	}
+	return usage, nil
+}
+
+func encodeChangeLogEntry(entry changeLogEntry) []byte {
+	c := entry.Change
+	e := newRecordEncoder(
+		recordTypeChangeLogEntry,
+		32+len(c.Type)+len(c.Namespace)+len(c.ModuleID)+len(c.ActorID)+len(c.ServerID))
+	e.PutVarint(entry.VersionStamp)
+	e.PutString(string(c.Type))
+	e.PutString(c.Namespace)
+	e.PutString(c.ModuleID)
+	e.PutString(c.ActorID)
+	e.PutString(c.ServerID)
+	e.PutVarint(c.ServerVersion)
+	return e.Bytes()
+}
+
+func decodeChangeLogEntry(b []byte) (changeLogEntry, error) {
+	d, err := newRecordDecoder(b, recordTypeChangeLogEntry)
+	if err != nil {
+		return changeLogEntry{}, err
+	}
+	var entry changeLogEntry
+	entry.VersionStamp = d.ReadVarint()
+	entry.Change.Type = ActivationChangeType(d.ReadString())
+	entry.Change.Namespace = d.ReadString()
+	entry.Change.ModuleID = d.ReadString()
+	entry.Change.ActorID = d.ReadString()
+	entry.Change.ServerID = d.ReadString()
+	entry.Change.ServerVersion = d.ReadVarint()
+	if err := d.Finish(); err != nil {
+		return changeLogEntry{}, err
+	}
+	return entry, nil
+}
+
+// recordEncoder extends kv.RecordEncoder with the fields that are shared by multiple
+// registry records.
+type recordEncoder struct {
+	*kv.RecordEncoder
+}
+
+func newRecordEncoder(t kv.RecordType, sizeHint int) *recordEncoder {
+	return &recordEncoder{kv.NewRecordEncoder(t, sizeHint)}
+}
+
+func (e *recordEncoder) putActorOptions(opts types.ActorOptions) {
+	e.PutUvarint(opts.ExtraReplicas)
+	e.PutString(string(opts.ReplicationStrategy))
+	e.PutVarint(int64(opts.RetryPolicy.PerAttemptTimeout))
+	e.PutUvarint(uint64(opts.RetryPolicy.MaxNumRetries))
+	e.PutVarint(int64(opts.RetryPolicy.InitialBackoff))
+	e.PutVarint(int64(opts.RetryPolicy.MaxBackoff))
+	e.PutFloat64(opts.RetryPolicy.HedgeAfterPercentile)
+}
+
+// recordDecoder extends kv.RecordDecoder with the fields that are shared by multiple
+// registry records.
+type recordDecoder struct {
+	*kv.RecordDecoder
+}
+
+func newRecordDecoder(b []byte, expected kv.RecordType) (*recordDecoder, error) {
+	d, err := kv.NewRecordDecoder(b, expected)
+	if err != nil {
+		return nil, err
+	}
+	return &recordDecoder{d}, nil
+}
+
+func (d *recordDecoder) actorOptions() types.ActorOptions {
+	var opts types.ActorOptions
+	opts.ExtraReplicas = d.ReadUvarint()
+	opts.ReplicationStrategy = types.ReplicaSelectionStrategy(d.ReadString())
+	opts.RetryPolicy.PerAttemptTimeout = time.Duration(d.ReadVarint())
+	opts.RetryPolicy.MaxNumRetries = uint(d.ReadUvarint())
+	opts.RetryPolicy.InitialBackoff = time.Duration(d.ReadVarint())
+	opts.RetryPolicy.MaxBackoff = time.Duration(d.ReadVarint())
+	opts.RetryPolicy.HedgeAfterPercentile = d.ReadFloat64()
+	return opts
+}
@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordEncodingRoundTrip(t *testing.T) {
+	ra := registeredActor{
+		Opts: types.ActorOptions{
+			ExtraReplicas:       2,
+			ReplicationStrategy: types.ReplicaSelectionStrategySorted,
+			RetryPolicy: types.RetryPolicy{
+				PerAttemptTimeout:    time.Second,
+				MaxNumRetries:        3,
+				InitialBackoff:       time.Millisecond,
+				MaxBackoff:           time.Second,
+				HedgeAfterPercentile: 0.95,
+			},
+		},
+		ModuleID:   "module",
+		Generation: 7,
+		Activations: []activation{
+			newActivation("server1", 1),
+			newActivation("server2", 1<<40),
+		},
+	}
+	decodedActor, err := decodeRegisteredActor(encodeRegisteredActor(ra))
+	require.NoError(t, err)
+	require.Equal(t, ra, decodedActor)
+
+	decodedActor, err = decodeRegisteredActor(encodeRegisteredActor(registeredActor{}))
+	require.NoError(t, err)
+	require.Equal(t, registeredActor{}, decodedActor)
+
+	server := newServerState("server1", 3, HeartbeatState{
+		NumActivatedActors: 10,
+		UsedMemory:         1 << 30,
+		Address:            "127.0.0.1:9090",
+		MemoryLimitBytes:   1 << 32,
+		NumCPUCores:        8,
+	}, 123456789)
+	server.NumHeartbeats = 5
+	server.LastShedRequestedAt = 12345
+	decodedServer, err := decodeServerState(encodeServerState(server))
+	require.NoError(t, err)
+	require.Equal(t, server, decodedServer)
+
+	module := registeredModule{Bytes: []byte{0, 1, 2, '{'}, Opts: ModuleOptions{
+		Reentrant:          true,
+		ReadOnlyOperations: []string{"get", "list"},
+	}}
+	decodedModule, err := decodeRegisteredModule(encodeRegisteredModule(module))
+	require.NoError(t, err)
+	require.Equal(t, module, decodedModule)
+
+	tombstone := serverTombstone{ServerVersion: 4, CompactedAt: 987654321}
+	decodedTombstone, err := decodeServerTombstone(encodeServerTombstone(tombstone))
+	require.NoError(t, err)
+	require.Equal(t, tombstone, decodedTombstone)
+
+	limits := NamespaceLimits{
+		MaxActors:               1,
+		MaxModuleBytes:          2,
+		MaxActivatedMemoryBytes: 3,
+		MaxInvocationsPerSecond: 4,
+	}
+	decodedLimits, err := decodeNamespaceLimits(encodeNamespaceLimits(limits))
+	require.NoError(t, err)
+	require.Equal(t, limits, decodedLimits)
+
+	decodedUsage, err := decodeNamespaceUsage(encodeNamespaceUsage(1 << 40))
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<40), decodedUsage)
+
+	entry := changeLogEntry{
+		VersionStamp: 1 << 40,
+		Change: ActivationChange{
+			Type:          ActivationChangeTypeActorMoved,
+			Namespace:     "ns1",
+			ModuleID:      "module1",
+			ActorID:       "actor1",
+			ServerID:      "server1",
+			ServerVersion: 7,
+		},
+	}
+	decodedEntry, err := decodeChangeLogEntry(encodeChangeLogEntry(entry))
+	require.NoError(t, err)
+	require.Equal(t, entry, decodedEntry)
+
+	// The binary encoding should be much smaller than the equivalent JSON.
+	marshaled, err := json.Marshal(&ra)
+	require.NoError(t, err)
+	require.Less(t, 2*len(encodeRegisteredActor(ra)), len(marshaled))
+}
+
+func TestRecordEncodingLegacyJSON(t *testing.T) {
+	ra := registeredActor{
+		ModuleID:    "module",
+		Generation:  2,
+		Activations: []activation{newActivation("server1", 1)},
+	}
+	marshaled, err := json.Marshal(&ra)
+	require.NoError(t, err)
+	require.True(t, isLegacyRecord(marshaled))
+
+	decoded, err := decodeRegisteredActor(marshaled)
+	require.NoError(t, err)
+	require.True(t, decoded.needsMigration)
+	decoded.needsMigration = false
+	require.Equal(t, ra, decoded)
+
+	server := newServerState("server1", 3, HeartbeatState{Address: "addr"}, 100)
+	marshaled, err = json.Marshal(&server)
+	require.NoError(t, err)
+	decodedServer, err := decodeServerState(marshaled)
+	require.NoError(t, err)
+	require.Equal(t, server, decodedServer)
+
+	module := registeredModule{Bytes: []byte("wasm")}
+	marshaled, err = json.Marshal(&module)
+	require.NoError(t, err)
+	decodedModule, err := decodeRegisteredModule(marshaled)
+	require.NoError(t, err)
+	require.True(t, decodedModule.needsMigration)
+	require.Equal(t, module.Bytes, decodedModule.Bytes)
+}
+
+func TestRecordEncodingRejectsInvalidRecords(t *testing.T) {
+	encoded := encodeRegisteredActor(registeredActor{
+		ModuleID:    "module",
+		Activations: []activation{newActivation("server1", 1)},
+	})
+
+	_, err := decodeRegisteredActor(encoded[:len(encoded)-3])
+	require.ErrorIs(t, err, kv.ErrRecordTruncated)
+
+	_, err = decodeRegisteredActor(append(append([]byte(nil), encoded...), 0))
+	require.Error(t, err)
+
+	_, err = decodeServerState(encoded)
+	require.Error(t, err)
+
+	unknownVersion := append([]byte(nil), encoded...)
+	unknownVersion[0] = recordTypeRegisteredActor.Version + 1
+	_, err = decodeRegisteredActor(unknownVersion)
+	require.Error(t, err)
+
+	_, err = decodeRegisteredActor(nil)
+	require.ErrorIs(t, err, kv.ErrRecordTruncated)
+}
@@ -0,0 +1,193 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"golang.org/x/exp/slog"
+)
+
+func (k *kvRegistry) MigrateActor(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	targetServerID string,
+) (MigrateActorResult, error) {
+	// Only used for logging.
+	var numPrevActivations int
+
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		settings, _, err := k.getClusterSettings(ctx, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			req = EnsureActivationRequest{
+				Namespace: namespace,
+				ModuleID:  moduleID,
+				ActorID:   actorID,
+			}
+			actorKey = getActorKey(namespace, actorID, moduleID)
+		)
+		// Unlike EnsureActivation, migrating an actor never creates it so that a typo in
+		// the actor's ID doesn't activate a brand new actor.
+		ra, ok, err := k.getActor(ctx, tr, actorKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get actor: %w", err)
+		}
+		if !ok {
+			return nil, NewActorNotFoundError(fmt.Errorf(
+				"actor: %s with module: %s does not exist in namespace: %s",
+				actorID, moduleID, namespace))
+		}
+		k.indexLegacyActivations(ctx, tr, req, ra)
+
+		liveServers, err := getLiveServers(ctx, vs, settings.HeartbeatTTL, tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get live servers: %w", err)
+		}
+		liveServersByID := make(map[string]serverState, len(liveServers))
+		for _, server := range liveServers {
+			liveServersByID[server.ServerID] = server
+		}
+
+		target, ok := liveServersByID[targetServerID]
+		if !ok {
+			return nil, fmt.Errorf("target server: %s is not alive", targetServerID)
+		}
+		if target.NumHeartbeats < k.opts.MinSuccessiveHeartbeatsBeforeAllowActivations {
+			return nil, fmt.Errorf(
+				"target server: %s numHeartbeats: %d < MinSuccessiveHeartbeatsBeforeAllowActivations(%d)",
+				targetServerID, target.NumHeartbeats, k.opts.MinSuccessiveHeartbeatsBeforeAllowActivations)
+		}
+
+		var (
+			prevActivations  = ra.Activations
+			targetActivation = newActivation(target.ServerID, target.ServerVersion)
+		)
+		// The target replaces the actor's primary activation (the first one, which is the
+		// one that EnsureActivation returns first) and the other replicas are kept.
+		ra.Activations = nil
+		if hasActivation(prevActivations, targetActivation) {
+			ra.Activations = append(ra.Activations, targetActivation)
+		} else if err := k.activateActor(ctx, tr, target, req, &ra); err != nil {
+			return nil, fmt.Errorf("failed activating actor: %w", err)
+		}
+		for i, a := range prevActivations {
+			if i == 0 || a.ServerID == target.ServerID {
+				continue
+			}
+			ra.Activations = append(ra.Activations, a)
+		}
+		tr.Put(ctx, actorKey, encodeRegisteredActor(ra))
+
+		changes := movedActivationChanges(req, prevActivations, ra.Activations)
+		numPrevActivations = len(changes)
+		for _, change := range changes {
+			if !hasActivationOnServer(ra.Activations, change.ServerID) {
+				tr.Delete(ctx, getServerActivationKey(change.ServerID, namespace, moduleID, actorID))
+			}
+		}
+		k.recordChanges(ctx, tr, vs, changes...)
+
+		var result MigrateActorResult
+		ref, err := types.NewActorReference(
+			target.ServerID, target.ServerVersion, namespace, ra.ModuleID, actorID, ra.Generation,
+			types.ServerState{Address: target.HeartbeatState.Address})
+		if err != nil {
+			return nil, fmt.Errorf("error creating new actor reference: %w", err)
+		}
+		result.References = append(result.References, ref)
+
+		for _, change := range changes {
+			server, ok := liveServersByID[change.ServerID]
+			if !ok || server.ServerVersion != change.ServerVersion {
+				// The server is dead (or restarted) so the activation is gone already.
+				continue
+			}
+			ref, err := types.NewActorReference(
+				server.ServerID, server.ServerVersion, namespace, ra.ModuleID, actorID, ra.Generation,
+				types.ServerState{Address: server.HeartbeatState.Address})
+			if err != nil {
+				return nil, fmt.Errorf("error creating previous actor reference: %w", err)
+			}
+			result.PreviousReferences = append(result.PreviousReferences, ref)
+		}
+
+		return result, nil
+	})
+	if err != nil {
+		return MigrateActorResult{}, fmt.Errorf("MigrateActor: error: %w", err)
+	}
+
+	k.opts.Logger.Info(
+		"migrated actor to server",
+		slog.String("actor_id", fmt.Sprintf("%s::%s:%s", namespace, moduleID, actorID)),
+		slog.String("server_id", targetServerID),
+		slog.Int("num_previous_activations", numPrevActivations))
+	return result.(MigrateActorResult), nil
+}
+
+func (k *kvRegistry) LookupActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		settings, _, err := k.getClusterSettings(ctx, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		ra, ok, err := k.getActor(ctx, tr, getActorKey(namespace, actorID, moduleID))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return []types.ActorReference(nil), nil
+		}
+
+		req := EnsureActivationRequest{
+			Namespace: namespace,
+			ModuleID:  moduleID,
+			ActorID:   actorID,
+			// Return all of the live activations.
+			ExtraReplicas: uint64(len(ra.Activations)),
+		}
+		refs, _, err := k.getExistingUnblacklistedActivations(
+			ctx, tr, req, nil, vs, settings.HeartbeatTTL, ra)
+		if err != nil {
+			return nil, fmt.Errorf("error getting existing activations: %w", err)
+		}
+		return refs, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("LookupActivation: error: %w", err)
+	}
+	return result.([]types.ActorReference), nil
+}
+
+func hasActivation(activations []activation, a activation) bool {
+	for _, curr := range activations {
+		if curr == a {
+			return true
+		}
+	}
+	return false
+}
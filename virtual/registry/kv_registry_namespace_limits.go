@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+)
+
+const (
+	namespaceUsageActors      = "actors"
+	namespaceUsageModuleBytes = "module_bytes"
+)
+
+func (k *kvRegistry) GetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+) (NamespaceLimits, error) {
+	result, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		return getNamespaceLimits(ctx, tr, namespace)
+	})
+	if err != nil {
+		return NamespaceLimits{}, fmt.Errorf("GetNamespaceLimits: error: %w", err)
+	}
+	return result.(NamespaceLimits), nil
+}
+
+func (k *kvRegistry) SetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+	limits NamespaceLimits,
+) error {
+	if err := limits.Validate(); err != nil {
+		return fmt.Errorf("SetNamespaceLimits: invalid limits: %w", err)
+	}
+
+	_, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		if limits.IsUnlimited() {
+			tr.Delete(ctx, getNamespaceLimitsKey(namespace))
+		} else {
+			tr.Put(ctx, getNamespaceLimitsKey(namespace), encodeNamespaceLimits(limits))
+		}
+
+		// Usage is only tracked while the corresponding limit is set to avoid contending
+		// on the usage keys in namespaces without limits. Delete the usage when the limit
+		// is removed so that it is recomputed from scratch (see incrementNamespaceUsage)
+		// if the limit is ever set again.
+		if limits.MaxActors == 0 {
+			tr.Delete(ctx, getNamespaceUsageKey(namespace, namespaceUsageActors))
+		}
+		if limits.MaxModuleBytes == 0 {
+			tr.Delete(ctx, getNamespaceUsageKey(namespace, namespaceUsageModuleBytes))
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("SetNamespaceLimits: error: %w", err)
+	}
+	return nil
+}
+
+func getNamespaceLimits(
+	ctx context.Context,
+	tr kv.Transaction,
+	namespace string,
+) (NamespaceLimits, error) {
+	v, ok, err := tr.Get(ctx, getNamespaceLimitsKey(namespace))
+	if err != nil {
+		return NamespaceLimits{}, fmt.Errorf("error getting namespace limits: %w", err)
+	}
+	if !ok {
+		return NamespaceLimits{}, nil
+	}
+
+	limits, err := decodeNamespaceLimits(v)
+	if err != nil {
+		return NamespaceLimits{}, fmt.Errorf("error decoding namespace limits: %w", err)
+	}
+	return limits, nil
+}
+
+// getAllNamespaceLimits returns the limits of every namespace that has any configured.
+func getAllNamespaceLimits(
+	ctx context.Context,
+	tr kv.Transaction,
+) (map[string]NamespaceLimits, error) {
+	var allLimits map[string]NamespaceLimits
+	err := tr.IterPrefix(ctx, getNamespaceLimitsPrefix(), func(k, v []byte) error {
+		key, err := tuple.Unpack(k)
+		if err != nil {
+			return fmt.Errorf("error unpacking namespace limits key: %w", err)
+		}
+		namespace, ok := key[len(key)-1].(string)
+		if !ok {
+			return fmt.Errorf("unexpected namespace limits key: %v", key)
+		}
+
+		limits, err := decodeNamespaceLimits(v)
+		if err != nil {
+			return fmt.Errorf("error decoding namespace limits: %w", err)
+		}
+		if allLimits == nil {
+			allLimits = make(map[string]NamespaceLimits)
+		}
+		allLimits[namespace] = limits
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error iterating namespace limits: %w", err)
+	}
+	return allLimits, nil
+}
+
+// incrementNamespaceUsage increments the namespace's usage of the resource by delta, or
+// returns a NamespaceLimitExceededErr if doing so would exceed limit. If the usage has not
+// been tracked yet (because the limit was just set) it is initialized with computeUsage.
+func incrementNamespaceUsage(
+	ctx context.Context,
+	tr kv.Transaction,
+	namespace string,
+	resource string,
+	limit int,
+	delta int,
+	computeUsage func() (int, error),
+) error {
+	key := getNamespaceUsageKey(namespace, resource)
+	v, ok, err := tr.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error getting namespace usage: %w", err)
+	}
+
+	var usage int
+	if ok {
+		decoded, err := decodeNamespaceUsage(v)
+		if err != nil {
+			return fmt.Errorf("error decoding namespace usage: %w", err)
+		}
+		usage = int(decoded)
+	} else {
+		usage, err = computeUsage()
+		if err != nil {
+			return fmt.Errorf("error computing namespace usage: %w", err)
+		}
+	}
+
+	if usage+delta > limit {
+		return NewNamespaceLimitExceededError(fmt.Errorf(
+			"namespace: %s is using: %d %s, limit is: %d, requested: %d more",
+			namespace, usage, resource, limit, delta))
+	}
+	tr.Put(ctx, key, encodeNamespaceUsage(int64(usage+delta)))
+	return nil
+}
+
+func countNamespaceActors(ctx context.Context, tr kv.Transaction, namespace string) (int, error) {
+	count := 0
+	err := tr.IterPrefix(ctx, getActorsPrefix(namespace), func(k, v []byte) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func countNamespaceModuleBytes(ctx context.Context, tr kv.Transaction, namespace string) (int, error) {
+	numBytes := 0
+	err := tr.IterPrefix(ctx, getModulesPrefix(namespace), func(k, v []byte) error {
+		numBytes += len(v)
+		return nil
+	})
+	return numBytes, err
+}
+
+func getNamespaceLimitsKey(namespace string) []byte {
+	return tuple.Tuple{"namespace_limits", namespace}.Pack()
+}
+
+func getNamespaceLimitsPrefix() []byte {
+	return tuple.Tuple{"namespace_limits"}.Pack()
+}
+
+func getNamespaceUsageKey(namespace, resource string) []byte {
+	return tuple.Tuple{namespace, "usage", resource}.Pack()
+}
+
+func getActorsPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "actors"}.Pack()
+}
+
+func getModulesPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "modules"}.Pack()
+}
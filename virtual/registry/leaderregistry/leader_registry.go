@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/richardartoul/nola/virtual"
 	"github.com/richardartoul/nola/virtual/registry"
@@ -21,6 +23,10 @@ const (
 	leaderNamespace  = "leader-namespace"
 	leaderActorName  = "leader-actor"
 	leaderModuleName = "leader-module"
+
+	// watchPollInterval controls how often each leaderRegistry polls the leader for
+	// activation changes while it has watchers.
+	watchPollInterval = 250 * time.Millisecond
 )
 
 // LeaderProvider is the interface that must be implemented so the leader
@@ -39,6 +45,28 @@ type leaderRegistry struct {
 	env      virtual.Environment
 	server   *virtual.Server
 	serverID string
+
+	// Activation changes are polled from the leader and then fanned out to local
+	// watchers.
+	changes    *registry.ActivationChangeFeed
+	pollerOnce sync.Once
+	closeOnce  sync.Once
+	closeCh    chan struct{}
+	pollerWg   sync.WaitGroup
+
+	// clusterSettings are the settings last returned by the leader. They're included in
+	// every heartbeat so that a newly elected leader (whose in-memory registry starts out
+	// empty) restores them instead of reverting to the defaults.
+	clusterSettings struct {
+		sync.Mutex
+		settings *registry.ClusterSettings
+	}
+	// namespaceLimits are the limits last returned by the leader. They're included in
+	// every heartbeat for the same reason as clusterSettings.
+	namespaceLimits struct {
+		sync.Mutex
+		limits map[string]registry.NamespaceLimits
+	}
 }
 
 // LeaderRegistry creates a new leader-backed registry. The idea with the LeaderRegistry is
@@ -81,8 +109,13 @@ func NewLeaderRegistry(
 		return nil, fmt.Errorf("NewLeaderRegistry: error creating new DNS registry from resolver: %w", err)
 	}
 
+	client, err := virtual.NewHTTPClientWithOptions(virtual.HTTPClientOptions{TLS: envOpts.TLS})
+	if err != nil {
+		return nil, fmt.Errorf("NewLeaderRegistry: error creating HTTP client: %w", err)
+	}
+
 	env, err := virtual.NewEnvironment(
-		ctx, serverID, reg, registry.NewNoopModuleStore(), virtual.NewHTTPClient(), envOpts)
+		ctx, serverID, reg, registry.NewNoopModuleStore(), client, envOpts)
 	if err != nil {
 		return nil, fmt.Errorf("NewLeaderRegistry: error creating new virtual environment: %w", err)
 	}
@@ -95,7 +128,8 @@ func NewLeaderRegistry(
 	if envOpts.Discovery.DiscoveryType != virtual.DiscoveryTypeLocalHost {
 		// Skip this if DiscoveryTypeLocalhost because it usually means we're running in
 		// a test environment where we don't actually want to physically bind ports.
-		server = virtual.NewServer(registry.NewNoopModuleStore(), env)
+		server = virtual.NewServerWithOptions(
+			registry.NewNoopModuleStore(), env, virtual.ServerOptions{TLS: envOpts.TLS})
 		go func() {
 			err := server.Start(envOpts.Discovery.Port)
 			if err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -109,6 +143,8 @@ func NewLeaderRegistry(
 		env:      env,
 		server:   server,
 		serverID: serverID,
+		changes:  registry.NewActivationChangeFeed(),
+		closeCh:  make(chan struct{}),
 	}), nil
 }
 
@@ -134,6 +170,87 @@ func (l *leaderRegistry) EnsureActivation(
 	return result, nil
 }
 
+func (l *leaderRegistry) EnsureActivations(
+	ctx context.Context,
+	reqs []registry.EnsureActivationRequest,
+) ([]registry.EnsureActivationResult, error) {
+	var results []registry.EnsureActivationResult
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"ensureActivations", &reqs, types.CreateIfNotExist{}, &results)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error invoking ensureActivations on leader: %w", err)
+	}
+
+	if len(results) != len(reqs) {
+		return nil, fmt.Errorf(
+			"illegal EnsureActivations result received from leader, expected %d results but got %d",
+			len(reqs), len(results))
+	}
+	for _, result := range results {
+		if result.VersionStamp == 0 || result.RegistryServerID == "" {
+			// Basic sanity check we didn't just parse some empty JSON.
+			return nil, fmt.Errorf(
+				"illegal EnsureActivationResult received from leader: %v", result)
+		}
+	}
+
+	return results, nil
+}
+
+func (l *leaderRegistry) MigrateActor(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	targetServerID string,
+) (registry.MigrateActorResult, error) {
+	req := migrateActorRequest{
+		Namespace:      namespace,
+		ModuleID:       moduleID,
+		ActorID:        actorID,
+		TargetServerID: targetServerID,
+	}
+	var result registry.MigrateActorResult
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"migrateActor", &req, types.CreateIfNotExist{}, &result)
+	if err != nil {
+		return registry.MigrateActorResult{}, fmt.Errorf(
+			"error invoking migrateActor on leader: %w", err)
+	}
+
+	if len(result.References) == 0 {
+		// Basic sanity check we didn't just parse some empty JSON.
+		return registry.MigrateActorResult{}, fmt.Errorf(
+			"illegal MigrateActorResult received from leader: %v", result)
+	}
+
+	return result, nil
+}
+
+func (l *leaderRegistry) LookupActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	req := lookupActivationRequest{
+		Namespace: namespace,
+		ModuleID:  moduleID,
+		ActorID:   actorID,
+	}
+	var references []types.ActorReference
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"lookupActivation", &req, types.CreateIfNotExist{}, &references)
+	if err != nil {
+		return nil, fmt.Errorf("error invoking lookupActivation on leader: %w", err)
+	}
+	return references, nil
+}
+
 func (l *leaderRegistry) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
@@ -173,9 +290,18 @@ func (l *leaderRegistry) Heartbeat(
 	//       fails, the new node that takes over at least already knows how many
 	//       servers there are to work with. However, for now we work around this
 	//       issue with the MinSuccessiveHeartbeatsBeforeAllowActivations setting.
+	l.clusterSettings.Lock()
+	settings := l.clusterSettings.settings
+	l.clusterSettings.Unlock()
+	l.namespaceLimits.Lock()
+	namespaceLimits := l.namespaceLimits.limits
+	l.namespaceLimits.Unlock()
+
 	req := heartbeatRequest{
-		ServerID:       serverID,
-		HeartbeatState: heartbeatState,
+		ServerID:        serverID,
+		HeartbeatState:  heartbeatState,
+		ClusterSettings: settings,
+		NamespaceLimits: namespaceLimits,
 	}
 
 	var heartbeatResult registry.HeartbeatResult
@@ -186,10 +312,167 @@ func (l *leaderRegistry) Heartbeat(
 		return registry.HeartbeatResult{}, fmt.Errorf("error heartbeating leader: %w", err)
 	}
 
+	if heartbeatResult.HeartbeatTTL > 0 && heartbeatResult.HeartbeatInterval > 0 {
+		// HeartbeatResult uses the same unit as the versionstamp (microseconds).
+		settings := registry.ClusterSettings{
+			HeartbeatTTL:      time.Duration(heartbeatResult.HeartbeatTTL) * time.Microsecond,
+			HeartbeatInterval: time.Duration(heartbeatResult.HeartbeatInterval) * time.Microsecond,
+		}
+		l.clusterSettings.Lock()
+		l.clusterSettings.settings = &settings
+		l.clusterSettings.Unlock()
+
+		l.namespaceLimits.Lock()
+		l.namespaceLimits.limits = heartbeatResult.NamespaceLimits
+		l.namespaceLimits.Unlock()
+	}
+
 	return heartbeatResult, nil
 }
 
+func (l *leaderRegistry) GetClusterSettings(ctx context.Context) (registry.ClusterSettings, error) {
+	var settings registry.ClusterSettings
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"getClusterSettings", nil, types.CreateIfNotExist{}, &settings)
+	if err != nil {
+		return registry.ClusterSettings{}, fmt.Errorf("error getting cluster settings from leader: %w", err)
+	}
+	return settings, nil
+}
+
+func (l *leaderRegistry) SetClusterSettings(ctx context.Context, settings registry.ClusterSettings) error {
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"setClusterSettings", &settings, types.CreateIfNotExist{}, nil)
+	if err != nil {
+		return fmt.Errorf("error setting cluster settings on leader: %w", err)
+	}
+
+	l.clusterSettings.Lock()
+	l.clusterSettings.settings = &settings
+	l.clusterSettings.Unlock()
+	return nil
+}
+
+func (l *leaderRegistry) GetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+) (registry.NamespaceLimits, error) {
+	req := getNamespaceLimitsRequest{Namespace: namespace}
+	var limits registry.NamespaceLimits
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"getNamespaceLimits", &req, types.CreateIfNotExist{}, &limits)
+	if err != nil {
+		return registry.NamespaceLimits{}, fmt.Errorf("error getting namespace limits from leader: %w", err)
+	}
+	return limits, nil
+}
+
+func (l *leaderRegistry) SetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+	limits registry.NamespaceLimits,
+) error {
+	req := setNamespaceLimitsRequest{Namespace: namespace, Limits: limits}
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"setNamespaceLimits", &req, types.CreateIfNotExist{}, nil)
+	if err != nil {
+		return fmt.Errorf("error setting namespace limits on leader: %w", err)
+	}
+	return nil
+}
+
+func (l *leaderRegistry) Watch(ctx context.Context) (<-chan registry.ActivationChange, error) {
+	ch, err := l.changes.Subscribe(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Watch: error subscribing: %w", err)
+	}
+
+	l.pollerOnce.Do(func() {
+		// Establish the initial cursor synchronously so that changes that occur right
+		// after Watch() returns are not missed. If the leader is unavailable the loop
+		// will establish the cursor itself later.
+		var resp watchResponse
+		if err := l.pollChanges(ctx, watchRequest{}, &resp); err != nil {
+			slog.Default().Error(
+				"error establishing initial activation changes cursor with leader",
+				slog.String("error", err.Error()))
+		}
+
+		l.pollerWg.Add(1)
+		go l.pollChangesLoop(resp)
+	})
+
+	return ch, nil
+}
+
+// pollChangesLoop polls the leader for activation changes and publishes them to local
+// watchers. If we fell so far behind that the leader no longer retains the changes since
+// our cursor, a reset is published instead since an unknown number of changes may have
+// been missed.
+//
+// Leader transitions (detected by a change in epoch) intentionally do *not* publish a
+// reset. The new leader starts with an empty registry and relies on the activations
+// cached by each environment to avoid relocating actors so clearing those caches would
+// do more harm than good.
+func (l *leaderRegistry) pollChangesLoop(initial watchResponse) {
+	defer l.pollerWg.Done()
+
+	var (
+		ticker = time.NewTicker(watchPollInterval)
+		req    = watchRequest{Epoch: initial.Epoch, Cursor: initial.Cursor}
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.closeCh:
+			return
+		}
+
+		var resp watchResponse
+		ctx, cc := context.WithTimeout(context.Background(), watchPollInterval*4)
+		err := l.pollChanges(ctx, req, &resp)
+		cc()
+		if err != nil {
+			slog.Default().Error(
+				"error polling leader for activation changes in background",
+				slog.String("error", err.Error()))
+			continue
+		}
+
+		if !resp.OK && resp.Epoch == req.Epoch {
+			l.changes.Publish(registry.ActivationChange{Type: registry.ActivationChangeTypeReset})
+		}
+		l.changes.Publish(resp.Changes...)
+		req = watchRequest{Epoch: resp.Epoch, Cursor: resp.Cursor}
+	}
+}
+
+func (l *leaderRegistry) pollChanges(
+	ctx context.Context,
+	req watchRequest,
+	resp *watchResponse,
+) error {
+	err := l.env.InvokeActorJSON(
+		ctx, leaderNamespace, leaderActorName, leaderModuleName,
+		"watch", &req, types.CreateIfNotExist{}, resp)
+	if err != nil {
+		return fmt.Errorf("error polling leader for activation changes: %w", err)
+	}
+	return nil
+}
+
 func (l *leaderRegistry) Close(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+	})
+	l.pollerWg.Wait()
+	l.changes.Close()
+
 	var (
 		envErr    = l.env.Close(ctx)
 		serverErr error
@@ -227,7 +510,7 @@ func (m *leaderActorModule) Instantiate(
 	payload []byte,
 	host virtual.HostCapabilities,
 ) (virtual.Actor, error) {
-	return newLeaderActor(m.serverID), nil
+	return newLeaderActor(m.serverID)
 }
 
 func (m *leaderActorModule) Close(ctx context.Context) error {
@@ -236,10 +519,24 @@ func (m *leaderActorModule) Close(ctx context.Context) error {
 
 type leaderActor struct {
 	registry registry.Registry
+
+	// changes retains the activation changes observed by the registry so that
+	// leaderRegistry instances can poll for them.
+	changes       *registry.ActivationChangeFeed
+	stopWatchFunc context.CancelFunc
+
+	// clusterSettingsRestored is set once the cluster settings have been restored from
+	// a heartbeat (or set explicitly) after this actor was activated. Actor invocations
+	// are serialized so it doesn't require synchronization.
+	clusterSettingsRestored bool
+	// namespaceLimitsRestored is the equivalent of clusterSettingsRestored for the
+	// namespace limits.
+	namespaceLimitsRestored bool
 }
 
-func newLeaderActor(serverID string) virtual.ActorBytes {
-	return &leaderActor{
+func newLeaderActor(serverID string) (virtual.ActorBytes, error) {
+	a := &leaderActor{
+		changes: registry.NewActivationChangeFeed(),
 		registry: localregistry.NewLocalRegistryWithOptions(
 			serverID,
 			registry.KVRegistryOptions{
@@ -250,6 +547,22 @@ func newLeaderActor(serverID string) virtual.ActorBytes {
 				MinSuccessiveHeartbeatsBeforeAllowActivations: 4,
 			}),
 	}
+
+	ctx, cc := context.WithCancel(context.Background())
+	watchCh, err := a.registry.Watch(ctx)
+	if err != nil {
+		cc()
+		return nil, fmt.Errorf("error watching registry: %w", err)
+	}
+	a.stopWatchFunc = cc
+
+	go func() {
+		for change := range watchCh {
+			a.changes.Publish(change)
+		}
+	}()
+
+	return a, nil
 }
 
 func (a *leaderActor) MemoryUsageBytes() int {
@@ -274,10 +587,26 @@ func (a *leaderActor) Invoke(
 		return nil, nil
 	case "ensureActivation":
 		return a.handleEnsureActivation(ctx, payload)
+	case "ensureActivations":
+		return a.handleEnsureActivations(ctx, payload)
+	case "migrateActor":
+		return a.handleMigrateActor(ctx, payload)
+	case "lookupActivation":
+		return a.handleLookupActivation(ctx, payload)
 	case "getVersionStamp":
 		return nil, errors.New("getVersionStamp not implemented")
 	case "heartbeat":
 		return a.handleHeartbeat(ctx, payload)
+	case "watch":
+		return a.handleWatch(payload)
+	case "getClusterSettings":
+		return a.handleGetClusterSettings(ctx)
+	case "setClusterSettings":
+		return a.handleSetClusterSettings(ctx, payload)
+	case "getNamespaceLimits":
+		return a.handleGetNamespaceLimits(ctx, payload)
+	case "setNamespaceLimits":
+		return a.handleSetNamespaceLimits(ctx, payload)
 	case "unsafeWipeAll":
 		return nil, a.registry.UnsafeWipeAll()
 	default:
@@ -306,6 +635,70 @@ func (a *leaderActor) handleEnsureActivation(
 	return marshaled, nil
 }
 
+func (a *leaderActor) handleEnsureActivations(
+	ctx context.Context,
+	payload []byte,
+) ([]byte, error) {
+	var reqs []registry.EnsureActivationRequest
+	if err := json.Unmarshal(payload, &reqs); err != nil {
+		return nil, fmt.Errorf("error unmarshaling ensureActivations request: %w", err)
+	}
+	results, err := a.registry.EnsureActivations(ctx, reqs)
+	if err != nil {
+		return nil, fmt.Errorf("error ensuring activations: %w", err)
+	}
+
+	marshaled, err := json.Marshal(results)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling ensureActivations result: %w", err)
+	}
+
+	return marshaled, nil
+}
+
+func (a *leaderActor) handleMigrateActor(
+	ctx context.Context,
+	payload []byte,
+) ([]byte, error) {
+	var req migrateActorRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("error unmarshaling migrateActor request: %w", err)
+	}
+	result, err := a.registry.MigrateActor(
+		ctx, req.Namespace, req.ModuleID, req.ActorID, req.TargetServerID)
+	if err != nil {
+		return nil, fmt.Errorf("error migrating actor: %w", err)
+	}
+
+	marshaled, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling migrateActor result: %w", err)
+	}
+
+	return marshaled, nil
+}
+
+func (a *leaderActor) handleLookupActivation(
+	ctx context.Context,
+	payload []byte,
+) ([]byte, error) {
+	var req lookupActivationRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("error unmarshaling lookupActivation request: %w", err)
+	}
+	references, err := a.registry.LookupActivation(ctx, req.Namespace, req.ModuleID, req.ActorID)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up activation: %w", err)
+	}
+
+	marshaled, err := json.Marshal(references)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling lookupActivation result: %w", err)
+	}
+
+	return marshaled, nil
+}
+
 func (a *leaderActor) handleHeartbeat(
 	ctx context.Context,
 	payload []byte,
@@ -315,6 +708,23 @@ func (a *leaderActor) handleHeartbeat(
 		return nil, fmt.Errorf("error unmarshaling heartbeat request: %w", err)
 	}
 
+	if req.ClusterSettings != nil && !a.clusterSettingsRestored {
+		// This actor was activated on a new leader so restore the settings the
+		// cluster was using before the leader transition.
+		if err := a.registry.SetClusterSettings(ctx, *req.ClusterSettings); err != nil {
+			return nil, fmt.Errorf("error restoring cluster settings: %w", err)
+		}
+		a.clusterSettingsRestored = true
+	}
+	if req.NamespaceLimits != nil && !a.namespaceLimitsRestored {
+		for namespace, limits := range req.NamespaceLimits {
+			if err := a.registry.SetNamespaceLimits(ctx, namespace, limits); err != nil {
+				return nil, fmt.Errorf("error restoring namespace limits: %w", err)
+			}
+		}
+		a.namespaceLimitsRestored = true
+	}
+
 	result, err := a.registry.Heartbeat(ctx, req.ServerID, req.HeartbeatState)
 	if err != nil {
 		return nil, fmt.Errorf("error heartbeating: %w", err)
@@ -328,8 +738,103 @@ func (a *leaderActor) handleHeartbeat(
 	return marshaled, nil
 }
 
+func (a *leaderActor) handleGetClusterSettings(
+	ctx context.Context,
+) ([]byte, error) {
+	settings, err := a.registry.GetClusterSettings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting cluster settings: %w", err)
+	}
+
+	marshaled, err := json.Marshal(&settings)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling cluster settings: %w", err)
+	}
+
+	return marshaled, nil
+}
+
+func (a *leaderActor) handleSetClusterSettings(
+	ctx context.Context,
+	payload []byte,
+) ([]byte, error) {
+	var settings registry.ClusterSettings
+	if err := json.Unmarshal(payload, &settings); err != nil {
+		return nil, fmt.Errorf("error unmarshaling cluster settings: %w", err)
+	}
+
+	if err := a.registry.SetClusterSettings(ctx, settings); err != nil {
+		return nil, fmt.Errorf("error setting cluster settings: %w", err)
+	}
+	a.clusterSettingsRestored = true
+
+	return nil, nil
+}
+
+func (a *leaderActor) handleGetNamespaceLimits(
+	ctx context.Context,
+	payload []byte,
+) ([]byte, error) {
+	var req getNamespaceLimitsRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("error unmarshaling getNamespaceLimits request: %w", err)
+	}
+
+	limits, err := a.registry.GetNamespaceLimits(ctx, req.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace limits: %w", err)
+	}
+
+	marshaled, err := json.Marshal(&limits)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling namespace limits: %w", err)
+	}
+
+	return marshaled, nil
+}
+
+func (a *leaderActor) handleSetNamespaceLimits(
+	ctx context.Context,
+	payload []byte,
+) ([]byte, error) {
+	var req setNamespaceLimitsRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("error unmarshaling setNamespaceLimits request: %w", err)
+	}
+
+	if err := a.registry.SetNamespaceLimits(ctx, req.Namespace, req.Limits); err != nil {
+		return nil, fmt.Errorf("error setting namespace limits: %w", err)
+	}
+	// Once any limits are set explicitly the ones included in heartbeats (which may be
+	// stale) should not overwrite them.
+	a.namespaceLimitsRestored = true
+
+	return nil, nil
+}
+
+func (a *leaderActor) handleWatch(
+	payload []byte,
+) ([]byte, error) {
+	var req watchRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("error unmarshaling watch request: %w", err)
+	}
+
+	var resp watchResponse
+	resp.Changes, resp.Epoch, resp.Cursor, resp.OK = a.changes.ChangesSince(req.Epoch, req.Cursor)
+
+	marshaled, err := json.Marshal(&resp)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling watch response: %w", err)
+	}
+
+	return marshaled, nil
+}
+
 func (a *leaderActor) Close(ctx context.Context) error {
-	return nil
+	a.stopWatchFunc()
+	a.changes.Close()
+	return a.registry.Close(ctx)
 }
 
 // leaderProviderToDNSResolver makes a LeaderProvider implement the DNSResolver
@@ -358,4 +863,44 @@ func (lp *leaderProviderToDNSResolver) LookupIP(host string) ([]registry.Address
 type heartbeatRequest struct {
 	ServerID       string                  `json:"server_id"`
 	HeartbeatState registry.HeartbeatState `json:"heartbeat_state"`
+	// ClusterSettings are the settings last observed by the server, if any. They're used
+	// to restore the cluster's settings after leader transitions.
+	ClusterSettings *registry.ClusterSettings `json:"cluster_settings,omitempty"`
+	// NamespaceLimits are the namespace limits last observed by the server, if any.
+	// They're used to restore the limits after leader transitions.
+	NamespaceLimits map[string]registry.NamespaceLimits `json:"namespace_limits,omitempty"`
+}
+
+type getNamespaceLimitsRequest struct {
+	Namespace string `json:"namespace"`
+}
+
+type setNamespaceLimitsRequest struct {
+	Namespace string                   `json:"namespace"`
+	Limits    registry.NamespaceLimits `json:"limits"`
+}
+
+type migrateActorRequest struct {
+	Namespace      string `json:"namespace"`
+	ModuleID       string `json:"module_id"`
+	ActorID        string `json:"actor_id"`
+	TargetServerID string `json:"target_server_id"`
+}
+
+type lookupActivationRequest struct {
+	Namespace string `json:"namespace"`
+	ModuleID  string `json:"module_id"`
+	ActorID   string `json:"actor_id"`
+}
+
+type watchRequest struct {
+	Epoch  string `json:"epoch"`
+	Cursor int64  `json:"cursor"`
+}
+
+type watchResponse struct {
+	Changes []registry.ActivationChange `json:"changes"`
+	Epoch   string                      `json:"epoch"`
+	Cursor  int64                       `json:"cursor"`
+	OK      bool                        `json:"ok"`
 }
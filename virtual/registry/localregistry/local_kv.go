@@ -116,6 +116,19 @@ func (l *localKV) Get(
 	return v.v, true, nil
 }
 
+// "transaction" method so no lock because we're already locked.
+func (l *localKV) Delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	if l.closed {
+		return errors.New("KV already closed")
+	}
+
+	l.b.Delete(btreeKV{k, nil})
+	return nil
+}
+
 // "transaction" method so no lock because we're already locked.
 func (l *localKV) IterPrefix(
 	ctx context.Context,
@@ -139,6 +152,27 @@ func (l *localKV) IterPrefix(
 	return globalErr
 }
 
+// "transaction" method so no lock because we're already locked.
+func (l *localKV) IterRange(
+	ctx context.Context,
+	start, end []byte,
+	fn func(k, v []byte) error,
+) error {
+	if l.closed {
+		return errors.New("KV already closed")
+	}
+
+	var globalErr error
+	l.b.AscendRange(btreeKV{start, nil}, btreeKV{end, nil}, func(currKV btreeKV) bool {
+		if err := fn(currKV.k, currKV.v); err != nil {
+			globalErr = err
+			return false
+		}
+		return true
+	})
+	return globalErr
+}
+
 // "transaction" method so no lock because we're already locked.
 func (l *localKV) GetVersionStamp() (int64, error) {
 	// Return microseconds since l.t since that will automatically increase at
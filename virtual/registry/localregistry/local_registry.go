@@ -1,6 +1,9 @@
 package localregistry
 
-import "github.com/richardartoul/nola/virtual/registry"
+import (
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+)
 
 // NewLocalRegistry creates a new local (in-memory) registry. It is primarily used for
 // tests and simple benchmarking.
@@ -16,3 +19,11 @@ func NewLocalRegistryWithOptions(
 ) registry.Registry {
 	return registry.NewKVRegistry(selfID, newLocalKV(), opts)
 }
+
+// NewLocalKV creates a new local (in-memory) kv.Store. It is primarily used for tests
+// and simple benchmarking of the functionality built on top of kv.Store (like async
+// invocations). Since it is in-memory, it is neither durable nor shared between
+// processes.
+func NewLocalKV() kv.Store {
+	return newLocalKV()
+}
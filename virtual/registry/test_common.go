@@ -1,11 +1,14 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/richardartoul/nola/virtual/registry/kv"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/stretchr/testify/require"
 )
@@ -26,6 +29,46 @@ func TestAllCommon(t *testing.T, registryCtor func() Registry) {
 	t.Run("test ensure activations persistence", func(t *testing.T) {
 		testEnsureActivationPersistence(t, registryCtor())
 	})
+
+	t.Run("test ensure activations batch", func(t *testing.T) {
+		testEnsureActivationsBatch(t, registryCtor())
+	})
+
+	t.Run("test watch", func(t *testing.T) {
+		testWatch(t, registryCtor())
+	})
+
+	t.Run("test watch shared kv", func(t *testing.T) {
+		testWatchSharedKV(t, registryCtor())
+	})
+
+	t.Run("test compaction", func(t *testing.T) {
+		testCompaction(t, registryCtor())
+	})
+
+	t.Run("test legacy record migration", func(t *testing.T) {
+		testLegacyRecordMigration(t, registryCtor())
+	})
+
+	t.Run("test cluster settings", func(t *testing.T) {
+		testClusterSettings(t, registryCtor())
+	})
+
+	t.Run("test heterogeneous capacity", func(t *testing.T) {
+		testHeterogeneousCapacity(t, registryCtor())
+	})
+
+	t.Run("test actor count rebalancing", func(t *testing.T) {
+		testActorCountRebalancing(t, registryCtor())
+	})
+
+	t.Run("test migrate actor", func(t *testing.T) {
+		testMigrateActor(t, registryCtor())
+	})
+
+	t.Run("test namespace limits", func(t *testing.T) {
+		testNamespaceLimits(t, registryCtor())
+	})
 }
 
 // testRegistryServiceDiscoveryAndEnsureActivation tests the combination of the
@@ -58,7 +101,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 		})
 		require.NoError(t, err)
 		require.True(t, heartbeatResult.VersionStamp > 0)
-		require.Equal(t, HeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
+		require.Equal(t, DefaultHeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
 	}
 
 	// Should succeed now that we have a server to activate on.
@@ -191,7 +234,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	//
 	// TODO: Sleeps in tests are bad, but I'm lazy to inject a clock right now and deal
 	//       with all of that.
-	time.Sleep(HeartbeatTTL + time.Second)
+	time.Sleep(DefaultHeartbeatTTL + time.Second)
 
 	// Heartbeat server2. After this, the Registry should only consider server2 to be alive.
 	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
@@ -252,7 +295,7 @@ func testRegistryReplication(t *testing.T, registry Registry) {
 		})
 		require.NoError(t, err)
 		require.True(t, heartbeatResult.VersionStamp > 0)
-		require.Equal(t, HeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
+		require.Equal(t, DefaultHeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
 
 		heartbeatResult, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
 			NumActivatedActors: 10,
@@ -260,7 +303,7 @@ func testRegistryReplication(t *testing.T, registry Registry) {
 		})
 		require.NoError(t, err)
 		require.True(t, heartbeatResult.VersionStamp > 0)
-		require.Equal(t, HeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
+		require.Equal(t, DefaultHeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
 	}
 
 	activations, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
@@ -312,7 +355,7 @@ func testEnsureActivationPersistence(t *testing.T, registry Registry) {
 		})
 		require.NoError(t, err)
 		require.True(t, heartbeatResult.VersionStamp > 0)
-		require.Equal(t, HeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
+		require.Equal(t, DefaultHeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
 
 		heartbeatResult, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
 			NumActivatedActors: 10,
@@ -320,7 +363,7 @@ func testEnsureActivationPersistence(t *testing.T, registry Registry) {
 		})
 		require.NoError(t, err)
 		require.True(t, heartbeatResult.VersionStamp > 0)
-		require.Equal(t, HeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
+		require.Equal(t, DefaultHeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
 	}
 
 	go func() {
@@ -338,9 +381,9 @@ func testEnsureActivationPersistence(t *testing.T, registry Registry) {
 				Address:            "server2_address",
 			})
 
-			// Wait for HeartbeatTTL / 2 before sending the next heartbeat
+			// Wait for DefaultHeartbeatTTL / 2 before sending the next heartbeat
 			select {
-			case <-time.After(HeartbeatTTL / 2):
+			case <-time.After(DefaultHeartbeatTTL / 2):
 			case <-ctx.Done():
 				return
 			}
@@ -361,3 +404,804 @@ func testEnsureActivationPersistence(t *testing.T, registry Registry) {
 		require.False(t, differentActivation, "actor has been activated in more than one server.")
 	}
 }
+
+// testWatch verifies that watchers are notified when an actor is moved away from a
+// server.
+func testWatch(t *testing.T, registry Registry) {
+	ctx, cc := context.WithCancel(context.Background())
+	defer cc()
+	defer registry.Close(context.Background())
+
+	changes, err := registry.Watch(ctx)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		// Heartbeat 5 times because some registry implementations (like the
+		// LeaderRegistry) require multiple successful heartbeats from at least
+		// 1 server before any actors can be placed.
+		for _, serverID := range []string{"server1", "server2"} {
+			_, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+				NumActivatedActors: 10,
+				Address:            serverID + "_address",
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	activations, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace: "ns1",
+		ActorID:   "a",
+		ModuleID:  "test-module1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(activations.References))
+	prevServerID := activations.References[0].Physical.ServerID
+
+	// Blacklisting the server should move the actor and notify watchers.
+	activations, err = registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace:            "ns1",
+		ActorID:              "a",
+		ModuleID:             "test-module1",
+		BlacklistedServerIDs: []string{prevServerID},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(activations.References))
+	require.NotEqual(t, prevServerID, activations.References[0].Physical.ServerID)
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case change, ok := <-changes:
+			require.True(t, ok)
+			if change.Type != ActivationChangeTypeActorMoved {
+				continue
+			}
+			require.Equal(t, "ns1", change.Namespace)
+			require.Equal(t, "test-module1", change.ModuleID)
+			require.Equal(t, "a", change.ActorID)
+			require.Equal(t, prevServerID, change.ServerID)
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for actor moved change")
+		}
+	}
+}
+
+// testWatchSharedKV verifies that watchers are notified of the changes made by other
+// instances of a KV-backed registry that share the same KV store.
+func testWatchSharedKV(t *testing.T, registry Registry) {
+	ctx, cc := context.WithCancel(context.Background())
+	defer cc()
+	defer registry.Close(context.Background())
+
+	v, ok := registry.(*validator)
+	if !ok {
+		t.Skip("registry is not validated")
+	}
+	k, ok := v.r.(*kvRegistry)
+	if !ok {
+		t.Skip("shared KV stores only apply to KV-backed registries")
+	}
+
+	other := NewKVRegistry("other-server-id", k.kv, KVRegistryOptions{DisableCompaction: true})
+	defer other.Close(context.Background())
+
+	changes, err := other.Watch(ctx)
+	require.NoError(t, err)
+
+	for _, serverID := range []string{"server1", "server2"} {
+		_, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+			NumActivatedActors: 10,
+			Address:            serverID + "_address",
+		})
+		require.NoError(t, err)
+	}
+
+	activations, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace: "ns1",
+		ActorID:   "a",
+		ModuleID:  "test-module1",
+	})
+	require.NoError(t, err)
+	prevServerID := activations.References[0].Physical.ServerID
+
+	_, err = registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace:            "ns1",
+		ActorID:              "a",
+		ModuleID:             "test-module1",
+		BlacklistedServerIDs: []string{prevServerID},
+	})
+	require.NoError(t, err)
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case change, ok := <-changes:
+			require.True(t, ok)
+			if change.Type != ActivationChangeTypeActorMoved {
+				continue
+			}
+			require.Equal(t, "a", change.ActorID)
+			require.Equal(t, prevServerID, change.ServerID)
+
+			// The change should only be delivered once even though it is re-read from
+			// the change log until it falls out of the lookback window.
+			select {
+			case change := <-changes:
+				require.NotEqual(t, ActivationChangeTypeActorMoved, change.Type)
+			case <-time.After(2 * changeLogPollInterval):
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for actor moved change")
+		}
+	}
+}
+
+// testEnsureActivationsBatch verifies that EnsureActivations applies the same rules as
+// EnsureActivation to every actor in the batch, and that actors in the same batch are
+// balanced across servers.
+func testEnsureActivationsBatch(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	for i := 0; i < 5; i++ {
+		// Heartbeat 5 times because some registry implementations (like the
+		// LeaderRegistry) require multiple successful heartbeats from at least
+		// 1 server before any actors can be placed.
+		for _, serverID := range []string{"server1", "server2"} {
+			_, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+				NumActivatedActors: 10,
+				Address:            serverID + "_address",
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	_, err := registry.EnsureActivations(ctx, nil)
+	require.Error(t, err)
+
+	var reqs []EnsureActivationRequest
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, EnsureActivationRequest{
+			Namespace: "ns1",
+			ActorID:   fmt.Sprintf("a-%d", i),
+			ModuleID:  "test-module1",
+		})
+	}
+	// Include a duplicate to make sure requests for the same actor within a batch
+	// observe each other.
+	reqs = append(reqs, reqs[0])
+
+	results, err := registry.EnsureActivations(ctx, reqs)
+	require.NoError(t, err)
+	require.Equal(t, len(reqs), len(results))
+
+	countByServer := map[string]int{}
+	for i, result := range results {
+		require.Equal(t, 1, len(result.References))
+		require.Equal(t, reqs[i].ActorID, result.References[0].Virtual.ActorID)
+		require.True(t, result.VersionStamp > 0)
+		if i < 10 {
+			countByServer[result.References[0].Physical.ServerID]++
+		}
+	}
+	require.Equal(t, results[0].References[0], results[len(results)-1].References[0])
+	require.Equal(t, 5, countByServer["server1"])
+	require.Equal(t, 5, countByServer["server2"])
+
+	// Subsequent (unbatched) calls should return the same activations.
+	for i, req := range reqs {
+		result, err := registry.EnsureActivation(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, results[i].References, result.References)
+	}
+}
+
+// testCompaction verifies that the compaction pass removes dead servers and any
+// activations that reference them. It only applies to KV-backed registries.
+func testCompaction(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	v, ok := registry.(*validator)
+	if !ok {
+		t.Skip("registry is not validated")
+	}
+	k, ok := v.r.(*kvRegistry)
+	if !ok {
+		t.Skip("compaction only applies to KV-backed registries")
+	}
+
+	heartbeat := func(serverID string) HeartbeatResult {
+		result, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+			NumActivatedActors: 10,
+			Address:            serverID + "_address",
+		})
+		require.NoError(t, err)
+		return result
+	}
+	heartbeat("server1")
+	heartbeat("server2")
+
+	var (
+		actorIDs     = []string{"a", "b", "c", "d"}
+		serverActors = map[string][]string{}
+	)
+	for _, actorID := range actorIDs {
+		result, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+			Namespace: "ns1",
+			ActorID:   actorID,
+			ModuleID:  "test-module1",
+		})
+		require.NoError(t, err)
+		serverID := result.References[0].Physical.ServerID
+		serverActors[serverID] = append(serverActors[serverID], actorID)
+	}
+	require.NotEmpty(t, serverActors["server1"])
+	require.NotEmpty(t, serverActors["server2"])
+
+	// Use tiny values so server1 becomes compactable as soon as it stops heartbeating.
+	// Servers are never compacted before 2x the TTL so it has to be reduced as well.
+	require.NoError(t, registry.SetClusterSettings(ctx, ClusterSettings{
+		HeartbeatTTL:      50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+	}))
+	k.opts.CompactServersAfter = 100 * time.Millisecond
+	time.Sleep(200 * time.Millisecond)
+	heartbeat("server2")
+
+	// Simulate an activation that was created before the server activations index
+	// existed. It should be backfilled and then compacted like the others.
+	_, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		return nil, tr.Delete(ctx, getServerActivationKey(
+			"server1", "ns1", "test-module1", serverActors["server1"][0]))
+	})
+	require.NoError(t, err)
+
+	result, err := k.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, len(actorIDs), result.numActivationsBackfilled)
+	require.Equal(t, 1, result.numServersCompacted)
+	require.Equal(t, len(serverActors["server1"]), result.numActivationsRemoved)
+
+	_, err = k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		_, ok, err := getServer(ctx, tr, "server1")
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, ok, err = getServer(ctx, tr, "server2")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		numIndexed := 0
+		require.NoError(t, tr.IterPrefix(ctx, getServerActivationsPrefix("server1"), func(k, v []byte) error {
+			numIndexed++
+			return nil
+		}))
+		require.Equal(t, 0, numIndexed)
+
+		for _, actorID := range actorIDs {
+			ra, ok, err := k.getActor(ctx, tr, getActorKey("ns1", actorID, "test-module1"))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.False(t, hasActivationOnServer(ra.Activations, "server1"))
+		}
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	// The compacted server should resume with a higher version than it had previously.
+	require.Equal(t, int64(2), heartbeat("server1").ServerVersion)
+}
+
+// testLegacyRecordMigration ensures that records written with the legacy JSON encoding
+// can still be read and are rewritten with the binary encoding when they're accessed.
+func testLegacyRecordMigration(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	v, ok := registry.(*validator)
+	if !ok {
+		t.Skip("registry is not validated")
+	}
+	k, ok := v.r.(*kvRegistry)
+	if !ok {
+		t.Skip("record encoding only applies to KV-backed registries")
+	}
+
+	_, err := registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	result, err := registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+
+	// Large enough that it has to be split over multiple parts, and the JSON (base64)
+	// encoding requires more parts than the binary encoding.
+	moduleBytes := bytes.Repeat([]byte{0, 1, 2, 3}, 40_000)
+
+	putLegacy := func(key []byte, v any) {
+		marshaled, err := json.Marshal(v)
+		require.NoError(t, err)
+		_, err = k.kv.Transact(func(tr kv.Transaction) (any, error) {
+			for i := 0; len(marshaled) > 0; i++ {
+				numBytes := 99_999
+				if len(marshaled) < numBytes {
+					numBytes = len(marshaled)
+				}
+				partKey := key
+				if partKey == nil {
+					partKey = getModulePartKey("ns1", "test-module1", i)
+				}
+				tr.Put(ctx, partKey, marshaled[:numBytes])
+				marshaled = marshaled[numBytes:]
+			}
+			return nil, nil
+		})
+		require.NoError(t, err)
+	}
+	putLegacy(getActorKey("ns1", "a", "test-module1"), &registeredActor{
+		ModuleID:    "test-module1",
+		Generation:  3,
+		Activations: []activation{newActivation("server1", result.ServerVersion)},
+	})
+	putLegacy(getServerKey("server2"), newServerState(
+		"server2", 7, HeartbeatState{Address: "server2_address"}, result.VersionStamp))
+	// nil key means module parts.
+	putLegacy(nil, &registeredModule{Bytes: moduleBytes})
+
+	countModuleParts := func() int {
+		numParts := 0
+		_, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+			numParts = 0
+			return nil, tr.IterPrefix(ctx, getModulePrefix("ns1", "test-module1"), func(k, v []byte) error {
+				numParts++
+				return nil
+			})
+		})
+		require.NoError(t, err)
+		return numParts
+	}
+	require.Equal(t, 3, countModuleParts())
+
+	// Legacy records should be readable.
+	activationResult, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace: "ns1",
+		ActorID:   "a",
+		ModuleID:  "test-module1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(activationResult.References))
+	require.Equal(t, "server1", activationResult.References[0].Physical.ServerID)
+	require.Equal(t, uint64(3), activationResult.References[0].Virtual.Generation)
+
+	storedModuleBytes, _, err := k.GetModule(ctx, "ns1", "test-module1")
+	require.NoError(t, err)
+	require.Equal(t, moduleBytes, storedModuleBytes)
+
+	result, err = registry.Heartbeat(ctx, "server2", HeartbeatState{Address: "server2_address"})
+	require.NoError(t, err)
+	require.Equal(t, int64(7), result.ServerVersion)
+
+	// And they should have been rewritten using the binary encoding.
+	require.Equal(t, 2, countModuleParts())
+	_, err = k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		for key, recordType := range map[string]kv.RecordType{
+			string(getActorKey("ns1", "a", "test-module1")):    recordTypeRegisteredActor,
+			string(getServerKey("server2")):                    recordTypeServerState,
+			string(getModulePartKey("ns1", "test-module1", 0)): recordTypeRegisteredModule,
+		} {
+			v, ok, err := tr.Get(ctx, []byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.False(t, isLegacyRecord(v))
+			require.Equal(t, recordType.Version, v[0])
+		}
+
+		ra, ok, err := k.getActor(ctx, tr, getActorKey("ns1", "a", "test-module1"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.False(t, ra.needsMigration)
+		require.Equal(t, uint64(3), ra.Generation)
+
+		// The legacy activation should have been added to the server activations index.
+		_, ok, err = tr.Get(ctx, getServerActivationKey("server1", "ns1", "test-module1", "a"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	storedModuleBytes, _, err = k.GetModule(ctx, "ns1", "test-module1")
+	require.NoError(t, err)
+	require.Equal(t, moduleBytes, storedModuleBytes)
+}
+
+// testClusterSettings ensures that the cluster settings are stored in the registry and
+// that the heartbeat TTL is enforced based on the stored value.
+func testClusterSettings(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	settings, err := registry.GetClusterSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DefaultClusterSettings(), settings)
+
+	heartbeat := func(serverID string) HeartbeatResult {
+		result, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+			Address: serverID + "_address",
+		})
+		require.NoError(t, err)
+		return result
+	}
+	result := heartbeat("server1")
+	require.Equal(t, DefaultHeartbeatTTL.Microseconds(), result.HeartbeatTTL)
+	require.Equal(t, DefaultHeartbeatInterval.Microseconds(), result.HeartbeatInterval)
+
+	// Invalid settings should be rejected.
+	require.Error(t, registry.SetClusterSettings(ctx, ClusterSettings{}))
+	require.Error(t, registry.SetClusterSettings(ctx, ClusterSettings{
+		HeartbeatTTL:      time.Second,
+		HeartbeatInterval: time.Second,
+	}))
+
+	newSettings := ClusterSettings{
+		HeartbeatTTL:      500 * time.Millisecond,
+		HeartbeatInterval: 100 * time.Millisecond,
+	}
+	require.NoError(t, registry.SetClusterSettings(ctx, newSettings))
+	settings, err = registry.GetClusterSettings(ctx)
+	require.NoError(t, err)
+	require.Equal(t, newSettings, settings)
+
+	result = heartbeat("server1")
+	require.Equal(t, newSettings.HeartbeatTTL.Microseconds(), result.HeartbeatTTL)
+	require.Equal(t, newSettings.HeartbeatInterval.Microseconds(), result.HeartbeatInterval)
+	serverVersion := result.ServerVersion
+	heartbeat("server1")
+	heartbeat("server1")
+
+	activation, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace: "ns1",
+		ActorID:   "a",
+		ModuleID:  "test-module1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "server1", activation.References[0].Physical.ServerID)
+
+	// Wait for longer than the new TTL, but less than the default one. The server's
+	// heartbeat should be considered expired according to the new TTL.
+	time.Sleep(newSettings.HeartbeatTTL + 100*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		heartbeat("server2")
+	}
+	activation, err = registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace: "ns1",
+		ActorID:   "a",
+		ModuleID:  "test-module1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "server2", activation.References[0].Physical.ServerID)
+
+	require.Equal(t, serverVersion+1, heartbeat("server1").ServerVersion)
+}
+
+// testHeterogeneousCapacity ensures that actors are balanced based on utilization when
+// servers of different sizes report their capacity.
+func testHeterogeneousCapacity(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	var (
+		// 80% utilization, but uses less memory than large in absolute terms.
+		small = HeartbeatState{
+			NumActivatedActors: 10,
+			UsedMemory:         800 << 20,
+			MemoryLimitBytes:   1 << 30,
+			NumCPUCores:        2,
+			Address:            "small_address",
+		}
+		// 12.5% utilization.
+		large = HeartbeatState{
+			NumActivatedActors: 40,
+			UsedMemory:         2 << 30,
+			MemoryLimitBytes:   16 << 30,
+			NumCPUCores:        16,
+			Address:            "large_address",
+		}
+	)
+	heartbeatAll := func() (smallResult, largeResult HeartbeatResult) {
+		var err error
+		smallResult, err = registry.Heartbeat(ctx, "small", small)
+		require.NoError(t, err)
+		largeResult, err = registry.Heartbeat(ctx, "large", large)
+		require.NoError(t, err)
+		return smallResult, largeResult
+	}
+	for i := 0; i < 4; i++ {
+		heartbeatAll()
+	}
+
+	// The small server is much more utilized so it should be asked to shed memory even
+	// though it is using less memory than the large server in absolute terms.
+	smallResult, largeResult := heartbeatAll()
+	require.Equal(t, int64(0), largeResult.MemoryBytesToShed)
+	require.Equal(t, int64((800<<20)-(1<<30)/8), smallResult.MemoryBytesToShed)
+
+	ensureActivation := func(actorID string) string {
+		result, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+			Namespace: "ns1",
+			ActorID:   actorID,
+			ModuleID:  "test-module1",
+		})
+		require.NoError(t, err)
+		return result.References[0].Physical.ServerID
+	}
+	require.Equal(t, "large", ensureActivation("a"))
+
+	// Same memory utilization, but the large server has fewer actors per core even though
+	// it has more actors in absolute terms.
+	small.UsedMemory = 1 << 29
+	large.UsedMemory = 8 << 30
+	heartbeatAll()
+	require.Equal(t, "large", ensureActivation("b"))
+
+	// Once one of the servers doesn't report its capacity the registry should fall back
+	// to comparing absolute values.
+	small.MemoryLimitBytes = 0
+	small.NumCPUCores = 0
+	smallResult, _ = heartbeatAll()
+	require.Equal(t, int64(0), smallResult.MemoryBytesToShed)
+	require.Equal(t, "small", ensureActivation("c"))
+}
+
+// testActorCountRebalancing tests that the registry asks servers with significantly more
+// actors than their peers to shed a bounded number of actors, and that it rate limits how
+// often it does so.
+func testActorCountRebalancing(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	heartbeat := func(serverID string, numActors int) HeartbeatResult {
+		result, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+			NumActivatedActors: numActors,
+			Address:            serverID + "_address",
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), result.MemoryBytesToShed)
+		return result
+	}
+
+	for i := 0; i < 4; i++ {
+		// The new server is below the average so it should never be asked to shed actors.
+		require.Equal(t, 0, heartbeat("new", 0).NumActorsToShed)
+
+		oldResult := heartbeat("old", 500)
+		if i == 0 {
+			// The old server should be asked to shed actors, but no more than the
+			// maximum allowed per request.
+			require.Equal(t, DefaultMaxActorsToShedPerRequest, oldResult.NumActorsToShed)
+		} else {
+			// Subsequent heartbeats should not ask the old server to shed actors
+			// again until the rebalance interval has elapsed.
+			require.Equal(t, 0, oldResult.NumActorsToShed)
+		}
+	}
+
+	// Servers that are within the threshold of the average should not be asked to shed
+	// actors.
+	require.Equal(t, 0, heartbeat("balanced1", 260).NumActorsToShed)
+	require.Equal(t, 0, heartbeat("balanced2", 240).NumActorsToShed)
+
+	// Servers should not be asked to shed actors while the registry is trying to
+	// rebalance memory usage, even if it's a different server that has to shed memory.
+	hogResult, err := registry.Heartbeat(ctx, "hog", HeartbeatState{
+		NumActivatedActors: 1,
+		UsedMemory:         1 << 40,
+		Address:            "hog_address",
+	})
+	require.NoError(t, err)
+	require.True(t, hogResult.MemoryBytesToShed > 0)
+	require.Equal(t, 0, hogResult.NumActorsToShed)
+	require.Equal(t, 0, heartbeat("busy", 10000).NumActorsToShed)
+}
+
+// testMigrateActor tests that MigrateActor moves an actor's activation to the target
+// server and reports the previous activations that need to be deactivated.
+func testMigrateActor(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	for i := 0; i < 4; i++ {
+		for _, serverID := range []string{"server1", "server2", "server3"} {
+			_, err := registry.Heartbeat(ctx, serverID, HeartbeatState{
+				NumActivatedActors: 0,
+				Address:            serverID + "_address",
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	ensureActivation := func() types.ActorReference {
+		result, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+			Namespace: "ns1",
+			ActorID:   "a",
+			ModuleID:  "test-module1",
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(result.References))
+		return result.References[0]
+	}
+	lookupActivation := func(actorID string) []types.ActorReference {
+		references, err := registry.LookupActivation(ctx, "ns1", "test-module1", actorID)
+		require.NoError(t, err)
+		return references
+	}
+	// Looking up an actor never activates it.
+	require.Empty(t, lookupActivation("a"))
+	require.Empty(t, lookupActivation("a"))
+
+	prev := ensureActivation()
+	target := "server1"
+	if prev.Physical.ServerID == "server1" {
+		target = "server2"
+	}
+	references := lookupActivation("a")
+	require.Equal(t, 1, len(references))
+	require.Equal(t, prev.Physical.ServerID, references[0].Physical.ServerID)
+
+	result, err := registry.MigrateActor(ctx, "ns1", "test-module1", "a", target)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(result.References))
+	require.Equal(t, target, result.References[0].Physical.ServerID)
+	require.Equal(t, target+"_address", result.References[0].Physical.ServerState.Address)
+	require.Equal(t, 1, len(result.PreviousReferences))
+	require.Equal(t, prev.Physical.ServerID, result.PreviousReferences[0].Physical.ServerID)
+
+	references = lookupActivation("a")
+	require.Equal(t, 1, len(references))
+	require.Equal(t, target, references[0].Physical.ServerID)
+
+	// Subsequent activations should be on the target server.
+	require.Equal(t, target, ensureActivation().Physical.ServerID)
+
+	// Migrating to the server the actor is already activated on is a no-op.
+	result, err = registry.MigrateActor(ctx, "ns1", "test-module1", "a", target)
+	require.NoError(t, err)
+	require.Equal(t, target, result.References[0].Physical.ServerID)
+	require.Empty(t, result.PreviousReferences)
+
+	// Actors can't be migrated to servers that aren't alive.
+	_, err = registry.MigrateActor(ctx, "ns1", "test-module1", "a", "server4")
+	require.Error(t, err)
+	require.Equal(t, target, ensureActivation().Physical.ServerID)
+
+	// Actors that don't exist can't be migrated, and migrating them doesn't create them.
+	_, err = registry.MigrateActor(ctx, "ns1", "test-module1", "does-not-exist", target)
+	require.Error(t, err)
+	require.Empty(t, lookupActivation("does-not-exist"))
+
+	// Only the primary activation is replaced, the other replicas are kept.
+	replicated, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+		Namespace:     "ns1",
+		ActorID:       "b",
+		ModuleID:      "test-module1",
+		ExtraReplicas: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(replicated.References))
+	var (
+		primary = replicated.References[0].Physical.ServerID
+		replica = replicated.References[1].Physical.ServerID
+	)
+	for _, serverID := range []string{"server1", "server2", "server3"} {
+		if serverID != primary && serverID != replica {
+			target = serverID
+		}
+	}
+	result, err = registry.MigrateActor(ctx, "ns1", "test-module1", "b", target)
+	require.NoError(t, err)
+	require.Equal(t, target, result.References[0].Physical.ServerID)
+	require.Equal(t, 1, len(result.PreviousReferences))
+	require.Equal(t, primary, result.PreviousReferences[0].Physical.ServerID)
+
+	references = lookupActivation("b")
+	require.Equal(t, 2, len(references))
+	require.Equal(t, target, references[0].Physical.ServerID)
+	require.Equal(t, replica, references[1].Physical.ServerID)
+}
+
+// testNamespaceLimits tests that the registry stores the namespace limits, returns them
+// in heartbeats, and enforces the ones that it is responsible for.
+func testNamespaceLimits(t *testing.T, registry Registry) {
+	ctx := context.Background()
+	defer registry.Close(ctx)
+
+	limits, err := registry.GetNamespaceLimits(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, NamespaceLimits{}, limits)
+
+	// Invalid limits should be rejected.
+	require.Error(t, registry.SetNamespaceLimits(ctx, "ns1", NamespaceLimits{MaxActors: -1}))
+	require.Error(t, registry.SetNamespaceLimits(ctx, "", NamespaceLimits{MaxActors: 1}))
+
+	heartbeat := func() HeartbeatResult {
+		result, err := registry.Heartbeat(ctx, "server1", HeartbeatState{
+			Address: "server1_address",
+		})
+		require.NoError(t, err)
+		return result
+	}
+	for i := 0; i < 4; i++ {
+		result := heartbeat()
+		require.Empty(t, result.NamespaceLimits)
+		require.Equal(t, 1, result.NumLiveServers)
+	}
+
+	ensureActivation := func(namespace, actorID string) error {
+		_, err := registry.EnsureActivation(ctx, EnsureActivationRequest{
+			Namespace: namespace,
+			ActorID:   actorID,
+			ModuleID:  "test-module1",
+		})
+		return err
+	}
+
+	// Actors created before the limit is set should count towards it.
+	require.NoError(t, ensureActivation("ns1", "a"))
+
+	limits = NamespaceLimits{
+		MaxActors:               2,
+		MaxModuleBytes:          1024,
+		MaxActivatedMemoryBytes: 1 << 20,
+		MaxInvocationsPerSecond: 100,
+	}
+	require.NoError(t, registry.SetNamespaceLimits(ctx, "ns1", limits))
+	stored, err := registry.GetNamespaceLimits(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, limits, stored)
+	require.Equal(t, map[string]NamespaceLimits{"ns1": limits}, heartbeat().NamespaceLimits)
+
+	require.NoError(t, ensureActivation("ns1", "b"))
+	err = ensureActivation("ns1", "c")
+	require.Error(t, err)
+	require.True(t, IsNamespaceLimitExceededError(err))
+	// Existing actors can still be activated and other namespaces are not affected.
+	require.NoError(t, ensureActivation("ns1", "a"))
+	require.NoError(t, ensureActivation("ns2", "c"))
+
+	limits.MaxActors = 3
+	require.NoError(t, registry.SetNamespaceLimits(ctx, "ns1", limits))
+	require.NoError(t, ensureActivation("ns1", "c"))
+	require.True(t, IsNamespaceLimitExceededError(ensureActivation("ns1", "d")))
+
+	// Removing the limits should stop enforcing them and remove them from heartbeats.
+	require.NoError(t, registry.SetNamespaceLimits(ctx, "ns1", NamespaceLimits{}))
+	require.Empty(t, heartbeat().NamespaceLimits)
+	require.NoError(t, ensureActivation("ns1", "d"))
+
+	// If the limit is set again the actors that were created in the meantime should
+	// count towards it.
+	require.NoError(t, registry.SetNamespaceLimits(ctx, "ns1", NamespaceLimits{MaxActors: 5}))
+	require.NoError(t, ensureActivation("ns1", "e"))
+	require.True(t, IsNamespaceLimitExceededError(ensureActivation("ns1", "f")))
+
+	// Not every registry implementation also stores modules.
+	moduleStore, ok := registry.(ModuleStore)
+	if !ok {
+		return
+	}
+	if _, err := moduleStore.RegisterModule(
+		ctx, "ns1", "module-0", []byte("module"), ModuleOptions{}); err != nil {
+		return
+	}
+	require.NoError(t, registry.SetNamespaceLimits(ctx, "ns1", NamespaceLimits{MaxModuleBytes: 256}))
+	_, err = moduleStore.RegisterModule(
+		ctx, "ns1", "module-1", make([]byte, 128), ModuleOptions{})
+	require.NoError(t, err)
+	_, err = moduleStore.RegisterModule(
+		ctx, "ns1", "module-2", make([]byte, 128), ModuleOptions{})
+	require.Error(t, err)
+	require.True(t, IsNamespaceLimitExceededError(err))
+	_, err = moduleStore.RegisterModule(
+		ctx, "ns2", "module-2", make([]byte, 128), ModuleOptions{})
+	require.NoError(t, err)
+}
@@ -2,11 +2,24 @@ package registry
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/types"
 )
 
+const (
+	// MaxEnsureActivationsBatchSize is the maximum number of requests that can be
+	// provided in a single call to EnsureActivations().
+	MaxEnsureActivationsBatchSize = 1024
+
+	// DefaultHeartbeatTTL is the default value for ClusterSettings.HeartbeatTTL.
+	DefaultHeartbeatTTL = 5 * time.Second
+	// DefaultHeartbeatInterval is the default value for ClusterSettings.HeartbeatInterval.
+	DefaultHeartbeatInterval = time.Second
+)
+
 // Registry is the interface that is implemented by the virtual actor registry.
 type Registry interface {
 	// Heartbeat updates the "lastHeartbeatedAt" value for the provided server ID. Server's
@@ -33,6 +46,45 @@ type Registry interface {
 		req EnsureActivationRequest,
 	) (EnsureActivationResult, error)
 
+	// EnsureActivations is the same as EnsureActivation except it ensures the activations
+	// of many actors at once so that callers with high fan-out (like an environment that
+	// was just started and has nothing cached) don't have to make one round-trip to the
+	// registry per actor. Implementations should resolve the entire batch with as few
+	// round-trips / transactions as possible while still applying the exact same rules to
+	// each individual actor as EnsureActivation would.
+	//
+	// The results are returned in the same order as the requests and the batch either
+	// succeeds or fails as a whole. At most MaxEnsureActivationsBatchSize requests can be
+	// provided in a single call.
+	EnsureActivations(
+		ctx context.Context,
+		reqs []EnsureActivationRequest,
+	) ([]EnsureActivationResult, error)
+
+	// MigrateActor moves the primary activation of the provided actor to the server with
+	// ID targetServerID, which must be alive, so that all subsequent calls to
+	// EnsureActivation return the target server first. The actor's other replicas (if
+	// any) are kept. It is up to the caller to make sure the activation that was replaced
+	// (see MigrateActorResult.PreviousReferences) is deactivated. An ActorNotFoundErr is
+	// returned if the actor doesn't exist.
+	MigrateActor(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+		actorID string,
+		targetServerID string,
+	) (MigrateActorResult, error)
+
+	// LookupActivation returns the references of the actor's current activations (on
+	// servers that are still alive). Unlike EnsureActivation, it never activates the actor
+	// anywhere, so no references are returned if the actor is not activated.
+	LookupActivation(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+		actorID string,
+	) ([]types.ActorReference, error)
+
 	// GetVersionStamp() returns a monotonically increasing integer that should increase
 	// at a rate of ~ 1 million/s.
 	GetVersionStamp(ctx context.Context) (int64, error)
@@ -40,11 +92,158 @@ type Registry interface {
 	// Close closes the registry and releases any resources associated (DB connections, etc).
 	Close(ctx context.Context) error
 
+	// Watch subscribes to the stream of activation changes (actors moving to a different
+	// server, actor generations being bumped, servers dying, etc) observed by the registry
+	// so that callers can invalidate any activations they have cached immediately instead
+	// of waiting for them to expire. The returned channel is closed when ctx is canceled
+	// or the registry is closed.
+	//
+	// Delivery is best effort: if the subscriber falls behind (or the registry can't tell
+	// exactly what changed) a change of type ActivationChangeTypeReset is delivered which
+	// indicates that the subscriber should discard everything it has cached.
+	Watch(ctx context.Context) (<-chan ActivationChange, error)
+
+	// GetClusterSettings returns the settings that every server in the cluster should
+	// use. They're also returned as part of every HeartbeatResult.
+	GetClusterSettings(ctx context.Context) (ClusterSettings, error)
+
+	// SetClusterSettings updates the settings that every server in the cluster should
+	// use. Servers pick up the new settings with their next heartbeat.
+	SetClusterSettings(ctx context.Context, settings ClusterSettings) error
+
+	// GetNamespaceLimits returns the limits configured for the namespace. The zero value
+	// (no limits) is returned if none have been configured.
+	GetNamespaceLimits(ctx context.Context, namespace string) (NamespaceLimits, error)
+
+	// SetNamespaceLimits configures the limits for the namespace. Limits that are enforced
+	// by the registry take effect immediately, servers pick up the rest with their next
+	// heartbeat.
+	SetNamespaceLimits(ctx context.Context, namespace string, limits NamespaceLimits) error
+
 	// UnsafeWipeAll wipes the entire registry. Only used for tests. Do not call it anywhere
 	// in production code.
 	UnsafeWipeAll() error
 }
 
+// ClusterSettings contains the failure-detection settings that must be agreed upon by
+// every server in the cluster. They're stored in the registry instead of being configured
+// on each server individually so that servers can't disagree about whether a server
+// should be considered dead.
+type ClusterSettings struct {
+	// HeartbeatTTL is the maximum amount of time between server heartbeats before the
+	// registry will consider a server as dead and activate its actors elsewhere. Lower
+	// values result in faster failover, higher values tolerate longer network partitions
+	// and pauses without churning actor activations.
+	HeartbeatTTL time.Duration `json:"heartbeat_ttl"`
+	// HeartbeatInterval is how often servers should heartbeat. Must be lower than
+	// HeartbeatTTL, ideally by a factor of 3 or more so that a server can miss a
+	// heartbeat or two without being considered dead.
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+}
+
+// DefaultClusterSettings returns the settings that are used by clusters that have not
+// been configured explicitly.
+func DefaultClusterSettings() ClusterSettings {
+	return ClusterSettings{
+		HeartbeatTTL:      DefaultHeartbeatTTL,
+		HeartbeatInterval: DefaultHeartbeatInterval,
+	}
+}
+
+// Validate validates that the ClusterSettings struct is valid.
+func (s ClusterSettings) Validate() error {
+	if s.HeartbeatTTL <= 0 {
+		return fmt.Errorf("HeartbeatTTL must be > 0, but was: %s", s.HeartbeatTTL)
+	}
+	if s.HeartbeatInterval <= 0 {
+		return fmt.Errorf("HeartbeatInterval must be > 0, but was: %s", s.HeartbeatInterval)
+	}
+	if s.HeartbeatInterval >= s.HeartbeatTTL {
+		return fmt.Errorf(
+			"HeartbeatInterval(%s) must be < HeartbeatTTL(%s)",
+			s.HeartbeatInterval, s.HeartbeatTTL)
+	}
+	return nil
+}
+
+// NamespaceLimits contains the limits that are enforced for a single namespace so that one
+// tenant can't starve the others of resources. A value of 0 means unlimited. Operations
+// that would exceed one of the limits fail with a NamespaceLimitExceededErr.
+type NamespaceLimits struct {
+	// MaxActors is the maximum number of actors that can be created in the namespace. It
+	// is enforced by the registry.
+	MaxActors int `json:"max_actors"`
+	// MaxModuleBytes is the maximum total size of all the modules registered in the
+	// namespace. It is enforced by the registry.
+	MaxModuleBytes int `json:"max_module_bytes"`
+	// MaxActivatedMemoryBytes is the maximum amount of memory that the namespace's
+	// activated actors can use across the whole cluster. It is enforced by splitting it
+	// evenly across the live servers (see HeartbeatResult.NumLiveServers), each of which
+	// refuses to activate additional actors once the namespace has used up its share.
+	MaxActivatedMemoryBytes int `json:"max_activated_memory_bytes"`
+	// MaxInvocationsPerSecond is the maximum rate of invocations of the namespace's actors
+	// and workers across the whole cluster. Like MaxActivatedMemoryBytes, it is split
+	// evenly across the live servers, each of which rejects the invocations it receives
+	// beyond its share.
+	MaxInvocationsPerSecond int `json:"max_invocations_per_second"`
+}
+
+// Validate validates that the NamespaceLimits struct is valid.
+func (l NamespaceLimits) Validate() error {
+	if l.MaxActors < 0 {
+		return fmt.Errorf("MaxActors must be >= 0, but was: %d", l.MaxActors)
+	}
+	if l.MaxModuleBytes < 0 {
+		return fmt.Errorf("MaxModuleBytes must be >= 0, but was: %d", l.MaxModuleBytes)
+	}
+	if l.MaxActivatedMemoryBytes < 0 {
+		return fmt.Errorf(
+			"MaxActivatedMemoryBytes must be >= 0, but was: %d", l.MaxActivatedMemoryBytes)
+	}
+	if l.MaxInvocationsPerSecond < 0 {
+		return fmt.Errorf(
+			"MaxInvocationsPerSecond must be >= 0, but was: %d", l.MaxInvocationsPerSecond)
+	}
+	return nil
+}
+
+// IsUnlimited returns true if none of the limits are set.
+func (l NamespaceLimits) IsUnlimited() bool {
+	return l == NamespaceLimits{}
+}
+
+// ActivationChangeType is the type of an ActivationChange.
+type ActivationChangeType string
+
+const (
+	// ActivationChangeTypeActorMoved indicates that the actor's activation on ServerID
+	// was dropped (because the server was blacklisted, died, etc) and that the actor
+	// will be (or already has been) activated somewhere else.
+	ActivationChangeTypeActorMoved ActivationChangeType = "actor_moved"
+	// ActivationChangeTypeServerDied indicates that the server with ServerID and
+	// ServerVersion stopped heartbeating so every activation that referenced it is stale.
+	ActivationChangeTypeServerDied ActivationChangeType = "server_died"
+	// ActivationChangeTypeReset indicates that an unknown number of changes may have been
+	// missed and that every cached activation should be considered stale.
+	ActivationChangeTypeReset ActivationChangeType = "reset"
+)
+
+// ActivationChange describes a change to the activations tracked by the registry. Which
+// fields are populated depends on the Type.
+type ActivationChange struct {
+	Type ActivationChangeType `json:"type"`
+
+	// Namespace, ModuleID and ActorID identify the actor for ActorMoved changes.
+	Namespace string `json:"namespace,omitempty"`
+	ModuleID  string `json:"module_id,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+
+	// ServerID and ServerVersion identify the server the actor was moved away from for
+	// ActorMoved changes, and the server that died for ServerDied changes.
+	ServerID      string `json:"server_id,omitempty"`
+	ServerVersion int64  `json:"server_version,omitempty"`
+}
+
 // CreateActorResult is the result of a call to CreateActor().
 type CreateActorResult struct{}
 
@@ -63,6 +262,34 @@ type HeartbeatState struct {
 	UsedMemory int `json:"used_memory"`
 	// Address is the address at which the server can be reached.
 	Address string `json:"address"`
+
+	// MemoryLimitBytes is the amount of memory available to actors on the server. Clusters
+	// with servers of different sizes should set it on every server so that actors are
+	// balanced based on memory utilization (UsedMemory / MemoryLimitBytes) instead of
+	// absolute memory usage. 0 means the limit is unknown.
+	MemoryLimitBytes int `json:"memory_limit_bytes"`
+	// NumCPUCores is the number of CPU cores available to actors on the server. When every
+	// server reports it, actors are balanced based on the number of activated actors per
+	// core instead of the absolute number of activated actors. 0 means it is unknown.
+	NumCPUCores int `json:"num_cpu_cores"`
+}
+
+// MemoryUtilization returns the fraction of the server's memory limit that is in use, or
+// -1 if the server did not report a memory limit.
+func (h HeartbeatState) MemoryUtilization() float64 {
+	if h.MemoryLimitBytes <= 0 {
+		return -1
+	}
+	return float64(h.UsedMemory) / float64(h.MemoryLimitBytes)
+}
+
+// ActorsPerCPUCore returns the number of activated actors per CPU core, or -1 if the
+// server did not report its number of CPU cores.
+func (h HeartbeatState) ActorsPerCPUCore() float64 {
+	if h.NumCPUCores <= 0 {
+		return -1
+	}
+	return float64(h.NumActivatedActors) / float64(h.NumCPUCores)
 }
 
 // HeartbeatResult is the result returned by the Heartbeat() method.
@@ -72,14 +299,40 @@ type HeartbeatResult struct {
 	// TTL of the successful heartbeat in the same unit as the
 	// VerisionStamp.
 	HeartbeatTTL int64 `json:"heartbeat_ttl"`
+	// HeartbeatInterval is how often the server should heartbeat in the same unit as
+	// the VersionStamp. It is controlled by ClusterSettings.HeartbeatInterval. A value
+	// of 0 means the server should use DefaultHeartbeatInterval.
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
 	// ServerVersion is incremented every time a server's heartbeat expires and resumes,
 	// guaranteeing the server's ability to identify periods of inactivity/death for correctness purposes.
 	ServerVersion int64 `json:"server_version"`
 	// MemoryBytesToShed is the number of bytes of memory usage that the registry recommends
 	// that the server try to shed for balancing purposes. This value will only ever be > 0
 	// when the registry things that rebalancing should occur by requesting that the current
-	// server shed some of its load.
+	// server shed some of its load. If every server reports its memory limit the value is
+	// computed from the difference in memory utilization between servers (relative to the
+	// current server's limit) instead of the difference in absolute memory usage.
 	MemoryBytesToShed int64
+	// NumActorsToShed is the number of actors that the registry recommends that the server
+	// try to shed because it has significantly more activated actors than the rest of the
+	// cluster (for example, because a new server just joined). This value will only ever be
+	// > 0 for one server at a time and registry implementations bound it and limit how often
+	// each server is asked to shed actors so that rebalancing is gradual.
+	NumActorsToShed int `json:"num_actors_to_shed"`
+	// MembershipVersion is incremented by registry implementations that determine actor
+	// placement without coordination (like dnsregistry) every time the set of servers
+	// in the cluster changes. When the value changes, the server should check whether
+	// it still "owns" each of its activated actors and hand off any that it does not.
+	// Registry implementations that track activations explicitly leave this value at 0.
+	MembershipVersion int64 `json:"membership_version"`
+	// NamespaceLimits contains the limits of every namespace that has any configured so
+	// that the server can enforce the ones that apply to it (see NamespaceLimits).
+	NamespaceLimits map[string]NamespaceLimits `json:"namespace_limits,omitempty"`
+	// NumLiveServers is the number of servers in the cluster whose heartbeats have not
+	// expired (including the current one). Servers use it to compute their share of the
+	// cluster-wide NamespaceLimits. A value of 0 means the registry doesn't track it, in
+	// which case servers enforce the limits as if they were the only server.
+	NumLiveServers int `json:"num_live_servers,omitempty"`
 }
 
 // ModuleStore is the interface that must be implemented by the module store so that the
@@ -105,6 +358,17 @@ type ModuleStore interface {
 
 // ModuleOptions contains the options for a given module.
 type ModuleOptions struct {
+	// Reentrant allows the module's actors to be invoked again by a call chain that is
+	// already invoking them (for example when actor A invokes actor B which then invokes
+	// actor A) instead of failing the invocation with a deadlock error. The reentrant
+	// invocation runs while the original invocation is still in progress (waiting for the
+	// result of the call that led back to the actor) so the actor must be able to tolerate
+	// that. Invocations that loop back to a read-only invocation must be read-only as well.
+	Reentrant bool `json:"reentrant"`
+	// ReadOnlyOperations are the operations of the module that don't modify the state of
+	// its actors. Invocations of read-only operations run concurrently with each other
+	// (but never with any other operation) instead of one at a time.
+	ReadOnlyOperations []string `json:"read_only_operations"`
 }
 
 // RegisterModuleResult is the result of a call to RegisterModule().
@@ -140,6 +404,15 @@ type EnsureActivationResult struct {
 	RegistryServerID string                 `json:"registry_server_id"`
 }
 
+// MigrateActorResult contains the result of invoking the MigrateActor method.
+type MigrateActorResult struct {
+	// References contains the new location of the actor.
+	References []types.ActorReference `json:"references"`
+	// PreviousReferences contains the locations the actor was migrated away from, that
+	// belong to servers which are still alive, and should be deactivated.
+	PreviousReferences []types.ActorReference `json:"previous_references"`
+}
+
 // NewEnsureActivationResult creates a new EnsureActivationResult.
 func NewEnsureActivationResult(
 	references []types.ActorReference,
@@ -165,4 +438,9 @@ func NewEnsureActivationResult(
 type Address struct {
 	IP   net.IP
 	Port int
+	// Weight is the (optional) relative weight of the address, for example
+	// as advertised by an SRV record. Registry implementations that support
+	// weights will assign proportionally more actors to addresses with a
+	// higher weight. Values <= 0 are treated as a weight of 1.
+	Weight int
 }
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/richardartoul/nola/virtual/types"
 )
 
 var (
@@ -95,6 +97,69 @@ func (v *validator) EnsureActivation(
 	return v.r.EnsureActivation(ctx, req)
 }
 
+func (v *validator) EnsureActivations(
+	ctx context.Context,
+	reqs []EnsureActivationRequest,
+) ([]EnsureActivationResult, error) {
+	if len(reqs) == 0 {
+		return nil, errors.New("reqs must not be empty")
+	}
+	if len(reqs) > MaxEnsureActivationsBatchSize {
+		return nil, fmt.Errorf(
+			"reqs cannot contain more than %d requests, but contained: %d",
+			MaxEnsureActivationsBatchSize, len(reqs))
+	}
+	for _, req := range reqs {
+		if err := validateString("namespace", req.Namespace); err != nil {
+			return nil, err
+		}
+		if err := validateString("actorID", req.ActorID); err != nil {
+			return nil, err
+		}
+	}
+	return v.r.EnsureActivations(ctx, reqs)
+}
+
+func (v *validator) MigrateActor(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	targetServerID string,
+) (MigrateActorResult, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return MigrateActorResult{}, err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return MigrateActorResult{}, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return MigrateActorResult{}, err
+	}
+	if err := validateString("targetServerID", targetServerID); err != nil {
+		return MigrateActorResult{}, err
+	}
+	return v.r.MigrateActor(ctx, namespace, moduleID, actorID, targetServerID)
+}
+
+func (v *validator) LookupActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return nil, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, err
+	}
+	return v.r.LookupActivation(ctx, namespace, moduleID, actorID)
+}
+
 func (v *validator) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
@@ -112,9 +177,53 @@ func (v *validator) Heartbeat(
 	if err := validateString("address", state.Address); err != nil {
 		return HeartbeatResult{}, err
 	}
+	if state.MemoryLimitBytes < 0 {
+		return HeartbeatResult{}, fmt.Errorf(
+			"memoryLimitBytes must be >= 0, but was: %d", state.MemoryLimitBytes)
+	}
+	if state.NumCPUCores < 0 {
+		return HeartbeatResult{}, fmt.Errorf(
+			"numCPUCores must be >= 0, but was: %d", state.NumCPUCores)
+	}
 	return v.r.Heartbeat(ctx, serverID, state)
 }
 
+func (v *validator) Watch(ctx context.Context) (<-chan ActivationChange, error) {
+	return v.r.Watch(ctx)
+}
+
+func (v *validator) GetClusterSettings(ctx context.Context) (ClusterSettings, error) {
+	return v.r.GetClusterSettings(ctx)
+}
+
+func (v *validator) SetClusterSettings(ctx context.Context, settings ClusterSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	return v.r.SetClusterSettings(ctx, settings)
+}
+
+func (v *validator) GetNamespaceLimits(ctx context.Context, namespace string) (NamespaceLimits, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return NamespaceLimits{}, err
+	}
+	return v.r.GetNamespaceLimits(ctx, namespace)
+}
+
+func (v *validator) SetNamespaceLimits(
+	ctx context.Context,
+	namespace string,
+	limits NamespaceLimits,
+) error {
+	if err := validateString("namespace", namespace); err != nil {
+		return err
+	}
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	return v.r.SetNamespaceLimits(ctx, namespace, limits)
+}
+
 func (v *validator) Close(ctx context.Context) error {
 	return v.r.Close(ctx)
 }
@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// activationChangeSubscriberBufferSize is the number of changes that can be buffered
+	// for each subscriber before it is considered to be lagging.
+	activationChangeSubscriberBufferSize = 1024
+	// activationChangeLogSize is the number of recent changes retained by the feed for
+	// consumers that poll with ChangesSince() instead of subscribing.
+	activationChangeLogSize = 4096
+)
+
+var errActivationChangeFeedClosed = errors.New("activation change feed is closed")
+
+// ActivationChangeFeed fans out ActivationChanges to any number of subscribers. It is
+// used by registry implementations to implement the Watch() method.
+//
+// In addition to pushing changes to subscribers, the feed retains a bounded log of the
+// most recent changes so that consumers that can't hold a subscription open (for example
+// because they're on the other side of a request/response API) can poll for changes with
+// ChangesSince() instead.
+type ActivationChangeFeed struct {
+	sync.Mutex
+
+	// epoch uniquely identifies this instance of the feed so pollers can tell when
+	// the cursor they hold was issued by a different instance.
+	epoch       string
+	subscribers map[*activationChangeSubscriber]struct{}
+	closed      bool
+
+	// log contains the most recent changes. log[0] has sequence number firstSeq.
+	log      []ActivationChange
+	firstSeq int64
+}
+
+type activationChangeSubscriber struct {
+	ch chan ActivationChange
+	// lagging is set when a change could not be delivered because the subscriber's
+	// buffer was full. A reset is delivered as soon as there is room again.
+	lagging bool
+}
+
+// NewActivationChangeFeed creates a new ActivationChangeFeed.
+func NewActivationChangeFeed() *ActivationChangeFeed {
+	return &ActivationChangeFeed{
+		epoch:       fmt.Sprintf("%d", time.Now().UnixNano()),
+		subscribers: make(map[*activationChangeSubscriber]struct{}),
+	}
+}
+
+// Subscribe returns a channel on which every change published after the call will be
+// delivered. The channel is closed when ctx is canceled or the feed is closed.
+func (f *ActivationChangeFeed) Subscribe(ctx context.Context) (<-chan ActivationChange, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return nil, errActivationChangeFeedClosed
+	}
+
+	sub := &activationChangeSubscriber{
+		ch: make(chan ActivationChange, activationChangeSubscriberBufferSize),
+	}
+	f.subscribers[sub] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		f.Lock()
+		defer f.Unlock()
+		if _, ok := f.subscribers[sub]; ok {
+			delete(f.subscribers, sub)
+			close(sub.ch)
+		}
+	}()
+
+	return sub.ch, nil
+}
+
+// NumSubscribers returns the number of active subscribers.
+func (f *ActivationChangeFeed) NumSubscribers() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.subscribers)
+}
+
+// Publish delivers the provided changes to every subscriber and appends them to the
+// log. It never blocks: subscribers that are not keeping up are sent a reset once they
+// have room in their buffer again.
+func (f *ActivationChangeFeed) Publish(changes ...ActivationChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return
+	}
+
+	f.log = append(f.log, changes...)
+	if overflow := len(f.log) - activationChangeLogSize; overflow > 0 {
+		f.log = append(f.log[:0:0], f.log[overflow:]...)
+		f.firstSeq += int64(overflow)
+	}
+
+	for sub := range f.subscribers {
+		if sub.lagging {
+			select {
+			case sub.ch <- ActivationChange{Type: ActivationChangeTypeReset}:
+				sub.lagging = false
+			default:
+				// Still full, the reset will cover these changes too.
+				continue
+			}
+		}
+
+		for _, change := range changes {
+			select {
+			case sub.ch <- change:
+			default:
+				sub.lagging = true
+			}
+			if sub.lagging {
+				break
+			}
+		}
+	}
+}
+
+// ChangesSince returns all the changes that were published after the provided cursor
+// (obtained from a previous call to ChangesSince or 0 for "from the beginning"), as well
+// as the cursor that should be passed to the next call. ok is false if the cursor was
+// issued by a different feed instance (as identified by epoch) or changes since the
+// cursor were already evicted from the log in which case the caller should assume it
+// missed some changes.
+func (f *ActivationChangeFeed) ChangesSince(
+	epoch string,
+	cursor int64,
+) (changes []ActivationChange, currEpoch string, nextCursor int64, ok bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	nextSeq := f.firstSeq + int64(len(f.log))
+	if epoch != f.epoch || cursor < f.firstSeq || cursor > nextSeq {
+		return nil, f.epoch, nextSeq, false
+	}
+
+	changes = append([]ActivationChange(nil), f.log[cursor-f.firstSeq:]...)
+	return changes, f.epoch, nextSeq, true
+}
+
+// Close closes the feed and all of its subscriptions.
+func (f *ActivationChangeFeed) Close() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.closed = true
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.ch)
+	}
+}
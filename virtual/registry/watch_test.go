@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivationChangeFeed(t *testing.T) {
+	f := NewActivationChangeFeed()
+
+	ctx, cc := context.WithCancel(context.Background())
+	ch, err := f.Subscribe(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, f.NumSubscribers())
+
+	moved := ActivationChange{Type: ActivationChangeTypeActorMoved, ActorID: "a"}
+	f.Publish(moved)
+	require.Equal(t, moved, <-ch)
+
+	// Pollers should be able to catch up from the beginning of the log.
+	changes, epoch, cursor, ok := f.ChangesSince("", 0)
+	require.False(t, ok)
+	require.Empty(t, changes)
+	changes, epoch, cursor, ok = f.ChangesSince(epoch, 0)
+	require.True(t, ok)
+	require.Equal(t, []ActivationChange{moved}, changes)
+	require.Equal(t, int64(1), cursor)
+	changes, _, cursor, ok = f.ChangesSince(epoch, cursor)
+	require.True(t, ok)
+	require.Empty(t, changes)
+	require.Equal(t, int64(1), cursor)
+
+	// Subscribers that fall behind should receive a reset once they catch up.
+	for i := 0; i < activationChangeSubscriberBufferSize+1; i++ {
+		f.Publish(moved)
+	}
+	for i := 0; i < activationChangeSubscriberBufferSize; i++ {
+		<-ch
+	}
+	f.Publish(moved)
+	require.Equal(t, ActivationChangeTypeReset, (<-ch).Type)
+	require.Equal(t, moved, <-ch)
+
+	// Pollers whose cursor was evicted from the log should be told they missed changes.
+	for i := 0; i < activationChangeLogSize; i++ {
+		f.Publish(moved)
+	}
+	_, _, _, ok = f.ChangesSince(epoch, 1)
+	require.False(t, ok)
+
+	// Canceling the context should close the subscription.
+	cc()
+	for range ch {
+	}
+	require.Equal(t, 0, f.NumSubscribers())
+
+	f.Close()
+	_, err = f.Subscribe(context.Background())
+	require.Error(t, err)
+}
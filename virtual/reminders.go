@@ -0,0 +1,765 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// DefaultReminderNumShards is the default value for ReminderOptions.NumShards.
+	DefaultReminderNumShards = 64
+	// DefaultReminderPollInterval is the default value for ReminderOptions.PollInterval.
+	DefaultReminderPollInterval = time.Second
+	// DefaultReminderLeaseDuration is the default value for ReminderOptions.LeaseDuration.
+	DefaultReminderLeaseDuration = 30 * time.Second
+	// DefaultReminderRetryInterval is the default value for ReminderOptions.RetryInterval.
+	DefaultReminderRetryInterval = 10 * time.Second
+	// DefaultReminderMaxAttempts is the default value for ReminderOptions.MaxAttempts.
+	DefaultReminderMaxAttempts = 10
+
+	remindersKeyPrefix = "reminders"
+	// maxRemindersFiredPerShardPoll bounds how many due reminders are read from a single
+	// shard each time the shards are polled to keep the transaction small.
+	maxRemindersFiredPerShardPoll = 1000
+)
+
+// ReminderOptions configures the durable reminders that back RegisterReminder.
+//
+// Reminders are persisted in Store and divided into NumShards shards by the actor they
+// belong to. Every environment sharing the Store leases an equal share of the shards and
+// fires the reminders in the shards it owns, so the work is spread across the cluster and
+// the shards of a server that dies are taken over by the remaining servers once its
+// leases expire. Firing a reminder invokes its operation on the actor and reactivates the
+// actor if necessary. Reminders fire at-least-once: if the server that fired a reminder
+// dies before recording that it did, the reminder will fire again on another server.
+// Reminders are also not precise timers, they may fire up to PollInterval late.
+type ReminderOptions struct {
+	// Store is the KV store that reminders are persisted in. Every environment in the
+	// cluster should use the same Store. RegisterReminder returns an error if it is nil.
+	Store kv.Store
+	// NumShards is the number of shards that reminders are divided into. It bounds the
+	// number of servers that can share the work of firing reminders and must be the same
+	// for every environment that uses the same Store. Defaults to DefaultReminderNumShards.
+	NumShards int
+	// PollInterval controls how often the environment renews its shard leases and checks
+	// them for reminders that are due. Defaults to DefaultReminderPollInterval.
+	PollInterval time.Duration
+	// LeaseDuration is how long an environment owns a shard after it last renewed its
+	// lease. It also determines how long it takes for the shards of a server that died to
+	// be taken over. Invoking the actor times out after half of LeaseDuration, and
+	// reminders are only fired while at least half of the lease remains so that a large
+	// backlog of reminders can't prevent the leases from being renewed. Defaults to
+	// DefaultReminderLeaseDuration.
+	LeaseDuration time.Duration
+	// RetryInterval is how long to wait before firing a one-shot reminder again after
+	// invoking the actor failed. Periodic reminders are not retried, the failed invocation
+	// is skipped and the reminder fires again at the next period. Defaults to
+	// DefaultReminderRetryInterval.
+	RetryInterval time.Duration
+	// MaxAttempts is the maximum number of times a one-shot reminder is fired before it is
+	// discarded. Defaults to DefaultReminderMaxAttempts.
+	MaxAttempts int
+}
+
+// Enabled returns true if reminders are enabled.
+func (r ReminderOptions) Enabled() bool {
+	return r.Store != nil
+}
+
+// Validate validates the options.
+func (r ReminderOptions) Validate() error {
+	if r.NumShards < 0 {
+		return fmt.Errorf("NumShards must be >= 0, but was: %d", r.NumShards)
+	}
+	if r.PollInterval < 0 {
+		return fmt.Errorf("PollInterval must be >= 0, but was: %s", r.PollInterval)
+	}
+	if r.LeaseDuration < 0 {
+		return fmt.Errorf("LeaseDuration must be >= 0, but was: %s", r.LeaseDuration)
+	}
+	if r.RetryInterval < 0 {
+		return fmt.Errorf("RetryInterval must be >= 0, but was: %s", r.RetryInterval)
+	}
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts must be >= 0, but was: %d", r.MaxAttempts)
+	}
+	return nil
+}
+
+func (r ReminderOptions) withDefaults() ReminderOptions {
+	if r.NumShards == 0 {
+		r.NumShards = DefaultReminderNumShards
+	}
+	if r.PollInterval == 0 {
+		r.PollInterval = DefaultReminderPollInterval
+	}
+	if r.LeaseDuration == 0 {
+		r.LeaseDuration = DefaultReminderLeaseDuration
+	}
+	if r.RetryInterval == 0 {
+		r.RetryInterval = DefaultReminderRetryInterval
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = DefaultReminderMaxAttempts
+	}
+	return r
+}
+
+// reminderRecord is the persisted state of a single reminder.
+type reminderRecord struct {
+	Namespace string
+	ActorID   string
+	ModuleID  string
+	Reminder  types.Reminder
+	// NextFireAt is the versionstamp at which the reminder should fire next. The reminder
+	// is also indexed by it in its shard's schedule.
+	NextFireAt int64
+	// Attempts is the number of consecutive times firing a one-shot reminder has failed.
+	Attempts int
+}
+
+// reminderLease is the state of a shard's lease, or of a member's registration.
+type reminderLease struct {
+	Owner     string
+	ExpiresAt int64
+}
+
+// reminderService persists reminders in a kv.Store and fires the reminders in the shards
+// that it leases. See ReminderOptions for a description of the semantics.
+type reminderService struct {
+	log     *slog.Logger
+	store   kv.Store
+	opts    ReminderOptions
+	ownerID string
+	fire    func(context.Context, reminderRecord) error
+
+	// ownedShards and leaseExpiresAt are only accessed by the polling goroutine.
+	ownedShards []int64
+	// leaseExpiresAt is a conservative estimate (based on the local clock) of when the
+	// leases on ownedShards expire if they're not renewed.
+	leaseExpiresAt time.Time
+
+	closeCh  chan struct{}
+	closedCh chan struct{}
+}
+
+func newReminderService(
+	log *slog.Logger,
+	serverID string,
+	opts ReminderOptions,
+	fire func(context.Context, reminderRecord) error,
+) *reminderService {
+	return &reminderService{
+		log:   log.With(slog.String("module", "reminderService")),
+		store: opts.Store,
+		opts:  opts.withDefaults(),
+		// Include a random component so that a restarted server with the same ID doesn't
+		// mistake the leases of its previous incarnation for its own.
+		ownerID:  fmt.Sprintf("%s-%d", serverID, rand.Int63()),
+		fire:     fire,
+		closeCh:  make(chan struct{}),
+		closedCh: make(chan struct{}),
+	}
+}
+
+// start starts leasing shards and firing reminders in the background.
+func (s *reminderService) start() {
+	go func() {
+		defer close(s.closedCh)
+		ticker := time.NewTicker(s.opts.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.poll(); err != nil {
+					s.log.Error("error polling for reminders", slog.Any("error", err))
+				}
+			case <-s.closeCh:
+				// Release the leases so that other environments can take over the shards
+				// immediately instead of waiting for them to expire.
+				if err := s.release(context.Background()); err != nil {
+					s.log.Error("error releasing reminder shards", slog.Any("error", err))
+				}
+				return
+			}
+		}
+	}()
+}
+
+// close stops firing reminders and waits for the in-flight invocations to complete.
+func (s *reminderService) close() {
+	close(s.closeCh)
+	<-s.closedCh
+}
+
+// register persists the reminder, replacing any existing reminder for the actor with the
+// same name.
+func (s *reminderService) register(
+	ctx context.Context,
+	id types.NamespacedActorID,
+	reminder types.Reminder,
+) error {
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		existing, ok, err := getReminderRecord(ctx, tr, id, reminder.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := tr.Delete(ctx, s.getScheduleKey(existing)); err != nil {
+				return nil, err
+			}
+		}
+
+		record := reminderRecord{
+			Namespace:  id.Namespace,
+			ActorID:    id.ID,
+			ModuleID:   id.Module,
+			Reminder:   reminder,
+			NextFireAt: vs + (time.Duration(reminder.AfterMillis) * time.Millisecond).Microseconds(),
+		}
+		return nil, s.putReminderRecord(ctx, tr, record)
+	})
+	if err != nil {
+		return fmt.Errorf("error registering reminder: %w", err)
+	}
+	return nil
+}
+
+// unregister deletes the reminder with the provided name, if it exists.
+func (s *reminderService) unregister(
+	ctx context.Context,
+	id types.NamespacedActorID,
+	name string,
+) error {
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		record, ok, err := getReminderRecord(ctx, tr, id, name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+		return nil, s.deleteReminderRecord(ctx, tr, record)
+	})
+	if err != nil {
+		return fmt.Errorf("error unregistering reminder: %w", err)
+	}
+	return nil
+}
+
+// list returns the reminders registered for the actor ordered by name.
+func (s *reminderService) list(
+	ctx context.Context,
+	id types.NamespacedActorID,
+) ([]types.Reminder, error) {
+	var reminders []types.Reminder
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		reminders = nil
+		return nil, tr.IterPrefix(ctx, getRemindersPrefix(id), func(k, v []byte) error {
+			record, err := decodeReminderRecord(v)
+			if err != nil {
+				return fmt.Errorf("error decoding reminder: %w", err)
+			}
+			reminders = append(reminders, record.Reminder)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing reminders: %w", err)
+	}
+	return reminders, nil
+}
+
+// poll renews the environment's membership and shard leases, and then fires the
+// reminders that are due in the shards it owns. Firing stops before the leases expire
+// so that they're renewed in time by the next poll even if there is a large backlog.
+func (s *reminderService) poll() error {
+	ctx := context.Background()
+	if err := s.lease(ctx); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, shard := range s.ownedShards {
+		wg.Add(1)
+		go func(shard int64) {
+			defer wg.Done()
+			if err := s.fireShard(ctx, shard); err != nil {
+				s.log.Error(
+					"error firing reminders",
+					slog.Int64("shard", shard),
+					slog.Any("error", err))
+			}
+		}(shard)
+	}
+	wg.Wait()
+	return nil
+}
+
+// lease renews the environment's membership and updates the set of shards that it owns.
+// Each environment owns at most its fair share of the shards (based on the number of live
+// members) so that when a new environment joins the others release some of their shards
+// for it to claim.
+func (s *reminderService) lease(ctx context.Context) error {
+	// The leases expire LeaseDuration after the versionstamp of the transaction, which
+	// is always later than this.
+	start := time.Now()
+
+	var owned []int64
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		owned = nil
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		expiresAt := vs + s.opts.LeaseDuration.Microseconds()
+
+		if err := putReminderLease(ctx, tr, getReminderMemberKey(s.ownerID), reminderLease{
+			Owner:     s.ownerID,
+			ExpiresAt: expiresAt,
+		}); err != nil {
+			return nil, err
+		}
+
+		var (
+			numMembers int
+			expired    [][]byte
+		)
+		err = tr.IterPrefix(ctx, getReminderMembersPrefix(), func(k, v []byte) error {
+			member, err := decodeReminderLease(v)
+			if err != nil {
+				return fmt.Errorf("error decoding reminder member: %w", err)
+			}
+			if member.ExpiresAt > vs {
+				numMembers++
+			} else {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error iterating reminder members: %w", err)
+		}
+		for _, k := range expired {
+			if err := tr.Delete(ctx, k); err != nil {
+				return nil, err
+			}
+		}
+		fairShare := (s.opts.NumShards + numMembers - 1) / numMembers
+
+		leases := make(map[int64]reminderLease, s.opts.NumShards)
+		err = tr.IterPrefix(ctx, getReminderShardsPrefix(), func(k, v []byte) error {
+			shard, err := unpackReminderShardKey(k)
+			if err != nil {
+				return err
+			}
+			lease, err := decodeReminderLease(v)
+			if err != nil {
+				return fmt.Errorf("error decoding reminder shard lease: %w", err)
+			}
+			leases[shard] = lease
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error iterating reminder shards: %w", err)
+		}
+
+		// Renew the shards we already own first so that shards don't move around
+		// unnecessarily, and then claim the available ones.
+		var available []int64
+		for shard := int64(0); shard < int64(s.opts.NumShards); shard++ {
+			lease, ok := leases[shard]
+			switch {
+			case ok && lease.Owner == s.ownerID && lease.ExpiresAt > vs:
+				if len(owned) < fairShare {
+					owned = append(owned, shard)
+				} else if err := tr.Delete(ctx, getReminderShardKey(shard)); err != nil {
+					// Release shards above our fair share so other members can claim them.
+					return nil, err
+				}
+			case !ok || lease.ExpiresAt <= vs:
+				available = append(available, shard)
+			}
+		}
+		// Start at a random offset so that members that join at the same time don't
+		// contend for the same shards.
+		offset := 0
+		if len(available) > 0 {
+			offset = rand.Intn(len(available))
+		}
+		for i := 0; i < len(available) && len(owned) < fairShare; i++ {
+			owned = append(owned, available[(offset+i)%len(available)])
+		}
+
+		for _, shard := range owned {
+			if err := putReminderLease(ctx, tr, getReminderShardKey(shard), reminderLease{
+				Owner:     s.ownerID,
+				ExpiresAt: expiresAt,
+			}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error leasing reminder shards: %w", err)
+	}
+
+	s.ownedShards = owned
+	s.leaseExpiresAt = start.Add(s.opts.LeaseDuration)
+	return nil
+}
+
+// release releases the environment's membership and shard leases.
+func (s *reminderService) release(ctx context.Context) error {
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		if err := tr.Delete(ctx, getReminderMemberKey(s.ownerID)); err != nil {
+			return nil, err
+		}
+		for _, shard := range s.ownedShards {
+			lease, ok, err := getReminderLease(ctx, tr, getReminderShardKey(shard))
+			if err != nil {
+				return nil, err
+			}
+			if ok && lease.Owner == s.ownerID {
+				if err := tr.Delete(ctx, getReminderShardKey(shard)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.ownedShards = nil
+	return nil
+}
+
+// fireShard fires the reminders in the shard that are due, in the order they were due.
+func (s *reminderService) fireShard(ctx context.Context, shard int64) error {
+	var due []reminderRecord
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		// Reset in case the transaction is retried.
+		due = nil
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		var keys [][]byte
+		err = tr.IterPrefix(ctx, getReminderSchedulePrefix(shard), func(k, v []byte) error {
+			// The schedule is ordered by the time each reminder is due so we can stop at
+			// the first one that isn't due yet.
+			unpacked, err := tuple.Unpack(k)
+			if err != nil {
+				return fmt.Errorf("error unpacking reminder schedule key: %w", err)
+			}
+			if len(unpacked) != 8 {
+				return fmt.Errorf("unexpected reminder schedule key: %v", unpacked)
+			}
+			fireAt, ok := unpacked[3].(int64)
+			if !ok {
+				return fmt.Errorf("unexpected reminder schedule key: %v", unpacked)
+			}
+			if fireAt > vs || len(keys) >= maxRemindersFiredPerShardPoll {
+				return errStopIteration
+			}
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return nil, fmt.Errorf("error iterating reminder schedule: %w", err)
+		}
+
+		for _, k := range keys {
+			unpacked, err := tuple.Unpack(k)
+			if err != nil {
+				return nil, fmt.Errorf("error unpacking reminder schedule key: %w", err)
+			}
+			namespace, ok1 := unpacked[4].(string)
+			moduleID, ok2 := unpacked[5].(string)
+			actorID, ok3 := unpacked[6].(string)
+			name, ok4 := unpacked[7].(string)
+			if !ok1 || !ok2 || !ok3 || !ok4 {
+				return nil, fmt.Errorf("unexpected reminder schedule key: %v", unpacked)
+			}
+
+			id := types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor)
+			record, ok, err := getReminderRecord(ctx, tr, id, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// Should never happen since the schedule is always updated in the same
+				// transaction as the reminder, but clean it up just in case.
+				if err := tr.Delete(ctx, k); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			due = append(due, record)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range due {
+		select {
+		case <-s.closeCh:
+			return nil
+		default:
+		}
+
+		if time.Until(s.leaseExpiresAt) < s.opts.LeaseDuration/2 {
+			// Firing the reminder could outlast the lease, leave it (and the rest of the
+			// backlog) for after the lease has been renewed.
+			return nil
+		}
+
+		fireCtx, cc := context.WithTimeout(ctx, s.opts.LeaseDuration/2)
+		fireErr := s.fire(fireCtx, record)
+		cc()
+		if fireErr != nil {
+			s.log.Error(
+				"error firing reminder",
+				slog.String("actor_id", fmt.Sprintf("%s::%s::%s", record.Namespace, record.ModuleID, record.ActorID)),
+				slog.String("reminder", record.Reminder.Name),
+				slog.Any("error", fireErr))
+		}
+
+		if err := s.ack(ctx, shard, record, fireErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ack reschedules (or deletes) the reminder after it was fired. It is a no-op if the
+// reminder was unregistered or replaced while it was being fired.
+func (s *reminderService) ack(
+	ctx context.Context,
+	shard int64,
+	fired reminderRecord,
+	fireErr error,
+) error {
+	_, err := s.store.Transact(func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		lease, ok, err := getReminderLease(ctx, tr, getReminderShardKey(shard))
+		if err != nil {
+			return nil, err
+		}
+		if !ok || lease.Owner != s.ownerID || lease.ExpiresAt <= vs {
+			// Someone else took over the shard in the meantime so they'll (re)fire
+			// the reminder.
+			return nil, errors.New("lost lease on reminder shard")
+		}
+
+		id := fired.actorID()
+		record, ok, err := getReminderRecord(ctx, tr, id, fired.Reminder.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || record.NextFireAt != fired.NextFireAt {
+			return nil, nil
+		}
+
+		period := (time.Duration(record.Reminder.PeriodMillis) * time.Millisecond).Microseconds()
+		switch {
+		case period > 0:
+			if err := tr.Delete(ctx, s.getScheduleKey(record)); err != nil {
+				return nil, err
+			}
+			record.NextFireAt += period
+			if record.NextFireAt <= vs {
+				// Skip the periods that were missed (because the reminder was late or
+				// the actor took longer than the period to respond) instead of firing
+				// the reminder repeatedly to catch up.
+				record.NextFireAt = vs + period
+			}
+			return nil, s.putReminderRecord(ctx, tr, record)
+		case fireErr != nil && record.Attempts+1 < s.opts.MaxAttempts:
+			if err := tr.Delete(ctx, s.getScheduleKey(record)); err != nil {
+				return nil, err
+			}
+			record.Attempts++
+			record.NextFireAt = vs + s.opts.RetryInterval.Microseconds()
+			return nil, s.putReminderRecord(ctx, tr, record)
+		default:
+			if fireErr != nil {
+				s.log.Warn(
+					"discarding one-shot reminder after exhausting its attempts",
+					slog.String("actor_id", fmt.Sprintf("%s::%s::%s", record.Namespace, record.ModuleID, record.ActorID)),
+					slog.String("reminder", record.Reminder.Name),
+					slog.Int("attempts", record.Attempts+1))
+			}
+			return nil, s.deleteReminderRecord(ctx, tr, record)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error acknowledging reminder: %w", err)
+	}
+	return nil
+}
+
+// shard returns the shard that the actor's reminders belong to.
+func (s *reminderService) shard(id types.NamespacedActorID) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(id.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(id.Module))
+	h.Write([]byte{0})
+	h.Write([]byte(id.ID))
+	return int64(h.Sum32() % uint32(s.opts.NumShards))
+}
+
+func (s *reminderService) getScheduleKey(record reminderRecord) []byte {
+	return tuple.Tuple{
+		remindersKeyPrefix, "schedule", s.shard(record.actorID()), record.NextFireAt,
+		record.Namespace, record.ModuleID, record.ActorID, record.Reminder.Name,
+	}.Pack()
+}
+
+func (s *reminderService) putReminderRecord(
+	ctx context.Context,
+	tr kv.Transaction,
+	record reminderRecord,
+) error {
+	if err := tr.Put(ctx, getReminderKey(record.actorID(), record.Reminder.Name), encodeReminderRecord(record)); err != nil {
+		return err
+	}
+	return tr.Put(ctx, s.getScheduleKey(record), nil)
+}
+
+func (s *reminderService) deleteReminderRecord(
+	ctx context.Context,
+	tr kv.Transaction,
+	record reminderRecord,
+) error {
+	if err := tr.Delete(ctx, getReminderKey(record.actorID(), record.Reminder.Name)); err != nil {
+		return err
+	}
+	return tr.Delete(ctx, s.getScheduleKey(record))
+}
+
+func (r reminderRecord) actorID() types.NamespacedActorID {
+	return types.NewNamespacedActorID(r.Namespace, r.ActorID, r.ModuleID, types.IDTypeActor)
+}
+
+func getReminderRecord(
+	ctx context.Context,
+	tr kv.Transaction,
+	id types.NamespacedActorID,
+	name string,
+) (reminderRecord, bool, error) {
+	v, ok, err := tr.Get(ctx, getReminderKey(id, name))
+	if err != nil {
+		return reminderRecord{}, false, fmt.Errorf("error getting reminder: %w", err)
+	}
+	if !ok {
+		return reminderRecord{}, false, nil
+	}
+
+	record, err := decodeReminderRecord(v)
+	if err != nil {
+		return reminderRecord{}, false, fmt.Errorf("error decoding reminder: %w", err)
+	}
+	return record, true, nil
+}
+
+func getReminderLease(
+	ctx context.Context,
+	tr kv.Transaction,
+	key []byte,
+) (reminderLease, bool, error) {
+	v, ok, err := tr.Get(ctx, key)
+	if err != nil {
+		return reminderLease{}, false, fmt.Errorf("error getting reminder lease: %w", err)
+	}
+	if !ok {
+		return reminderLease{}, false, nil
+	}
+
+	lease, err := decodeReminderLease(v)
+	if err != nil {
+		return reminderLease{}, false, fmt.Errorf("error decoding reminder lease: %w", err)
+	}
+	return lease, true, nil
+}
+
+func putReminderLease(
+	ctx context.Context,
+	tr kv.Transaction,
+	key []byte,
+	lease reminderLease,
+) error {
+	return tr.Put(ctx, key, encodeReminderLease(lease))
+}
+
+func unpackReminderShardKey(k []byte) (int64, error) {
+	unpacked, err := tuple.Unpack(k)
+	if err != nil {
+		return 0, fmt.Errorf("error unpacking reminder shard key: %w", err)
+	}
+	if len(unpacked) != 3 {
+		return 0, fmt.Errorf("unexpected reminder shard key: %v", unpacked)
+	}
+	shard, ok := unpacked[2].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reminder shard key: %v", unpacked)
+	}
+	return shard, nil
+}
+
+func getRemindersPrefix(id types.NamespacedActorID) []byte {
+	return tuple.Tuple{remindersKeyPrefix, "reminders", id.Namespace, id.Module, id.ID}.Pack()
+}
+
+func getReminderKey(id types.NamespacedActorID, name string) []byte {
+	return tuple.Tuple{remindersKeyPrefix, "reminders", id.Namespace, id.Module, id.ID, name}.Pack()
+}
+
+func getReminderSchedulePrefix(shard int64) []byte {
+	return tuple.Tuple{remindersKeyPrefix, "schedule", shard}.Pack()
+}
+
+func getReminderShardsPrefix() []byte {
+	return tuple.Tuple{remindersKeyPrefix, "shards"}.Pack()
+}
+
+func getReminderShardKey(shard int64) []byte {
+	return tuple.Tuple{remindersKeyPrefix, "shards", shard}.Pack()
+}
+
+func getReminderMembersPrefix() []byte {
+	return tuple.Tuple{remindersKeyPrefix, "members"}.Pack()
+}
+
+func getReminderMemberKey(ownerID string) []byte {
+	return tuple.Tuple{remindersKeyPrefix, "members", ownerID}.Pack()
+}
@@ -0,0 +1,321 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// TestReminderService tests that one-shot and periodic reminders fire, that they can be
+// listed and unregistered, and that failed one-shot reminders are retried.
+func TestReminderService(t *testing.T) {
+	var (
+		ctx = context.Background()
+		id  = types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+
+		mu    sync.Mutex
+		fired = map[string]int{}
+	)
+	getFired := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fired[name]
+	}
+
+	s := newReminderService(slog.Default(), "server1", ReminderOptions{
+		Store:         localregistry.NewLocalKV(),
+		NumShards:     4,
+		PollInterval:  time.Millisecond,
+		RetryInterval: time.Millisecond,
+		MaxAttempts:   3,
+	}, func(ctx context.Context, record reminderRecord) error {
+		require.Equal(t, id, record.actorID())
+
+		mu.Lock()
+		defer mu.Unlock()
+		fired[record.Reminder.Name]++
+		if record.Reminder.Operation == "fail" {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	s.start()
+	defer s.close()
+
+	require.NoError(t, s.register(ctx, id, types.Reminder{
+		Name: "once", Operation: "inc"}))
+	require.NoError(t, s.register(ctx, id, types.Reminder{
+		Name: "periodic", Operation: "inc", PeriodMillis: 5}))
+	require.NoError(t, s.register(ctx, id, types.Reminder{
+		Name: "failing", Operation: "fail"}))
+	require.NoError(t, s.register(ctx, id, types.Reminder{
+		Name: "later", Operation: "inc", AfterMillis: int(time.Hour.Milliseconds())}))
+
+	require.Eventually(t, func() bool {
+		return getFired("once") == 1 && getFired("periodic") >= 3 && getFired("failing") == 3
+	}, 10*time.Second, time.Millisecond)
+
+	// One-shot reminders are removed after they fire (or exhaust their attempts).
+	reminders, err := s.list(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(reminders))
+	require.Equal(t, "later", reminders[0].Name)
+	require.Equal(t, "periodic", reminders[1].Name)
+	require.Equal(t, 1, getFired("once"))
+	require.Equal(t, 3, getFired("failing"))
+	require.Equal(t, 0, getFired("later"))
+
+	// Re-registering a reminder replaces it.
+	require.NoError(t, s.register(ctx, id, types.Reminder{
+		Name: "later", Operation: "inc"}))
+	require.Eventually(t, func() bool {
+		return getFired("later") == 1
+	}, 10*time.Second, time.Millisecond)
+
+	require.NoError(t, s.unregister(ctx, id, "periodic"))
+	// Unregistering a reminder that doesn't exist is a no-op.
+	require.NoError(t, s.unregister(ctx, id, "periodic"))
+	reminders, err = s.list(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(reminders))
+
+	// Wait for any in-flight firing of the periodic reminder to complete and then make
+	// sure it doesn't fire again.
+	time.Sleep(50 * time.Millisecond)
+	numFired := getFired("periodic")
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, numFired, getFired("periodic"))
+}
+
+// TestReminderServiceSharding tests that the shards are divided evenly between the
+// environments that share the store, and taken over when an environment leaves.
+func TestReminderServiceSharding(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = localregistry.NewLocalKV()
+		opts  = ReminderOptions{Store: store, NumShards: 8}
+		fire  = func(context.Context, reminderRecord) error { return nil }
+		s1    = newReminderService(slog.Default(), "server1", opts, fire)
+		s2    = newReminderService(slog.Default(), "server2", opts, fire)
+	)
+
+	require.NoError(t, s1.lease(ctx))
+	require.Equal(t, 8, len(s1.ownedShards))
+
+	// s2 can't claim any shards until s1 releases the ones above its fair share.
+	require.NoError(t, s2.lease(ctx))
+	require.Equal(t, 0, len(s2.ownedShards))
+	require.NoError(t, s1.lease(ctx))
+	require.Equal(t, 4, len(s1.ownedShards))
+	require.NoError(t, s2.lease(ctx))
+	require.Equal(t, 4, len(s2.ownedShards))
+
+	owners := map[int64]bool{}
+	for _, shard := range append(append([]int64(nil), s1.ownedShards...), s2.ownedShards...) {
+		owners[shard] = true
+	}
+	require.Equal(t, 8, len(owners))
+
+	// s1 should take over every shard once s2 leaves.
+	require.NoError(t, s2.release(ctx))
+	require.NoError(t, s1.lease(ctx))
+	require.Equal(t, 8, len(s1.ownedShards))
+}
+
+// TestReminderServiceLeaseExpiry tests that reminders are fired by another environment
+// if the environment that owns their shard dies.
+func TestReminderServiceLeaseExpiry(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = localregistry.NewLocalKV()
+		opts  = ReminderOptions{
+			Store:         store,
+			NumShards:     1,
+			PollInterval:  time.Millisecond,
+			LeaseDuration: 100 * time.Millisecond,
+		}
+		firedCh = make(chan string, 1)
+		s1      = newReminderService(slog.Default(), "server1", opts, func(context.Context, reminderRecord) error {
+			return errors.New("should not be called")
+		})
+		s2 = newReminderService(slog.Default(), "server2", opts, func(ctx context.Context, record reminderRecord) error {
+			firedCh <- record.Reminder.Name
+			return nil
+		})
+		id = types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+	)
+
+	// s1 claims the only shard and then "dies" without releasing it.
+	require.NoError(t, s1.lease(ctx))
+	require.Equal(t, 1, len(s1.ownedShards))
+	require.NoError(t, s1.register(ctx, id, types.Reminder{Name: "once", Operation: "inc"}))
+
+	s2.start()
+	defer s2.close()
+	select {
+	case name := <-firedCh:
+		require.Equal(t, "once", name)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for s2 to take over")
+	}
+}
+
+// TestReminderServiceBacklog tests that a backlog of slow reminders doesn't prevent the
+// shard leases from being renewed.
+func TestReminderServiceBacklog(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		opts = ReminderOptions{
+			Store:         localregistry.NewLocalKV(),
+			NumShards:     1,
+			LeaseDuration: 200 * time.Millisecond,
+		}
+
+		mu       sync.Mutex
+		numFired int
+		s        = newReminderService(slog.Default(), "server1", opts, func(context.Context, reminderRecord) error {
+			time.Sleep(40 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			numFired++
+			return nil
+		})
+		getNumFired = func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return numFired
+		}
+		id = types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+	)
+
+	const numReminders = 10
+	for i := 0; i < numReminders; i++ {
+		require.NoError(t, s.register(ctx, id, types.Reminder{
+			Name: strconv.Itoa(i), Operation: "inc"}))
+	}
+
+	// Firing every reminder would take twice as long as the lease so the poll should stop
+	// early, while the lease is still valid.
+	start := time.Now()
+	require.NoError(t, s.poll())
+	require.Less(t, time.Since(start), opts.LeaseDuration)
+	require.Greater(t, getNumFired(), 0)
+	require.Less(t, getNumFired(), numReminders)
+
+	// The rest of the backlog is fired by the subsequent polls.
+	for getNumFired() < numReminders {
+		require.NoError(t, s.poll())
+		require.Equal(t, 1, len(s.ownedShards))
+	}
+	reminders, err := s.list(ctx, id)
+	require.NoError(t, err)
+	require.Empty(t, reminders)
+}
+
+func TestReminderValidate(t *testing.T) {
+	require.NoError(t, ReminderOptions{}.Validate())
+	require.Error(t, ReminderOptions{NumShards: -1}.Validate())
+
+	valid := types.Reminder{Name: "a", Operation: "inc", PeriodMillis: 1}
+	require.NoError(t, valid.Validate())
+	for _, invalid := range []types.Reminder{
+		{Operation: "inc"},
+		{Name: "a"},
+		{Name: "a", Operation: "inc", AfterMillis: -1},
+		{Name: "a", Operation: "inc", PeriodMillis: -1},
+	} {
+		require.Error(t, invalid.Validate())
+	}
+}
+
+// TestReminders tests that reminders registered through the environment (and the host
+// function) fire, and that they reactivate their actor on a different environment after
+// the environment that the actor was activated on is closed.
+func TestReminders(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		opts        = defaultOptsGoByte
+	)
+	defer reg.Close(ctx)
+
+	// Reminders are disabled by default.
+	env, err := NewEnvironment(ctx, "serverID1", reg, moduleStore, nil, opts)
+	require.NoError(t, err)
+	require.Error(t, env.RegisterReminder(
+		ctx, "ns-1", "a", "test-module", types.Reminder{Name: "a", Operation: "inc"}))
+	require.NoError(t, env.Close(ctx))
+
+	opts.Reminders = ReminderOptions{
+		Store:        localregistry.NewLocalKV(),
+		PollInterval: time.Millisecond,
+	}
+	newEnv := func(serverID string) Environment {
+		env, err := NewEnvironment(ctx, serverID, reg, moduleStore, nil, opts)
+		require.NoError(t, err)
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+		return env
+	}
+	getCount := func(env Environment) int {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		count, err := strconv.Atoi(string(result))
+		require.NoError(t, err)
+		return count
+	}
+
+	env1 := newEnv("serverID1")
+	defer func() { noErrIgnoreDupeClose(t, env1.Close(context.Background())) }()
+
+	// Register a periodic reminder through the actor's host capabilities.
+	reminder, err := json.Marshal(types.Reminder{
+		Name: "periodic", Operation: "inc", PeriodMillis: 10})
+	require.NoError(t, err)
+	_, err = env1.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "registerReminder", reminder, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	result, err := env1.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "listReminders", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	var reminders []types.Reminder
+	require.NoError(t, json.Unmarshal(result, &reminders))
+	require.Equal(t, 1, len(reminders))
+	require.Equal(t, "periodic", reminders[0].Name)
+
+	require.Eventually(t, func() bool {
+		return getCount(env1) >= 3
+	}, 10*time.Second, time.Millisecond)
+
+	// Close env1 so the actor is deactivated, the reminder should reactivate it on env2
+	// without any other invocations.
+	require.NoError(t, env1.Close(ctx))
+	env2 := newEnv("serverID2")
+	defer func() { noErrIgnoreDupeClose(t, env2.Close(context.Background())) }()
+	require.Eventually(t, func() bool {
+		return env2.NumActivatedActors() == 1
+	}, 10*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return getCount(env2) >= 3
+	}, 10*time.Second, time.Millisecond)
+
+	_, err = env2.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "unregisterReminder", []byte("periodic"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	reminders, err = env2.ListReminders(ctx, "ns-1", "a", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, 0, len(reminders))
+}
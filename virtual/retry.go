@@ -0,0 +1,340 @@
+package virtual
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// hedgeLatencyWindowSize is the number of recent invocation latencies of each operation
+	// that are used to compute the latency percentile after which requests are hedged.
+	hedgeLatencyWindowSize = 128
+	// hedgeMinLatencySamples is the minimum number of latencies of an operation that must
+	// have been recorded before its requests are hedged so that a handful of fast (or slow)
+	// invocations can't skew the threshold.
+	hedgeMinLatencySamples = 16
+	// hedgeMaxTrackedOperations bounds the number of operations whose latencies are tracked
+	// since the operation names are chosen by the callers. The least recently used ones are
+	// evicted first.
+	hedgeMaxTrackedOperations = 1024
+)
+
+// retryClass classifies invocation errors by how they should be retried (see
+// types.RetryPolicy).
+type retryClass int
+
+const (
+	// retryClassFatal errors are returned immediately because retrying can't fix them.
+	retryClassFatal retryClass = iota
+	// retryClassReplica errors (which may have been returned by the actor itself) are only
+	// retried against the replicas that have not been tried yet.
+	retryClassReplica
+	// retryClassTransient errors are retried against the replicas that have not been tried
+	// yet, and then against the activations that are re-resolved from the activation cache.
+	retryClassTransient
+	// retryClassStale errors indicate that the references are stale, so the activation
+	// cache is invalidated before the activations are re-resolved through the registry.
+	retryClassStale
+)
+
+func (c retryClass) String() string {
+	switch c {
+	case retryClassFatal:
+		return "fatal"
+	case retryClassReplica:
+		return "replica"
+	case retryClassTransient:
+		return "transient"
+	case retryClassStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// classifyInvocationError classifies the error returned by an invocation attempt made with
+// a context derived from ctx.
+func classifyInvocationError(ctx context.Context, err error) retryClass {
+	switch {
+	case ctx.Err() != nil:
+		// The caller is no longer waiting for the result.
+		return retryClassFatal
+	case IsDeadlockError(err),
+		IsIdempotencyKeyMismatchError(err),
+		IsUnauthenticatedError(err),
+		IsPermissionDeniedError(err),
+		registry.IsNamespaceLimitExceededError(err):
+		return retryClassFatal
+	case IsStaleActivationError(err),
+		errors.Is(err, ErrEnvironmentClosed),
+		errors.Is(err, errRPCConnClosed),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		// The server is unreachable, shutting down or no longer hosts the activation, so
+		// the activation may have moved somewhere else.
+		return retryClassStale
+	case IsMailboxFullError(err),
+		errors.Is(err, context.DeadlineExceeded):
+		// The actor is overloaded or the attempt timed out (since the caller's context is
+		// not done), so it may succeed if it's retried a little later.
+		return retryClassTransient
+	default:
+		return retryClassReplica
+	}
+}
+
+// retryBackoff returns how long to wait before the retryAttempt'th retry (starting at 1).
+func (r *environment) retryBackoff(policy types.RetryPolicy, retryAttempt uint) time.Duration {
+	r.randState.Lock()
+	jitter := r.randState.rng.Float64()
+	r.randState.Unlock()
+	return jitteredBackoff(policy, retryAttempt, jitter)
+}
+
+// jitteredBackoff doubles the policy's initial backoff for every retry after the first one
+// (up to its max backoff) and then jitters it to somewhere between half of the backoff and
+// the full backoff depending on jitter, which must be in [0, 1).
+func jitteredBackoff(policy types.RetryPolicy, retryAttempt uint, jitter float64) time.Duration {
+	initial, max := policy.Backoffs()
+	backoff := initial
+	for i := uint(1); i < retryAttempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff/2 + time.Duration(jitter*float64(backoff/2))
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// invokeReferencesWithHedging invokes the specified operation on the given references like
+// invokeReferences, except that if RetryPolicy.HedgeAfterPercentile is set and more than one
+// reference is available, the request is also sent to a second reference once the first
+// one has taken longer than the configured percentile of the operation's recent latencies.
+// The first successful response is returned and the other request is canceled.
+//
+// Invocations with an idempotency key are never hedged because each replica remembers the
+// responses of its own invocations, so the key wouldn't prevent the operation from being
+// executed by both of them.
+func (r *environment) invokeReferencesWithHedging(
+	ctx context.Context,
+	versionStamp int64,
+	namespace string,
+	moduleID string,
+	references []types.ActorReference,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, []types.ActorReference, error) {
+	percentile := create.Options.RetryPolicy.HedgeAfterPercentile
+	if percentile <= 0 || idempotencyKeyFromContext(ctx) != "" {
+		return r.invokeReferences(ctx, versionStamp, references, operation, payload, create)
+	}
+
+	var (
+		key            = latencyKey{namespace: namespace, moduleID: moduleID, operation: operation}
+		hedgeAfter, ok = r.latencies.percentile(key, percentile)
+	)
+	if !ok || len(references) < 2 {
+		start := time.Now()
+		resp, selected, err := r.invokeReferences(
+			ctx, versionStamp, references, operation, payload, create)
+		if err == nil {
+			r.latencies.record(key, time.Since(start))
+		}
+		return resp, selected, err
+	}
+
+	selected, err := r.pickServerForInvocation(references, create)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error picking server for activation: %w", err)
+	}
+	hedge, err := r.pickServerForInvocation(filterReferences(references, selected), create)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error picking server for hedged request: %w", err)
+	}
+
+	type hedgedResult struct {
+		ref     types.ActorReference
+		resp    io.ReadCloser
+		err     error
+		latency time.Duration
+	}
+	var (
+		results  = make(chan hedgedResult, 2)
+		cancels  = make(map[types.ActorReference]context.CancelFunc, 2)
+		inflight = 0
+	)
+	invoke := func(ref types.ActorReference) {
+		ctx, cc := context.WithCancel(ctx)
+		cancels[ref] = cc
+		inflight++
+
+		start := time.Now()
+		go func() {
+			resp, err := r.invokeSingleReference(ctx, versionStamp, ref, operation, payload, create)
+			results <- hedgedResult{ref: ref, resp: resp, err: err, latency: time.Since(start)}
+		}()
+	}
+	invoke(selected[0])
+
+	timer := time.NewTimer(hedgeAfter)
+	defer timer.Stop()
+
+	var errs []error
+	for {
+		select {
+		case <-timer.C:
+			selected = append(selected, hedge[0])
+			invoke(hedge[0])
+			r.metrics.hedgedRequests.Inc()
+		case result := <-results:
+			inflight--
+			if result.err != nil {
+				cancels[result.ref]()
+				errs = append(errs, result.err)
+				if inflight > 0 {
+					// Wait for the hedged request.
+					continue
+				}
+				// Don't hedge if the first request failed before the hedging threshold so
+				// that the error is subject to the usual retry policy instead.
+				return nil, selected, errors.Join(errs...)
+			}
+
+			r.latencies.record(key, result.latency)
+			if len(selected) > 1 {
+				winner := "primary"
+				if result.ref == hedge[0] {
+					winner = "hedge"
+				}
+				r.metrics.hedgedRequestWins.Inc(winner)
+			}
+
+			// Cancel the request that lost and clean up its response in case it succeeded
+			// before it was canceled.
+			for ref, cc := range cancels {
+				if ref != result.ref {
+					cc()
+				}
+			}
+			go func(inflight int) {
+				for ; inflight > 0; inflight-- {
+					if loser := <-results; loser.err == nil {
+						loser.resp.Close()
+					}
+				}
+			}(inflight)
+
+			return newCtxReaderCloser(cancels[result.ref], result.resp), selected, nil
+		}
+	}
+}
+
+// latencyKey identifies an operation of a module whose latencies are tracked.
+type latencyKey struct {
+	namespace string
+	moduleID  string
+	operation string
+}
+
+// latencyTracker tracks the recent latencies of invocations so that the latency percentile
+// after which requests are hedged can be computed. At most maxKeys operations are tracked,
+// the least recently used ones are evicted once there are more.
+type latencyTracker struct {
+	sync.Mutex
+
+	maxKeys int
+	windows map[latencyKey]*list.Element
+	// byUse contains *latencyWindow ordered from least to most recently used.
+	byUse *list.List
+}
+
+// latencyWindow is a ring buffer of the most recent latencies of an operation.
+type latencyWindow struct {
+	key     latencyKey
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyTracker(maxKeys int) *latencyTracker {
+	return &latencyTracker{
+		maxKeys: maxKeys,
+		windows: make(map[latencyKey]*list.Element),
+		byUse:   list.New(),
+	}
+}
+
+func (t *latencyTracker) record(key latencyKey, latency time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	var w *latencyWindow
+	if elem, ok := t.windows[key]; ok {
+		t.byUse.MoveToBack(elem)
+		w = elem.Value.(*latencyWindow)
+	} else {
+		w = &latencyWindow{key: key, samples: make([]time.Duration, 0, hedgeLatencyWindowSize)}
+		t.windows[key] = t.byUse.PushBack(w)
+		for t.byUse.Len() > t.maxKeys {
+			evicted := t.byUse.Remove(t.byUse.Front()).(*latencyWindow)
+			delete(t.windows, evicted.key)
+		}
+	}
+	if len(w.samples) < hedgeLatencyWindowSize {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % hedgeLatencyWindowSize
+}
+
+// percentile returns the p (between 0 and 1) percentile of the recent latencies of the
+// operation, or false if not enough latencies have been recorded yet.
+func (t *latencyTracker) percentile(key latencyKey, p float64) (time.Duration, bool) {
+	t.Lock()
+	elem, ok := t.windows[key]
+	if !ok {
+		t.Unlock()
+		return 0, false
+	}
+	t.byUse.MoveToBack(elem)
+	w := elem.Value.(*latencyWindow)
+	if len(w.samples) < hedgeMinLatencySamples {
+		t.Unlock()
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), w.samples...)
+	t.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx], true
+}
@@ -0,0 +1,189 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJitteredBackoff(t *testing.T) {
+	policy := types.RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+	for _, tc := range []struct {
+		retryAttempt uint
+		expected     time.Duration
+	}{
+		{retryAttempt: 1, expected: 10 * time.Millisecond},
+		{retryAttempt: 2, expected: 20 * time.Millisecond},
+		{retryAttempt: 3, expected: 40 * time.Millisecond},
+		{retryAttempt: 4, expected: 50 * time.Millisecond},
+		{retryAttempt: 100, expected: 50 * time.Millisecond},
+	} {
+		require.Equal(t, tc.expected/2, jitteredBackoff(policy, tc.retryAttempt, 0))
+		require.InDelta(t, tc.expected, jitteredBackoff(policy, tc.retryAttempt, 0.999999999), 1)
+	}
+
+	// The defaults are used if the backoffs are not set.
+	require.Equal(t, types.DefaultRetryInitialBackoff/2, jitteredBackoff(types.RetryPolicy{}, 1, 0))
+	require.Equal(t, types.DefaultRetryMaxBackoff/2, jitteredBackoff(types.RetryPolicy{}, 100, 0))
+}
+
+func TestClassifyInvocationError(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		err      error
+		expected retryClass
+	}{
+		{err: errors.New("actor error"), expected: retryClassReplica},
+		{err: NewDeadlockError(errors.New("deadlock")), expected: retryClassFatal},
+		{err: NewIdempotencyKeyMismatchError(errors.New("mismatch")), expected: retryClassFatal},
+		{err: registry.NewNamespaceLimitExceededError(errors.New("limit")), expected: retryClassFatal},
+		{err: NewMailboxFullError(errors.New("full")), expected: retryClassTransient},
+		{err: context.DeadlineExceeded, expected: retryClassTransient},
+		{err: NewStaleActivationError(errors.New("stale")), expected: retryClassStale},
+		{err: fmt.Errorf("%w: closed", errRPCConnClosed), expected: retryClassStale},
+		{err: fmt.Errorf("error dialing: %w", syscall.ECONNREFUSED), expected: retryClassStale},
+		{err: fmt.Errorf("error running request: %w", io.EOF), expected: retryClassStale},
+	} {
+		require.Equal(t, tc.expected, classifyInvocationError(ctx, tc.err), tc.err.Error())
+	}
+
+	// Nothing is retried once the caller's context is done.
+	canceled, cc := context.WithCancel(ctx)
+	cc()
+	require.Equal(t, retryClassFatal, classifyInvocationError(
+		canceled, NewStaleActivationError(errors.New("stale"))))
+}
+
+func TestLatencyTracker(t *testing.T) {
+	var (
+		tracker = newLatencyTracker(2)
+		key     = latencyKey{namespace: "ns-1", moduleID: "test-module", operation: "inc"}
+	)
+	for i := 1; i < hedgeMinLatencySamples; i++ {
+		tracker.record(key, time.Duration(i)*time.Millisecond)
+	}
+	_, ok := tracker.percentile(key, 0.5)
+	require.False(t, ok)
+
+	for i := hedgeMinLatencySamples; i <= 100; i++ {
+		tracker.record(key, time.Duration(i)*time.Millisecond)
+	}
+	p50, ok := tracker.percentile(key, 0.5)
+	require.True(t, ok)
+	require.Equal(t, 50*time.Millisecond, p50)
+	p99, _ := tracker.percentile(key, 0.99)
+	require.Equal(t, 99*time.Millisecond, p99)
+
+	// Only the most recent latencies are used.
+	for i := 0; i < hedgeLatencyWindowSize; i++ {
+		tracker.record(key, time.Second)
+	}
+	p50, _ = tracker.percentile(key, 0.5)
+	require.Equal(t, time.Second, p50)
+
+	_, ok = tracker.percentile(latencyKey{namespace: "ns-1"}, 0.5)
+	require.False(t, ok)
+
+	// The least recently used operations are evicted once too many are tracked.
+	var (
+		other  = latencyKey{namespace: "ns-1", moduleID: "test-module", operation: "other"}
+		other2 = latencyKey{namespace: "ns-1", moduleID: "test-module", operation: "other2"}
+	)
+	tracker.record(other, time.Millisecond)
+	_, ok = tracker.percentile(key, 0.5)
+	require.True(t, ok)
+	tracker.record(other2, time.Millisecond)
+	_, ok = tracker.percentile(key, 0.5)
+	require.True(t, ok)
+	require.Equal(t, 2, len(tracker.windows))
+	_, ok = tracker.windows[other]
+	require.False(t, ok)
+}
+
+// TestHedgedRequests ensures that invocations of actors with replicas are hedged to a
+// different replica once they take longer than the configured latency percentile, and that
+// the response of whichever replica responds first is returned.
+func TestHedgedRequests(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		slow        atomic.Bool
+	)
+	defer reg.Close(ctx)
+
+	newEnv := func(serverID string, port int, delay time.Duration) Environment {
+		opts := defaultOptsGoByte
+		opts.Discovery.Port = port
+		opts.CustomHostFns = map[string]func([]byte) ([]byte, error){
+			"whoami": func([]byte) ([]byte, error) {
+				if slow.Load() {
+					time.Sleep(delay)
+				}
+				return []byte(serverID), nil
+			},
+		}
+		env, err := NewEnvironment(ctx, serverID, reg, moduleStore, nil, opts)
+		require.NoError(t, err)
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+		return env
+	}
+	env1 := newEnv("serverID1", 1, time.Second)
+	defer env1.Close(ctx)
+	env2 := newEnv("serverID2", 2, 0)
+	defer env2.Close(ctx)
+
+	create := types.CreateIfNotExist{Options: types.ActorOptions{
+		ExtraReplicas: 1,
+		RetryPolicy:   types.RetryPolicy{HedgeAfterPercentile: 0.5},
+	}}
+	invoke := func() string {
+		result, err := env1.InvokeActor(
+			ctx, "ns-1", "a", "test-module", "invokeCustomHostFn", []byte("whoami"), create)
+		require.NoError(t, err)
+		return string(result)
+	}
+
+	// Both replicas respond quickly so the latency threshold for hedging is very low.
+	for i := 0; i < 2*hedgeMinLatencySamples; i++ {
+		invoke()
+	}
+
+	// Once one of the replicas becomes slow, the requests sent to it are hedged to the other
+	// replica so every invocation is answered by the fast one well before the slow one.
+	slow.Store(true)
+	hedgedRequests := env1.(*environment).metrics.hedgedRequests
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		require.Equal(t, "serverID2", invoke())
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+	}
+	require.Greater(t, hedgedRequests.Value(), float64(0))
+
+	// Invocations with an idempotency key are never hedged since the other replica doesn't
+	// know about the responses of the first one.
+	numHedged := hedgedRequests.Value()
+	for i := 0; i < 4; i++ {
+		result, err := env1.InvokeActor(
+			WithIdempotencyKey(ctx, fmt.Sprintf("key-%d", i)),
+			"ns-1", "a", "test-module", "invokeCustomHostFn", []byte("whoami"), create)
+		require.NoError(t, err)
+		require.Contains(t, []string{"serverID1", "serverID2"}, string(result))
+	}
+	require.Equal(t, numHedged, hedgedRequests.Value())
+}
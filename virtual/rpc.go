@@ -0,0 +1,300 @@
+package virtual
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// The binary RPC protocol is an alternative to the HTTP/JSON protocol that is used for
+// server-to-server invocations. Clients establish a small number of persistent TCP
+// connections to each server and multiplex many concurrent invocations over each of them.
+//
+// Immediately after connecting, the client writes rpcPreface so that the server can
+// distinguish RPC connections from HTTP connections (both are served on the same port).
+// When TLS is enabled, RPC connections are identified by negotiating rpcALPNProtocol
+// during the handshake instead, but the preface is still sent. The preface is followed
+// by the client's peer token (see ServerOptions.PeerToken) as a length-prefixed string.
+// After that, both sides exchange frames which have the following format:
+//
+//	[uint32 body length][uint64 stream ID][uint8 frame type][body]
+//
+// Every invocation is assigned a unique stream ID by the client (per connection) which is
+// echoed back by the server in the corresponding response frame so that responses can be
+// delivered out of order.
+const (
+	rpcPreface         = "NOLARPC2"
+	rpcFrameHeaderSize = 4 + 8 + 1
+	// rpcMaxPeerTokenSize is the maximum size of the peer token that follows the preface.
+	rpcMaxPeerTokenSize = 1 << 10
+
+	// DefaultRPCMaxFrameSize is the default maximum size of a single frame (and thus the
+	// maximum size of an invocation's request or response) in the binary RPC protocol.
+	// Frames are buffered in memory in their entirety, so it's bounded, but it matches the
+	// limit on the size of the requests that the HTTP endpoints accept so that switching
+	// a cluster from the HTTP client to the RPC client doesn't break invocations.
+	DefaultRPCMaxFrameSize = 1 << 24
+
+	// rpcFrameTypeInvoke is sent by the client to start an invocation. Its body is an
+	// encoded rpcInvokeRequest.
+	rpcFrameTypeInvoke byte = 1
+	// rpcFrameTypeCancel is sent by the client to cancel an in-flight invocation (because
+	// the caller's context was canceled). Its body is empty.
+	rpcFrameTypeCancel byte = 2
+	// rpcFrameTypeResult is sent by the server when an invocation succeeds. Its body is the
+	// invocation's response.
+	rpcFrameTypeResult byte = 3
+	// rpcFrameTypeError is sent by the server when an invocation fails. Its body is the
+	// uvarint encoded status code of the error (see HTTPError) followed by the error message.
+	rpcFrameTypeError byte = 4
+)
+
+var errRPCFrameTruncated = errors.New("rpc frame truncated")
+
+// rpcInvokeRequest is the binary equivalent of invokeActorDirectRequest.
+type rpcInvokeRequest struct {
+	// Timeout is the remaining time until the caller's deadline, if any. The server uses
+	// DefaultHTTPRequestTimeout if it is zero just like it does for HTTP requests without
+	// a timeout header.
+	Timeout          time.Duration
+	VersionStamp     int64
+	ServerID         string
+	ServerVersion    int64
+	Reference        types.ActorReferenceVirtual
+	Operation        string
+	CreateIfNotExist types.CreateIfNotExist
+	// CallChain is the call chain that the invocation is part of. Its ID is empty if the
+	// invocation is not part of a call chain.
+	CallChain callChain
+	// IdempotencyKey is the invocation's idempotency key, if any.
+	IdempotencyKey string
+	// TraceParent and TraceState are the W3C Trace Context of the caller's span, if any.
+	TraceParent string
+	TraceState  string
+	Payload     []byte
+}
+
+func encodeRPCInvokeRequest(buf []byte, req rpcInvokeRequest) []byte {
+	buf = binary.AppendVarint(buf, int64(req.Timeout))
+	buf = binary.AppendVarint(buf, req.VersionStamp)
+	buf = appendRPCString(buf, req.ServerID)
+	buf = binary.AppendVarint(buf, req.ServerVersion)
+	buf = appendRPCString(buf, req.Reference.Namespace)
+	buf = appendRPCString(buf, req.Reference.ModuleID)
+	buf = appendRPCString(buf, req.Reference.ActorID)
+	buf = binary.AppendUvarint(buf, req.Reference.Generation)
+	buf = appendRPCString(buf, req.Operation)
+
+	opts := req.CreateIfNotExist.Options
+	buf = binary.AppendUvarint(buf, opts.ExtraReplicas)
+	buf = appendRPCString(buf, string(opts.ReplicationStrategy))
+	buf = binary.AppendVarint(buf, int64(opts.RetryPolicy.PerAttemptTimeout))
+	buf = binary.AppendUvarint(buf, uint64(opts.RetryPolicy.MaxNumRetries))
+	buf = binary.AppendVarint(buf, int64(opts.RetryPolicy.InitialBackoff))
+	buf = binary.AppendVarint(buf, int64(opts.RetryPolicy.MaxBackoff))
+	buf = binary.AppendUvarint(buf, math.Float64bits(opts.RetryPolicy.HedgeAfterPercentile))
+	buf = appendRPCBytes(buf, req.CreateIfNotExist.InstantiatePayload)
+
+	buf = appendRPCString(buf, req.CallChain.ID)
+	buf = binary.AppendUvarint(buf, uint64(len(req.CallChain.Actors)))
+	for _, actor := range req.CallChain.Actors {
+		buf = appendRPCString(buf, actor.Namespace)
+		buf = appendRPCString(buf, actor.Module)
+		buf = appendRPCString(buf, actor.ID)
+		buf = appendRPCString(buf, actor.IDType)
+	}
+	buf = appendRPCString(buf, req.IdempotencyKey)
+	buf = appendRPCString(buf, req.TraceParent)
+	buf = appendRPCString(buf, req.TraceState)
+
+	// The payload is last so it doesn't need to be length-prefixed.
+	return append(buf, req.Payload...)
+}
+
+func decodeRPCInvokeRequest(b []byte) (rpcInvokeRequest, error) {
+	var (
+		d   = rpcDecoder{b: b}
+		req rpcInvokeRequest
+	)
+	req.Timeout = time.Duration(d.varint())
+	req.VersionStamp = d.varint()
+	req.ServerID = d.string()
+	req.ServerVersion = d.varint()
+	var (
+		namespace  = d.string()
+		moduleID   = d.string()
+		actorID    = d.string()
+		generation = d.uvarint()
+	)
+	req.Operation = d.string()
+
+	opts := &req.CreateIfNotExist.Options
+	opts.ExtraReplicas = d.uvarint()
+	opts.ReplicationStrategy = types.ReplicaSelectionStrategy(d.string())
+	opts.RetryPolicy.PerAttemptTimeout = time.Duration(d.varint())
+	opts.RetryPolicy.MaxNumRetries = uint(d.uvarint())
+	opts.RetryPolicy.InitialBackoff = time.Duration(d.varint())
+	opts.RetryPolicy.MaxBackoff = time.Duration(d.varint())
+	opts.RetryPolicy.HedgeAfterPercentile = math.Float64frombits(d.uvarint())
+	req.CreateIfNotExist.InstantiatePayload = d.bytes()
+
+	req.CallChain.ID = d.string()
+	numActors := d.uvarint()
+	if numActors > uint64(len(d.b)) {
+		// Every actor takes at least one byte so this can only happen if the request is
+		// corrupt, make sure it can't trigger a huge allocation.
+		return rpcInvokeRequest{}, errRPCFrameTruncated
+	}
+	for i := uint64(0); i < numActors && d.err == nil; i++ {
+		var actor types.NamespacedActorID
+		actor.Namespace = d.string()
+		actor.Module = d.string()
+		actor.ID = d.string()
+		actor.IDType = d.string()
+		req.CallChain.Actors = append(req.CallChain.Actors, actor)
+	}
+	req.IdempotencyKey = d.string()
+	req.TraceParent = d.string()
+	req.TraceState = d.string()
+	req.Payload = d.rest()
+	if d.err != nil {
+		return rpcInvokeRequest{}, d.err
+	}
+
+	ref, err := types.NewVirtualActorReference(namespace, moduleID, actorID, generation)
+	if err != nil {
+		return rpcInvokeRequest{}, err
+	}
+	req.Reference = ref
+	return req, nil
+}
+
+func encodeRPCError(buf []byte, err error) []byte {
+	buf = binary.AppendUvarint(buf, uint64(statusCodeForError(err)))
+	return append(buf, err.Error()...)
+}
+
+func decodeRPCError(b []byte) (statusCode int, msg string, err error) {
+	d := rpcDecoder{b: b}
+	statusCode = int(d.uvarint())
+	msg = string(d.rest())
+	return statusCode, msg, d.err
+}
+
+func appendRPCString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendRPCBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// rpcDecoder decodes the fields of a frame body. The first error encountered is sticky
+// and all subsequent reads return zero values.
+type rpcDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *rpcDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errRPCFrameTruncated
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *rpcDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errRPCFrameTruncated
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *rpcDecoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.b)) < l {
+		d.err = errRPCFrameTruncated
+		return nil
+	}
+	if l == 0 {
+		return nil
+	}
+	v := d.b[:l:l]
+	d.b = d.b[l:]
+	return v
+}
+
+func (d *rpcDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *rpcDecoder) rest() []byte {
+	if d.err != nil || len(d.b) == 0 {
+		return nil
+	}
+	v := d.b
+	d.b = nil
+	return v
+}
+
+// writeRPCFrame writes a single frame to w, but does not flush it.
+func writeRPCFrame(w *bufio.Writer, streamID uint64, frameType byte, body []byte) error {
+	var header [rpcFrameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint64(header[4:12], streamID)
+	header[12] = frameType
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// readRPCFrame reads a single frame from r. The returned body is always a newly
+// allocated slice so it is safe to retain.
+func readRPCFrame(
+	r *bufio.Reader,
+	maxFrameSize int,
+) (streamID uint64, frameType byte, body []byte, err error) {
+	var header [rpcFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	streamID = binary.BigEndian.Uint64(header[4:12])
+	frameType = header[12]
+	if int64(length) > int64(maxFrameSize) {
+		return 0, 0, nil, fmt.Errorf(
+			"rpc frame of size: %d exceeds max frame size: %d", length, maxFrameSize)
+	}
+
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return streamID, frameType, body, nil
+}
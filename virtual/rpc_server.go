@@ -0,0 +1,394 @@
+package virtual
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+// rpcPrefaceTimeout is the maximum amount of time the server will wait for a newly
+// accepted connection to send enough bytes to determine whether it is an RPC or an
+// HTTP connection.
+const rpcPrefaceTimeout = 10 * time.Second
+
+// rpcServer serves connections that use the binary RPC protocol by dispatching the
+// invocations to the environment.
+type rpcServer struct {
+	sync.Mutex
+
+	environment  Environment
+	maxFrameSize int
+	// peerToken is the token that clients must present after the preface, if any.
+	peerToken string
+	log       *slog.Logger
+
+	_conns  map[net.Conn]struct{}
+	_closed bool
+	wg      sync.WaitGroup
+}
+
+func newRPCServer(environment Environment, maxFrameSize int, peerToken string) *rpcServer {
+	return &rpcServer{
+		environment:  environment,
+		maxFrameSize: maxFrameSize,
+		peerToken:    peerToken,
+		log:          slog.Default().With(slog.String("module", "rpcServer")),
+		_conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// serveConn serves the RPC connection until it is closed. r must wrap conn and have
+// already consumed the preface.
+func (s *rpcServer) serveConn(conn net.Conn, r *bufio.Reader) {
+	if err := s.verifyPeerToken(conn, r); err != nil {
+		s.log.Warn(
+			"rejecting rpc connection",
+			slog.String("remote_addr", conn.RemoteAddr().String()),
+			slog.Any("error", err))
+		conn.Close()
+		return
+	}
+
+	s.Lock()
+	if s._closed {
+		s.Unlock()
+		conn.Close()
+		return
+	}
+	s._conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.Unlock()
+
+	sc := &rpcServerConn{
+		s:        s,
+		conn:     conn,
+		w:        bufio.NewWriterSize(conn, rpcBufferSize),
+		_cancels: make(map[uint64]context.CancelFunc),
+	}
+	defer func() {
+		conn.Close()
+		sc.cancelAll()
+		sc.inflight.Wait()
+
+		s.Lock()
+		delete(s._conns, conn)
+		s.Unlock()
+		s.wg.Done()
+	}()
+
+	for {
+		streamID, frameType, body, err := readRPCFrame(r, s.maxFrameSize)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.log.Warn(
+					"error reading rpc frame, closing connection",
+					slog.String("remote_addr", conn.RemoteAddr().String()),
+					slog.Any("error", err))
+			}
+			return
+		}
+
+		switch frameType {
+		case rpcFrameTypeInvoke:
+			sc.invoke(streamID, body)
+		case rpcFrameTypeCancel:
+			sc.cancel(streamID)
+		default:
+			s.log.Warn(
+				"received unexpected rpc frame type, closing connection",
+				slog.String("remote_addr", conn.RemoteAddr().String()),
+				slog.Int("frame_type", int(frameType)))
+			return
+		}
+	}
+}
+
+// verifyPeerToken reads the peer token that the client sends after the preface and returns
+// an error if it doesn't match the server's peer token (if the server requires one).
+func (s *rpcServer) verifyPeerToken(conn net.Conn, r *bufio.Reader) error {
+	conn.SetReadDeadline(time.Now().Add(rpcPrefaceTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("error reading peer token: %w", err)
+	}
+	if size > rpcMaxPeerTokenSize {
+		return fmt.Errorf("peer token size: %d exceeds maximum: %d", size, rpcMaxPeerTokenSize)
+	}
+	token := make([]byte, size)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return fmt.Errorf("error reading peer token: %w", err)
+	}
+	if !peerTokenMatches(s.peerToken, string(token)) {
+		return errors.New("invalid peer token")
+	}
+	return nil
+}
+
+// serveTLSConn serves an RPC connection that negotiated rpcALPNProtocol during the TLS
+// handshake. The RPC protocol is only used for server-to-server communication so the
+// client must have presented a verified client certificate.
+func (s *rpcServer) serveTLSConn(conn *tls.Conn) {
+	state := conn.ConnectionState()
+	if !hasVerifiedClientCert(&state) {
+		s.log.Warn(
+			"rejecting rpc connection without a verified client certificate",
+			slog.String("remote_addr", conn.RemoteAddr().String()))
+		conn.Close()
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(rpcPrefaceTimeout))
+	preface, err := r.Peek(len(rpcPreface))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || string(preface) != rpcPreface {
+		conn.Close()
+		return
+	}
+	r.Discard(len(rpcPreface))
+	s.serveConn(conn, r)
+}
+
+// close closes all of the RPC connections and waits for their in-flight invocations to
+// complete (or be canceled).
+func (s *rpcServer) close(ctx context.Context) error {
+	s.Lock()
+	s._closed = true
+	for conn := range s._conns {
+		conn.Close()
+	}
+	s.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type rpcServerConn struct {
+	sync.Mutex
+
+	s    *rpcServer
+	conn net.Conn
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+
+	inflight sync.WaitGroup
+	_cancels map[uint64]context.CancelFunc
+}
+
+func (c *rpcServerConn) invoke(streamID uint64, body []byte) {
+	req, err := decodeRPCInvokeRequest(body)
+	if err != nil {
+		c.writeError(streamID, fmt.Errorf("error decoding rpc invoke request: %w", err))
+		return
+	}
+
+	timeout := DefaultHTTPRequestTimeout
+	if req.Timeout > 0 {
+		timeout = req.Timeout
+	}
+	ctx, cc := context.WithTimeout(context.Background(), timeout)
+	if req.CallChain.ID != "" {
+		ctx = withCallChain(ctx, req.CallChain)
+	}
+	if req.IdempotencyKey != "" {
+		ctx = WithIdempotencyKey(ctx, req.IdempotencyKey)
+	}
+	if sc, err := tracing.ParseTraceParent(req.TraceParent); err == nil {
+		sc.TraceState = req.TraceState
+		ctx = tracing.ContextWithRemoteSpanContext(ctx, sc)
+	}
+
+	c.Lock()
+	c._cancels[streamID] = cc
+	c.Unlock()
+
+	c.inflight.Add(1)
+	go func() {
+		defer c.inflight.Done()
+		defer c.cancel(streamID)
+
+		result, err := c.s.environment.InvokeActorDirectStream(
+			ctx, req.VersionStamp, req.ServerID, req.ServerVersion, req.Reference,
+			req.Operation, req.Payload, req.CreateIfNotExist)
+		if err != nil {
+			c.writeError(streamID, err)
+			return
+		}
+		defer result.Close()
+
+		// Unlike the HTTP server the response is buffered entirely before it is sent so
+		// that errors encountered while reading the stream can be returned to the caller
+		// instead of having to terminate the (shared) connection.
+		var buf bytes.Buffer
+		n, err := buf.ReadFrom(io.LimitReader(result, int64(c.s.maxFrameSize)+1))
+		if err != nil {
+			c.writeError(streamID, fmt.Errorf("error reading actor response from stream: %w", err))
+			return
+		}
+		if n > int64(c.s.maxFrameSize) {
+			c.writeError(streamID, fmt.Errorf(
+				"actor response exceeds max rpc frame size: %d", c.s.maxFrameSize))
+			return
+		}
+		c.writeFrame(streamID, rpcFrameTypeResult, buf.Bytes())
+	}()
+}
+
+func (c *rpcServerConn) cancel(streamID uint64) {
+	c.Lock()
+	cc, ok := c._cancels[streamID]
+	delete(c._cancels, streamID)
+	c.Unlock()
+	if ok {
+		cc()
+	}
+}
+
+func (c *rpcServerConn) cancelAll() {
+	c.Lock()
+	defer c.Unlock()
+	for streamID, cc := range c._cancels {
+		cc()
+		delete(c._cancels, streamID)
+	}
+}
+
+func (c *rpcServerConn) writeError(streamID uint64, err error) {
+	c.writeFrame(streamID, rpcFrameTypeError, encodeRPCError(nil, err))
+}
+
+func (c *rpcServerConn) writeFrame(streamID uint64, frameType byte, body []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err := writeRPCFrame(c.w, streamID, frameType, body)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		// Closing the connection will cause the read loop to exit and the client to
+		// fail all of its in-flight invocations on this connection.
+		c.conn.Close()
+	}
+}
+
+// rpcMuxListener wraps a net.Listener and hands off connections that begin with the
+// RPC preface to the rpcServer. All other connections are returned from Accept so that
+// they can be served by the HTTP server.
+type rpcMuxListener struct {
+	net.Listener
+
+	rpc   *rpcServer
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	acceptErr error
+}
+
+func newRPCMuxListener(l net.Listener, rpc *rpcServer) *rpcMuxListener {
+	ml := &rpcMuxListener{
+		Listener: l,
+		rpc:      rpc,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go ml.acceptLoop()
+	return ml
+}
+
+func (l *rpcMuxListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.close(err)
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+func (l *rpcMuxListener) route(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(rpcPrefaceTimeout))
+	preface, err := r.Peek(len(rpcPreface))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if string(preface) == rpcPreface {
+		r.Discard(len(rpcPreface))
+		l.rpc.serveConn(conn, r)
+		return
+	}
+
+	select {
+	case l.conns <- &bufferedConn{Conn: conn, r: r}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *rpcMuxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		if l.acceptErr != nil {
+			return nil, l.acceptErr
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *rpcMuxListener) Close() error {
+	return l.close(nil)
+}
+
+func (l *rpcMuxListener) close(acceptErr error) error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.acceptErr = acceptErr
+		err = l.Listener.Close()
+		close(l.closed)
+	})
+	return err
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader that may already
+// contain some of the connection's data.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
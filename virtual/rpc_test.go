@@ -0,0 +1,302 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRPCInvokeRequestEncoding(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns", "module", "actor", 3)
+	require.NoError(t, err)
+
+	req := rpcInvokeRequest{
+		Timeout:       time.Second,
+		VersionStamp:  123,
+		ServerID:      "server1",
+		ServerVersion: 4,
+		Reference:     ref,
+		Operation:     "inc",
+		CreateIfNotExist: types.CreateIfNotExist{
+			Options: types.ActorOptions{
+				ExtraReplicas:       1,
+				ReplicationStrategy: types.ReplicaSelectionStrategySorted,
+				RetryPolicy: types.RetryPolicy{
+					PerAttemptTimeout:    time.Millisecond,
+					MaxNumRetries:        2,
+					InitialBackoff:       time.Millisecond,
+					MaxBackoff:           time.Second,
+					HedgeAfterPercentile: 0.9,
+				},
+			},
+			InstantiatePayload: []byte("instantiate"),
+		},
+		CallChain: callChain{
+			ID: "chain",
+			Actors: []types.NamespacedActorID{
+				types.NewNamespacedActorID("ns", "a", "module", types.IDTypeActor),
+				types.NewNamespacedActorID("ns", "b", "module", types.IDTypeActor),
+			},
+		},
+		IdempotencyKey: "key",
+		TraceParent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceState:     "vendor=value",
+		Payload:        []byte("payload"),
+	}
+	encoded := encodeRPCInvokeRequest(nil, req)
+	decoded, err := decodeRPCInvokeRequest(encoded)
+	require.NoError(t, err)
+	require.Equal(t, req, decoded)
+
+	_, err = decodeRPCInvokeRequest(encoded[:10])
+	require.Error(t, err)
+
+	statusCode, msg, err := decodeRPCError(encodeRPCError(
+		nil, NewActorNotOwnedError(fmt.Errorf("not owned"), []string{"server1"})))
+	require.NoError(t, err)
+	require.Equal(t, 421, statusCode)
+	require.Contains(t, msg, "not owned")
+}
+
+// TestRPCClient tests that environments using the RPC client can communicate with each
+// other, and that servers continue to serve HTTP clients on the same port.
+func TestRPCClient(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+	)
+	defer reg.Close(ctx)
+
+	rpcClient, err := NewRPCClient(RPCClientOptions{NumConnsPerHost: 2})
+	require.NoError(t, err)
+	var (
+		rpcEnv  = newTestServerEnvironment(t, reg, moduleStore, "serverID1", rpcClient)
+		httpEnv = newTestServerEnvironment(t, reg, moduleStore, "serverID2", NewHTTPClient())
+	)
+
+	var (
+		numActors      = 20
+		numInvocations = 10
+		wg             sync.WaitGroup
+	)
+	for i := 0; i < numActors; i++ {
+		for j := 0; j < numInvocations; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := rpcEnv.InvokeActor(
+					ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "inc", nil, types.CreateIfNotExist{})
+				require.NoError(t, err)
+			}(i)
+		}
+	}
+	wg.Wait()
+	require.True(t, rpcEnv.NumActivatedActors() > 0)
+	require.True(t, httpEnv.NumActivatedActors() > 0)
+
+	for i := 0; i < numActors; i++ {
+		result, err := httpEnv.InvokeActor(
+			ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "getCount", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(numInvocations), getCount(t, result))
+	}
+
+	// Errors should be propagated to the caller.
+	_, err = rpcEnv.InvokeActor(
+		ctx, "ns-1", "a-0", "test-module", "unknown", nil, types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "unhandled operation: unknown")
+
+	// The server should still validate the server ID and server version.
+	result, err := reg.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		Namespace: "ns-1",
+		ModuleID:  "test-module",
+		ActorID:   "a-0",
+	})
+	require.NoError(t, err)
+	ref := result.References[0]
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+
+	resp, err := rpcClient.InvokeActorRemote(ctx, vs, ref, "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp)
+	require.NoError(t, err)
+	require.Equal(t, int64(numInvocations), getCount(t, b))
+
+	wrongVersion := ref
+	wrongVersion.Physical.ServerVersion++
+	_, err = rpcClient.InvokeActorRemote(ctx, vs, wrongVersion, "getCount", nil, types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "server version")
+
+	wrongServer := ref
+	wrongServer.Physical.ServerID = "some-other-server"
+	_, err = rpcClient.InvokeActorRemote(ctx, vs, wrongServer, "getCount", nil, types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "cannot fullfil")
+
+	// Requests that exceed the max frame size should be rejected without breaking the
+	// connection for the other invocations multiplexed on it.
+	smallClient, err := NewRPCClient(RPCClientOptions{NumConnsPerHost: 1, MaxFrameSize: 1 << 10})
+	require.NoError(t, err)
+	_, err = smallClient.InvokeActorRemote(
+		ctx, vs, ref, "inc", make([]byte, 1<<11), types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "exceeds max frame size")
+	resp, err = smallClient.InvokeActorRemote(ctx, vs, ref, "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(resp)
+	require.NoError(t, err)
+	require.Equal(t, int64(numInvocations), getCount(t, b))
+}
+
+func TestRPCClientDialHonorsContext(t *testing.T) {
+	// Accept TCP connections but never complete the TLS handshake so that dialing hangs
+	// until the DialTimeout.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ca := newTestCA(t)
+	client, err := NewRPCClient(RPCClientOptions{
+		DialTimeout: time.Minute,
+		TLS:         writeTestTLSFiles(t, t.TempDir(), ca.issue(t, 1), ca.certPEM),
+	})
+	require.NoError(t, err)
+
+	ctx, cc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cc()
+	ref, err := types.NewActorReference(
+		"server1", 1, "ns-1", "test-module", "a", 1,
+		types.ServerState{Address: listener.Addr().String()})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = client.InvokeActorRemote(ctx, 1, ref, "inc", nil, types.CreateIfNotExist{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+func BenchmarkRemoteClientHTTP(b *testing.B) {
+	benchmarkRemoteClient(b, NewHTTPClient())
+}
+
+func BenchmarkRemoteClientRPC(b *testing.B) {
+	client, err := NewRPCClient(RPCClientOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkRemoteClient(b, client)
+}
+
+func benchmarkRemoteClient(b *testing.B, client RemoteClient) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		env         = newTestServerEnvironment(b, reg, moduleStore, "serverID1", client)
+	)
+	defer reg.Close(ctx)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			_, err := env.InvokeActor(
+				ctx, "ns-1", fmt.Sprintf("a-%d", i%100), "test-module", "inc", nil, types.CreateIfNotExist{})
+			if err != nil {
+				panic(err)
+			}
+		}
+	})
+}
+
+// newTestServerEnvironment creates a new environment that always invokes actors remotely
+// with the provided client and starts a server for it on a random port.
+func newTestServerEnvironment(
+	t testing.TB,
+	reg registry.Registry,
+	moduleStore registry.ModuleStore,
+	serverID string,
+	client RemoteClient,
+) Environment {
+	return newTestServerEnvironmentWithOptions(t, reg, moduleStore, serverID, client, ServerOptions{})
+}
+
+// newTestServerEnvironmentWithOptions is the same as newTestServerEnvironment, but allows
+// the caller to specify the server's options.
+func newTestServerEnvironmentWithOptions(
+	t testing.TB,
+	reg registry.Registry,
+	moduleStore registry.ModuleStore,
+	serverID string,
+	client RemoteClient,
+	serverOpts ServerOptions,
+) Environment {
+	return newTestServerEnvironmentWithEnvOptions(
+		t, reg, moduleStore, serverID, client, defaultOptsGoByte, serverOpts)
+}
+
+// newTestServerEnvironmentWithEnvOptions is the same as newTestServerEnvironmentWithOptions,
+// but allows the caller to specify the environment's options as well. The environment is
+// always configured to listen on a free port and to force remote procedure calls.
+func newTestServerEnvironmentWithEnvOptions(
+	t testing.TB,
+	reg registry.Registry,
+	moduleStore registry.ModuleStore,
+	serverID string,
+	client RemoteClient,
+	opts EnvironmentOptions,
+	serverOpts ServerOptions,
+) Environment {
+	var (
+		ctx  = context.Background()
+		port = getFreePort(t)
+	)
+	opts.Discovery.Port = port
+	opts.ForceRemoteProcedureCalls = true
+	env, err := NewEnvironment(ctx, serverID, reg, moduleStore, client, opts)
+	require.NoError(t, err)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	server := NewServerWithOptions(moduleStore, env, serverOpts)
+	go server.Start(port)
+	t.Cleanup(func() { server.Stop(context.Background()) })
+
+	// Wait for the server to start.
+	for {
+		conn, err := net.Dial("tcp", net.JoinHostPort(Localhost, strconv.Itoa(port)))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return env
+}
+
+func getFreePort(t testing.TB) int {
+	l, err := net.Listen("tcp", net.JoinHostPort(Localhost, "0"))
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -2,17 +2,22 @@ package virtual
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 )
 
@@ -24,37 +29,144 @@ type Server struct {
 	// Dependencies.
 	moduleStore registry.ModuleStore
 	environment Environment
+	opts        ServerOptions
 
 	server *http.Server
+	rpc    *rpcServer
+}
+
+// ServerOptions contains the options for the Server.
+type ServerOptions struct {
+	// TLS configures the server to only accept TLS connections. When enabled, the
+	// endpoints used for server-to-server communication require clients to present a
+	// verified client certificate (mutual TLS). This should generally match the TLS
+	// options of the environment's RemoteClient.
+	TLS TLSOptions
+
+	// PeerToken is a secret shared by all the servers in the cluster. When set, the
+	// endpoints used for server-to-server communication (the invoke-actor-direct endpoint
+	// and the binary RPC protocol) reject requests that don't present it. The
+	// environment's RemoteClient must be configured with the same token.
+	PeerToken string
+
+	// RPCMaxFrameSize is the maximum size of an invocation's request or response in the
+	// binary RPC protocol. It should match the MaxFrameSize of the clients. Defaults to
+	// DefaultRPCMaxFrameSize.
+	RPCMaxFrameSize int
+
+	// Authenticator authenticates the requests received by the public endpoints. All
+	// requests are allowed if it is nil. The invoke-actor-direct endpoint (and the binary
+	// RPC protocol) are only used by other servers in the cluster so they are never
+	// authenticated with it, instead they are restricted to peers that present a verified
+	// client certificate when TLS is enabled and the PeerToken when one is set. As a
+	// result, an Authenticator can only be set if TLS is enabled or PeerToken is set,
+	// otherwise anyone could bypass it by using the server-to-server endpoints.
+	Authenticator Authenticator
+	// Authorizer grants permissions within namespaces to the principals authenticated by
+	// Authenticator. If nil, all authenticated principals have all permissions. It can
+	// only be set if Authenticator is set as well.
+	Authorizer Authorizer
 }
 
 // NewServer creates a new server for the actor virtual environment.
 func NewServer(
 	moduleStore registry.ModuleStore,
 	environment Environment,
+) *Server {
+	return NewServerWithOptions(moduleStore, environment, ServerOptions{})
+}
+
+// NewServerWithOptions is the same as NewServer, but allows the caller to specify the
+// options.
+func NewServerWithOptions(
+	moduleStore registry.ModuleStore,
+	environment Environment,
+	opts ServerOptions,
 ) *Server {
 	return &Server{
 		moduleStore: moduleStore,
 		environment: environment,
+		opts:        opts,
 	}
 }
 
 // Start starts the server.
 func (s *Server) Start(port int) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/register-module", s.registerModule)
-	mux.HandleFunc("/api/v1/invoke-actor", s.invoke)
-	mux.HandleFunc("/api/v1/invoke-actor-direct", s.invokeDirect)
-	mux.HandleFunc("/api/v1/invoke-worker", s.invokeWorker)
+	var (
+		tlsEnabled    = s.opts.TLS.Enabled()
+		requirePublic = tlsEnabled && s.opts.TLS.RequireClientCertsForPublicEndpoints
+		requireDirect = tlsEnabled
+		mux           = http.NewServeMux()
+	)
+	mux.HandleFunc("/api/v1/register-module",
+		requireClientCert(s.authenticate(s.registerModule), requirePublic))
+	mux.HandleFunc("/api/v1/invoke-actor",
+		requireClientCert(s.authenticate(s.invoke), requirePublic))
+	mux.HandleFunc("/api/v1/invoke-actor-async",
+		requireClientCert(s.authenticate(s.invokeAsync), requirePublic))
+	mux.HandleFunc("/api/v1/invoke-actor-direct",
+		requireClientCert(requirePeerToken(s.invokeDirect, s.opts.PeerToken), requireDirect))
+	mux.HandleFunc("/api/v1/invoke-worker",
+		requireClientCert(s.authenticate(s.invokeWorker), requirePublic))
+	mux.HandleFunc("/api/v1/admin/migrate-actor",
+		requireClientCert(s.authenticate(s.migrateActor), requirePublic))
+	mux.HandleFunc("/metrics",
+		requireClientCert(s.authenticate(s.metrics), requirePublic))
+
+	if s.opts.Authorizer != nil && s.opts.Authenticator == nil {
+		return errors.New("ServerOptions.Authorizer cannot be set without an Authenticator")
+	}
+	if s.opts.Authenticator != nil && !tlsEnabled && s.opts.PeerToken == "" {
+		return errors.New(
+			"ServerOptions.Authenticator cannot be set without TLS or a PeerToken because the server-to-server endpoints would be unauthenticated")
+	}
+
+	var reloader *tlsReloader
+	if tlsEnabled {
+		var err error
+		reloader, err = newTLSReloader(s.opts.TLS)
+		if err != nil {
+			return fmt.Errorf("error loading TLS files: %w", err)
+		}
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	maxFrameSize := s.opts.RPCMaxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultRPCMaxFrameSize
+	}
 
 	s.Lock()
+	s.rpc = newRPCServer(s.environment, maxFrameSize, s.opts.PeerToken)
 	s.server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
+		Addr:    addr,
 		Handler: mux,
 	}
+	if tlsEnabled {
+		// RPC connections are identified by the ALPN protocol they negotiate and then
+		// handed off by the HTTP server.
+		rpc := s.rpc
+		s.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+			rpcALPNProtocol: func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+				rpc.serveTLSConn(conn)
+			},
+		}
+		listener = tls.NewListener(
+			listener, reloader.serverConfig([]string{rpcALPNProtocol, httpALPNProtocol}))
+	} else {
+		// Connections from clients that use the binary RPC protocol (see NewRPCClient) are
+		// served on the same port as HTTP so that servers don't have to advertise a separate
+		// address for them.
+		listener = newRPCMuxListener(listener, s.rpc)
+	}
 	s.Unlock()
 
-	if err := s.server.ListenAndServe(); err != nil {
+	if err := s.server.Serve(listener); err != nil {
 		return err
 	}
 
@@ -67,6 +179,12 @@ func (s *Server) Stop(ctx context.Context) error {
 	if s.server == nil {
 		return nil
 	}
+	// The RPC server is closed first because with TLS enabled, its connections are owned
+	// by the HTTP server which would otherwise wait for them to be closed.
+	if err := s.rpc.close(ctx); err != nil {
+		s.Unlock()
+		return fmt.Errorf("failed to shut down rpc server: %w", err)
+	}
 	if err := s.server.Shutdown(ctx); err != nil {
 		s.Unlock()
 		return fmt.Errorf("failed to shut down http server: %w", err)
@@ -90,7 +208,19 @@ func (s *Server) registerModule(w http.ResponseWriter, r *http.Request) {
 	var (
 		namespace = r.Header.Get("namespace")
 		moduleID  = r.Header.Get("module_id")
+		reentrant = r.Header.Get("reentrant") == "true"
+		// Comma-separated list of the module's read-only operations.
+		readOnlyOperations []string
 	)
+	if header := r.Header.Get("read_only_operations"); header != "" {
+		readOnlyOperations = strings.Split(header, ",")
+	}
+
+	if err := s.authorize(r, namespace, PermissionRegisterModule); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	moduleBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
 	if err != nil {
@@ -99,7 +229,12 @@ func (s *Server) registerModule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := s.moduleStore.RegisterModule(getContextFromRequest(r), namespace, moduleID, moduleBytes, registry.ModuleOptions{})
+	result, err := s.moduleStore.RegisterModule(
+		getContextFromRequest(r), namespace, moduleID, moduleBytes,
+		registry.ModuleOptions{
+			Reentrant:          reentrant,
+			ReadOnlyOperations: readOnlyOperations,
+		})
 	if err != nil {
 		writeStatusCodeForError(w, err)
 		w.Write([]byte(err.Error()))
@@ -146,6 +281,17 @@ func (s *Server) invoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.authorize(r, req.Namespace, PermissionInvoke); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := validateOperation(req.Operation); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	if len(req.Payload) == 0 && req.PayloadJSON != nil {
 		marshaled, err := json.Marshal(req.PayloadJSON)
 		if err != nil {
@@ -156,8 +302,12 @@ func (s *Server) invoke(w http.ResponseWriter, r *http.Request) {
 		req.Payload = marshaled
 	}
 
+	ctx := getContextFromRequest(r)
+	if req.IdempotencyKey != "" {
+		ctx = WithIdempotencyKey(ctx, req.IdempotencyKey)
+	}
 	result, err := s.environment.InvokeActorStream(
-		getContextFromRequest(r), req.Namespace, req.ActorID, req.ModuleID, req.Operation, req.Payload, req.CreateIfNotExist)
+		ctx, req.Namespace, req.ActorID, req.ModuleID, req.Operation, req.Payload, req.CreateIfNotExist)
 	if err != nil {
 		writeStatusCodeForError(w, err)
 		w.Write([]byte(err.Error()))
@@ -167,6 +317,50 @@ func (s *Server) invoke(w http.ResponseWriter, r *http.Request) {
 	copyResultIntoStreamAndCloseResult(w, result)
 }
 
+// invokeAsync durably enqueues the invocation and responds with http.StatusAccepted
+// without waiting for the actor to perform it.
+func (s *Server) invokeAsync(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	if err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req invokeActorRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := s.authorize(r, req.Namespace, PermissionInvoke); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if len(req.Payload) == 0 && req.PayloadJSON != nil {
+		marshaled, err := json.Marshal(req.PayloadJSON)
+		if err != nil {
+			writeStatusCodeForError(w, err)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		req.Payload = marshaled
+	}
+
+	err = s.environment.InvokeActorAsync(
+		getContextFromRequest(r), req.Namespace, req.ActorID, req.ModuleID, req.Operation, req.Payload, req.CreateIfNotExist)
+	if err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
 type invokeActorDirectRequest struct {
 	VersionStamp     int64                  `json:"version_stamp"`
 	ServerID         string                 `json:"server_id"`
@@ -178,6 +372,10 @@ type invokeActorDirectRequest struct {
 	Operation        string                 `json:"operation"`
 	Payload          []byte                 `json:"payload"`
 	CreateIfNotExist types.CreateIfNotExist `json:"create_if_not_exist"`
+	// CallChain is the call chain that the invocation is part of, if any.
+	CallChain *callChain `json:"call_chain,omitempty"`
+	// IdempotencyKey is the invocation's idempotency key, if any.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 func (s *Server) invokeDirect(w http.ResponseWriter, r *http.Request) {
@@ -207,8 +405,15 @@ func (s *Server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := getContextFromRequest(r)
+	if req.CallChain != nil {
+		ctx = withCallChain(ctx, *req.CallChain)
+	}
+	if req.IdempotencyKey != "" {
+		ctx = WithIdempotencyKey(ctx, req.IdempotencyKey)
+	}
 	result, err := s.environment.InvokeActorDirectStream(
-		getContextFromRequest(r), req.VersionStamp, req.ServerID, req.ServerVersion, ref,
+		ctx, req.VersionStamp, req.ServerID, req.ServerVersion, ref,
 		req.Operation, req.Payload, req.CreateIfNotExist)
 	if err != nil {
 		writeStatusCodeForError(w, err)
@@ -249,6 +454,12 @@ func (s *Server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.authorize(r, req.Namespace, PermissionInvoke); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	result, err := s.environment.InvokeWorkerStream(
 		getContextFromRequest(r), req.Namespace, req.ModuleID, req.Operation, req.Payload, req.CreateIfNotExist)
 	if err != nil {
@@ -260,6 +471,109 @@ func (s *Server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 	copyResultIntoStreamAndCloseResult(w, result)
 }
 
+type migrateActorRequest struct {
+	Namespace      string `json:"namespace"`
+	ModuleID       string `json:"module_id"`
+	ActorID        string `json:"actor_id"`
+	TargetServerID string `json:"target_server_id"`
+}
+
+func (s *Server) migrateActor(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	if err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req migrateActorRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := s.authorize(r, req.Namespace, PermissionAdmin); err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = s.environment.MigrateActor(
+		getContextFromRequest(r), req.Namespace, req.ActorID, req.ModuleID, req.TargetServerID)
+	if err != nil {
+		writeStatusCodeForError(w, err)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// metrics serves the environment's metrics in the Prometheus text exposition format.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	s.environment.Metrics().ServeHTTP(w, r)
+}
+
+// authenticate wraps h so that requests are authenticated with the Authenticator (if
+// any) before h is invoked. The authenticated principal is stored in the request's
+// context so that h can authorize the request once it knows which namespace it targets.
+func (s *Server) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	if s.opts.Authenticator == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := s.opts.Authenticator.Authenticate(r)
+		if err != nil {
+			writeStatusCodeForError(w, err)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		h(w, r.WithContext(contextWithPrincipal(r.Context(), principal)))
+	}
+}
+
+// requirePeerToken wraps h so that requests which don't present the peer token are
+// rejected. h is returned as is if token is empty.
+func requirePeerToken(h http.HandlerFunc, token string) http.HandlerFunc {
+	if token == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !peerTokenMatches(token, r.Header.Get(types.HTTPHeaderPeerToken)) {
+			err := NewUnauthenticatedError(errors.New("a valid peer token is required"))
+			writeStatusCodeForError(w, err)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// peerTokenMatches returns whether presented matches the expected peer token. It always
+// returns true if expected is empty.
+func peerTokenMatches(expected, presented string) bool {
+	if expected == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(presented)) == 1
+}
+
+// authorize returns an error if the principal that sent the request does not have the
+// permission in the namespace.
+func (s *Server) authorize(r *http.Request, namespace string, permission Permission) error {
+	if s.opts.Authenticator == nil || s.opts.Authorizer == nil {
+		return nil
+	}
+
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return fmt.Errorf(
+			"[invariant violated] request for namespace: %s was not authenticated", namespace)
+	}
+	return s.opts.Authorizer.Authorize(r.Context(), principal, namespace, permission)
+}
+
 // ensureHijackable and terminateConnection are used in conjunction to close tcp connections
 // for requests where we've started copying the response stream into the HTTP response body
 // after submitting an HTTP 200 status code, but then encounter an error reading from the
@@ -284,12 +598,15 @@ func terminateConnection(w http.ResponseWriter) {
 }
 
 func writeStatusCodeForError(w http.ResponseWriter, err error) {
+	w.WriteHeader(statusCodeForError(err))
+}
+
+func statusCodeForError(err error) int {
 	var httpErr HTTPError
 	if errors.As(err, &httpErr) {
-		w.WriteHeader(httpErr.HTTPStatusCode())
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
+		return httpErr.HTTPStatusCode()
 	}
+	return http.StatusInternalServerError
 }
 
 func copyResultIntoStreamAndCloseResult(
@@ -348,6 +665,9 @@ func getContextFromRequest(r *http.Request) context.Context {
 		}
 	}
 
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+	// Continue the trace of the caller (if any) so the request's spans are children of the
+	// caller's span.
+	ctx := tracing.Extract(r.Context(), r.Header)
+	ctx, _ = context.WithTimeout(ctx, timeout)
 	return ctx
 }
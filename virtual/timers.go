@@ -0,0 +1,128 @@
+package virtual
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+// actorTimers tracks the outstanding timers scheduled by a single activation of an actor
+// so that they can be listed and cancelled, and so that they're all stopped when the actor
+// is closed instead of lingering in the timing wheel.
+type actorTimers struct {
+	sync.Mutex
+
+	wheel *timingWheel
+
+	_closed bool
+	_nextID int64
+	_timers map[string]*actorTimer
+}
+
+type actorTimer struct {
+	seq   int64
+	timer *wheelTimer
+	info  wapcutils.SelfTimer
+}
+
+func newActorTimers(wheel *timingWheel) *actorTimers {
+	return &actorTimers{
+		wheel:   wheel,
+		_timers: make(map[string]*actorTimer),
+	}
+}
+
+// schedule schedules fn to run after the provided delay and returns the ID of the timer.
+// fn is not called if the timer is cancelled, or the actor is closed, before it fires.
+func (t *actorTimers) schedule(
+	operation string,
+	after time.Duration,
+	fn func(),
+) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t._closed {
+		return "", errors.New("cant schedule timer for actor that has already been closed")
+	}
+
+	t._nextID++
+	id := strconv.FormatInt(t._nextID, 10)
+	timer := &actorTimer{
+		seq: t._nextID,
+		info: wapcutils.SelfTimer{
+			TimerID:           id,
+			Operation:         operation,
+			FiresAtUnixMillis: time.Now().Add(after).UnixMilli(),
+		},
+	}
+	timer.timer = t.wheel.schedule(after, func() {
+		// Remove the timer before firing it, and don't fire it if it was already removed
+		// because that means it was cancelled (or the actor was closed) concurrently.
+		if !t.remove(id) {
+			return
+		}
+		// fn invokes the actor which can block for an arbitrary amount of time so it can't
+		// run on the wheel's goroutine.
+		go fn()
+	})
+	t._timers[id] = timer
+	return id, nil
+}
+
+// cancel stops the timer with the provided ID. It is a no-op if the timer doesn't exist,
+// for example because it already fired.
+func (t *actorTimers) cancel(id string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if timer, ok := t._timers[id]; ok {
+		timer.timer.stop()
+		delete(t._timers, id)
+	}
+}
+
+// list returns the outstanding timers ordered by the time they were scheduled.
+func (t *actorTimers) list() []wapcutils.SelfTimer {
+	t.Lock()
+	defer t.Unlock()
+
+	sorted := make([]*actorTimer, 0, len(t._timers))
+	for _, timer := range t._timers {
+		sorted = append(sorted, timer)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].seq < sorted[j].seq
+	})
+
+	timers := make([]wapcutils.SelfTimer, 0, len(sorted))
+	for _, timer := range sorted {
+		timers = append(timers, timer.info)
+	}
+	return timers
+}
+
+// close stops all the outstanding timers and prevents new ones from being scheduled.
+func (t *actorTimers) close() {
+	t.Lock()
+	defer t.Unlock()
+
+	for id, timer := range t._timers {
+		timer.timer.stop()
+		delete(t._timers, id)
+	}
+	t._closed = true
+}
+
+func (t *actorTimers) remove(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	_, ok := t._timers[id]
+	delete(t._timers, id)
+	return ok
+}
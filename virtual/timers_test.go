@@ -0,0 +1,72 @@
+package virtual
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActorTimers(t *testing.T) {
+	var (
+		wheel  = newTimingWheel(time.Millisecond, 16, 2)
+		timers = newActorTimers(wheel)
+		fired  = make(chan string, 10)
+	)
+	wheel.start()
+	defer wheel.close()
+
+	schedule := func(operation string, after time.Duration) string {
+		id, err := timers.schedule(operation, after, func() { fired <- operation })
+		require.NoError(t, err)
+		return id
+	}
+
+	id1 := schedule("a", time.Hour)
+	id2 := schedule("b", time.Hour)
+	id3 := schedule("c", time.Millisecond)
+	require.NotEqual(t, id1, id2)
+
+	// Timers are removed once they fire.
+	require.Equal(t, "c", <-fired)
+	list := timers.list()
+	require.Equal(t, 2, len(list))
+	require.Equal(t, id1, list[0].TimerID)
+	require.Equal(t, "a", list[0].Operation)
+	require.True(t, list[0].FiresAtUnixMillis > time.Now().UnixMilli())
+	require.Equal(t, id2, list[1].TimerID)
+
+	// Cancelling a timer that already fired (or doesn't exist) is a no-op.
+	timers.cancel(id3)
+	timers.cancel("unknown")
+	timers.cancel(id1)
+	list = timers.list()
+	require.Equal(t, 1, len(list))
+	require.Equal(t, id2, list[0].TimerID)
+}
+
+func TestActorTimersClose(t *testing.T) {
+	var (
+		wheel    = newTimingWheel(time.Millisecond, 16, 2)
+		timers   = newActorTimers(wheel)
+		numFired int64
+	)
+	wheel.start()
+	defer wheel.close()
+
+	for i := 0; i < 10; i++ {
+		_, err := timers.schedule("inc", 10*time.Millisecond, func() {
+			atomic.AddInt64(&numFired, 1)
+		})
+		require.NoError(t, err)
+	}
+
+	timers.close()
+	require.Equal(t, 0, len(timers.list()))
+	_, err := timers.schedule("inc", time.Millisecond, func() {})
+	require.Error(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(0), atomic.LoadInt64(&numFired))
+}
@@ -0,0 +1,232 @@
+package virtual
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimingWheelTick      = 10 * time.Millisecond
+	defaultTimingWheelNumSlots  = 256
+	defaultTimingWheelNumLevels = 4
+)
+
+// timingWheel is a hierarchical timing wheel that multiplexes a large number of timers
+// onto a single goroutine and a single runtime ticker. Scheduling and stopping a timer are
+// O(1) and don't touch the Go runtime's timer heap, which matters when every activated
+// actor has a GC check (and potentially several self timers) outstanding at all times.
+//
+// Level 0 has numSlots slots that are each one tick wide, and every level above it has
+// numSlots slots that are each as wide as the entire level below it. Timers are placed in
+// the lowest level that can hold them and are cascaded down into lower levels as the wheel
+// turns until they land in level 0 and fire. Timers that expire further out than the top
+// level can hold are parked in the top level and re-placed every time they're cascaded.
+//
+// Timers never fire early, but they may fire up to one tick late. Callbacks are run
+// synchronously on the wheel's goroutine so they must not block, callbacks that need to do
+// any real work should hand it off to another goroutine.
+type timingWheel struct {
+	sync.Mutex
+
+	_now    int64
+	_levels [][]wheelSlot
+	_fired  []*wheelTimer
+
+	epoch    time.Time
+	tick     time.Duration
+	numSlots int64
+	closeCh  chan struct{}
+	closedCh chan struct{}
+	closeMu  sync.Once
+}
+
+type wheelSlot struct {
+	head *wheelTimer
+}
+
+// wheelTimer is a handle to a timer that was scheduled on a timingWheel.
+type wheelTimer struct {
+	wheel  *timingWheel
+	expiry int64
+	fn     func()
+
+	// Only accessed with the wheel's lock held.
+	slot       *wheelSlot
+	prev, next *wheelTimer
+}
+
+func newTimingWheel(
+	tick time.Duration,
+	numSlots int,
+	numLevels int,
+) *timingWheel {
+	if tick <= 0 || numSlots < 2 || numLevels < 1 {
+		panic("[invariant violated] illegal timing wheel configuration")
+	}
+
+	levels := make([][]wheelSlot, 0, numLevels)
+	for i := 0; i < numLevels; i++ {
+		levels = append(levels, make([]wheelSlot, numSlots))
+	}
+	return &timingWheel{
+		_levels:  levels,
+		epoch:    time.Now(),
+		tick:     tick,
+		numSlots: int64(numSlots),
+		closeCh:  make(chan struct{}),
+		closedCh: make(chan struct{}),
+	}
+}
+
+func (w *timingWheel) start() {
+	go func() {
+		defer close(w.closedCh)
+
+		ticker := time.NewTicker(w.tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.closeCh:
+				return
+			case <-ticker.C:
+				w.advance(int64(time.Since(w.epoch) / w.tick))
+			}
+		}
+	}()
+}
+
+// close stops the wheel. Timers that have not fired yet never will.
+func (w *timingWheel) close() {
+	w.closeMu.Do(func() {
+		close(w.closeCh)
+	})
+	<-w.closedCh
+}
+
+// schedule schedules fn to run on the wheel's goroutine after the provided delay.
+func (w *timingWheel) schedule(after time.Duration, fn func()) *wheelTimer {
+	// Compute the expiry from the wall clock instead of the last tick the wheel processed
+	// so that timers are never fired early if the wheel's goroutine is lagging behind.
+	expiry := int64((time.Since(w.epoch) + after + w.tick - 1) / w.tick)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if expiry <= w._now {
+		expiry = w._now + 1
+	}
+	t := &wheelTimer{wheel: w, expiry: expiry, fn: fn}
+	w.addWithLock(t)
+	return t
+}
+
+// stop prevents the timer from firing. It returns false if the timer already fired or was
+// already stopped.
+func (t *wheelTimer) stop() bool {
+	t.wheel.Lock()
+	defer t.wheel.Unlock()
+
+	if t.slot == nil {
+		return false
+	}
+	t.removeWithLock()
+	return true
+}
+
+// advance turns the wheel until it has processed every tick up to and including the
+// provided one, and then runs the callbacks for all the timers that expired.
+func (w *timingWheel) advance(until int64) {
+	w.Lock()
+	for w._now < until {
+		w._now++
+		w.cascadeWithLock()
+
+		slot := &w._levels[0][w._now%w.numSlots]
+		for slot.head != nil {
+			t := slot.head
+			t.removeWithLock()
+			w._fired = append(w._fired, t)
+		}
+	}
+	fired := w._fired
+	w._fired = nil
+	w.Unlock()
+
+	for i, t := range fired {
+		t.fn()
+		fired[i] = nil
+	}
+
+	w.Lock()
+	if w._fired == nil {
+		// Reuse the buffer for the next tick.
+		w._fired = fired[:0]
+	}
+	w.Unlock()
+}
+
+// cascadeWithLock moves the timers in every higher level slot that the wheel has just
+// rotated onto down into the lower levels.
+func (w *timingWheel) cascadeWithLock() {
+	span := int64(1)
+	for level := 1; level < len(w._levels); level++ {
+		span *= w.numSlots
+		if w._now%span != 0 {
+			// Higher levels can only rotate if this one did.
+			return
+		}
+
+		slot := &w._levels[level][(w._now/span)%w.numSlots]
+		for slot.head != nil {
+			t := slot.head
+			t.removeWithLock()
+			w.addWithLock(t)
+		}
+	}
+}
+
+func (w *timingWheel) addWithLock(t *wheelTimer) {
+	var (
+		delta  = t.expiry - w._now
+		expiry = t.expiry
+		span   = int64(1)
+		level  = 0
+	)
+	for ; level < len(w._levels)-1; level++ {
+		if delta < span*w.numSlots {
+			break
+		}
+		span *= w.numSlots
+	}
+	if maxDelta := span*w.numSlots - 1; delta > maxDelta {
+		// The timer expires beyond the range of the top level, park it in the furthest slot
+		// and it will be re-placed once it gets cascaded.
+		expiry = w._now + maxDelta
+	}
+	if delta <= 0 {
+		// Can happen while cascading, fire the timer on this tick.
+		expiry = w._now
+	}
+
+	slot := &w._levels[level][(expiry/span)%w.numSlots]
+	t.slot = slot
+	t.prev = nil
+	t.next = slot.head
+	if slot.head != nil {
+		slot.head.prev = t
+	}
+	slot.head = t
+}
+
+func (t *wheelTimer) removeWithLock() {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		t.slot.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.slot, t.prev, t.next = nil, nil, nil
+}
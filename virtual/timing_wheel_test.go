@@ -0,0 +1,162 @@
+package virtual
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTimingWheelCascade tests that timers in every level of the wheel (and beyond the
+// range of the top level) fire on the right tick by turning the wheel manually. The tick
+// is so long that the wall clock never advances the wheel by itself.
+func TestTimingWheelCascade(t *testing.T) {
+	var (
+		wheel   = newTimingWheel(time.Hour, 4, 3)
+		firedAt = map[int]int64{}
+	)
+	// The wheel can hold timers up to 4^3 = 64 ticks out.
+	for _, ticks := range []int{0, 1, 3, 4, 5, 15, 16, 17, 63, 64, 65, 200} {
+		ticks := ticks
+		wheel.schedule(time.Duration(ticks)*time.Hour, func() {
+			firedAt[ticks] = wheel._now
+		})
+	}
+	stopped := wheel.schedule(10*time.Hour, func() {
+		t.Fatal("stopped timer should not fire")
+	})
+	require.True(t, stopped.stop())
+	require.False(t, stopped.stop())
+
+	for tick := int64(1); tick <= 300; tick++ {
+		wheel.advance(tick)
+	}
+
+	require.Equal(t, 12, len(firedAt))
+	for ticks, at := range firedAt {
+		// Timers are never fired early and at most one tick late (because the time that
+		// elapsed on the wall clock since the wheel was created is rounded up).
+		require.True(t, at >= int64(ticks), fmt.Sprintf("%d fired at %d", ticks, at))
+		require.True(t, at <= int64(ticks)+1, fmt.Sprintf("%d fired at %d", ticks, at))
+	}
+}
+
+func TestTimingWheel(t *testing.T) {
+	wheel := newTimingWheel(time.Millisecond, 8, 2)
+	wheel.start()
+	defer wheel.close()
+
+	var (
+		start = time.Now()
+		wg    sync.WaitGroup
+	)
+	for _, after := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond, 100 * time.Millisecond} {
+		after := after
+		wg.Add(1)
+		wheel.schedule(after, func() {
+			defer wg.Done()
+			require.True(t, time.Since(start) >= after)
+		})
+	}
+
+	var stoppedFired int64
+	stopped := wheel.schedule(20*time.Millisecond, func() {
+		atomic.AddInt64(&stoppedFired, 1)
+	})
+	require.True(t, stopped.stop())
+
+	wg.Wait()
+	require.Equal(t, int64(0), atomic.LoadInt64(&stoppedFired))
+}
+
+func TestTimingWheelClose(t *testing.T) {
+	wheel := newTimingWheel(time.Millisecond, 8, 2)
+	wheel.start()
+
+	var numFired int64
+	wheel.schedule(20*time.Millisecond, func() {
+		atomic.AddInt64(&numFired, 1)
+	})
+	wheel.close()
+	// Closing multiple times is fine.
+	wheel.close()
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(0), atomic.LoadInt64(&numFired))
+}
+
+const benchmarkNumActors = 1_000_000
+
+// BenchmarkActorTimers compares scheduling timers with the Go runtime against the shared
+// timing wheel while 1M other timers (one per activated actor) are outstanding. See
+// BenchmarkActivatedActorGC for the benchmarks of the activations themselves.
+func BenchmarkActorTimers(b *testing.B) {
+	noop := func() {}
+
+	b.Run("schedule_and_cancel/runtime", func(b *testing.B) {
+		timers := make([]*time.Timer, 0, benchmarkNumActors)
+		for i := 0; i < benchmarkNumActors; i++ {
+			timers = append(timers, time.AfterFunc(time.Hour, noop))
+		}
+		defer func() {
+			for _, timer := range timers {
+				timer.Stop()
+			}
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			time.AfterFunc(time.Minute, noop).Stop()
+		}
+	})
+
+	b.Run("schedule_and_cancel/wheel", func(b *testing.B) {
+		wheel := newTimingWheel(
+			defaultTimingWheelTick, defaultTimingWheelNumSlots, defaultTimingWheelNumLevels)
+		wheel.start()
+		defer wheel.close()
+		for i := 0; i < benchmarkNumActors; i++ {
+			wheel.schedule(time.Hour, noop)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			wheel.schedule(time.Minute, noop).stop()
+		}
+	})
+
+	// Every iteration expires the GC checks of all 1M actors at once.
+	b.Run("expire/runtime", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			wg.Add(benchmarkNumActors)
+			for j := 0; j < benchmarkNumActors; j++ {
+				time.AfterFunc(time.Millisecond, wg.Done)
+			}
+			wg.Wait()
+		}
+	})
+
+	b.Run("expire/wheel", func(b *testing.B) {
+		wheel := newTimingWheel(
+			defaultTimingWheelTick, defaultTimingWheelNumSlots, defaultTimingWheelNumLevels)
+		wheel.start()
+		defer wheel.close()
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			wg.Add(benchmarkNumActors)
+			for j := 0; j < benchmarkNumActors; j++ {
+				wheel.schedule(time.Millisecond, wg.Done)
+			}
+			wg.Wait()
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package virtual
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// DefaultTLSReloadInterval is the default value for TLSOptions.ReloadInterval.
+	DefaultTLSReloadInterval = time.Minute
+
+	// rpcALPNProtocol is the ALPN protocol that clients using the binary RPC protocol
+	// negotiate when TLS is enabled. The RPC preface can't be used to distinguish RPC
+	// connections from HTTP connections in that case because the HTTP server needs to
+	// own the TLS connection to populate http.Request.TLS.
+	rpcALPNProtocol  = "nola-rpc/1"
+	httpALPNProtocol = "http/1.1"
+)
+
+// TLSOptions configures TLS for the communication between servers and, optionally, between
+// clients and servers. TLS is disabled if CertFile and KeyFile are empty.
+//
+// Servers present the certificate in CertFile to their clients and verify client
+// certificates against the CAs in CAFile. Clients present the same certificate to the
+// servers they connect to and verify the servers' certificates against the same CAs so
+// that every server in the cluster authenticates every other server (mutual TLS). As a
+// result, the certificate must be valid for both server and client authentication.
+//
+// All of the files are checked for changes every ReloadInterval so that certificates can
+// be rotated without restarting the process.
+type TLSOptions struct {
+	// CertFile is the path to the PEM encoded certificate (chain).
+	CertFile string
+	// KeyFile is the path to the PEM encoded private key for the certificate in CertFile.
+	KeyFile string
+	// CAFile is the path to the PEM encoded CA certificates that are used to verify the
+	// certificates of peers.
+	CAFile string
+	// ServerName is the name that clients verify the certificates of servers against. If
+	// empty, the host that the server advertised to the registry (usually an I.P address)
+	// is used instead.
+	ServerName string
+	// RequireClientCertsForPublicEndpoints requires clients of the public endpoints (like
+	// invoke-actor and register-module) to present a verified client certificate as well.
+	// The endpoints that are used for server-to-server communication always require one.
+	RequireClientCertsForPublicEndpoints bool
+	// ReloadInterval controls how often the files are checked for changes. Defaults to
+	// DefaultTLSReloadInterval.
+	ReloadInterval time.Duration
+}
+
+// Enabled returns true if TLS is enabled.
+func (t TLSOptions) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Validate validates the options. It does not check the contents of the files.
+func (t TLSOptions) Validate() error {
+	if !t.Enabled() {
+		if t.CAFile != "" || t.ServerName != "" || t.RequireClientCertsForPublicEndpoints {
+			return errors.New("CertFile and KeyFile must be set when TLS options are provided")
+		}
+		return nil
+	}
+
+	if t.CertFile == "" {
+		return errors.New("CertFile cannot be empty if KeyFile is set")
+	}
+	if t.KeyFile == "" {
+		return errors.New("KeyFile cannot be empty if CertFile is set")
+	}
+	if t.CAFile == "" {
+		return errors.New("CAFile cannot be empty")
+	}
+	if t.ReloadInterval < 0 {
+		return errors.New("ReloadInterval must be >= 0")
+	}
+	return nil
+}
+
+// tlsReloader holds the certificate and CAs loaded from the files in TLSOptions and
+// reloads them when the files change.
+type tlsReloader struct {
+	sync.Mutex
+
+	opts TLSOptions
+	log  *slog.Logger
+
+	_cert      *tls.Certificate
+	_roots     *x509.CertPool
+	_modTimes  [3]time.Time
+	_lastCheck time.Time
+}
+
+func newTLSReloader(opts TLSOptions) (*tlsReloader, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating TLS options: %w", err)
+	}
+	if !opts.Enabled() {
+		return nil, errors.New("TLS is not enabled")
+	}
+	if opts.ReloadInterval == 0 {
+		opts.ReloadInterval = DefaultTLSReloadInterval
+	}
+
+	r := &tlsReloader{
+		opts: opts,
+		log:  slog.Default().With(slog.String("module", "tlsReloader")),
+	}
+	modTimes, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.loadWithLock(modTimes); err != nil {
+		return nil, err
+	}
+	r._lastCheck = time.Now()
+	return r, nil
+}
+
+// get returns the current certificate and CAs, reloading them first if the files have
+// changed since they were last loaded. Errors encountered while reloading are logged and
+// the previously loaded certificate and CAs are returned so that a partially written
+// file doesn't take down the server.
+func (r *tlsReloader) get() (*tls.Certificate, *x509.CertPool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r._lastCheck) >= r.opts.ReloadInterval {
+		r._lastCheck = time.Now()
+		modTimes, err := r.modTimes()
+		if err != nil {
+			r.log.Warn("error checking TLS files for changes", slog.Any("error", err))
+		} else if modTimes != r._modTimes {
+			if err := r.loadWithLock(modTimes); err != nil {
+				r.log.Warn("error reloading TLS files, continuing to use previous ones",
+					slog.Any("error", err))
+			} else {
+				r.log.Info("reloaded TLS files")
+			}
+		}
+	}
+
+	return r._cert, r._roots
+}
+
+func (r *tlsReloader) modTimes() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, path := range []string{r.opts.CertFile, r.opts.KeyFile, r.opts.CAFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, fmt.Errorf("error checking TLS file: %s: %w", path, err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *tlsReloader) loadWithLock(modTimes [3]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(r.opts.CAFile)
+	if err != nil {
+		return fmt.Errorf("error reading TLS CA file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no CA certificates found in: %s", r.opts.CAFile)
+	}
+
+	r._cert = &cert
+	r._roots = roots
+	r._modTimes = modTimes
+	return nil
+}
+
+// serverConfig returns the TLS config for servers. Client certificates are verified if
+// they're provided, but it is up to the handlers to decide whether they're required.
+func (r *tlsReloader) serverConfig(nextProtos []string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		// The config is constructed per connection so that reloaded CAs are used to verify
+		// client certificates.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, roots := r.get()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				ClientCAs:    roots,
+			}, nil
+		},
+	}
+}
+
+// clientConfig returns the TLS config for connecting to the server with the provided host.
+func (r *tlsReloader) clientConfig(host string, nextProtos []string) *tls.Config {
+	serverName := r.opts.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.get()
+			return cert, nil
+		},
+		// The server's certificate is verified in VerifyConnection instead of by the
+		// standard verification so that reloaded CAs are used.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+			_, roots := r.get()
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				DNSName:       serverName,
+			})
+			return err
+		},
+	}
+}
+
+// dial establishes a TLS connection to address and completes the handshake.
+func (r *tlsReloader) dial(
+	ctx context.Context,
+	dialer *net.Dialer,
+	network string,
+	address string,
+	nextProtos []string,
+) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing address: %s: %w", address, err)
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, r.clientConfig(host, nextProtos))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error performing TLS handshake with: %s: %w", address, err)
+	}
+	return tlsConn, nil
+}
+
+// hasVerifiedClientCert returns true if the client presented a certificate that was
+// verified against the configured CAs.
+func hasVerifiedClientCert(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// requireClientCert wraps h so that requests from clients that did not present a verified
+// client certificate are rejected. It returns h unmodified if required is false.
+func requireClientCert(h http.HandlerFunc, required bool) http.HandlerFunc {
+	if !required {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasVerifiedClientCert(r.TLS) {
+			err := NewUnauthenticatedError(errors.New("a verified client certificate is required"))
+			writeStatusCodeForError(w, err)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,315 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSOptionsValidate(t *testing.T) {
+	require.NoError(t, TLSOptions{}.Validate())
+	require.NoError(t, TLSOptions{CertFile: "cert", KeyFile: "key", CAFile: "ca"}.Validate())
+
+	require.Error(t, TLSOptions{CAFile: "ca"}.Validate())
+	require.Error(t, TLSOptions{CertFile: "cert", CAFile: "ca"}.Validate())
+	require.Error(t, TLSOptions{KeyFile: "key", CAFile: "ca"}.Validate())
+	require.Error(t, TLSOptions{CertFile: "cert", KeyFile: "key"}.Validate())
+	require.Error(t, TLSOptions{
+		CertFile: "cert", KeyFile: "key", CAFile: "ca", ReloadInterval: -1}.Validate())
+
+	_, err := NewHTTPClientWithOptions(HTTPClientOptions{TLS: TLSOptions{
+		CertFile: "does-not-exist", KeyFile: "does-not-exist", CAFile: "does-not-exist"}})
+	require.Error(t, err)
+}
+
+// TestTLS tests that servers communicate with each other using mutual TLS with both the
+// HTTP and RPC clients, that clients without a verified certificate can only use the
+// public endpoints, and that rotated certificates are picked up without restarts.
+func TestTLS(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		ca          = newTestCA(t)
+		tlsOpts     = writeTestTLSFiles(t, t.TempDir(), ca.issue(t, 1), ca.certPEM)
+	)
+	defer reg.Close(ctx)
+	tlsOpts.ReloadInterval = time.Millisecond
+
+	rpcClient, err := NewRPCClient(RPCClientOptions{TLS: tlsOpts})
+	require.NoError(t, err)
+	httpClient, err := NewHTTPClientWithOptions(HTTPClientOptions{TLS: tlsOpts})
+	require.NoError(t, err)
+
+	var (
+		serverOpts = ServerOptions{TLS: tlsOpts}
+		rpcEnv     = newTestServerEnvironmentWithOptions(
+			t, reg, moduleStore, "serverID1", rpcClient, serverOpts)
+		httpEnv = newTestServerEnvironmentWithOptions(
+			t, reg, moduleStore, "serverID2", httpClient, serverOpts)
+	)
+
+	invokeAll := func(env Environment, numActors int) {
+		for i := 0; i < numActors; i++ {
+			_, err := env.InvokeActor(
+				ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "inc", nil, types.CreateIfNotExist{})
+			require.NoError(t, err)
+		}
+	}
+	invokeAll(rpcEnv, 10)
+	invokeAll(httpEnv, 10)
+	require.True(t, rpcEnv.NumActivatedActors() > 0)
+	require.True(t, httpEnv.NumActivatedActors() > 0)
+
+	result, err := reg.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		Namespace: "ns-1",
+		ModuleID:  "test-module",
+		ActorID:   "a-0",
+	})
+	require.NoError(t, err)
+	var (
+		ref     = result.References[0]
+		address = ref.Physical.ServerState.Address
+	)
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+
+	// Clients that don't use TLS can't communicate with the servers at all.
+	_, err = NewHTTPClient().InvokeActorRemote(ctx, vs, ref, "getCount", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+	plainRPCClient, err := NewRPCClient(RPCClientOptions{DialTimeout: time.Second})
+	require.NoError(t, err)
+	ctxWithTimeout, cc := context.WithTimeout(ctx, time.Second)
+	_, err = plainRPCClient.InvokeActorRemote(
+		ctxWithTimeout, vs, ref, "getCount", nil, types.CreateIfNotExist{})
+	cc()
+	require.Error(t, err)
+
+	// Clients that use TLS, but don't present a client certificate, can use the public
+	// endpoints, but not the server-to-server ones.
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(ca.certPEM))
+	noCertClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	defer noCertClient.CloseIdleConnections()
+
+	resp := postJSON(t, noCertClient, address, "invoke-actor", invokeActorRequest{
+		Namespace: "ns-1",
+		InvokeActorRequest: types.InvokeActorRequest{
+			ActorID:   "a-0",
+			ModuleID:  "test-module",
+			Operation: "inc",
+		},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = postJSON(t, noCertClient, address, "invoke-actor-direct", invokeActorDirectRequest{
+		VersionStamp:  vs,
+		ServerID:      ref.Physical.ServerID,
+		ServerVersion: ref.Physical.ServerVersion,
+		Namespace:     "ns-1",
+		ModuleID:      "test-module",
+		ActorID:       "a-0",
+		Operation:     "getCount",
+	})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Rotate the certificate to one that is issued by a different CA. The servers and the
+	// clients should all pick up the new files.
+	var (
+		newCA    = newTestCA(t)
+		bothCAs  = append(append([]byte(nil), ca.certPEM...), newCA.certPEM...)
+		newCert  = newCA.issue(t, 2)
+		newRoots = x509.NewCertPool()
+	)
+	require.True(t, newRoots.AppendCertsFromPEM(newCA.certPEM))
+	writeTestTLSFiles(t, filepath.Dir(tlsOpts.CertFile), newCert, bothCAs)
+
+	require.Eventually(t, func() bool {
+		conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: newRoots})
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Ensure new connections are established with the new certificates.
+	rpcClient, err = NewRPCClient(RPCClientOptions{TLS: tlsOpts})
+	require.NoError(t, err)
+	resp2, err := rpcClient.InvokeActorRemote(ctx, vs, ref, "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	resp2.Close()
+	invokeAll(httpEnv, 10)
+}
+
+// TestTLSRequireClientCertsForPublicEndpoints tests that the public endpoints require a
+// verified client certificate if configured to do so.
+func TestTLSRequireClientCertsForPublicEndpoints(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		reg         = localregistry.NewLocalRegistry("test-server-id")
+		moduleStore = newTestModuleStore()
+		ca          = newTestCA(t)
+		tlsOpts     = writeTestTLSFiles(t, t.TempDir(), ca.issue(t, 1), ca.certPEM)
+	)
+	defer reg.Close(ctx)
+	tlsOpts.RequireClientCertsForPublicEndpoints = true
+
+	client, err := NewHTTPClientWithOptions(HTTPClientOptions{TLS: tlsOpts})
+	require.NoError(t, err)
+	newTestServerEnvironmentWithOptions(
+		t, reg, moduleStore, "serverID1", client, ServerOptions{TLS: tlsOpts})
+
+	result, err := reg.EnsureActivation(ctx, registry.EnsureActivationRequest{
+		Namespace: "ns-1",
+		ModuleID:  "test-module",
+		ActorID:   "a-0",
+	})
+	require.NoError(t, err)
+	address := result.References[0].Physical.ServerState.Address
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(ca.certPEM))
+	cert, err := tls.LoadX509KeyPair(tlsOpts.CertFile, tlsOpts.KeyFile)
+	require.NoError(t, err)
+
+	req := invokeActorRequest{
+		Namespace: "ns-1",
+		InvokeActorRequest: types.InvokeActorRequest{
+			ActorID:   "a-0",
+			ModuleID:  "test-module",
+			Operation: "inc",
+		},
+	}
+	noCertClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	defer noCertClient.CloseIdleConnections()
+	resp := postJSON(t, noCertClient, address, "invoke-actor", req)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	certClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}},
+	}}
+	defer certClient.CloseIdleConnections()
+	resp = postJSON(t, certClient, address, "invoke-actor", req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func postJSON(t *testing.T, c *http.Client, address, endpoint string, v interface{}) *http.Response {
+	marshaled, err := json.Marshal(v)
+	require.NoError(t, err)
+	resp, err := c.Post(
+		fmt.Sprintf("https://%s/api/v1/%s", address, endpoint),
+		"application/json", bytes.NewReader(marshaled))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nola-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+type testKeyPair struct {
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issue issues a certificate for localhost that is valid for both server and client
+// authentication.
+func (ca testCA) issue(t *testing.T, serial int64) testKeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "nola-test-node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP(Localhost)},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return testKeyPair{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestTLSFiles writes the key pair and CAs to dir and returns TLSOptions that point
+// to them. The modification times are bumped so that the change is detected even if the
+// file system's timestamps are coarse.
+func writeTestTLSFiles(t *testing.T, dir string, kp testKeyPair, caPEM []byte) TLSOptions {
+	opts := TLSOptions{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	modTime := time.Now().Add(time.Second)
+	for path, contents := range map[string][]byte{
+		opts.CertFile: kp.certPEM,
+		opts.KeyFile:  kp.keyPEM,
+		opts.CAFile:   caPEM,
+	} {
+		require.NoError(t, os.WriteFile(path, contents, 0o600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	return opts
+}
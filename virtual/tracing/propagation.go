@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// TraceParentHeader is the W3C Trace Context header that contains the trace ID, the
+	// parent span ID and the trace flags.
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader is the W3C Trace Context header that contains vendor-specific trace
+	// state.
+	TraceStateHeader = "tracestate"
+
+	traceParentVersion = "00"
+	// 2 (version) + 32 (trace ID) + 16 (span ID) + 2 (flags) + 3 separators.
+	traceParentLen = 55
+)
+
+// Inject writes the span context of the span in ctx (if any) to the W3C Trace Context
+// headers.
+func Inject(ctx context.Context, header http.Header) {
+	sc := SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	header.Set(TraceParentHeader, FormatTraceParent(sc))
+	if sc.TraceState != "" {
+		header.Set(TraceStateHeader, sc.TraceState)
+	}
+}
+
+// Extract returns a copy of ctx that contains the remote span context from the W3C Trace
+// Context headers. ctx is returned unmodified if the headers don't contain a valid span
+// context.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, err := ParseTraceParent(header.Get(TraceParentHeader))
+	if err != nil {
+		return ctx
+	}
+	sc.TraceState = header.Get(TraceStateHeader)
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// FormatTraceParent formats the span context as the value of a W3C traceparent header.
+func FormatTraceParent(sc SpanContext) string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceParentVersion, sc.TraceID, sc.SpanID, byte(sc.TraceFlags))
+}
+
+// ParseTraceParent parses the value of a W3C traceparent header.
+func ParseTraceParent(traceParent string) (SpanContext, error) {
+	if len(traceParent) < traceParentLen {
+		return SpanContext{}, fmt.Errorf("traceparent: %q is too short", traceParent)
+	}
+	version := traceParent[:2]
+	if version == "ff" {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has invalid version", traceParent)
+	}
+	// Future versions may append fields, but they must start with the fields of version 00.
+	if (version == traceParentVersion && len(traceParent) != traceParentLen) ||
+		(len(traceParent) > traceParentLen && traceParent[traceParentLen] != '-') {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has invalid length", traceParent)
+	}
+	if traceParent[2] != '-' || traceParent[35] != '-' || traceParent[52] != '-' {
+		return SpanContext{}, fmt.Errorf("traceparent: %q is malformed", traceParent)
+	}
+
+	var (
+		sc                 SpanContext
+		versionByte, flags [1]byte
+	)
+	if err := decodeLowerHex(versionByte[:], version); err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has invalid version: %w", traceParent, err)
+	}
+	if err := decodeLowerHex(sc.TraceID[:], traceParent[3:35]); err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has invalid trace ID: %w", traceParent, err)
+	}
+	if err := decodeLowerHex(sc.SpanID[:], traceParent[36:52]); err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has invalid span ID: %w", traceParent, err)
+	}
+	if err := decodeLowerHex(flags[:], traceParent[53:55]); err != nil {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has invalid flags: %w", traceParent, err)
+	}
+	sc.TraceFlags = TraceFlags(flags[0])
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("traceparent: %q has an all zero trace or span ID", traceParent)
+	}
+	return sc, nil
+}
+
+// decodeLowerHex decodes hex into dst, rejecting upper case characters as required by the
+// W3C Trace Context spec.
+func decodeLowerHex(dst []byte, s string) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'F' {
+			return fmt.Errorf("invalid upper case hex character: %q", s[i])
+		}
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
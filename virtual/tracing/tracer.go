@@ -0,0 +1,161 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// NewNoopTracer returns a Tracer that doesn't record anything. The spans it starts carry
+// the span context of their parent so that trace context that was propagated from other
+// servers is still propagated to any downstream servers.
+func NewNoopTracer() Tracer {
+	return noopTracer{}
+}
+
+type noopTracer struct{}
+
+func (t noopTracer) Start(
+	ctx context.Context,
+	spanName string,
+	opts ...SpanStartOption,
+) (context.Context, Span) {
+	span := nonRecordingSpan{sc: SpanContextFromContext(ctx)}
+	return ContextWithSpan(ctx, span), span
+}
+
+// Exporter receives the spans recorded by a Tracer returned by NewTracer once they end.
+type Exporter interface {
+	// ExportSpan exports an ended span. It is called synchronously by Span.End so it must
+	// not block.
+	ExportSpan(span SpanData)
+}
+
+// NewTracer returns a Tracer that records every span and hands them to exporter once they
+// end.
+func NewTracer(exporter Exporter) Tracer {
+	return &tracer{exporter: exporter}
+}
+
+type tracer struct {
+	exporter Exporter
+}
+
+func (t *tracer) Start(
+	ctx context.Context,
+	spanName string,
+	opts ...SpanStartOption,
+) (context.Context, Span) {
+	var (
+		config = NewSpanConfig(opts...)
+		parent = SpanContextFromContext(ctx)
+		sc     = SpanContext{TraceFlags: FlagsSampled}
+	)
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.TraceFlags = parent.TraceFlags
+		sc.TraceState = parent.TraceState
+	} else {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+
+	span := &recordingSpan{
+		exporter: t.exporter,
+		data: SpanData{
+			Name:        spanName,
+			SpanContext: sc,
+			Parent:      parent,
+			Kind:        config.Kind,
+			StartTime:   time.Now(),
+			Attributes:  config.Attributes,
+		},
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	sync.Mutex
+	exporter Exporter
+	data     SpanData
+	ended    bool
+}
+
+func (s *recordingSpan) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *recordingSpan) IsRecording() bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.ended
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.Lock()
+	defer s.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Err = err
+}
+
+func (s *recordingSpan) End() {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+	s.Unlock()
+
+	s.exporter.ExportSpan(data)
+}
+
+// InMemoryExporter is an Exporter that keeps every span in memory, it's intended to be
+// used in tests.
+type InMemoryExporter struct {
+	sync.Mutex
+	spans []SpanData
+}
+
+// NewInMemoryExporter returns a new InMemoryExporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpan implements Exporter.
+func (e *InMemoryExporter) ExportSpan(span SpanData) {
+	e.Lock()
+	defer e.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// GetSpans returns the spans that were exported so far in the order they ended in.
+func (e *InMemoryExporter) GetSpans() []SpanData {
+	e.Lock()
+	defer e.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset discards every span that was exported so far.
+func (e *InMemoryExporter) Reset() {
+	e.Lock()
+	defer e.Unlock()
+	e.spans = nil
+}
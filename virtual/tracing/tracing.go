@@ -0,0 +1,226 @@
+// Package tracing implements a small, dependency-free subset of the OpenTelemetry tracing
+// API that is used to trace actor invocations as they propagate between environments and
+// actors. Tracer and Span mirror the shape of their OpenTelemetry counterparts so that an
+// OpenTelemetry tracer can be plugged in with a thin adapter, and span contexts are
+// propagated between servers using the W3C Trace Context format (see Inject and Extract).
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+)
+
+// TraceID uniquely identifies a trace.
+type TraceID [16]byte
+
+// IsValid returns whether the trace ID is valid (non-zero).
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID uniquely identifies a span within a trace.
+type SpanID [8]byte
+
+// IsValid returns whether the span ID is valid (non-zero).
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// TraceFlags are the W3C trace flags of a span.
+type TraceFlags byte
+
+// FlagsSampled is set on spans that are sampled.
+const FlagsSampled TraceFlags = 0x01
+
+// SpanContext is the portion of a span that is propagated to its children, including
+// children on other servers.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	TraceFlags TraceFlags
+	// TraceState is the vendor-specific trace state that is propagated unmodified.
+	TraceState string
+	// Remote is true if the span context was propagated from another server.
+	Remote bool
+}
+
+// IsValid returns whether the span context has a valid trace and span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// IsSampled returns whether the sampled flag is set.
+func (sc SpanContext) IsSampled() bool {
+	return sc.TraceFlags&FlagsSampled == FlagsSampled
+}
+
+// SpanKind describes the relationship between a span and its parent and children.
+type SpanKind int
+
+const (
+	// SpanKindInternal is the default kind for spans that represent internal operations.
+	SpanKindInternal SpanKind = iota
+	// SpanKindServer is the kind for spans that handle a request from another server.
+	SpanKindServer
+	// SpanKindClient is the kind for spans that make a request to another server.
+	SpanKindClient
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// Attribute is a key/value pair that describes a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int64 returns an integer attribute.
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer creates spans.
+type Tracer interface {
+	// Start creates a span that is a child of the span in ctx (if any) and returns a copy of
+	// ctx that contains the new span. The caller must call End on the span once the
+	// operation it represents is complete.
+	Start(ctx context.Context, spanName string, opts ...SpanStartOption) (context.Context, Span)
+}
+
+// Span represents a single operation within a trace.
+type Span interface {
+	// SpanContext returns the span's context, which is propagated to its children.
+	SpanContext() SpanContext
+	// IsRecording returns whether the span is recording its attributes and errors.
+	IsRecording() bool
+	// SetAttributes sets attributes on the span.
+	SetAttributes(attrs ...Attribute)
+	// RecordError marks the span as failed with the provided error. It is a no-op if err
+	// is nil.
+	RecordError(err error)
+	// End completes the span. Only the first call has any effect.
+	End()
+}
+
+// SpanConfig is the configuration of a span that is being started.
+type SpanConfig struct {
+	Kind       SpanKind
+	Attributes []Attribute
+}
+
+// SpanStartOption configures a span that is being started.
+type SpanStartOption func(*SpanConfig)
+
+// WithSpanKind sets the kind of the span.
+func WithSpanKind(kind SpanKind) SpanStartOption {
+	return func(c *SpanConfig) {
+		c.Kind = kind
+	}
+}
+
+// WithAttributes adds attributes to the span.
+func WithAttributes(attrs ...Attribute) SpanStartOption {
+	return func(c *SpanConfig) {
+		c.Attributes = append(c.Attributes, attrs...)
+	}
+}
+
+// NewSpanConfig applies opts to a new SpanConfig.
+func NewSpanConfig(opts ...SpanStartOption) SpanConfig {
+	var c SpanConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// SpanData is a snapshot of an ended span.
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	// Parent is the context of the span's parent, it is invalid for root spans.
+	Parent     SpanContext
+	Kind       SpanKind
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []Attribute
+	// Err is the error recorded on the span, if any.
+	Err error
+}
+
+// Attribute returns the value of the span's attribute with the provided key, if any.
+func (s SpanData) Attribute(key string) (any, bool) {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+type spanCtxKey struct{}
+
+// ContextWithSpan returns a copy of ctx that contains span.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanCtxKey{}, span)
+}
+
+// SpanFromContext returns the span in ctx, or a non-recording span with an invalid span
+// context if ctx doesn't contain one.
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanCtxKey{}).(Span); ok {
+		return span
+	}
+	return nonRecordingSpan{}
+}
+
+// SpanContextFromContext returns the context of the span in ctx, if any.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	return SpanFromContext(ctx).SpanContext()
+}
+
+// ContextWithRemoteSpanContext returns a copy of ctx whose spans will be children of the
+// provided span context that was propagated from another server.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return ContextWithSpan(ctx, nonRecordingSpan{sc: sc})
+}
+
+// nonRecordingSpan is a span that only carries a span context.
+type nonRecordingSpan struct {
+	sc SpanContext
+}
+
+func (s nonRecordingSpan) SpanContext() SpanContext         { return s.sc }
+func (s nonRecordingSpan) IsRecording() bool                { return false }
+func (s nonRecordingSpan) SetAttributes(attrs ...Attribute) {}
+func (s nonRecordingSpan) RecordError(err error)            {}
+func (s nonRecordingSpan) End()                             {}
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceParent(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(traceParent)
+	require.NoError(t, err)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	require.True(t, sc.IsSampled())
+	require.Equal(t, traceParent, FormatTraceParent(sc))
+
+	// Future versions can append fields.
+	_, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	require.NoError(t, err)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceParent(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		exporter = NewInMemoryExporter()
+		tracer   = NewTracer(exporter)
+		header   = http.Header{}
+	)
+	// Nothing is injected if there is no span.
+	Inject(ctx, header)
+	require.Empty(t, header)
+	require.Equal(t, ctx, Extract(ctx, header))
+
+	ctx, span := tracer.Start(ctx, "client", WithSpanKind(SpanKindClient))
+	Inject(ctx, header)
+	span.End()
+
+	remoteCtx := Extract(context.Background(), header)
+	remoteSC := SpanContextFromContext(remoteCtx)
+	require.True(t, remoteSC.Remote)
+	require.Equal(t, span.SpanContext().TraceID, remoteSC.TraceID)
+	require.Equal(t, span.SpanContext().SpanID, remoteSC.SpanID)
+
+	_, serverSpan := tracer.Start(remoteCtx, "server", WithSpanKind(SpanKindServer))
+	serverSpan.End()
+
+	spans := exporter.GetSpans()
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "server", spans[1].Name)
+	require.Equal(t, SpanKindServer, spans[1].Kind)
+	require.Equal(t, spans[0].SpanContext.TraceID, spans[1].SpanContext.TraceID)
+	require.Equal(t, spans[0].SpanContext.SpanID, spans[1].Parent.SpanID)
+}
+
+func TestTracer(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		exporter = NewInMemoryExporter()
+		tracer   = NewTracer(exporter)
+	)
+	ctx, root := tracer.Start(ctx, "root", WithAttributes(String("key", "value")))
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(Int64("count", 1), Bool("ok", false))
+	child.RecordError(errors.New("child failed"))
+	child.End()
+	// Ending multiple times is fine.
+	child.End()
+	require.False(t, child.IsRecording())
+	root.End()
+
+	spans := exporter.GetSpans()
+	require.Equal(t, 2, len(spans))
+	childData, rootData := spans[0], spans[1]
+	require.False(t, rootData.Parent.IsValid())
+	require.Equal(t, rootData.SpanContext.TraceID, childData.SpanContext.TraceID)
+	require.Equal(t, rootData.SpanContext.SpanID, childData.Parent.SpanID)
+	require.NotEqual(t, rootData.SpanContext.SpanID, childData.SpanContext.SpanID)
+	require.True(t, childData.EndTime.After(childData.StartTime) || childData.EndTime.Equal(childData.StartTime))
+	require.EqualError(t, childData.Err, "child failed")
+
+	value, ok := rootData.Attribute("key")
+	require.True(t, ok)
+	require.Equal(t, "value", value)
+	value, ok = childData.Attribute("count")
+	require.True(t, ok)
+	require.Equal(t, int64(1), value)
+
+	exporter.Reset()
+	require.Empty(t, exporter.GetSpans())
+}
+
+func TestNoopTracer(t *testing.T) {
+	tracer := NewNoopTracer()
+	ctx, span := tracer.Start(context.Background(), "root")
+	require.False(t, span.IsRecording())
+	require.False(t, span.SpanContext().IsValid())
+	span.End()
+
+	// Propagated span contexts are passed through.
+	sc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	ctx = ContextWithRemoteSpanContext(ctx, sc)
+	ctx, span = tracer.Start(ctx, "child")
+	require.Equal(t, sc.TraceID, span.SpanContext().TraceID)
+
+	header := http.Header{}
+	Inject(ctx, header)
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", header.Get(TraceParentHeader))
+}
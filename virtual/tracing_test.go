@@ -0,0 +1,104 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/tracing"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTracing tests that invocations are traced end to end, including the remote hops
+// between servers and the invocations that actors make to other actors.
+func TestTracing(t *testing.T) {
+	rpcClient, err := NewRPCClient(RPCClientOptions{})
+	require.NoError(t, err)
+
+	for name, client := range map[string]RemoteClient{
+		"http": NewHTTPClient(),
+		"rpc":  rpcClient,
+	} {
+		client := client
+		t.Run(name, func(t *testing.T) {
+			var (
+				ctx      = context.Background()
+				reg      = localregistry.NewLocalRegistry("test-server-id")
+				exporter = tracing.NewInMemoryExporter()
+				opts     = defaultOptsGoByte
+			)
+			defer reg.Close(ctx)
+
+			// The environment invokes actors through the server, even though they're all
+			// activated on it, so every invocation makes a remote hop.
+			opts.Tracer = tracing.NewTracer(exporter)
+			env := newTestServerEnvironmentWithEnvOptions(
+				t, reg, newTestModuleStore(), "serverID1", client, opts, ServerOptions{})
+
+			// a -> b
+			_, err := env.InvokeActor(
+				ctx, "ns-1", "a", "test-module", "invokeActor",
+				invokeActorPayload(t, "b", "inc", nil), types.CreateIfNotExist{})
+			require.NoError(t, err)
+
+			var (
+				spans   = exporter.GetSpans()
+				byID    = map[tracing.SpanID]tracing.SpanData{}
+				byName  = map[string][]tracing.SpanData{}
+				traceID = spans[0].SpanContext.TraceID
+				roots   []tracing.SpanData
+			)
+			for _, span := range spans {
+				require.Equal(t, traceID, span.SpanContext.TraceID, span.Name)
+				require.NoError(t, span.Err, span.Name)
+				byID[span.SpanContext.SpanID] = span
+				byName[span.Name] = append(byName[span.Name], span)
+				if !span.Parent.IsValid() {
+					roots = append(roots, span)
+				}
+			}
+			for _, name := range []string{
+				"nola.InvokeActor",
+				"nola.activationCache.ensureActivation",
+				"nola.registry.EnsureActivation",
+				"nola.InvokeActorRemote",
+				"nola.InvokeActorDirect",
+				"nola.mailbox.wait",
+				"nola.actor.invoke",
+			} {
+				// One for each actor.
+				require.Equal(t, 2, len(byName[name]), name)
+			}
+
+			// The trace starts with the invocation of a.
+			require.Equal(t, 1, len(roots))
+			require.Equal(t, "nola.InvokeActor", roots[0].Name)
+			actorID, _ := roots[0].Attribute("nola.actor_id")
+			require.Equal(t, "a", actorID)
+
+			// Remote hops continue the trace on the server.
+			for _, span := range byName["nola.InvokeActorDirect"] {
+				require.Equal(t, tracing.SpanKindServer, span.Kind)
+				require.True(t, span.Parent.Remote)
+				require.Equal(t, "nola.InvokeActorRemote", byID[span.Parent.SpanID].Name)
+			}
+
+			// The invocation of b is a descendant of a's execution.
+			var invokeB tracing.SpanData
+			for _, span := range byName["nola.InvokeActor"] {
+				if actorID, _ := span.Attribute("nola.actor_id"); actorID == "b" {
+					invokeB = span
+				}
+			}
+			parent, ok := byID[invokeB.Parent.SpanID]
+			require.True(t, ok)
+			require.Equal(t, "nola.actor.invoke", parent.Name)
+			parent = byID[parent.Parent.SpanID]
+			require.Equal(t, "nola.InvokeActorDirect", parent.Name)
+			actorID, _ = parent.Attribute("nola.actor_id")
+			require.Equal(t, "a", actorID)
+		})
+	}
+}
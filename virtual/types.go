@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 
+	"github.com/richardartoul/nola/virtual/metrics"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 )
@@ -64,6 +65,52 @@ type Environment interface {
 		createIfNotExist types.CreateIfNotExist,
 	) (io.ReadCloser, error)
 
+	// InvokeActorAsync is the same as InvokeActor, except it returns as soon as the
+	// invocation has been durably enqueued instead of waiting for the actor to perform it,
+	// and the actor's response is discarded. Invocations are delivered at-least-once and
+	// in the order they were enqueued for each actor. See AsyncInvocationOptions for more
+	// details. Async invocations must be enabled with EnvironmentOptions.AsyncInvocations.
+	InvokeActorAsync(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		operation string,
+		payload []byte,
+		createIfNotExist types.CreateIfNotExist,
+	) error
+
+	// RegisterReminder registers a durable reminder on the specified actor, replacing any
+	// existing reminder with the same name. Unlike ScheduleSelfTimer, reminders survive the
+	// actor being deactivated and the server failing, and they reactivate the actor when
+	// they fire. See ReminderOptions for more details. Reminders must be enabled with
+	// EnvironmentOptions.Reminders.
+	RegisterReminder(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		reminder types.Reminder,
+	) error
+
+	// UnregisterReminder unregisters the specified actor's reminder with the provided
+	// name. It is a no-op if the reminder does not exist.
+	UnregisterReminder(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		name string,
+	) error
+
+	// ListReminders returns the reminders registered on the specified actor.
+	ListReminders(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+	) ([]types.Reminder, error)
+
 	// InvokeActorDirect is the same as InvokeActor, however, it performs the invocation
 	// "directly".
 	//
@@ -126,6 +173,38 @@ type Environment interface {
 		createIfNotExist types.CreateIfNotExist,
 	) (io.ReadCloser, error)
 
+	// MigrateActor moves the specified actor to the server with ID targetServerID. The
+	// actor's primary activation is deactivated (and its state is transferred to the target
+	// server if it implements ActorSnapshotter) so that the next invocation activates it on
+	// the target server. The actor's other replicas (if any) are left in place. This is
+	// useful for moving a hot actor to a dedicated server, or moving actors off of a server
+	// that needs to be investigated. The actor must already exist, otherwise a
+	// registry.ActorNotFoundErr is returned.
+	MigrateActor(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		targetServerID string,
+	) error
+
+	// MailboxStats returns the stats of the mailboxes of every actor that has been activated
+	// in the environment (see EnvironmentOptions.MaxActorMailboxDepth).
+	MailboxStats() MailboxStats
+
+	// ActorMailboxStats returns the stats of the mailbox of the specified actor since it was
+	// activated in the environment, or false if it is not currently activated in this
+	// environment.
+	ActorMailboxStats(
+		namespace string,
+		actorID string,
+		moduleID string,
+	) (MailboxStats, bool)
+
+	// Metrics returns the registry that the environment's metrics are registered with (see
+	// EnvironmentOptions.Metrics).
+	Metrics() *metrics.Registry
+
 	// Close closes the Environment and all of its associated resources.
 	Close(context.Context) error
 }
@@ -221,15 +300,74 @@ type ActorStream interface {
 	) (io.ReadCloser, error)
 }
 
+// ActorSnapshotter is an optional interface that can be implemented by an Actor to
+// allow its in-memory state to be transferred to a different server when the actor
+// is handed off (for example because cluster membership changed and the server no
+// longer owns the actor). Actors that do not implement it are simply deactivated and
+// reactivated from scratch on the new server.
+type ActorSnapshotter interface {
+	// Snapshot returns a serialized representation of the actor's in-memory state.
+	Snapshot(ctx context.Context) ([]byte, error)
+	// Hydrate restores the actor's in-memory state from a snapshot previously
+	// returned by Snapshot.
+	Hydrate(ctx context.Context, snapshot []byte) error
+}
+
+// ActorReadOnly is an optional interface that can be implemented by an Actor to declare
+// which of its operations don't modify its state. Read-only invocations run concurrently
+// with each other under a shared lock, while all other invocations still run exclusively.
+// Modules registered with the module store declare their read-only operations with
+// registry.ModuleOptions.ReadOnlyOperations instead.
+type ActorReadOnly interface {
+	// IsReadOnly returns whether the provided operation is read-only.
+	IsReadOnly(operation string) bool
+}
+
+// ReentrantModule is an optional interface that can be implemented by a Module to opt its
+// actors in to reentrancy. Invocations of a reentrant actor that loop back to it within the
+// same call chain (for example when actor A invokes actor B which then invokes actor A) run
+// immediately, interleaved with the invocation that is waiting further up the chain, instead
+// of failing with a DeadlockErr. The exception is invocations that loop back to an actor
+// that is waiting for a read-only invocation (see ActorReadOnly), which can only be reentered
+// by other read-only invocations. Modules registered with the module store opt in with
+// registry.ModuleOptions.Reentrant instead.
+type ReentrantModule interface {
+	// Reentrant returns whether the module's actors are reentrant.
+	Reentrant() bool
+}
+
 // HostCapabilities defines the interface of capabilities exposed by the host to the Actor.
 type HostCapabilities interface {
 	// InvokeActor invokes a function on the specified actor.
 	InvokeActor(context.Context, types.InvokeActorRequest) ([]byte, error)
 
+	// InvokeActorAsync is the same as InvokeActor, except the invocation is durably
+	// enqueued and performed asynchronously (see Environment.InvokeActorAsync).
+	InvokeActorAsync(context.Context, types.InvokeActorRequest) error
+
 	// ScheduleSelfTimer is the same as InvokeActor, except the invocation is scheduled
 	// in memory to be run later on the calling actor, and only if the actor is still
-	// instantiated / activated in-memory when the timer fires.
-	ScheduleSelfTimer(context.Context, wapcutils.ScheduleSelfTimer) error
+	// instantiated / activated in-memory when the timer fires. It returns the ID of the
+	// timer, which can be used to cancel it. Outstanding timers are stopped when the
+	// actor is deactivated.
+	ScheduleSelfTimer(context.Context, wapcutils.ScheduleSelfTimer) (string, error)
+
+	// CancelSelfTimer cancels the calling actor's timer with the provided ID. It is a
+	// no-op if the timer has already fired or been cancelled.
+	CancelSelfTimer(ctx context.Context, timerID string) error
+
+	// ListSelfTimers returns the calling actor's outstanding timers.
+	ListSelfTimers(context.Context) ([]wapcutils.SelfTimer, error)
+
+	// RegisterReminder registers a durable reminder on the calling actor (see
+	// Environment.RegisterReminder).
+	RegisterReminder(context.Context, types.Reminder) error
+
+	// UnregisterReminder unregisters the calling actor's reminder with the provided name.
+	UnregisterReminder(ctx context.Context, name string) error
+
+	// ListReminders returns the reminders registered on the calling actor.
+	ListReminders(context.Context) ([]types.Reminder, error)
 
 	// CustomFn invoke a custom (user defined) host function. This will only work if the
 	// custom host function was registered with the environment when it was instantiated.
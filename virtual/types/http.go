@@ -2,4 +2,7 @@ package types
 
 const (
 	HTTPHeaderTimeout = "nola-context-timeout"
+	// HTTPHeaderPeerToken carries the token that servers present to each other to prove
+	// that they're part of the cluster.
+	HTTPHeaderPeerToken = "nola-peer-token"
 )
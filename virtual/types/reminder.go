@@ -0,0 +1,57 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reminder is the JSON struct that represents a durable reminder registered on an actor.
+// Unlike the timers scheduled with ScheduleSelfTimer, reminders are persisted so they
+// survive the actor being deactivated and the server it was activated on failing, and
+// they will reactivate the actor if necessary when they fire.
+type Reminder struct {
+	// Name uniquely identifies the reminder for the actor. Registering a reminder with
+	// the same name as an existing one replaces it.
+	Name string `json:"name"`
+	// Operation is the name of the operation to invoke on the actor when the reminder
+	// fires.
+	Operation string `json:"operation"`
+	// Payload is the []byte payload to provide to the invoked function on the actor.
+	Payload []byte `json:"payload"`
+	// AfterMillis is the number of milliseconds after the reminder is registered that it
+	// should fire for the first time.
+	AfterMillis int `json:"after_millis"`
+	// PeriodMillis is the number of milliseconds between subsequent firings of the
+	// reminder. If it is 0, the reminder only fires once and is removed afterwards.
+	PeriodMillis int `json:"period_millis"`
+	// CreateIfNotExist provides the arguments to construct the actor if it has to be
+	// reactivated when the reminder fires. This field is optional.
+	CreateIfNotExist CreateIfNotExist `json:"create_if_not_exist"`
+}
+
+// Validate validates that the Reminder struct is valid.
+func (r *Reminder) Validate() error {
+	if r.Name == "" {
+		return errors.New("reminder name cannot be empty")
+	}
+	if r.Operation == "" {
+		return errors.New("reminder operation cannot be empty")
+	}
+	if r.AfterMillis < 0 {
+		return fmt.Errorf("reminder AfterMillis must be >= 0, but was: %d", r.AfterMillis)
+	}
+	if r.PeriodMillis < 0 {
+		return fmt.Errorf("reminder PeriodMillis must be >= 0, but was: %d", r.PeriodMillis)
+	}
+	if err := r.CreateIfNotExist.Validate(); err != nil {
+		return fmt.Errorf("error validating CreateIfNotExist: %w", err)
+	}
+	return nil
+}
+
+// UnregisterReminderRequest is the JSON struct that represents a request from an actor
+// to unregister one of its reminders.
+type UnregisterReminderRequest struct {
+	// Name is the name of the reminder to unregister.
+	Name string `json:"name"`
+}
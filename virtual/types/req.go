@@ -20,6 +20,10 @@ type InvokeActorRequest struct {
 	// CreateIfNotExist provides the arguments for InvokeActorRequest to construct the
 	// actor if it doesn't already exist. This field is optional.
 	CreateIfNotExist CreateIfNotExist `json:"create_if_not_exist"`
+	// IdempotencyKey is attached to the invocation so that retrying it with the same key
+	// returns the response of the original invocation instead of executing the operation
+	// again (see virtual.WithIdempotencyKey). This field is optional.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 // CreateIfNotExist provides the arguments for InvokeActorRequest to construct the
@@ -35,7 +39,7 @@ type CreateIfNotExist struct {
 // Validate validates that the CreateIfNotExist struct is valid.
 func (o *CreateIfNotExist) Validate() error {
 	if err := o.Options.Validate(); err != nil {
-		return fmt.Errorf("error validating CreateIfNotExist")
+		return fmt.Errorf("error validating CreateIfNotExist: %w", err)
 	}
 	return nil
 }
@@ -64,6 +68,13 @@ func (o *ActorOptions) Validate() error {
 		o.RetryPolicy.PerAttemptTimeout <= 0 {
 		return fmt.Errorf("PerAttemptTimeout must be > 0 when using ReplicaSelectionStrategyBroadcast")
 	}
+	if o.ReplicationStrategy == ReplicaSelectionStrategyBroadcast &&
+		o.RetryPolicy.HedgeAfterPercentile > 0 {
+		return fmt.Errorf("HedgeAfterPercentile can't be used with ReplicaSelectionStrategyBroadcast")
+	}
+	if err := o.RetryPolicy.Validate(); err != nil {
+		return fmt.Errorf("error validating RetryPolicy: %w", err)
+	}
 
 	return nil
 }
@@ -85,8 +96,23 @@ const (
 	ReplicaSelectionStrategyBroadcast ReplicaSelectionStrategy = "broadcast"
 )
 
+const (
+	// DefaultRetryInitialBackoff is the default value for RetryPolicy.InitialBackoff.
+	DefaultRetryInitialBackoff = 10 * time.Millisecond
+	// DefaultRetryMaxBackoff is the default value for RetryPolicy.MaxBackoff.
+	DefaultRetryMaxBackoff = time.Second
+)
+
 // RetryPolicy defines the retry policies for actor invocations.
-// It specifies the strategy, per-attempt timeout, and maximum number of retries.
+// It specifies the per-attempt timeout, the maximum number of retries, the backoff
+// between retries and whether requests should be hedged.
+//
+// Failed attempts are classified before they're retried: errors that retrying can't fix
+// (like the caller's context being canceled or the actor deadlocking) are returned
+// immediately, transient errors (like connections being refused or the actor's mailbox
+// being full) are retried against the remaining replicas and then against the actor's
+// activations as re-resolved through the registry, and all other errors (like errors
+// returned by the actor itself) are only retried against the remaining replicas.
 type RetryPolicy struct {
 	// PerAttemptTimeout defines the timeout duration for each retry attempt.
 	// If a single retry attempt exceeds this duration, it will be considered a failure.
@@ -96,6 +122,66 @@ type RetryPolicy struct {
 
 	// MaxNumRetries sets the maximum number of retries allowed for the actor invocation.
 	// After reaching this limit, the invocation will fail if no successful response is received.
-	// Note: Retries are limited by the availability of replicas.
+	// Note: Retries of errors that are not transient are limited by the availability of
+	// replicas.
 	MaxNumRetries uint `json:"max_num_retries"`
+
+	// InitialBackoff is how long to wait before the first retry. The backoff doubles with
+	// every subsequent retry until it reaches MaxBackoff, and the actual wait is jittered
+	// to somewhere between half of the backoff and the full backoff so that callers that
+	// failed at the same time don't retry in lockstep. Defaults to
+	// DefaultRetryInitialBackoff (or MaxBackoff if it's lower) if it is set to 0.
+	InitialBackoff time.Duration `json:"initial_backoff"`
+
+	// MaxBackoff caps the backoff between retries. Defaults to DefaultRetryMaxBackoff if
+	// it is set to 0.
+	MaxBackoff time.Duration `json:"max_backoff"`
+
+	// HedgeAfterPercentile enables hedged requests for actors with replicas. If an attempt
+	// has not received a response after the HedgeAfterPercentile (between 0 and 1, e.g.
+	// 0.95) latency percentile of the recent invocations of the same operation, the request
+	// is also sent to a different replica and whichever response arrives first is used
+	// while the other request is canceled. Hedging is disabled if it is set to 0.
+	//
+	// Note: Hedged requests can execute the operation on both replicas, so it should only
+	// be used for operations that are safe to execute more than once. Invocations with an
+	// idempotency key are never hedged for the same reason.
+	HedgeAfterPercentile float64 `json:"hedge_after_percentile"`
+}
+
+// Validate validates that the RetryPolicy struct is valid.
+func (p *RetryPolicy) Validate() error {
+	if p.PerAttemptTimeout < 0 {
+		return fmt.Errorf("PerAttemptTimeout(%s) must be >= 0", p.PerAttemptTimeout)
+	}
+	if p.InitialBackoff < 0 {
+		return fmt.Errorf("InitialBackoff(%s) must be >= 0", p.InitialBackoff)
+	}
+	if p.MaxBackoff < 0 {
+		return fmt.Errorf("MaxBackoff(%s) must be >= 0", p.MaxBackoff)
+	}
+	if initial, max := p.Backoffs(); initial > max {
+		return fmt.Errorf("InitialBackoff(%s) must be <= MaxBackoff(%s)", initial, max)
+	}
+	if p.HedgeAfterPercentile < 0 || p.HedgeAfterPercentile >= 1 {
+		return fmt.Errorf(
+			"HedgeAfterPercentile(%v) must be >= 0 and < 1", p.HedgeAfterPercentile)
+	}
+	return nil
+}
+
+// Backoffs returns the initial and maximum backoff between retries with the defaults
+// applied.
+func (p *RetryPolicy) Backoffs() (time.Duration, time.Duration) {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if max == 0 {
+		max = DefaultRetryMaxBackoff
+	}
+	if initial == 0 {
+		initial = DefaultRetryInitialBackoff
+		if initial > max {
+			initial = max
+		}
+	}
+	return initial, max
 }
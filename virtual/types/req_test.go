@@ -0,0 +1,38 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActorOptionsValidate(t *testing.T) {
+	for _, opts := range []ActorOptions{
+		{},
+		{RetryPolicy: RetryPolicy{MaxNumRetries: 3, InitialBackoff: time.Second, MaxBackoff: time.Second}},
+		// The default InitialBackoff is capped by a lower MaxBackoff.
+		{RetryPolicy: RetryPolicy{MaxBackoff: time.Millisecond}},
+		{ExtraReplicas: 1, RetryPolicy: RetryPolicy{HedgeAfterPercentile: 0.99}},
+	} {
+		require.NoError(t, opts.Validate())
+	}
+
+	for _, opts := range []ActorOptions{
+		{
+			ReplicationStrategy: ReplicaSelectionStrategyBroadcast,
+			ExtraReplicas:       1,
+		},
+		{
+			ReplicationStrategy: ReplicaSelectionStrategyBroadcast,
+			RetryPolicy:         RetryPolicy{PerAttemptTimeout: time.Second, HedgeAfterPercentile: 0.5},
+		},
+		{RetryPolicy: RetryPolicy{InitialBackoff: -1}},
+		{RetryPolicy: RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Millisecond}},
+		{RetryPolicy: RetryPolicy{InitialBackoff: 2 * DefaultRetryMaxBackoff}},
+		{RetryPolicy: RetryPolicy{HedgeAfterPercentile: 1}},
+		{RetryPolicy: RetryPolicy{HedgeAfterPercentile: -0.5}},
+	} {
+		require.Error(t, opts.Validate(), opts)
+	}
+}
@@ -1,14 +1,13 @@
 package virtual
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
-
-	"golang.org/x/exp/slog"
 
 	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 )
@@ -17,12 +16,14 @@ import (
 // field from the context.
 type hostFnActorReferenceCtxKey struct{}
 
+// hostFnHostCapabilitiesCtxKey is the key that is used to store/retrieve the actor's
+// HostCapabilities from the context.
+type hostFnHostCapabilitiesCtxKey struct{}
+
 // TODO: Should have some kind of ACL enforcement policy here, but for now allow any module to
 // run any host function.
 func newHostFnRouter(
-	log *slog.Logger,
 	environment Environment,
-	activations *activations,
 	customHostFns map[string]func([]byte) ([]byte, error),
 	actorNamespace string,
 	actorModuleID string,
@@ -50,6 +51,16 @@ func newHostFnRouter(
 				ctx, actorNamespace, req.ActorID, req.ModuleID,
 				req.Operation, req.Payload, req.CreateIfNotExist)
 
+		case wapcutils.InvokeActorAsyncOperationName:
+			var req types.InvokeActorRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling InvokeActorRequest: %w", err)
+			}
+
+			return nil, environment.InvokeActorAsync(
+				ctx, actorNamespace, req.ActorID, req.ModuleID,
+				req.Operation, req.Payload, req.CreateIfNotExist)
+
 		case wapcutils.ScheduleSelfTimerOperationName:
 			var req wapcutils.ScheduleSelfTimer
 			if err := json.Unmarshal(wapcPayload, &req); err != nil {
@@ -57,38 +68,68 @@ func newHostFnRouter(
 					"error unmarshaling ScheduleSelfTimer: %w, payload: %s",
 					err, string(wapcPayload))
 			}
-			if req.Operation == "" {
-				return nil, fmt.Errorf("cant schedule self timer with empty operation name")
+
+			// The request is validated by ScheduleSelfTimer so that Go and WASM actors
+			// behave the same.
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, err
 			}
-			if req.AfterMillis <= 0 {
-				return nil, fmt.Errorf("cant schedule self timer with AfterMillis <= 0")
+			timerID, err := host.ScheduleSelfTimer(ctx, req)
+			if err != nil {
+				return nil, err
 			}
+			return json.Marshal(wapcutils.ScheduleSelfTimerResult{TimerID: timerID})
 
-			// Copy the payload to make sure its safe to retain across invocations.
-			payloadCopy := make([]byte, len(req.Payload))
-			copy(payloadCopy, req.Payload)
-
-			// TODO: When the actor gets GC'd, this timer won't get GC'd with it. We
-			// should keep track of all outstanding timers with the instantiation and
-			// terminate them if the actor is killed, but it's fine for now.
-			time.AfterFunc(time.Duration(req.AfterMillis)*time.Millisecond, func() {
-				reader, err := activations.invoke(context.Background(), actorRef, req.Operation, nil, payloadCopy, true)
-				if err == nil {
-					if reader != nil {
-						// This is weird, but the reader can be nil in the case where the actor the timer is
-						// associated with is no longer activated in memory anymore.
-						//
-						// TestScheduleSelfTimersAndGC intentionally triggers this behavior to ensure that timers
-						// never trigger reactivation of deactivated actors.
-						defer reader.Close()
-					}
-				}
-				if err != nil {
-					log.Error("error firing timer for actor", slog.Any("actor", actorRef), slog.Any("error", err))
-				}
-			})
+		case wapcutils.CancelSelfTimerOperationName:
+			var req wapcutils.CancelSelfTimer
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling CancelSelfTimer: %w", err)
+			}
+
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return nil, host.CancelSelfTimer(ctx, req.TimerID)
+
+		case wapcutils.ListSelfTimersOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, err
+			}
+			timers, err := host.ListSelfTimers(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(timers)
+
+		case wapcutils.RegisterReminderOperationName:
+			var req types.Reminder
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling Reminder: %w", err)
+			}
+
+			return nil, environment.RegisterReminder(
+				ctx, actorNamespace, actorRef.ActorID, actorRef.ModuleID, req)
+
+		case wapcutils.UnregisterReminderOperationName:
+			var req types.UnregisterReminderRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling UnregisterReminderRequest: %w", err)
+			}
+
+			return nil, environment.UnregisterReminder(
+				ctx, actorNamespace, actorRef.ActorID, actorRef.ModuleID, req.Name)
+
+		case wapcutils.ListRemindersOperationName:
+			reminders, err := environment.ListReminders(
+				ctx, actorNamespace, actorRef.ActorID, actorRef.ModuleID)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(reminders)
 
-			return nil, nil
 		default:
 			customFn, ok := customHostFns[wapcOperation]
 			if ok {
@@ -117,8 +158,26 @@ func extractActorRef(ctx context.Context) (types.ActorReferenceVirtual, error) {
 	return actorRef, nil
 }
 
+func extractHostCapabilities(ctx context.Context) (HostCapabilities, error) {
+	host, ok := ctx.Value(hostFnHostCapabilitiesCtxKey{}).(HostCapabilities)
+	if !ok {
+		return nil, fmt.Errorf("wazeroHostFnRouter: could not find host capabilities in context")
+	}
+	return host, nil
+}
+
 type wazeroModule struct {
-	m durable.Module
+	m         durable.Module
+	reentrant bool
+	readOnly  map[string]struct{}
+}
+
+func newWazeroModule(m durable.Module, opts registry.ModuleOptions) wazeroModule {
+	readOnly := make(map[string]struct{}, len(opts.ReadOnlyOperations))
+	for _, operation := range opts.ReadOnlyOperations {
+		readOnly[operation] = struct{}{}
+	}
+	return wazeroModule{m: m, reentrant: opts.Reentrant, readOnly: readOnly}
 }
 
 func (w wazeroModule) Instantiate(
@@ -132,7 +191,11 @@ func (w wazeroModule) Instantiate(
 		return nil, err
 	}
 
-	return wazeroActor{obj, reference}, nil
+	return wazeroActor{obj, reference, host, w.readOnly}, nil
+}
+
+func (w wazeroModule) Reentrant() bool {
+	return w.reentrant
 }
 
 func (w wazeroModule) Close(ctx context.Context) error {
@@ -142,6 +205,8 @@ func (w wazeroModule) Close(ctx context.Context) error {
 type wazeroActor struct {
 	obj       durable.Object
 	reference types.ActorReferenceVirtual
+	host      HostCapabilities
+	readOnly  map[string]struct{}
 }
 
 func (w wazeroActor) MemoryUsageBytes() int {
@@ -158,12 +223,35 @@ func (w wazeroActor) Invoke(
 	// required is that the WAPC implementation we're using defines a host router
 	// per-module instead of per-actor, so we use the context.Context to "smuggle"
 	// the actor ID into each invocation. See newHostFnRouter in wazero.go to see
-	// the implementation.
+	// the implementation. The actor's HostCapabilities are smuggled the same way so that
+	// host functions which operate on the actor's own activation (like timers) can be
+	// routed to it.
 	ctx = context.WithValue(ctx, hostFnActorReferenceCtxKey{}, w.reference)
+	ctx = context.WithValue(ctx, hostFnHostCapabilitiesCtxKey{}, w.host)
 
 	return w.obj.Invoke(ctx, operation, payload)
 }
 
+// IsReadOnly implements ActorReadOnly. Note that the WASM object still only runs a single
+// invocation at a time, so read-only invocations of WASM actors don't block each other in
+// the actor's mailbox but they don't run in parallel either.
+func (w wazeroActor) IsReadOnly(operation string) bool {
+	_, ok := w.readOnly[operation]
+	return ok
+}
+
+func (w wazeroActor) Snapshot(ctx context.Context) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := w.obj.Snapshot(ctx, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w wazeroActor) Hydrate(ctx context.Context, snapshot []byte) error {
+	return w.obj.Hydrate(ctx, bytes.NewReader(snapshot), len(snapshot))
+}
+
 func (w wazeroActor) Close(ctx context.Context) error {
 	return w.obj.Close(ctx)
 }
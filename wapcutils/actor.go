@@ -23,3 +23,29 @@ type ScheduleSelfTimer struct {
 	Payload     []byte `json:"payload"`
 	AfterMillis int    `json:"after_millis"`
 }
+
+// ScheduleSelfTimerResult is the JSON struct that is returned to an actor after it
+// schedules a timer.
+type ScheduleSelfTimerResult struct {
+	// TimerID identifies the timer so that it can be cancelled later. It is only unique
+	// within the actor's current activation.
+	TimerID string `json:"timer_id"`
+}
+
+// CancelSelfTimer is the JSON struct that represents a request from an actor to cancel
+// one of its outstanding timers.
+type CancelSelfTimer struct {
+	// TimerID is the ID of the timer that was returned when it was scheduled.
+	TimerID string `json:"timer_id"`
+}
+
+// SelfTimer describes one of an actor's outstanding timers.
+type SelfTimer struct {
+	// TimerID is the ID of the timer that was returned when it was scheduled.
+	TimerID string `json:"timer_id"`
+	// Operation is the name of the operation that will be invoked when the timer fires.
+	Operation string `json:"operation"`
+	// FiresAtUnixMillis is the (approximate) time at which the timer will fire, in
+	// milliseconds since the unix epoch.
+	FiresAtUnixMillis int64 `json:"fires_at_unix_millis"`
+}
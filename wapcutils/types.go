@@ -11,6 +11,10 @@ const (
 	// InvokeActorOperationName is the string that indicates the operation in WAPC is to
 	// invoke an operation (function) on another actor.
 	InvokeActorOperationName = "INVOKE-ACTOR"
+	// InvokeActorAsyncOperationName is the string that indicates the operation in WAPC is to
+	// durably enqueue an invocation of an operation (function) on another actor without
+	// waiting for it to be performed.
+	InvokeActorAsyncOperationName = "INVOKE-ACTOR-ASYNC"
 	// StartupOperationName is the string that indicates the operation in WAPC is the
 	// startup function which should be run once when a worker/actor is first loaded into
 	// memory.
@@ -22,4 +26,31 @@ const (
 	// ScheduleSelfTimerOperationName is the string that indicates the operation in WAPC is to schedule
 	// a self timer.
 	ScheduleSelfTimerOperationName = "SCHEDULE-SELF-TIMER"
+	// CancelSelfTimerOperationName is the string that indicates the operation in WAPC is to
+	// cancel a self timer.
+	CancelSelfTimerOperationName = "CANCEL-SELF-TIMER"
+	// ListSelfTimersOperationName is the string that indicates the operation in WAPC is to
+	// list the calling actor's outstanding self timers.
+	ListSelfTimersOperationName = "LIST-SELF-TIMERS"
+	// RegisterReminderOperationName is the string that indicates the operation in WAPC is to
+	// register a durable reminder on the calling actor.
+	RegisterReminderOperationName = "REGISTER-REMINDER"
+	// UnregisterReminderOperationName is the string that indicates the operation in WAPC is to
+	// unregister one of the calling actor's durable reminders.
+	UnregisterReminderOperationName = "UNREGISTER-REMINDER"
+	// ListRemindersOperationName is the string that indicates the operation in WAPC is to list
+	// the calling actor's durable reminders.
+	ListRemindersOperationName = "LIST-REMINDERS"
+	// HydrateOperationName is the string that indicates the operation is to restore the
+	// actor's state from a snapshot taken by a different server that previously hosted the
+	// actor. It is handled by the host directly and never dispatched to the actor's code.
+	// It can only be sent by other servers in the cluster, and is rejected if the actor
+	// has been invoked since it was activated.
+	HydrateOperationName = "HYDRATE"
+	// MigrateOperationName is the string that indicates the operation is to check with the
+	// registry whether the server still owns the actor because the actor was migrated, and
+	// to hand the actor off to its new owner if not. It is handled by the host directly and
+	// never dispatched to the actor's code. It can only be sent by other servers in the
+	// cluster (see Environment.MigrateActor).
+	MigrateOperationName = "MIGRATE"
 )